@@ -0,0 +1,180 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"unicode/utf8"
+)
+
+// The charsets of the servers, the terminal in the browser uses UTF-8
+const (
+	CharsetUTF8   = "utf-8"
+	CharsetGBK    = "gbk"
+	CharsetLatin1 = "latin1"
+)
+
+var (
+	gbkEncodeTable map[rune]uint16
+	gbkEncodeOnce  sync.Once
+)
+
+func getGBKEncodeTable() map[rune]uint16 {
+	gbkEncodeOnce.Do(func() {
+		gbkEncodeTable = make(map[rune]uint16, len(gbkTable))
+		for i, r := range gbkTable {
+			if _, ok := gbkEncodeTable[rune(r)]; r != 0 && !ok {
+				gbkEncodeTable[rune(r)] = uint16((i/191+0x81)<<8 | (i%191 + 0x40))
+			}
+		}
+	})
+	return gbkEncodeTable
+}
+
+func appendRune(buf []byte, r rune) []byte {
+	b := [utf8.UTFMax]byte{}
+	n := utf8.EncodeRune(b[:], r)
+	return append(buf, b[:n]...)
+}
+
+// CheckCharset checks that the charset is supported, empty means UTF-8
+func CheckCharset(charset string) error {
+	switch charset {
+	case "", CharsetUTF8, CharsetGBK, CharsetLatin1:
+		return nil
+	default:
+		return fmt.Errorf("unknown charset \"%s\"", charset)
+	}
+}
+
+// IsUTF8Charset returns true if the text of the charset needs no conversion
+func IsUTF8Charset(charset string) bool {
+	return charset == "" || charset == CharsetUTF8
+}
+
+// CharsetDecoder converts the output of a server to UTF-8. The output can
+// be fed in chunks, a multi-byte sequence that is split between two chunks
+// is kept until the rest of it arrives.
+type CharsetDecoder struct {
+	charset string
+	pending []byte
+}
+
+// NewCharsetDecoder creates a decoder of the charset
+func NewCharsetDecoder(charset string) (*CharsetDecoder, error) {
+	if e := CheckCharset(charset); e != nil {
+		return nil, e
+	}
+	return &CharsetDecoder{charset: charset}, nil
+}
+
+// Decode returns the UTF-8 text of the data
+func (p *CharsetDecoder) Decode(data []byte) []byte {
+	if len(p.pending) > 0 {
+		data = append(p.pending, data...)
+		p.pending = nil
+	}
+
+	switch p.charset {
+	case CharsetGBK:
+		return p.decodeGBK(data)
+	case CharsetLatin1:
+		ret := make([]byte, 0, len(data)*2)
+		for _, c := range data {
+			ret = appendRune(ret, rune(c))
+		}
+		return ret
+	default:
+		return p.decodeUTF8(data)
+	}
+}
+
+func (p *CharsetDecoder) decodeGBK(data []byte) []byte {
+	ret := make([]byte, 0, len(data)*3/2)
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if c < 0x80 {
+			ret = append(ret, c)
+		} else if c == 0x80 {
+			ret = appendRune(ret, '€')
+		} else if c == 0xFF {
+			ret = appendRune(ret, utf8.RuneError)
+		} else if i+1 >= len(data) {
+			p.pending = append(p.pending, c)
+		} else if trail := data[i+1]; trail < 0x40 || trail == 0xFF {
+			// the trail byte is not part of the sequence
+			ret = appendRune(ret, utf8.RuneError)
+		} else if r := gbkTable[int(c-0x81)*191+int(trail-0x40)]; r == 0 {
+			ret = appendRune(ret, utf8.RuneError)
+			i++
+		} else {
+			ret = appendRune(ret, rune(r))
+			i++
+		}
+	}
+	return ret
+}
+
+// decodeUTF8 passes the data through and keeps an incomplete sequence at
+// the end of it
+func (p *CharsetDecoder) decodeUTF8(data []byte) []byte {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				p.pending = append(p.pending, data[i:]...)
+				return data[:i]
+			}
+			break
+		}
+	}
+	return data
+}
+
+// CharsetEncoder converts UTF-8 text to the charset of a server, a
+// character that the charset does not have is replaced with '?'
+type CharsetEncoder struct {
+	charset string
+	pending []byte
+}
+
+// NewCharsetEncoder creates an encoder of the charset
+func NewCharsetEncoder(charset string) (*CharsetEncoder, error) {
+	if e := CheckCharset(charset); e != nil {
+		return nil, e
+	}
+	return &CharsetEncoder{charset: charset}, nil
+}
+
+// Encode returns the data in the charset, an incomplete UTF-8 sequence at
+// the end of the text is kept until the rest of it arrives
+func (p *CharsetEncoder) Encode(text []byte) []byte {
+	if len(p.pending) > 0 {
+		text = append(p.pending, text...)
+		p.pending = nil
+	}
+	if IsUTF8Charset(p.charset) {
+		return text
+	}
+
+	ret := make([]byte, 0, len(text))
+	for len(text) > 0 {
+		if !utf8.FullRune(text) {
+			p.pending = append(p.pending, text...)
+			break
+		}
+
+		r, n := utf8.DecodeRune(text)
+		text = text[n:]
+		if r < 0x80 {
+			ret = append(ret, byte(r))
+		} else if p.charset == CharsetLatin1 && r < 0x100 {
+			ret = append(ret, byte(r))
+		} else if p.charset == CharsetGBK && r == '€' {
+			ret = append(ret, 0x80)
+		} else if code, ok := getGBKEncodeTable()[r]; p.charset == CharsetGBK && ok {
+			ret = append(ret, byte(code>>8), byte(code))
+		} else {
+			ret = append(ret, '?')
+		}
+	}
+	return ret
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/rpccloud/assert"
+)
+
+func TestCharsetDecoder(t *testing.T) {
+	t.Run("gbk", func(t *testing.T) {
+		assert := assert.New(t)
+		decoder, e := NewCharsetDecoder(CharsetGBK)
+		assert(e).IsNil()
+		assert(string(decoder.Decode([]byte("ls \xd6\xd0")))).Equals("ls 中")
+		// the sequence is split between two chunks
+		assert(string(decoder.Decode([]byte("\xce")))).Equals("")
+		assert(string(decoder.Decode([]byte("\xc4\x80\r\n")))).Equals("文€\r\n")
+		assert(string(decoder.Decode([]byte("\xd6\x0a\xff")))).Equals("�\n�")
+	})
+
+	t.Run("latin1", func(t *testing.T) {
+		assert := assert.New(t)
+		decoder, _ := NewCharsetDecoder(CharsetLatin1)
+		assert(string(decoder.Decode([]byte("caf\xe9")))).Equals("café")
+	})
+
+	t.Run("utf-8", func(t *testing.T) {
+		assert := assert.New(t)
+		decoder, _ := NewCharsetDecoder(CharsetUTF8)
+		assert(string(decoder.Decode([]byte("a\xe4\xb8")))).Equals("a")
+		assert(string(decoder.Decode([]byte("\xad")))).Equals("中")
+		assert(string(decoder.Decode([]byte("b")))).Equals("b")
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		assert := assert.New(t)
+		_, e := NewCharsetDecoder("big5")
+		assert(e).IsNotNil()
+		_, e = NewCharsetEncoder("big5")
+		assert(e).IsNotNil()
+	})
+}
+
+func TestCharsetEncoder(t *testing.T) {
+	t.Run("gbk", func(t *testing.T) {
+		assert := assert.New(t)
+		encoder, _ := NewCharsetEncoder(CharsetGBK)
+		assert(encoder.Encode([]byte("echo 中"))).Equals([]byte("echo \xd6\xd0"))
+		assert(encoder.Encode([]byte("\xe6\x96"))).Equals([]byte{})
+		assert(encoder.Encode([]byte("\x87€☃"))).Equals([]byte("\xce\xc4\x80?"))
+	})
+
+	t.Run("latin1", func(t *testing.T) {
+		assert := assert.New(t)
+		encoder, _ := NewCharsetEncoder(CharsetLatin1)
+		assert(encoder.Encode([]byte("café 中"))).Equals([]byte("caf\xe9 ?"))
+	})
+}
@@ -0,0 +1,176 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+)
+
+const (
+	CommandActionBlock     = "block"
+	CommandActionConfirm   = "confirm"
+	CommandActionConfirmed = "confirmed"
+	CommandActionCancelled = "cancelled"
+)
+
+// CommandRule matches the commands that are blocked or need confirmation
+type CommandRule struct {
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+}
+
+// CommandPolicy checks the command lines that are typed into a terminal. A
+// line that matches a deny rule gets the action of the rule. If there are
+// allow patterns, a line that matches none of them is blocked.
+type CommandPolicy struct {
+	deny      []*regexp.Regexp
+	denyRules []CommandRule
+	allow     []*regexp.Regexp
+}
+
+func NewCommandPolicy(deny []CommandRule, allow []string) (*CommandPolicy, error) {
+	ret := &CommandPolicy{denyRules: deny}
+	for _, rule := range deny {
+		if rule.Action != CommandActionBlock && rule.Action != CommandActionConfirm {
+			return nil, fmt.Errorf("unknown command action \"%s\"", rule.Action)
+		} else if re, e := regexp.Compile(rule.Pattern); e != nil {
+			return nil, fmt.Errorf("invalid command pattern \"%s\"", rule.Pattern)
+		} else {
+			ret.deny = append(ret.deny, re)
+		}
+	}
+
+	for _, pattern := range allow {
+		if re, e := regexp.Compile(pattern); e != nil {
+			return nil, fmt.Errorf("invalid command pattern \"%s\"", pattern)
+		} else {
+			ret.allow = append(ret.allow, re)
+		}
+	}
+
+	return ret, nil
+}
+
+// Check returns the action and the pattern that matches the line, the
+// action is empty if the line is allowed
+func (p *CommandPolicy) Check(line string) (string, string) {
+	for i, re := range p.deny {
+		if re.MatchString(line) {
+			return p.denyRules[i].Action, p.denyRules[i].Pattern
+		}
+	}
+
+	if len(p.allow) == 0 || line == "" {
+		return "", ""
+	}
+	for _, re := range p.allow {
+		if re.MatchString(line) {
+			return "", ""
+		}
+	}
+	return CommandActionBlock, "(not allowed)"
+}
+
+// CommandMatch is reported when a line matches the policy
+type CommandMatch struct {
+	Line    string
+	Pattern string
+	Action  string
+}
+
+const (
+	guardStateText = iota
+	guardStateEscape
+	guardStateCSI
+)
+
+// CommandGuard follows the line that the user types into a terminal and
+// applies the policy when Enter is pressed. The line is rebuilt from the
+// input only, so the edits made by the shell (history, completion) are not
+// seen.
+type CommandGuard struct {
+	policy  *CommandPolicy
+	line    []byte
+	state   int
+	pending *CommandMatch
+}
+
+func NewCommandGuard(policy *CommandPolicy) *CommandGuard {
+	return &CommandGuard{policy: policy}
+}
+
+// Feed processes the input of the user, it returns the bytes to forward to
+// the shell and the matches. A blocked line is cleared with Ctrl-U instead
+// of being sent. A line that needs confirmation is held until the next
+// input, Enter confirms it and any other key cancels it. The input after a
+// held line in the same chunk is discarded, so a paste can not confirm.
+func (p *CommandGuard) Feed(input []byte) ([]byte, []*CommandMatch) {
+	forward := make([]byte, 0, len(input)+1)
+	matches := make([]*CommandMatch, 0)
+
+	if p.pending != nil && len(input) > 0 {
+		match := p.pending
+		p.pending = nil
+		if input[0] == '\r' || input[0] == '\n' {
+			forward = append(forward, input[0])
+			match.Action = CommandActionConfirmed
+		} else {
+			forward = append(forward, 0x15)
+			match.Action = CommandActionCancelled
+		}
+		matches = append(matches, match)
+		input = input[1:]
+	}
+
+	for _, c := range input {
+		switch p.state {
+		case guardStateEscape:
+			if c == '[' || c == 'O' {
+				p.state = guardStateCSI
+			} else {
+				p.state = guardStateText
+			}
+			forward = append(forward, c)
+			continue
+		case guardStateCSI:
+			if c >= 0x40 && c <= 0x7E {
+				p.state = guardStateText
+			}
+			forward = append(forward, c)
+			continue
+		}
+
+		switch {
+		case c == '\r' || c == '\n':
+			line := string(p.line)
+			p.line = p.line[:0]
+			action, pattern := p.policy.Check(line)
+			if action == CommandActionBlock {
+				forward = append(forward, 0x15)
+				matches = append(matches, &CommandMatch{Line: line, Pattern: pattern, Action: action})
+			} else if action == CommandActionConfirm {
+				p.pending = &CommandMatch{Line: line, Pattern: pattern, Action: action}
+				matches = append(matches, &CommandMatch{Line: line, Pattern: pattern, Action: action})
+				return forward, matches
+			} else {
+				forward = append(forward, c)
+			}
+			continue
+		case c == 0x1B:
+			p.state = guardStateEscape
+		case c == 0x7F || c == 0x08:
+			if len(p.line) > 0 {
+				_, size := utf8.DecodeLastRune(p.line)
+				p.line = p.line[:len(p.line)-size]
+			}
+		case c == 0x03 || c == 0x15:
+			// Ctrl-C and Ctrl-U discard the line
+			p.line = p.line[:0]
+		case c >= 0x20:
+			p.line = append(p.line, c)
+		}
+		forward = append(forward, c)
+	}
+
+	return forward, matches
+}
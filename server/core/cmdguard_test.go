@@ -0,0 +1,92 @@
+package core
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rpccloud/assert"
+)
+
+func TestNewCommandPolicy(t *testing.T) {
+	t.Run("test error", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(NewCommandPolicy([]CommandRule{{Pattern: "rm", Action: "drop"}}, nil)).
+			Equals(nil, errors.New("unknown command action \"drop\""))
+		assert(NewCommandPolicy([]CommandRule{{Pattern: "(", Action: "block"}}, nil)).
+			Equals(nil, errors.New("invalid command pattern \"(\""))
+		assert(NewCommandPolicy(nil, []string{"["})).
+			Equals(nil, errors.New("invalid command pattern \"[\""))
+	})
+}
+
+func TestCommandPolicy_Check(t *testing.T) {
+	t.Run("deny and allow", func(t *testing.T) {
+		assert := assert.New(t)
+		policy, _ := NewCommandPolicy([]CommandRule{
+			{Pattern: `^\s*rm\s+-rf\s+/\s*$`, Action: CommandActionBlock},
+			{Pattern: `^\s*reboot\b`, Action: CommandActionConfirm},
+		}, []string{`^(ls|cat|rm|reboot)\b`})
+		assert(policy.Check("rm -rf /")).Equals(CommandActionBlock, `^\s*rm\s+-rf\s+/\s*$`)
+		assert(policy.Check("reboot now")).Equals(CommandActionConfirm, `^\s*reboot\b`)
+		assert(policy.Check("ls -l")).Equals("", "")
+		assert(policy.Check("")).Equals("", "")
+		assert(policy.Check("shutdown")).Equals(CommandActionBlock, "(not allowed)")
+	})
+}
+
+func TestCommandGuard_Feed(t *testing.T) {
+	newGuard := func() *CommandGuard {
+		policy, _ := NewCommandPolicy([]CommandRule{
+			{Pattern: `^rm -rf /$`, Action: CommandActionBlock},
+			{Pattern: `^reboot$`, Action: CommandActionConfirm},
+		}, nil)
+		return NewCommandGuard(policy)
+	}
+
+	t.Run("allowed line", func(t *testing.T) {
+		assert := assert.New(t)
+		guard := newGuard()
+		assert(guard.Feed([]byte("ls\r"))).Equals([]byte("ls\r"), []*CommandMatch{})
+	})
+
+	t.Run("blocked line", func(t *testing.T) {
+		assert := assert.New(t)
+		guard := newGuard()
+		assert(guard.Feed([]byte("rm -rf"))).Equals([]byte("rm -rf"), []*CommandMatch{})
+		assert(guard.Feed([]byte(" /\rls\r"))).Equals(
+			[]byte(" /\x15ls\r"),
+			[]*CommandMatch{{Line: "rm -rf /", Pattern: "^rm -rf /$", Action: CommandActionBlock}},
+		)
+	})
+
+	t.Run("line editing", func(t *testing.T) {
+		assert := assert.New(t)
+		guard := newGuard()
+		// backspace, arrow key and Ctrl-U
+		_, matches := guard.Feed([]byte("rm -rf /x\x7f\x1b[D\r"))
+		assert(len(matches)).Equals(1)
+		_, matches = guard.Feed([]byte("rm -rf /\x15ls\r"))
+		assert(len(matches)).Equals(0)
+		_, matches = guard.Feed([]byte("é\x7frm -rf /\r"))
+		assert(len(matches)).Equals(1)
+	})
+
+	t.Run("confirmation", func(t *testing.T) {
+		assert := assert.New(t)
+		guard := newGuard()
+		assert(guard.Feed([]byte("reboot\rls\r"))).Equals(
+			[]byte("reboot"),
+			[]*CommandMatch{{Line: "reboot", Pattern: "^reboot$", Action: CommandActionConfirm}},
+		)
+		assert(guard.Feed([]byte("\r"))).Equals(
+			[]byte("\r"),
+			[]*CommandMatch{{Line: "reboot", Pattern: "^reboot$", Action: CommandActionConfirmed}},
+		)
+
+		_, _ = guard.Feed([]byte("reboot\r"))
+		assert(guard.Feed([]byte("nls\r"))).Equals(
+			[]byte("\x15ls\r"),
+			[]*CommandMatch{{Line: "reboot", Pattern: "^reboot$", Action: CommandActionCancelled}},
+		)
+	})
+}
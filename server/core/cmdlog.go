@@ -0,0 +1,323 @@
+package core
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultPromptPattern matches the last line of the output when the shell
+// shows a prompt, e.g. "root@web:~# " or "[alice@db tmp]$ "
+const DefaultPromptPattern = `^(\S.{0,120})?[$#%>] ?$`
+
+const (
+	recorderStateIdle = iota
+	recorderStateTyping
+	recorderStateRunning
+)
+
+const (
+	recorderParseText = iota
+	recorderParseEscape
+	recorderParseCSI
+	recorderParseOSC
+	recorderParseString
+	recorderParseStringEscape
+)
+
+// RecordedCommand is a command that has been run in a terminal, the exit
+// code is nil if the shell does not report it
+type RecordedCommand struct {
+	Command   string
+	Output    string
+	Truncated bool
+	ExitCode  *int
+	Start     time.Time
+	End       time.Time
+}
+
+// CommandRecorder rebuilds the commands of a shell session from the output
+// of the terminal. A shell that emits the OSC 133 marks of the shell
+// integration (A prompt, B command, C output, D;<exit> done) is followed by
+// the marks, the other shells by matching the prompt at the end of the
+// output. The command is the echoed text after the prompt, so the edits of
+// the shell like history and completion are seen. Submit must be called
+// when the user presses Enter.
+type CommandRecorder struct {
+	prompt    *regexp.Regexp
+	maxOutput int
+	hasMarks  bool
+	state     int
+	submitted bool
+
+	parse  int
+	osc    []byte
+	params []int
+
+	line      []rune
+	cursor    int
+	promptLen int
+	typed     string
+
+	command   string
+	start     time.Time
+	output    []byte
+	truncated bool
+}
+
+// NewCommandRecorder creates a recorder that keeps up to maxOutput bytes
+// of the output of a command
+func NewCommandRecorder(prompt *regexp.Regexp, maxOutput int) *CommandRecorder {
+	return &CommandRecorder{prompt: prompt, maxOutput: maxOutput}
+}
+
+// Submit tells the recorder that the user has pressed Enter
+func (p *CommandRecorder) Submit() {
+	if p.state == recorderStateTyping {
+		p.submitted = true
+	}
+}
+
+// Feed processes the UTF-8 output of the terminal and returns the commands
+// that have finished
+func (p *CommandRecorder) Feed(output []byte, now time.Time) []*RecordedCommand {
+	ret := make([]*RecordedCommand, 0)
+	for len(output) > 0 {
+		r, size := utf8.DecodeRune(output)
+		output = output[size:]
+		if v := p.feed(r, now); v != nil {
+			ret = append(ret, v)
+		}
+	}
+
+	// without the marks, a prompt is only expected at the end of the output
+	if !p.hasMarks && p.state != recorderStateTyping && p.prompt.MatchString(string(p.line)) {
+		if v := p.finish(nil, now); v != nil {
+			ret = append(ret, v)
+		}
+		p.state, p.promptLen, p.submitted = recorderStateTyping, p.cursor, false
+	}
+	return ret
+}
+
+func (p *CommandRecorder) feed(r rune, now time.Time) *RecordedCommand {
+	switch p.parse {
+	case recorderParseEscape:
+		p.parse = recorderParseText
+		if r == '[' {
+			p.parse, p.params = recorderParseCSI, p.params[:0]
+		} else if r == ']' {
+			p.parse, p.osc = recorderParseOSC, p.osc[:0]
+		} else if r == 'P' || r == '_' || r == '^' || r == 'X' {
+			p.parse, p.osc = recorderParseString, p.osc[:0]
+		}
+		return nil
+	case recorderParseCSI:
+		if r >= '0' && r <= '9' {
+			if len(p.params) == 0 {
+				p.params = append(p.params, 0)
+			}
+			p.params[len(p.params)-1] = p.params[len(p.params)-1]*10 + int(r-'0')
+		} else if r == ';' {
+			p.params = append(p.params, 0)
+		} else if r >= 0x40 && r <= 0x7E {
+			p.parse = recorderParseText
+			p.csi(r)
+		}
+		return nil
+	case recorderParseOSC, recorderParseString:
+		if r == 0x07 {
+			p.parse = recorderParseText
+			return p.mark(now)
+		} else if r == 0x1B {
+			p.parse = recorderParseStringEscape
+		} else if p.parse == recorderParseOSC && len(p.osc) < 64 {
+			p.osc = append(p.osc, string(r)...)
+		}
+		return nil
+	case recorderParseStringEscape:
+		p.parse = recorderParseText
+		return p.mark(now)
+	}
+
+	switch {
+	case r == 0x1B:
+		p.parse = recorderParseEscape
+	case r == '\n':
+		return p.newline(now)
+	case r == '\r':
+		p.cursor = 0
+	case r == 0x08:
+		if p.cursor > 0 {
+			p.cursor--
+		}
+	case r == '\t':
+		for p.put(' '); p.cursor%8 != 0; {
+			p.put(' ')
+		}
+	case r >= 0x20 && r != 0x7F:
+		p.put(r)
+	}
+	return nil
+}
+
+// put writes the rune at the cursor of the current line
+func (p *CommandRecorder) put(r rune) {
+	if p.cursor < len(p.line) {
+		p.line[p.cursor] = r
+	} else if len(p.line) < 4096 {
+		for len(p.line) < p.cursor {
+			p.line = append(p.line, ' ')
+		}
+		p.line = append(p.line, r)
+	}
+	p.cursor++
+}
+
+func (p *CommandRecorder) param(defaultValue int) int {
+	if len(p.params) == 0 || p.params[0] == 0 {
+		return defaultValue
+	}
+	return p.params[0]
+}
+
+// csi applies the sequences that the line editors of the shells use to
+// redraw the line
+func (p *CommandRecorder) csi(c rune) {
+	switch c {
+	case 'C':
+		p.cursor += p.param(1)
+	case 'D':
+		if p.cursor -= p.param(1); p.cursor < 0 {
+			p.cursor = 0
+		}
+	case 'G':
+		p.cursor = p.param(1) - 1
+	case 'K':
+		if mode := p.param(0); mode == 0 && p.cursor < len(p.line) {
+			p.line = p.line[:p.cursor]
+		} else if mode == 2 {
+			p.line = p.line[:0]
+		}
+	case 'P':
+		if n := p.param(1); p.cursor < len(p.line) {
+			p.line = append(p.line[:p.cursor], p.line[min(p.cursor+n, len(p.line)):]...)
+		}
+	case '@':
+		if p.cursor < len(p.line) {
+			blanks := []rune(strings.Repeat(" ", p.param(1)))
+			p.line = append(p.line[:p.cursor], append(blanks, p.line[p.cursor:]...)...)
+		}
+	}
+}
+
+func (p *CommandRecorder) lineText() string {
+	return strings.TrimRight(string(p.line), " ")
+}
+
+func (p *CommandRecorder) commandText() string {
+	if p.promptLen >= len(p.line) {
+		return ""
+	}
+	return strings.TrimSpace(string(p.line[p.promptLen:]))
+}
+
+func (p *CommandRecorder) newline(now time.Time) *RecordedCommand {
+	switch p.state {
+	case recorderStateTyping:
+		p.typed = p.commandText()
+		if !p.hasMarks {
+			if p.submitted {
+				p.run(p.typed, now)
+			} else {
+				// the prompt was an output of a program, not of the shell
+				p.state = recorderStateIdle
+			}
+		}
+	case recorderStateRunning:
+		p.appendOutput(p.lineText() + "\n")
+	}
+
+	p.line, p.cursor, p.promptLen = p.line[:0], 0, 0
+	return nil
+}
+
+func (p *CommandRecorder) run(command string, now time.Time) {
+	p.state, p.submitted = recorderStateRunning, false
+	p.command, p.start = command, now
+	p.output, p.truncated = p.output[:0], false
+}
+
+func (p *CommandRecorder) appendOutput(text string) {
+	if n := p.maxOutput - len(p.output); n < len(text) {
+		text, p.truncated = text[:max(n, 0)], true
+		// do not cut a multi-byte char
+		for len(text) > 0 && !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+	}
+	p.output = append(p.output, text...)
+}
+
+// finish returns the running command, an empty command is not recorded
+func (p *CommandRecorder) finish(exitCode *int, now time.Time) *RecordedCommand {
+	if p.state != recorderStateRunning {
+		return nil
+	}
+	p.state = recorderStateIdle
+	if p.command == "" {
+		return nil
+	}
+
+	return &RecordedCommand{
+		Command:   p.command,
+		Output:    string(p.output),
+		Truncated: p.truncated,
+		ExitCode:  exitCode,
+		Start:     p.start,
+		End:       now,
+	}
+}
+
+// mark handles the OSC 133 marks of the shell integration
+func (p *CommandRecorder) mark(now time.Time) *RecordedCommand {
+	text := string(p.osc)
+	if !strings.HasPrefix(text, "133;") || len(text) < 5 {
+		return nil
+	}
+	p.hasMarks = true
+
+	switch text[4] {
+	case 'A':
+		return p.finish(nil, now)
+	case 'B':
+		ret := p.finish(nil, now)
+		p.state, p.promptLen, p.typed = recorderStateTyping, p.cursor, ""
+		return ret
+	case 'C':
+		if p.state == recorderStateTyping {
+			command := p.typed
+			if command == "" {
+				command = p.commandText()
+			}
+			p.run(command, now)
+			p.line, p.cursor, p.promptLen = p.line[:0], 0, 0
+		}
+	case 'D':
+		if p.state == recorderStateRunning {
+			if line := p.lineText(); line != "" {
+				p.appendOutput(line)
+			}
+			exitCode := (*int)(nil)
+			if args := strings.Split(text, ";"); len(args) > 2 {
+				if v, e := strconv.Atoi(args[2]); e == nil {
+					exitCode = &v
+				}
+			}
+			return p.finish(exitCode, now)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/rpccloud/assert"
+)
+
+func TestCommandRecorder_Feed(t *testing.T) {
+	prompt := regexp.MustCompile(DefaultPromptPattern)
+	now := time.Unix(1600000000, 0)
+
+	t.Run("prompt", func(t *testing.T) {
+		assert := assert.New(t)
+		v := NewCommandRecorder(prompt, 1024)
+		assert(len(v.Feed([]byte("Welcome\r\nroot@web:~# "), now))).Equals(0)
+		// the line is edited with backspace before Enter
+		assert(len(v.Feed([]byte("lx\bs -a"), now))).Equals(0)
+		v.Submit()
+		assert(len(v.Feed([]byte("\r\n.\r\n.."), now))).Equals(0)
+		ret := v.Feed([]byte("\r\nroot@web:~# "), now.Add(time.Second))
+		assert(len(ret)).Equals(1)
+		assert(ret[0].Command, ret[0].Output, ret[0].ExitCode).Equals("ls -a", ".\n..\n", (*int)(nil))
+		assert(ret[0].End.Sub(ret[0].Start)).Equals(time.Second)
+
+		// an empty line and a cancelled line are not commands
+		v.Submit()
+		assert(len(v.Feed([]byte("\r\nroot@web:~# "), now))).Equals(0)
+		assert(len(v.Feed([]byte("rm -rf /^C\r\nroot@web:~# "), now))).Equals(0)
+	})
+
+	t.Run("marks", func(t *testing.T) {
+		assert := assert.New(t)
+		v := NewCommandRecorder(prompt, 1024)
+		output := "\x1b]133;A\x07alice@db tmp> \x1b]133;B\x07gi\x1b[1@t status\r\n" +
+			"\x1b]133;C\x07fatal: not a git repository\r\n\x1b]133;D;128\x1b\\" +
+			"\x1b]133;A\x07alice@db tmp> \x1b]133;B\x07"
+		ret := v.Feed([]byte(output), now)
+		assert(len(ret)).Equals(1)
+		assert(ret[0].Command, ret[0].Output, *ret[0].ExitCode).
+			Equals("git status", "fatal: not a git repository\n", 128)
+
+		// the prompt pattern is not used after the marks
+		assert(len(v.Feed([]byte("true\r\n\x1b]133;C\x07$ "), now))).Equals(0)
+		ret = v.Feed([]byte("\x1b]133;D\x07"), now)
+		assert(len(ret), ret[0].Command, ret[0].ExitCode).Equals(1, "true", (*int)(nil))
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		assert := assert.New(t)
+		v := NewCommandRecorder(prompt, 8)
+		v.Feed([]byte("$ "), now)
+		v.Feed([]byte("cat"), now)
+		v.Submit()
+		ret := v.Feed([]byte("\r\n1234567\r\n你好\r\n$ "), now)
+		assert(len(ret)).Equals(1)
+		assert(ret[0].Output, ret[0].Truncated).Equals("1234567\n", true)
+	})
+}
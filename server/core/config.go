@@ -9,14 +9,46 @@ func GetConfig() *Config {
 }
 
 type Config struct {
-	dbFile         string
-	sessionTimeout time.Duration
+	dbFile                 string
+	sessionTimeout         time.Duration
+	healthCheckInterval    time.Duration
+	healthHistoryRetention time.Duration
+	factsInterval          time.Duration
+	metricsInterval        time.Duration
+	sshPoolIdleTimeout     time.Duration
+	alertInterval          time.Duration
+	auditRetention         time.Duration
+	maxSessionsPerUser     int64
+	maxSessionsPerServer   int64
+	terminalDetachTimeout  time.Duration
+	credentialKeyFile      string
+	localShellEnabled      bool
+	localShellUser         string
+	localShell             string
+	bandwidthPerSession    int64
+	bandwidthPerUser       int64
 }
 
 func newConfig() *Config {
 	return &Config{
-		dbFile:         "./vbot.db",
-		sessionTimeout: 120 * time.Second,
+		dbFile:                 "./vbot.db",
+		sessionTimeout:         120 * time.Second,
+		healthCheckInterval:    60 * time.Second,
+		healthHistoryRetention: 7 * 24 * time.Hour,
+		factsInterval:          time.Hour,
+		metricsInterval:        60 * time.Second,
+		sshPoolIdleTimeout:     5 * time.Minute,
+		alertInterval:          30 * time.Second,
+		auditRetention:         90 * 24 * time.Hour,
+		maxSessionsPerUser:     0,
+		maxSessionsPerServer:   0,
+		terminalDetachTimeout:  5 * time.Minute,
+		credentialKeyFile:      "./vbot.key",
+		localShellEnabled:      false,
+		localShellUser:         "",
+		localShell:             "/bin/bash",
+		bandwidthPerSession:    0,
+		bandwidthPerUser:       0,
 	}
 }
 
@@ -35,3 +67,131 @@ func (p *Config) GetSessionTimeout() time.Duration {
 func (p *Config) SetSessionTimeout(sessionTimeout time.Duration) {
 	p.sessionTimeout = sessionTimeout
 }
+
+func (p *Config) GetHealthCheckInterval() time.Duration {
+	return p.healthCheckInterval
+}
+
+func (p *Config) SetHealthCheckInterval(healthCheckInterval time.Duration) {
+	p.healthCheckInterval = healthCheckInterval
+}
+
+func (p *Config) GetHealthHistoryRetention() time.Duration {
+	return p.healthHistoryRetention
+}
+
+func (p *Config) SetHealthHistoryRetention(healthHistoryRetention time.Duration) {
+	p.healthHistoryRetention = healthHistoryRetention
+}
+
+func (p *Config) GetFactsInterval() time.Duration {
+	return p.factsInterval
+}
+
+func (p *Config) SetFactsInterval(factsInterval time.Duration) {
+	p.factsInterval = factsInterval
+}
+
+func (p *Config) GetMetricsInterval() time.Duration {
+	return p.metricsInterval
+}
+
+func (p *Config) SetMetricsInterval(metricsInterval time.Duration) {
+	p.metricsInterval = metricsInterval
+}
+
+func (p *Config) GetSSHPoolIdleTimeout() time.Duration {
+	return p.sshPoolIdleTimeout
+}
+
+func (p *Config) SetSSHPoolIdleTimeout(sshPoolIdleTimeout time.Duration) {
+	p.sshPoolIdleTimeout = sshPoolIdleTimeout
+}
+
+func (p *Config) GetAlertInterval() time.Duration {
+	return p.alertInterval
+}
+
+func (p *Config) SetAlertInterval(alertInterval time.Duration) {
+	p.alertInterval = alertInterval
+}
+
+func (p *Config) GetAuditRetention() time.Duration {
+	return p.auditRetention
+}
+
+func (p *Config) SetAuditRetention(auditRetention time.Duration) {
+	p.auditRetention = auditRetention
+}
+
+func (p *Config) GetMaxSessionsPerUser() int64 {
+	return p.maxSessionsPerUser
+}
+
+func (p *Config) SetMaxSessionsPerUser(maxSessionsPerUser int64) {
+	p.maxSessionsPerUser = maxSessionsPerUser
+}
+
+func (p *Config) GetMaxSessionsPerServer() int64 {
+	return p.maxSessionsPerServer
+}
+
+func (p *Config) SetMaxSessionsPerServer(maxSessionsPerServer int64) {
+	p.maxSessionsPerServer = maxSessionsPerServer
+}
+
+func (p *Config) GetTerminalDetachTimeout() time.Duration {
+	return p.terminalDetachTimeout
+}
+
+func (p *Config) SetTerminalDetachTimeout(terminalDetachTimeout time.Duration) {
+	p.terminalDetachTimeout = terminalDetachTimeout
+}
+
+func (p *Config) GetCredentialKeyFile() string {
+	return p.credentialKeyFile
+}
+
+func (p *Config) SetCredentialKeyFile(credentialKeyFile string) {
+	p.credentialKeyFile = credentialKeyFile
+}
+
+func (p *Config) GetLocalShellEnabled() bool {
+	return p.localShellEnabled
+}
+
+func (p *Config) SetLocalShellEnabled(localShellEnabled bool) {
+	p.localShellEnabled = localShellEnabled
+}
+
+func (p *Config) GetLocalShellUser() string {
+	return p.localShellUser
+}
+
+func (p *Config) SetLocalShellUser(localShellUser string) {
+	p.localShellUser = localShellUser
+}
+
+func (p *Config) GetLocalShell() string {
+	return p.localShell
+}
+
+func (p *Config) SetLocalShell(localShell string) {
+	p.localShell = localShell
+}
+
+func (p *Config) GetBandwidthPerSession() int64 {
+	return p.bandwidthPerSession
+}
+
+func (p *Config) SetBandwidthPerSession(bandwidthPerSession int64) {
+	p.bandwidthPerSession = bandwidthPerSession
+}
+
+func (p *Config) GetBandwidthPerUser() int64 {
+	return p.bandwidthPerUser
+}
+
+func (p *Config) SetBandwidthPerUser(bandwidthPerUser int64) {
+	p.bandwidthPerUser = bandwidthPerUser
+}
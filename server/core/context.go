@@ -1,7 +1,11 @@
 package core
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"path/filepath"
+	"time"
 
 	"rogchap.com/v8go"
 )
@@ -15,6 +19,16 @@ type Context struct {
 }
 
 func NewRootContext(file string) (*Context, error) {
+	return newContext(file, make(chan *LogItem, 1024000))
+}
+
+// NewScriptContext creates a context that only runs a script, it has no log
+// channel and its reports are dropped
+func NewScriptContext(file string) (*Context, error) {
+	return newContext(file, nil)
+}
+
+func newContext(file string, logCH chan *LogItem) (*Context, error) {
 	if absFile, e := filepath.Abs(file); e != nil {
 		return nil, e
 	} else if vm, e := v8go.NewIsolate(); e != nil {
@@ -27,7 +41,7 @@ func NewRootContext(file string) (*Context, error) {
 			vm:     vm,
 			v8Ctx:  v8Ctx,
 			file:   absFile,
-			logCH:  make(chan *LogItem, 1024000),
+			logCH:  logCH,
 		}, nil
 	}
 }
@@ -49,3 +63,77 @@ func (p *Context) Report(kind LogKind, data []byte) bool {
 		return false
 	}
 }
+
+// SetGlobal sets a global variable of the script to the JSON value of the
+// Go value
+func (p *Context) SetGlobal(name string, value interface{}) error {
+	if data, e := json.Marshal(value); e != nil {
+		return e
+	} else if v, e := v8go.JSONParse(p.v8Ctx, string(data)); e != nil {
+		return e
+	} else {
+		return p.v8Ctx.Global().Set(name, v)
+	}
+}
+
+// SetFunction sets a global function of the script, the arguments are
+// passed as strings and a non-empty result is returned to the script
+func (p *Context) SetFunction(name string, fn func(args []string) string) error {
+	tmpl, e := v8go.NewFunctionTemplate(p.vm, func(info *v8go.FunctionCallbackInfo) *v8go.Value {
+		args := make([]string, 0)
+		for _, arg := range info.Args() {
+			args = append(args, arg.String())
+		}
+		if ret := fn(args); ret != "" {
+			v, _ := v8go.NewValue(p.vm, ret)
+			return v
+		}
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+	return p.v8Ctx.Global().Set(name, tmpl.GetFunction(p.v8Ctx))
+}
+
+// Run runs the script of the context file and returns the JSON value of the
+// result, nil if it is undefined. The script is terminated after the
+// timeout, a termination that has started is finished when Run returns.
+func (p *Context) Run(source string, timeout time.Duration) (interface{}, error) {
+	if timeout > 0 {
+		terminated := make(chan bool)
+		timer := time.AfterFunc(timeout, func() {
+			p.vm.TerminateExecution()
+			close(terminated)
+		})
+		defer func() {
+			if !timer.Stop() {
+				<-terminated
+			}
+		}()
+	}
+
+	start := time.Now()
+	v, e := p.v8Ctx.RunScript(source, p.file)
+	if e != nil {
+		if timeout > 0 && time.Since(start) >= timeout {
+			return nil, fmt.Errorf("script timed out after %s", timeout)
+		}
+		return nil, e
+	} else if v == nil || v.IsUndefined() {
+		return nil, nil
+	} else if str, e := v8go.JSONStringify(p.v8Ctx, v); e != nil {
+		return nil, e
+	} else if str == "" {
+		return nil, errors.New("script result can not be converted to JSON")
+	} else {
+		var ret interface{}
+		return ret, json.Unmarshal([]byte(str), &ret)
+	}
+}
+
+// Close releases the VM of the context, the context can not be used after
+func (p *Context) Close() {
+	p.v8Ctx.Close()
+	p.vm.Dispose()
+}
@@ -1,9 +1,13 @@
 package core
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/rpccloud/assert"
 	"rogchap.com/v8go"
 )
 
@@ -15,3 +19,46 @@ func TestDebug(t *testing.T) {
 	val, _ := ctx.RunScript("result", "value.js")           // return a value in JavaScript back to Go
 	fmt.Printf("addition result: %s\n", val)
 }
+
+func TestContext_Run(t *testing.T) {
+	t.Run("globals and functions", func(t *testing.T) {
+		assert := assert.New(t)
+		ctx, e := NewScriptContext("test.js")
+		assert(e).IsNil()
+		defer ctx.Close()
+
+		args := []string(nil)
+		assert(ctx.SetGlobal("session", map[string]interface{}{"user": "alice", "port": 22})).IsNil()
+		assert(ctx.SetFunction("record", func(v []string) string {
+			args = v
+			return "done"
+		})).IsNil()
+		assert(ctx.Run("record(session.user, session.port)", time.Second)).Equals("done", nil)
+		assert(args).Equals([]string{"alice", "22"})
+		assert(ctx.Run("({ok: session.port > 0})", time.Second)).
+			Equals(map[string]interface{}{"ok": true}, nil)
+		assert(ctx.Run("undefined", time.Second)).Equals(nil, nil)
+		assert(ctx.Report(LogKindInfo, []byte("dropped"))).IsFalse()
+	})
+
+	t.Run("script error", func(t *testing.T) {
+		assert := assert.New(t)
+		ctx, _ := NewScriptContext("test.js")
+		defer ctx.Close()
+
+		_, e := ctx.Run("throw new Error('denied')", time.Second)
+		assert(e).IsNotNil()
+		assert(strings.Contains(e.Error(), "denied")).IsTrue()
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		assert := assert.New(t)
+		ctx, _ := NewScriptContext("test.js")
+		defer ctx.Close()
+
+		_, e := ctx.Run("while (true) {}", 50*time.Millisecond)
+		assert(e).Equals(errors.New("script timed out after 50ms"))
+		// the timer of a finished script does not terminate the next one
+		assert(ctx.Run("1", 50*time.Millisecond)).Equals(float64(1), nil)
+	})
+}
@@ -0,0 +1,69 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+const credentialKeySize = 64
+
+var gCredentialKeys = struct {
+	keys map[string][]byte
+	mu   sync.Mutex
+}{
+	keys: make(map[string][]byte),
+}
+
+// GetCredentialKey returns the key that encrypts the credentials. The key is
+// kept in its own file outside the database so that a copy of the database
+// does not reveal the credentials, the file is created if it does not exist.
+func GetCredentialKey() ([]byte, error) {
+	gCredentialKeys.mu.Lock()
+	defer gCredentialKeys.mu.Unlock()
+
+	keyFile := GetConfig().GetCredentialKeyFile()
+	if key, ok := gCredentialKeys.keys[keyFile]; ok {
+		return key, nil
+	}
+
+	key, e := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(e) {
+		if v, e := GetRandString(credentialKeySize); e != nil {
+			return nil, e
+		} else if e := ioutil.WriteFile(keyFile, []byte(v), 0600); e != nil {
+			return nil, e
+		} else {
+			key = []byte(v)
+		}
+	} else if e != nil {
+		return nil, e
+	} else if len(key) < credentialKeySize {
+		return nil, fmt.Errorf("credential key file \"%s\" is invalid", keyFile)
+	}
+
+	gCredentialKeys.keys[keyFile] = key
+	return key, nil
+}
+
+// EncryptCredential encrypts the secret with the credential key
+func EncryptCredential(secret []byte) ([]byte, error) {
+	if key, e := GetCredentialKey(); e != nil {
+		return nil, e
+	} else {
+		return Encrypt(key, secret)
+	}
+}
+
+// DecryptCredential decrypts the secret with the credential key
+func DecryptCredential(data []byte) ([]byte, error) {
+	if key, e := GetCredentialKey(); e != nil {
+		return nil, e
+	} else if len(data) < 32+12+16 {
+		// salt, nonce and tag
+		return nil, fmt.Errorf("credential is invalid")
+	} else {
+		return Decrypt(key, data)
+	}
+}
@@ -0,0 +1,46 @@
+package core
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rpccloud/assert"
+)
+
+func TestGetCredentialKey(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		GetConfig().SetCredentialKeyFile("test.key")
+		defer func() {
+			GetConfig().SetCredentialKeyFile("./vbot.key")
+			os.Remove("test.key")
+		}()
+
+		key, e := GetCredentialKey()
+		assert(e, len(key)).Equals(nil, credentialKeySize)
+		info, _ := os.Stat("test.key")
+		assert(info.Mode().Perm()).Equals(os.FileMode(0600))
+		assert(GetCredentialKey()).Equals(key, nil)
+
+		data, e := EncryptCredential([]byte("secret"))
+		assert(e).IsNil()
+		assert(DecryptCredential(data)).Equals([]byte("secret"), nil)
+		assert(DecryptCredential([]byte("short"))).
+			Equals(nil, errors.New("credential is invalid"))
+	})
+
+	t.Run("invalid key file", func(t *testing.T) {
+		assert := assert.New(t)
+		GetConfig().SetCredentialKeyFile("invalid.key")
+		_ = ioutil.WriteFile("invalid.key", []byte("abc"), 0600)
+		defer func() {
+			GetConfig().SetCredentialKeyFile("./vbot.key")
+			os.Remove("invalid.key")
+		}()
+
+		assert(GetCredentialKey()).
+			Equals(nil, errors.New("credential key file \"invalid.key\" is invalid"))
+	})
+}
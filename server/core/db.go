@@ -111,6 +111,21 @@ func (p *DB) DeleteBucket(name string) error {
 	})
 }
 
+func (p *DB) ListBuckets(prefix string) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ret := make([]string, 0)
+	return ret, p.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if bytes.HasPrefix(name, []byte(prefix)) {
+				ret = append(ret, string(name))
+			}
+			return nil
+		})
+	})
+}
+
 func (p *DB) Update(fn func(tx *bolt.Tx) error) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -213,3 +228,80 @@ func (p *DB) GetBucketID(bucketName string) (uint64, error) {
 		return nil
 	})
 }
+
+// AppendLog appends the record to the log bucket, the records are ordered by
+// time and are never changed. The bucket is created if it does not exist.
+func (p *DB) AppendLog(bucketName string, t time.Time, value []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.db.Update(func(tx *bolt.Tx) error {
+		b, e := tx.CreateBucketIfNotExists([]byte(bucketName))
+		if e != nil {
+			return e
+		}
+
+		seq, e := b.NextSequence()
+		if e != nil {
+			return e
+		}
+
+		return b.Put(DBKey("%020d.%020d", t.UnixNano(), seq), value)
+	})
+}
+
+// ScanLog calls fn with the records of the log bucket from start (included)
+// to end (excluded) in order, a zero start or end means no limit. The scan
+// stops when fn returns false.
+func (p *DB) ScanLog(bucketName string, start time.Time, end time.Time, fn func(value []byte) bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		k, v := c.First()
+		if !start.IsZero() {
+			k, v = c.Seek(DBKey("%020d", start.UnixNano()))
+		}
+		endKey := DBKey("%020d", end.UnixNano())
+		for ; k != nil; k, v = c.Next() {
+			if !end.IsZero() && bytes.Compare(k, endKey) >= 0 {
+				return nil
+			}
+			if !fn(v) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// TrimLog deletes the records of the log bucket before the time, it returns
+// the number of deleted records
+func (p *DB) TrimLog(bucketName string, before time.Time) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ret := 0
+	return ret, p.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		endKey := DBKey("%020d", before.UnixNano())
+		for k, _ := c.First(); k != nil && bytes.Compare(k, endKey) < 0; k, _ = c.First() {
+			if e := c.Delete(); e != nil {
+				return e
+			}
+			ret++
+		}
+		return nil
+	})
+}
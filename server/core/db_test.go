@@ -4,6 +4,7 @@ import (
 	"errors"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/rpccloud/assert"
 )
@@ -84,6 +85,21 @@ func TestDB_DeleteBucket(t *testing.T) {
 	})
 }
 
+func TestDB_ListBuckets(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		assert(db.ListBuckets("-")).Equals([]string{}, nil)
+		_ = db.CreateBucketIsNotExist("auth")
+		_ = db.CreateBucketIsNotExist("-a")
+		_ = db.CreateBucketIsNotExist("-b")
+		assert(db.ListBuckets("-")).Equals([]string{"-a", "-b"}, nil)
+	})
+}
+
 func TestDB_Put(t *testing.T) {
 	t.Run("test ok", func(t *testing.T) {
 		assert := assert.New(t)
@@ -212,3 +228,38 @@ func TestDB_GetBucketID(t *testing.T) {
 		}
 	})
 }
+
+func TestDB_Log(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		base := time.Unix(1000, 0)
+		for i := 0; i < 5; i++ {
+			at := base.Add(time.Duration(i) * time.Second)
+			assert(db.AppendLog("log", at, []byte{byte(i)})).IsNil()
+		}
+		assert(db.AppendLog("log", base, []byte{9})).IsNil()
+
+		scan := func(start time.Time, end time.Time) []byte {
+			ret := make([]byte, 0)
+			assert(db.ScanLog("log", start, end, func(value []byte) bool {
+				ret = append(ret, value...)
+				return true
+			})).IsNil()
+			return ret
+		}
+		assert(scan(time.Time{}, time.Time{})).Equals([]byte{0, 9, 1, 2, 3, 4})
+		assert(scan(base.Add(time.Second), base.Add(3*time.Second))).
+			Equals([]byte{1, 2})
+		assert(db.ScanLog("missing", time.Time{}, time.Time{}, func(value []byte) bool {
+			return true
+		})).IsNil()
+
+		assert(db.TrimLog("log", base.Add(2*time.Second))).Equals(3, nil)
+		assert(scan(time.Time{}, time.Time{})).Equals([]byte{2, 3, 4})
+		assert(db.TrimLog("missing", base)).Equals(0, nil)
+	})
+}
@@ -0,0 +1,188 @@
+//go:build linux
+// +build linux
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// LocalShell is a shell that runs in a pseudo terminal on the vbot host
+type LocalShell struct {
+	pty *os.File
+	cmd *exec.Cmd
+}
+
+type ptyWinsize struct {
+	rows uint16
+	cols uint16
+	x    uint16
+	y    uint16
+}
+
+// ptyIoctl runs the ioctl on the file without switching it to blocking
+// mode, so that a pending read is interrupted by Close
+func ptyIoctl(file *os.File, request uintptr, arg unsafe.Pointer) error {
+	conn, e := file.SyscallConn()
+	if e != nil {
+		return e
+	}
+
+	errno := syscall.Errno(0)
+	if e := conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	}); e != nil {
+		return e
+	} else if errno != 0 {
+		return errno
+	} else {
+		return nil
+	}
+}
+
+// openPTY opens a new pseudo terminal and returns its master and slave side
+func openPTY() (*os.File, *os.File, error) {
+	master, e := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_CLOEXEC, 0)
+	if e != nil {
+		return nil, nil, e
+	}
+
+	unlock, index := int32(0), uint32(0)
+	if e := ptyIoctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); e != nil {
+		_ = master.Close()
+		return nil, nil, e
+	} else if e := ptyIoctl(master, syscall.TIOCGPTN, unsafe.Pointer(&index)); e != nil {
+		_ = master.Close()
+		return nil, nil, e
+	} else if slave, e := os.OpenFile(
+		fmt.Sprintf("/dev/pts/%d", index), os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0,
+	); e != nil {
+		_ = master.Close()
+		return nil, nil, e
+	} else {
+		return master, slave, nil
+	}
+}
+
+// lookupShellUser returns the credential of the account, the shell must
+// not run as root
+func lookupShellUser(name string) (*user.User, *syscall.Credential, error) {
+	if name == "" {
+		return nil, nil, errors.New("local shell user is not configured")
+	}
+
+	u, e := user.Lookup(name)
+	if e != nil {
+		return nil, nil, e
+	}
+	uid, e := strconv.ParseUint(u.Uid, 10, 32)
+	if e != nil {
+		return nil, nil, e
+	}
+	gid, e := strconv.ParseUint(u.Gid, 10, 32)
+	if e != nil {
+		return nil, nil, e
+	}
+	if uid == 0 {
+		return nil, nil, fmt.Errorf("local shell user \"%s\" is privileged", name)
+	}
+
+	ret := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	if os.Getuid() != 0 {
+		// only root can set the supplementary groups
+		ret.NoSetGroups = true
+	} else if groups, e := u.GroupIds(); e == nil {
+		for _, group := range groups {
+			if v, e := strconv.ParseUint(group, 10, 32); e == nil {
+				ret.Groups = append(ret.Groups, uint32(v))
+			}
+		}
+	}
+	return u, ret, nil
+}
+
+// StartLocalShell starts the shell under the account in a pseudo terminal
+// of the size
+func StartLocalShell(shell string, userName string, rows int, cols int) (*LocalShell, error) {
+	u, credential, e := lookupShellUser(userName)
+	if e != nil {
+		return nil, e
+	}
+
+	master, slave, e := openPTY()
+	if e != nil {
+		return nil, e
+	}
+	defer slave.Close()
+
+	ret := &LocalShell{pty: master, cmd: exec.Command(shell, "-l")}
+	if e := ret.Resize(rows, cols); e != nil {
+		_ = master.Close()
+		return nil, e
+	}
+
+	ret.cmd.Dir = "/"
+	if info, e := os.Stat(u.HomeDir); e == nil && info.IsDir() {
+		ret.cmd.Dir = u.HomeDir
+	}
+	ret.cmd.Env = []string{
+		"HOME=" + u.HomeDir,
+		"USER=" + u.Username,
+		"LOGNAME=" + u.Username,
+		"SHELL=" + shell,
+		"TERM=xterm",
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	}
+	ret.cmd.Stdin, ret.cmd.Stdout, ret.cmd.Stderr = slave, slave, slave
+	ret.cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:     true,
+		Setctty:    true,
+		Credential: credential,
+	}
+
+	if e := ret.cmd.Start(); e != nil {
+		_ = master.Close()
+		return nil, e
+	}
+	return ret, nil
+}
+
+// Read reads the output of the shell, it returns io.EOF after the shell
+// has exited
+func (p *LocalShell) Read(b []byte) (int, error) {
+	n, e := p.pty.Read(b)
+	if pathError, ok := e.(*os.PathError); ok && pathError.Err == syscall.EIO {
+		return n, io.EOF
+	}
+	return n, e
+}
+
+// Write writes the input to the shell
+func (p *LocalShell) Write(b []byte) (int, error) {
+	return p.pty.Write(b)
+}
+
+// Resize changes the window size of the pseudo terminal
+func (p *LocalShell) Resize(rows int, cols int) error {
+	size := &ptyWinsize{rows: uint16(rows), cols: uint16(cols)}
+	return ptyIoctl(p.pty, syscall.TIOCSWINSZ, unsafe.Pointer(size))
+}
+
+// Wait waits for the shell to exit
+func (p *LocalShell) Wait() error {
+	return p.cmd.Wait()
+}
+
+// Close kills the processes of the shell and closes the pseudo terminal
+func (p *LocalShell) Close() error {
+	_ = syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+	return p.pty.Close()
+}
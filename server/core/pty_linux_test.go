@@ -0,0 +1,47 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rpccloud/assert"
+)
+
+func TestStartLocalShell(t *testing.T) {
+	t.Run("privileged user", func(t *testing.T) {
+		assert := assert.New(t)
+		_, e := StartLocalShell("/bin/sh", "root", 24, 80)
+		assert(e).IsNotNil()
+		_, e = StartLocalShell("/bin/sh", "", 24, 80)
+		assert(e).IsNotNil()
+	})
+
+	t.Run("test ok", func(t *testing.T) {
+		if os.Getuid() != 0 {
+			t.Skip("needs root to switch the user")
+		}
+		assert := assert.New(t)
+		shell, e := StartLocalShell("/bin/sh", "nobody", 24, 80)
+		assert(e).IsNil()
+		assert(shell.Resize(30, 100)).IsNil()
+
+		_, e = shell.Write([]byte("id -u; stty size; exit\n"))
+		assert(e).IsNil()
+		output := make([]byte, 0)
+		buf := make([]byte, 1024)
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			n, e := shell.Read(buf)
+			output = append(output, buf[:n]...)
+			if e != nil {
+				break
+			}
+		}
+		assert(bytes.Contains(output, []byte("65534"))).IsTrue()
+		assert(bytes.Contains(output, []byte("30 100"))).IsTrue()
+		assert(shell.Wait()).IsNil()
+		assert(shell.Close()).IsNil()
+	})
+}
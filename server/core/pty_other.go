@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+package core
+
+import "errors"
+
+// LocalShell is a shell that runs in a pseudo terminal on the vbot host
+type LocalShell struct{}
+
+// StartLocalShell is only supported on linux
+func StartLocalShell(shell string, userName string, rows int, cols int) (*LocalShell, error) {
+	return nil, errors.New("local shell is only supported on linux")
+}
+
+func (p *LocalShell) Read(b []byte) (int, error) {
+	return 0, errors.New("local shell is only supported on linux")
+}
+
+func (p *LocalShell) Write(b []byte) (int, error) {
+	return 0, errors.New("local shell is only supported on linux")
+}
+
+func (p *LocalShell) Resize(rows int, cols int) error {
+	return errors.New("local shell is only supported on linux")
+}
+
+func (p *LocalShell) Wait() error {
+	return errors.New("local shell is only supported on linux")
+}
+
+func (p *LocalShell) Close() error {
+	return nil
+}
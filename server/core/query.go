@@ -0,0 +1,236 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type queryKind int
+
+const (
+	queryKindTerm queryKind = iota
+	queryKindAnd
+	queryKindOr
+	queryKindNot
+)
+
+type queryNode struct {
+	kind    queryKind
+	key     string
+	pattern string
+	left    *queryNode
+	right   *queryNode
+}
+
+// Query is a parsed server selection expression such as
+// `tag:prod AND os:ubuntu AND host:10.2.*`
+type Query struct {
+	root *queryNode
+	expr string
+}
+
+func ParseQuery(expr string) (*Query, error) {
+	tokens, e := tokenizeQuery(expr)
+	if e != nil {
+		return nil, e
+	}
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("query \"%s\" is empty", expr)
+	}
+
+	parser := &queryParser{tokens: tokens}
+	root, e := parser.parseOr()
+	if e != nil {
+		return nil, e
+	}
+
+	if parser.pos != len(parser.tokens) {
+		return nil, fmt.Errorf(
+			"unexpected \"%s\" in query \"%s\"",
+			parser.tokens[parser.pos],
+			expr,
+		)
+	}
+
+	return &Query{root: root, expr: expr}, nil
+}
+
+func (p *Query) String() string {
+	return p.expr
+}
+
+// Match evaluates the query, fn reports whether the term key:pattern matches
+func (p *Query) Match(fn func(key string, pattern string) bool) bool {
+	return p.root.match(fn)
+}
+
+func (p *queryNode) match(fn func(key string, pattern string) bool) bool {
+	switch p.kind {
+	case queryKindAnd:
+		return p.left.match(fn) && p.right.match(fn)
+	case queryKindOr:
+		return p.left.match(fn) || p.right.match(fn)
+	case queryKindNot:
+		return !p.left.match(fn)
+	default:
+		return fn(p.key, p.pattern)
+	}
+}
+
+// MatchPattern reports whether value matches the glob pattern, "*" matches
+// any sequence of characters and "?" matches any single character.
+func MatchPattern(pattern string, value string) bool {
+	sb := strings.Builder{}
+	sb.WriteString("(?i)^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+
+	return regexp.MustCompile(sb.String()).MatchString(value)
+}
+
+func tokenizeQuery(expr string) ([]string, error) {
+	ret := make([]string, 0)
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			ret = append(ret, string(c))
+			i++
+		default:
+			sb := strings.Builder{}
+			for i < len(runes) {
+				c = runes[i]
+				if c == ' ' || c == '\t' || c == '\n' || c == '\r' ||
+					c == '(' || c == ')' {
+					break
+				} else if c == '"' {
+					end := i + 1
+					for end < len(runes) && runes[end] != '"' {
+						end++
+					}
+					if end >= len(runes) {
+						return nil, fmt.Errorf("unterminated quote in query \"%s\"", expr)
+					}
+					sb.WriteString(string(runes[i+1 : end]))
+					i = end + 1
+				} else {
+					sb.WriteRune(c)
+					i++
+				}
+			}
+			ret = append(ret, sb.String())
+		}
+	}
+
+	return ret, nil
+}
+
+type queryParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *queryParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *queryParser) parseOr() (*queryNode, error) {
+	left, e := p.parseAnd()
+	if e != nil {
+		return nil, e
+	}
+
+	for strings.ToUpper(p.peek()) == "OR" {
+		p.pos++
+		right, e := p.parseAnd()
+		if e != nil {
+			return nil, e
+		}
+		left = &queryNode{kind: queryKindOr, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (*queryNode, error) {
+	left, e := p.parseNot()
+	if e != nil {
+		return nil, e
+	}
+
+	for {
+		next := p.peek()
+		if strings.ToUpper(next) == "AND" {
+			p.pos++
+		} else if next == "" || next == ")" || strings.ToUpper(next) == "OR" {
+			return left, nil
+		}
+
+		// adjacent terms are joined with an implicit AND
+		right, e := p.parseNot()
+		if e != nil {
+			return nil, e
+		}
+		left = &queryNode{kind: queryKindAnd, left: left, right: right}
+	}
+}
+
+func (p *queryParser) parseNot() (*queryNode, error) {
+	if strings.ToUpper(p.peek()) == "NOT" {
+		p.pos++
+		node, e := p.parseNot()
+		if e != nil {
+			return nil, e
+		}
+		return &queryNode{kind: queryKindNot, left: node}, nil
+	}
+
+	return p.parseTerm()
+}
+
+func (p *queryParser) parseTerm() (*queryNode, error) {
+	token := p.peek()
+	switch strings.ToUpper(token) {
+	case "":
+		return nil, fmt.Errorf("unexpected end of query")
+	case ")", "AND", "OR":
+		return nil, fmt.Errorf("unexpected \"%s\" in query", token)
+	case "(":
+		p.pos++
+		node, e := p.parseOr()
+		if e != nil {
+			return nil, e
+		} else if p.peek() != ")" {
+			return nil, fmt.Errorf("missing \")\" in query")
+		}
+		p.pos++
+		return node, nil
+	default:
+		p.pos++
+		key, pattern := "", token
+		if idx := strings.Index(token, ":"); idx >= 0 {
+			key, pattern = strings.ToLower(token[:idx]), token[idx+1:]
+		}
+		if pattern == "" {
+			return nil, fmt.Errorf("term \"%s\" has empty pattern", token)
+		}
+		return &queryNode{kind: queryKindTerm, key: key, pattern: pattern}, nil
+	}
+}
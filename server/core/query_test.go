@@ -0,0 +1,76 @@
+package core
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rpccloud/assert"
+)
+
+func TestMatchPattern(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(MatchPattern("10.2.*", "10.2.0.1")).IsTrue()
+		assert(MatchPattern("10.2.*", "10.3.0.1")).IsFalse()
+		assert(MatchPattern("web-?", "web-1")).IsTrue()
+		assert(MatchPattern("web-?", "web-12")).IsFalse()
+		assert(MatchPattern("Ubuntu", "ubuntu")).IsTrue()
+		assert(MatchPattern("a.b", "axb")).IsFalse()
+	})
+}
+
+func TestParseQuery(t *testing.T) {
+	attrs := map[string][]string{
+		"tag":  {"prod", "web"},
+		"os":   {"ubuntu"},
+		"host": {"10.2.0.8"},
+		"name": {"web server"},
+	}
+	fnMatch := func(key string, pattern string) bool {
+		for _, v := range attrs[key] {
+			if MatchPattern(pattern, v) {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(ParseQuery("  ")).
+			Equals(nil, errors.New("query \"  \" is empty"))
+	})
+
+	t.Run("syntax error", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(ParseQuery("tag:prod AND")).
+			Equals(nil, errors.New("unexpected end of query"))
+		assert(ParseQuery("(tag:prod")).
+			Equals(nil, errors.New("missing \")\" in query"))
+		assert(ParseQuery("tag:prod)")).
+			Equals(nil, errors.New("unexpected \")\" in query \"tag:prod)\""))
+		assert(ParseQuery("tag:")).
+			Equals(nil, errors.New("term \"tag:\" has empty pattern"))
+		assert(ParseQuery("name:\"web")).
+			Equals(nil, errors.New("unterminated quote in query \"name:\"web\""))
+	})
+
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		for expr, want := range map[string]bool{
+			"tag:prod AND os:ubuntu AND host:10.2.*": true,
+			"tag:prod os:ubuntu":                     true,
+			"tag:prod AND os:centos":                 false,
+			"tag:dev OR os:ubuntu":                   true,
+			"NOT tag:dev":                            true,
+			"not (tag:prod or tag:dev)":              false,
+			"(tag:dev OR tag:web) AND host:10.2.0.8": true,
+			"name:\"web server\"":                    true,
+			"tag:dev OR tag:prod AND os:centos":      false,
+		} {
+			query, e := ParseQuery(expr)
+			assert(e).IsNil()
+			assert(query.Match(fnMatch)).Equals(want)
+		}
+	})
+}
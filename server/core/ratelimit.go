@@ -0,0 +1,105 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket limits a throughput in bytes per second, the bucket holds the
+// bytes of one second so that a short burst is not delayed. Zero rate means
+// no limit.
+type TokenBucket struct {
+	rate   int64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+// NewTokenBucket creates a full bucket of the rate
+func NewTokenBucket(rate int64) *TokenBucket {
+	return &TokenBucket{rate: rate, tokens: float64(rate)}
+}
+
+// Rate returns the rate of the bucket
+func (p *TokenBucket) Rate() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.rate
+}
+
+// SetRate changes the rate, the tokens above the new rate are dropped
+func (p *TokenBucket) SetRate(rate int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.rate = rate
+	if p.tokens > float64(rate) {
+		p.tokens = float64(rate)
+	}
+}
+
+// Reserve takes n bytes from the bucket and returns how long the caller
+// must wait before the bytes are within the rate
+func (p *TokenBucket) Reserve(n int, now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.rate <= 0 {
+		return 0
+	}
+
+	if !p.last.IsZero() && now.After(p.last) {
+		p.tokens += now.Sub(p.last).Seconds() * float64(p.rate)
+		if p.tokens > float64(p.rate) {
+			p.tokens = float64(p.rate)
+		}
+	}
+	if now.After(p.last) {
+		p.last = now
+	}
+
+	p.tokens -= float64(n)
+	if p.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-p.tokens / float64(p.rate) * float64(time.Second))
+}
+
+// RateMeter measures a throughput, the rate is the number of bytes of the
+// last complete second
+type RateMeter struct {
+	second  int64
+	current int64
+	last    int64
+	mu      sync.Mutex
+}
+
+func (p *RateMeter) roll(now time.Time) {
+	if second := now.Unix(); second != p.second {
+		if second == p.second+1 {
+			p.last = p.current
+		} else {
+			p.last = 0
+		}
+		p.second, p.current = second, 0
+	}
+}
+
+// Add counts n bytes at the time
+func (p *RateMeter) Add(n int, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.roll(now)
+	p.current += int64(n)
+}
+
+// Rate returns the bytes per second at the time
+func (p *RateMeter) Rate(now time.Time) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.roll(now)
+	return p.last
+}
@@ -0,0 +1,48 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rpccloud/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	t.Run("no limit", func(t *testing.T) {
+		assert := assert.New(t)
+		bucket := NewTokenBucket(0)
+		assert(bucket.Reserve(1<<30, time.Now())).Equals(time.Duration(0))
+	})
+
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		now := time.Unix(1000, 0)
+		bucket := NewTokenBucket(1000)
+		assert(bucket.Reserve(1000, now)).Equals(time.Duration(0))
+		assert(bucket.Reserve(500, now)).Equals(500 * time.Millisecond)
+		// the tokens of 1.5 seconds pay the debt and refill half the bucket
+		assert(bucket.Reserve(500, now.Add(1500*time.Millisecond))).Equals(time.Duration(0))
+		// the bucket holds the bytes of one second at most
+		assert(bucket.Reserve(1500, now.Add(time.Hour))).Equals(500 * time.Millisecond)
+
+		bucket.SetRate(100)
+		assert(bucket.Rate()).Equals(int64(100))
+		assert(bucket.Reserve(100, now.Add(2*time.Hour))).Equals(time.Duration(0))
+		assert(bucket.Reserve(50, now.Add(2*time.Hour))).Equals(500 * time.Millisecond)
+	})
+}
+
+func TestRateMeter(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		now := time.Unix(1000, 0)
+		meter := &RateMeter{}
+		meter.Add(100, now)
+		meter.Add(200, now.Add(500*time.Millisecond))
+		assert(meter.Rate(now)).Equals(int64(0))
+		assert(meter.Rate(now.Add(time.Second))).Equals(int64(300))
+		meter.Add(50, now.Add(1100*time.Millisecond))
+		assert(meter.Rate(now.Add(2 * time.Second))).Equals(int64(50))
+		assert(meter.Rate(now.Add(5 * time.Second))).Equals(int64(0))
+	})
+}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	SnippetParamString = "string"
+	SnippetParamInt    = "int"
+	SnippetParamEnum   = "enum"
+)
+
+var (
+	snippetPlaceholderRegex = regexp.MustCompile(`{{\s*([_0-9a-zA-Z]+)\s*}}`)
+	snippetParamNameRegex   = regexp.MustCompile(`^[_0-9a-zA-Z]+$`)
+	shellSafeRegex          = regexp.MustCompile(`^[-_./:=@%+,0-9a-zA-Z]+$`)
+)
+
+// SnippetParam is a typed parameter of a command snippet, the value of an
+// enum parameter must be one of the options
+type SnippetParam struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Default  string   `json:"default"`
+	Required bool     `json:"required"`
+	Options  []string `json:"options"`
+}
+
+func (p *SnippetParam) check(value string) error {
+	switch p.Type {
+	case SnippetParamInt:
+		if _, e := strconv.ParseInt(value, 10, 64); e != nil {
+			return fmt.Errorf("parameter \"%s\" must be an integer", p.Name)
+		}
+		return nil
+	case SnippetParamEnum:
+		for _, option := range p.Options {
+			if option == value {
+				return nil
+			}
+		}
+		return fmt.Errorf(
+			"parameter \"%s\" must be one of \"%s\"", p.Name, strings.Join(p.Options, "\", \""),
+		)
+	default:
+		return nil
+	}
+}
+
+// CheckSnippet checks the parameters and that every placeholder of the
+// template is a parameter
+func CheckSnippet(template string, params []SnippetParam) error {
+	if strings.TrimSpace(template) == "" {
+		return fmt.Errorf("snippet template is empty")
+	}
+
+	names := make(map[string]bool)
+	for _, param := range params {
+		if !snippetParamNameRegex.MatchString(param.Name) {
+			return fmt.Errorf("invalid parameter name \"%s\"", param.Name)
+		} else if names[param.Name] {
+			return fmt.Errorf("duplicated parameter \"%s\"", param.Name)
+		} else if param.Type != SnippetParamString && param.Type != SnippetParamInt &&
+			param.Type != SnippetParamEnum {
+			return fmt.Errorf("unknown parameter type \"%s\"", param.Type)
+		} else if param.Type == SnippetParamEnum && len(param.Options) == 0 {
+			return fmt.Errorf("parameter \"%s\" has no options", param.Name)
+		} else if param.Default != "" {
+			if e := param.check(param.Default); e != nil {
+				return e
+			}
+		}
+		names[param.Name] = true
+	}
+
+	for _, match := range snippetPlaceholderRegex.FindAllStringSubmatch(template, -1) {
+		if !names[match[1]] {
+			return fmt.Errorf("placeholder \"%s\" is not a parameter", match[1])
+		}
+	}
+	return nil
+}
+
+// ShellQuote quotes the value for a POSIX shell if it is not a plain word
+func ShellQuote(value string) string {
+	if shellSafeRegex.MatchString(value) {
+		return value
+	}
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// RenderSnippet replaces the placeholders of the template with the values.
+// The missing values take the defaults, and the string values are quoted so
+// that they are passed to the command as single words.
+func RenderSnippet(template string, params []SnippetParam, values map[string]string) (string, error) {
+	if e := CheckSnippet(template, params); e != nil {
+		return "", e
+	}
+
+	rendered := make(map[string]string)
+	for _, param := range params {
+		value, ok := values[param.Name]
+		if !ok || value == "" {
+			value = param.Default
+		}
+
+		if value == "" {
+			if param.Required {
+				return "", fmt.Errorf("parameter \"%s\" is required", param.Name)
+			}
+		} else if e := param.check(value); e != nil {
+			return "", e
+		} else if param.Type == SnippetParamString {
+			value = ShellQuote(value)
+		}
+		rendered[param.Name] = value
+	}
+
+	for name := range values {
+		if _, ok := rendered[name]; !ok {
+			return "", fmt.Errorf("unknown parameter \"%s\"", name)
+		}
+	}
+
+	return snippetPlaceholderRegex.ReplaceAllStringFunc(template, func(s string) string {
+		return rendered[snippetPlaceholderRegex.FindStringSubmatch(s)[1]]
+	}), nil
+}
@@ -0,0 +1,65 @@
+package core
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rpccloud/assert"
+)
+
+func TestCheckSnippet(t *testing.T) {
+	t.Run("test", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(CheckSnippet(" ", nil)).Equals(errors.New("snippet template is empty"))
+		assert(CheckSnippet("ls", []SnippetParam{{Name: "a b", Type: "string"}})).
+			Equals(errors.New("invalid parameter name \"a b\""))
+		assert(CheckSnippet("ls", []SnippetParam{{Name: "a", Type: "string"}, {Name: "a", Type: "int"}})).
+			Equals(errors.New("duplicated parameter \"a\""))
+		assert(CheckSnippet("ls", []SnippetParam{{Name: "a", Type: "bool"}})).
+			Equals(errors.New("unknown parameter type \"bool\""))
+		assert(CheckSnippet("ls", []SnippetParam{{Name: "a", Type: "enum"}})).
+			Equals(errors.New("parameter \"a\" has no options"))
+		assert(CheckSnippet("ls", []SnippetParam{{Name: "a", Type: "int", Default: "x"}})).
+			Equals(errors.New("parameter \"a\" must be an integer"))
+		assert(CheckSnippet("ls {{ dir }}", nil)).
+			Equals(errors.New("placeholder \"dir\" is not a parameter"))
+		assert(CheckSnippet("ls {{dir}}", []SnippetParam{{Name: "dir", Type: "string"}})).IsNil()
+	})
+}
+
+func TestShellQuote(t *testing.T) {
+	t.Run("test", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(ShellQuote("nginx.service")).Equals("nginx.service")
+		assert(ShellQuote("1 hour ago")).Equals("'1 hour ago'")
+		assert(ShellQuote("it's; rm -rf /")).Equals(`'it'\''s; rm -rf /'`)
+		assert(ShellQuote("")).Equals("''")
+	})
+}
+
+func TestRenderSnippet(t *testing.T) {
+	t.Run("test", func(t *testing.T) {
+		assert := assert.New(t)
+		template := "journalctl -u {{service}} --since {{since}} -n {{lines}} -o {{output}}"
+		params := []SnippetParam{
+			{Name: "service", Type: "string", Required: true},
+			{Name: "since", Type: "string", Default: "1 hour ago"},
+			{Name: "lines", Type: "int", Default: "100"},
+			{Name: "output", Type: "enum", Default: "short", Options: []string{"short", "json"}},
+		}
+
+		assert(RenderSnippet(template, params, map[string]string{"service": "nginx"})).
+			Equals("journalctl -u nginx --since '1 hour ago' -n 100 -o short", nil)
+		assert(RenderSnippet(template, params, map[string]string{
+			"service": "a;b", "since": "today", "lines": "5", "output": "json",
+		})).Equals("journalctl -u 'a;b' --since today -n 5 -o json", nil)
+		assert(RenderSnippet(template, params, map[string]string{})).
+			Equals("", errors.New("parameter \"service\" is required"))
+		assert(RenderSnippet(template, params, map[string]string{"service": "a", "lines": "x"})).
+			Equals("", errors.New("parameter \"lines\" must be an integer"))
+		assert(RenderSnippet(template, params, map[string]string{"service": "a", "output": "xml"})).
+			Equals("", errors.New("parameter \"output\" must be one of \"short\", \"json\""))
+		assert(RenderSnippet(template, params, map[string]string{"service": "a", "user": "root"})).
+			Equals("", errors.New("unknown parameter \"user\""))
+	})
+}
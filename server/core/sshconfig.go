@@ -0,0 +1,242 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+const sshConfigMaxIncludeDepth = 16
+
+// SSHConfigHost is the effective configuration of a Host alias in an
+// OpenSSH client config file
+type SSHConfigHost struct {
+	Alias        string
+	HostName     string
+	User         string
+	Port         string
+	IdentityFile string
+	ProxyJump    string
+}
+
+type sshConfigBlock struct {
+	patterns []string
+	options  [][2]string
+}
+
+func (p *sshConfigBlock) isMatch(alias string) bool {
+	ret := false
+	for _, pattern := range p.patterns {
+		if strings.HasPrefix(pattern, "!") {
+			if MatchPattern(pattern[1:], alias) {
+				return false
+			}
+		} else if MatchPattern(pattern, alias) {
+			ret = true
+		}
+	}
+	return ret
+}
+
+type sshConfigParser struct {
+	fnInclude func(pattern string) ([]string, error)
+	blocks    []*sshConfigBlock
+	aliases   []string
+	warnings  []string
+}
+
+// ParseSSHConfig parses the content of a ssh_config file. fnInclude returns
+// the contents of the files matched by the pattern of an Include keyword.
+// It returns the hosts with a concrete alias and the warnings about
+// the unsupported directives.
+func ParseSSHConfig(
+	content string,
+	fnInclude func(pattern string) ([]string, error),
+) ([]*SSHConfigHost, []string, error) {
+	parser := &sshConfigParser{
+		fnInclude: fnInclude,
+		blocks:    []*sshConfigBlock{{patterns: []string{"*"}}},
+		aliases:   make([]string, 0),
+		warnings:  make([]string, 0),
+	}
+
+	if e := parser.parse(content, 0); e != nil {
+		return nil, nil, e
+	}
+
+	ret := make([]*SSHConfigHost, 0, len(parser.aliases))
+	for _, alias := range parser.aliases {
+		host := &SSHConfigHost{Alias: alias}
+		for _, block := range parser.blocks {
+			if block.isMatch(alias) {
+				// the first obtained value for each parameter will be used
+				for _, option := range block.options {
+					switch option[0] {
+					case "hostname":
+						if host.HostName == "" {
+							host.HostName = option[1]
+						}
+					case "user":
+						if host.User == "" {
+							host.User = option[1]
+						}
+					case "port":
+						if host.Port == "" {
+							host.Port = option[1]
+						}
+					case "identityfile":
+						if host.IdentityFile == "" {
+							host.IdentityFile = option[1]
+						}
+					case "proxyjump":
+						if host.ProxyJump == "" {
+							host.ProxyJump = option[1]
+						}
+					}
+				}
+			}
+		}
+
+		if host.HostName == "" {
+			host.HostName = alias
+		}
+		host.HostName = strings.ReplaceAll(host.HostName, "%h", alias)
+		if host.Port == "" {
+			host.Port = "22"
+		}
+		if strings.EqualFold(host.ProxyJump, "none") {
+			host.ProxyJump = ""
+		}
+		ret = append(ret, host)
+	}
+
+	return ret, parser.warnings, nil
+}
+
+func (p *sshConfigParser) parse(content string, depth int) error {
+	if depth > sshConfigMaxIncludeDepth {
+		return fmt.Errorf("include nested too deeply")
+	}
+
+	for idx, line := range strings.Split(content, "\n") {
+		keyword, args, e := splitSSHConfigLine(line)
+		if e != nil {
+			return fmt.Errorf("line %d: %s", idx+1, e.Error())
+		} else if keyword == "" {
+			continue
+		} else if len(args) == 0 {
+			return fmt.Errorf("line %d: keyword \"%s\" has no value", idx+1, keyword)
+		}
+
+		switch keyword {
+		case "host":
+			p.blocks = append(p.blocks, &sshConfigBlock{patterns: args})
+			for _, alias := range args {
+				if !strings.ContainsAny(alias, "*?!") && !p.hasAlias(alias) {
+					p.aliases = append(p.aliases, alias)
+				}
+			}
+		case "match":
+			// match blocks can not be evaluated without a client, skip them
+			p.blocks = append(p.blocks, &sshConfigBlock{})
+			p.warnings = append(
+				p.warnings,
+				fmt.Sprintf("line %d: \"Match\" is not supported", idx+1),
+			)
+		case "include":
+			if p.fnInclude == nil {
+				return fmt.Errorf("line %d: \"Include\" is not supported", idx+1)
+			}
+			for _, pattern := range args {
+				contents, e := p.fnInclude(pattern)
+				if e != nil {
+					return fmt.Errorf("line %d: %s", idx+1, e.Error())
+				}
+				for _, v := range contents {
+					if e := p.parse(v, depth+1); e != nil {
+						return fmt.Errorf("include \"%s\": %s", pattern, e.Error())
+					}
+				}
+			}
+		default:
+			block := p.blocks[len(p.blocks)-1]
+			block.options = append(
+				block.options,
+				[2]string{keyword, strings.Join(args, " ")},
+			)
+		}
+	}
+
+	return nil
+}
+
+func (p *sshConfigParser) hasAlias(alias string) bool {
+	for _, v := range p.aliases {
+		if v == alias {
+			return true
+		}
+	}
+	return false
+}
+
+func splitSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+
+	// keyword and arguments may be separated by whitespace or "="
+	keyword := line
+	rest := ""
+	if idx := strings.IndexAny(line, " \t="); idx >= 0 {
+		keyword, rest = line[:idx], strings.TrimSpace(line[idx:])
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, "="))
+	}
+
+	args := make([]string, 0)
+	for rest != "" {
+		if rest[0] == '"' {
+			end := strings.Index(rest[1:], "\"")
+			if end < 0 {
+				return "", nil, fmt.Errorf("unterminated quote")
+			}
+			args = append(args, rest[1:end+1])
+			rest = strings.TrimSpace(rest[end+2:])
+		} else if rest[0] == '#' {
+			break
+		} else {
+			end := strings.IndexAny(rest, " \t")
+			if end < 0 {
+				end = len(rest)
+			}
+			args = append(args, rest[:end])
+			rest = strings.TrimSpace(rest[end:])
+		}
+	}
+
+	return strings.ToLower(keyword), args, nil
+}
+
+// FormatSSHConfig generates a ssh_config file for the hosts
+func FormatSSHConfig(hosts []*SSHConfigHost) string {
+	sb := strings.Builder{}
+	for idx, host := range hosts {
+		if idx > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(fmt.Sprintf("Host %s\n", host.Alias))
+		sb.WriteString(fmt.Sprintf("    HostName %s\n", host.HostName))
+		if host.User != "" {
+			sb.WriteString(fmt.Sprintf("    User %s\n", host.User))
+		}
+		if host.Port != "" && host.Port != "22" {
+			sb.WriteString(fmt.Sprintf("    Port %s\n", host.Port))
+		}
+		if host.IdentityFile != "" {
+			sb.WriteString(fmt.Sprintf("    IdentityFile %s\n", host.IdentityFile))
+		}
+		if host.ProxyJump != "" {
+			sb.WriteString(fmt.Sprintf("    ProxyJump %s\n", host.ProxyJump))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rpccloud/assert"
+)
+
+func TestParseSSHConfig(t *testing.T) {
+	t.Run("syntax error", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(ParseSSHConfig("Host", nil)).
+			Equals(nil, nil, errors.New("line 1: keyword \"host\" has no value"))
+		assert(ParseSSHConfig("Host a\n  User \"root", nil)).
+			Equals(nil, nil, errors.New("line 2: unterminated quote"))
+		assert(ParseSSHConfig("Include a.conf", nil)).
+			Equals(nil, nil, errors.New("line 1: \"Include\" is not supported"))
+	})
+
+	t.Run("include error", func(t *testing.T) {
+		assert := assert.New(t)
+		fnInclude := func(pattern string) ([]string, error) {
+			return nil, errors.New("custom")
+		}
+		assert(ParseSSHConfig("Include a.conf", fnInclude)).
+			Equals(nil, nil, errors.New("line 1: custom"))
+	})
+
+	t.Run("include loop", func(t *testing.T) {
+		assert := assert.New(t)
+		fnInclude := func(pattern string) ([]string, error) {
+			return []string{"Include a.conf"}, nil
+		}
+		_, _, e := ParseSSHConfig("Include a.conf", fnInclude)
+		assert(e).IsNotNil()
+	})
+
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		fnInclude := func(pattern string) ([]string, error) {
+			assert(pattern).Equals("config.d/*")
+			return []string{"Host db\n  HostName 10.0.0.3\n  ProxyJump bastion"}, nil
+		}
+		hosts, warnings, e := ParseSSHConfig(`
+# global
+Include config.d/*
+
+Host bastion
+    HostName=bastion.example.com
+    User admin
+    Port 2222
+    IdentityFile "~/.ssh/id bastion"
+
+Host web1 web2
+    User deploy
+
+Host * !bastion
+    User root
+    IdentityFile ~/.ssh/id_rsa
+
+Match exec "true"
+    User nobody
+`, fnInclude)
+		assert(e).IsNil()
+		assert(warnings).Equals([]string{"line 18: \"Match\" is not supported"})
+		assert(hosts).Equals([]*SSHConfigHost{
+			{
+				Alias:        "db",
+				HostName:     "10.0.0.3",
+				User:         "root",
+				Port:         "22",
+				IdentityFile: "~/.ssh/id_rsa",
+				ProxyJump:    "bastion",
+			},
+			{
+				Alias:        "bastion",
+				HostName:     "bastion.example.com",
+				User:         "admin",
+				Port:         "2222",
+				IdentityFile: "~/.ssh/id bastion",
+			},
+			{
+				Alias:        "web1",
+				HostName:     "web1",
+				User:         "deploy",
+				Port:         "22",
+				IdentityFile: "~/.ssh/id_rsa",
+			},
+			{
+				Alias:        "web2",
+				HostName:     "web2",
+				User:         "deploy",
+				Port:         "22",
+				IdentityFile: "~/.ssh/id_rsa",
+			},
+		})
+	})
+}
+
+func TestFormatSSHConfig(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		content := FormatSSHConfig([]*SSHConfigHost{
+			{Alias: "web", HostName: "10.0.0.1", User: "root", Port: "22"},
+			{Alias: "db", HostName: "10.0.0.2", Port: "2222", ProxyJump: "web"},
+		})
+		assert(content).Equals(
+			"Host web\n    HostName 10.0.0.1\n    User root\n\n" +
+				"Host db\n    HostName 10.0.0.2\n    Port 2222\n    ProxyJump web\n",
+		)
+		hosts, _, e := ParseSSHConfig(content, nil)
+		assert(e).IsNil()
+		assert(len(hosts)).Equals(2)
+		assert(hosts[1].ProxyJump).Equals("web")
+	})
+}
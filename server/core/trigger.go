@@ -0,0 +1,113 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+)
+
+const outputWatcherBufferSize = 4096
+
+const (
+	watchStateText = iota
+	watchStateEscape
+	watchStateCSI
+	watchStateString
+	watchStateStringEscape
+)
+
+// OutputMatch is reported when a pattern matches the output, the index is
+// the index of the pattern. AtEnd is true if only blanks follow the match in
+// the output so far, e.g. a prompt that is waiting for the input.
+type OutputMatch struct {
+	Index int
+	Text  string
+	AtEnd bool
+}
+
+// OutputWatcher searches the patterns in the output of a terminal. The
+// escape sequences and the control chars except newline and tab are removed
+// first, so the patterns see the text as it is shown. The text that has
+// been matched is consumed and is never matched again.
+type OutputWatcher struct {
+	patterns []*regexp.Regexp
+	text     []byte
+	state    int
+}
+
+func NewOutputWatcher(patterns []string) (*OutputWatcher, error) {
+	ret := &OutputWatcher{}
+	for _, pattern := range patterns {
+		if re, e := regexp.Compile(pattern); e != nil {
+			return nil, fmt.Errorf("invalid trigger pattern \"%s\"", pattern)
+		} else if re.MatchString("") {
+			return nil, fmt.Errorf("trigger pattern \"%s\" matches empty text", pattern)
+		} else {
+			ret.patterns = append(ret.patterns, re)
+		}
+	}
+	return ret, nil
+}
+
+func (p *OutputWatcher) appendText(output []byte) {
+	for _, c := range output {
+		switch p.state {
+		case watchStateEscape:
+			if c == '[' {
+				p.state = watchStateCSI
+			} else if c == ']' || c == 'P' || c == '_' || c == '^' {
+				p.state = watchStateString
+			} else {
+				p.state = watchStateText
+			}
+		case watchStateCSI:
+			if c >= 0x40 && c <= 0x7E {
+				p.state = watchStateText
+			}
+		case watchStateString:
+			if c == 0x07 {
+				p.state = watchStateText
+			} else if c == 0x1B {
+				p.state = watchStateStringEscape
+			}
+		case watchStateStringEscape:
+			p.state = watchStateText
+		default:
+			if c == 0x1B {
+				p.state = watchStateEscape
+			} else if c >= 0x20 || c == '\n' || c == '\t' {
+				p.text = append(p.text, c)
+			}
+		}
+	}
+
+	if over := len(p.text) - outputWatcherBufferSize; over > 0 {
+		p.text = append(p.text[:0], p.text[over:]...)
+	}
+}
+
+// Feed processes the output and returns the matches in the order of their
+// positions in the output
+func (p *OutputWatcher) Feed(output []byte) []OutputMatch {
+	p.appendText(output)
+
+	ret := make([]OutputMatch, 0)
+	for {
+		index, loc := -1, []int(nil)
+		for i, re := range p.patterns {
+			if v := re.FindIndex(p.text); v != nil && (loc == nil || v[0] < loc[0]) {
+				index, loc = i, v
+			}
+		}
+		if loc == nil {
+			return ret
+		}
+
+		ret = append(ret, OutputMatch{
+			Index: index,
+			Text:  string(p.text[loc[0]:loc[1]]),
+			AtEnd: len(bytes.Trim(p.text[loc[1]:], " \t")) == 0,
+		})
+		p.text = append(p.text[:0], p.text[loc[1]:]...)
+	}
+}
@@ -0,0 +1,42 @@
+package core
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rpccloud/assert"
+)
+
+func TestNewOutputWatcher(t *testing.T) {
+	t.Run("invalid pattern", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(NewOutputWatcher([]string{"("})).
+			Equals(nil, errors.New("invalid trigger pattern \"(\""))
+	})
+
+	t.Run("empty pattern", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(NewOutputWatcher([]string{"x*"})).
+			Equals(nil, errors.New("trigger pattern \"x*\" matches empty text"))
+	})
+}
+
+func TestOutputWatcher_Feed(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		watcher, _ := NewOutputWatcher([]string{
+			`\[sudo\] password for \w+: $`,
+			`\[y/N\]`,
+		})
+
+		assert(watcher.Feed([]byte("$ sudo ls\r\n[sudo] pass"))).Equals([]OutputMatch{})
+		assert(watcher.Feed([]byte("word for root: "))).
+			Equals([]OutputMatch{{Index: 0, Text: "[sudo] password for root: ", AtEnd: true}})
+		assert(watcher.Feed([]byte("\r\n"))).Equals([]OutputMatch{})
+
+		assert(watcher.Feed([]byte("\x1b[1mcontinue?\x1b[0m [y/\x1b]0;title\x07N] and [y/N]"))).
+			Equals([]OutputMatch{{Index: 1, Text: "[y/N]"}, {Index: 1, Text: "[y/N]", AtEnd: true}})
+		assert(watcher.Feed([]byte("more"))).Equals([]OutputMatch{})
+	})
+
+}
@@ -0,0 +1,860 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	VTFlagBold = 1 << iota
+	VTFlagDim
+	VTFlagItalic
+	VTFlagUnderline
+	VTFlagBlink
+	VTFlagReverse
+	VTFlagHidden
+	VTFlagStrike
+)
+
+const (
+	// VTColorDefault is the default color of the terminal, the other colors
+	// are 0-255 in the palette or VTColorRGB | 0xRRGGBB
+	VTColorDefault = -1
+	VTColorRGB     = 1 << 24
+
+	vtWideTail  = -1
+	vtMaxParams = 16
+	vtMaxParam  = 65535
+	vtMaxOSC    = 4096
+	vtTabWidth  = 8
+)
+
+const (
+	vtStateGround = iota
+	vtStateEscape
+	vtStateCharset
+	vtStateCSI
+	vtStateOSC
+	vtStateString
+	vtStateStringEscape
+)
+
+// VTAttr is the graphic rendition of a cell
+type VTAttr struct {
+	FG    int32
+	BG    int32
+	Flags uint16
+}
+
+var vtDefaultAttr = VTAttr{FG: VTColorDefault, BG: VTColorDefault}
+
+// VTCell is a cell of the screen, the char is 0 if the cell is blank. The
+// right half of a wide char is a cell with the char -1.
+type VTCell struct {
+	Char rune
+	Attr VTAttr
+}
+
+type vtLine struct {
+	cells   []VTCell
+	wrapped bool
+}
+
+func newVTLine(cols int) *vtLine {
+	ret := &vtLine{cells: make([]VTCell, cols)}
+	for i := range ret.cells {
+		ret.cells[i].Attr = vtDefaultAttr
+	}
+	return ret
+}
+
+func (p *vtLine) resize(cols int) {
+	if cols < len(p.cells) {
+		p.cells = p.cells[:cols]
+		if cols > 0 && p.cells[cols-1].Char != vtWideTail && isWideRune(p.cells[cols-1].Char) {
+			p.cells[cols-1] = VTCell{Attr: vtDefaultAttr}
+		}
+	} else {
+		for len(p.cells) < cols {
+			p.cells = append(p.cells, VTCell{Attr: vtDefaultAttr})
+		}
+	}
+}
+
+func (p *vtLine) String() string {
+	buf := make([]rune, 0, len(p.cells))
+	for _, cell := range p.cells {
+		if cell.Char == vtWideTail {
+			continue
+		} else if cell.Char == 0 {
+			buf = append(buf, ' ')
+		} else {
+			buf = append(buf, cell.Char)
+		}
+	}
+	return strings.TrimRight(string(buf), " ")
+}
+
+type vtCursor struct {
+	x    int
+	y    int
+	attr VTAttr
+}
+
+// VTMatch is a line of the terminal that contains the searched text, the
+// line is counted from the oldest line of the scrollback
+type VTMatch struct {
+	Line int
+	Text string
+}
+
+// VTerm is a VT100/xterm emulator that keeps the screen and the scrollback
+// of a terminal from its output. It is safe for concurrent use.
+type VTerm struct {
+	rows          int
+	cols          int
+	main          []*vtLine
+	alt           []*vtLine
+	isAlt         bool
+	scrollback    []*vtLine
+	maxScrollback int
+
+	x             int
+	y             int
+	attr          VTAttr
+	wrapNext      bool
+	top           int
+	bottom        int
+	saved         vtCursor
+	autowrap      bool
+	cursorVisible bool
+
+	state     int
+	private   byte
+	params    []int
+	hasParam  bool
+	osc       []byte
+	utf8Bytes []byte
+	mu        sync.Mutex
+}
+
+func NewVTerm(rows int, cols int, maxScrollback int) *VTerm {
+	ret := &VTerm{maxScrollback: maxScrollback}
+	ret.reset(max(rows, 1), max(cols, 1))
+	return ret
+}
+
+func max(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// isWideRune reports whether the rune takes two cells, it covers the east
+// asian wide and fullwidth blocks and the emoji
+func isWideRune(r rune) bool {
+	return r >= 0x1100 && (r <= 0x115F ||
+		r == 0x2329 || r == 0x232A ||
+		(r >= 0x2E80 && r <= 0x303E) ||
+		(r >= 0x3041 && r <= 0x33FF) ||
+		(r >= 0x3400 && r <= 0x4DBF) ||
+		(r >= 0x4E00 && r <= 0x9FFF) ||
+		(r >= 0xA000 && r <= 0xA4CF) ||
+		(r >= 0xA960 && r <= 0xA97F) ||
+		(r >= 0xAC00 && r <= 0xD7A3) ||
+		(r >= 0xF900 && r <= 0xFAFF) ||
+		(r >= 0xFE30 && r <= 0xFE4F) ||
+		(r >= 0xFF00 && r <= 0xFF60) ||
+		(r >= 0xFFE0 && r <= 0xFFE6) ||
+		(r >= 0x1F300 && r <= 0x1F64F) ||
+		(r >= 0x1F900 && r <= 0x1F9FF) ||
+		(r >= 0x20000 && r <= 0x3FFFD))
+}
+
+func (p *VTerm) reset(rows int, cols int) {
+	p.rows, p.cols = rows, cols
+	p.main = make([]*vtLine, rows)
+	p.alt = make([]*vtLine, rows)
+	for i := 0; i < rows; i++ {
+		p.main[i], p.alt[i] = newVTLine(cols), newVTLine(cols)
+	}
+	p.isAlt = false
+	p.x, p.y, p.attr, p.wrapNext = 0, 0, vtDefaultAttr, false
+	p.top, p.bottom = 0, rows-1
+	p.saved = vtCursor{attr: vtDefaultAttr}
+	p.autowrap, p.cursorVisible = true, true
+	p.state = vtStateGround
+}
+
+func (p *VTerm) lines() []*vtLine {
+	if p.isAlt {
+		return p.alt
+	}
+	return p.main
+}
+
+// Write feeds the output of the terminal
+func (p *VTerm) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, c := range data {
+		p.feed(c)
+	}
+	return len(data), nil
+}
+
+func (p *VTerm) feed(c byte) {
+	if p.state == vtStateGround && (len(p.utf8Bytes) > 0 || c >= 0x80) {
+		p.utf8Bytes = append(p.utf8Bytes, c)
+		if utf8.FullRune(p.utf8Bytes) {
+			r, size := utf8.DecodeRune(p.utf8Bytes)
+			rest := append([]byte(nil), p.utf8Bytes[size:]...)
+			p.utf8Bytes = p.utf8Bytes[:0]
+			p.print(r)
+			for _, v := range rest {
+				p.feed(v)
+			}
+		}
+		return
+	}
+
+	// the control chars are executed in the middle of the sequences and
+	// ESC starts a new one, the strings end with BEL or ESC \
+	if p.state != vtStateOSC && p.state != vtStateString && p.state != vtStateStringEscape {
+		if c == 0x1B {
+			p.state = vtStateEscape
+			return
+		} else if c < 0x20 {
+			p.execute(c)
+			return
+		}
+	}
+
+	switch p.state {
+	case vtStateGround:
+		if c != 0x7F {
+			p.print(rune(c))
+		}
+	case vtStateEscape:
+		p.escape(c)
+	case vtStateCharset:
+		p.state = vtStateGround
+	case vtStateCSI:
+		p.csi(c)
+	case vtStateOSC, vtStateString:
+		if c == 0x07 {
+			p.state = vtStateGround
+		} else if c == 0x1B {
+			p.state = vtStateStringEscape
+		} else if p.state == vtStateOSC && len(p.osc) < vtMaxOSC {
+			p.osc = append(p.osc, c)
+		}
+	case vtStateStringEscape:
+		if c == '\\' {
+			p.state = vtStateGround
+		} else {
+			p.state = vtStateEscape
+			p.escape(c)
+		}
+	}
+}
+
+func (p *VTerm) execute(c byte) {
+	switch c {
+	case 0x08:
+		if p.x > 0 {
+			p.x--
+		}
+		p.wrapNext = false
+	case 0x09:
+		p.x = min(p.cols-1, (p.x/vtTabWidth+1)*vtTabWidth)
+		p.wrapNext = false
+	case 0x0A, 0x0B, 0x0C:
+		p.index()
+	case 0x0D:
+		p.x, p.wrapNext = 0, false
+	case 0x18, 0x1A:
+		p.state = vtStateGround
+	}
+}
+
+func (p *VTerm) escape(c byte) {
+	p.state = vtStateGround
+	switch c {
+	case '[':
+		p.state = vtStateCSI
+		p.private, p.params, p.hasParam = 0, p.params[:0], false
+	case ']':
+		p.state = vtStateOSC
+		p.osc = p.osc[:0]
+	case 'P', 'X', '^', '_':
+		p.state = vtStateString
+	case '(', ')', '*', '+', '#', '%':
+		p.state = vtStateCharset
+	case '7':
+		p.saveCursor()
+	case '8':
+		p.restoreCursor()
+	case 'D':
+		p.index()
+	case 'E':
+		p.x = 0
+		p.index()
+	case 'M':
+		p.reverseIndex()
+	case 'c':
+		p.reset(p.rows, p.cols)
+		p.scrollback = nil
+	}
+}
+
+func (p *VTerm) csi(c byte) {
+	switch {
+	case c >= '0' && c <= '9':
+		if !p.hasParam {
+			p.params = append(p.params, 0)
+			p.hasParam = true
+		}
+		if v := &p.params[len(p.params)-1]; *v < vtMaxParam {
+			*v = *v*10 + int(c-'0')
+		}
+	case c == ';' || c == ':':
+		if !p.hasParam {
+			p.params = append(p.params, 0)
+		}
+		p.hasParam = false
+	case c >= '<' && c <= '?':
+		p.private = c
+	case c >= 0x20 && c <= 0x2F:
+		// intermediate bytes are not used by the supported sequences
+	case c >= 0x40 && c <= 0x7E:
+		p.state = vtStateGround
+		if len(p.params) > vtMaxParams {
+			p.params = p.params[:vtMaxParams]
+		}
+		p.dispatch(c)
+	default:
+		p.state = vtStateGround
+	}
+}
+
+func (p *VTerm) param(i int, defaultValue int) int {
+	if i >= len(p.params) || p.params[i] == 0 {
+		return defaultValue
+	}
+	return p.params[i]
+}
+
+func (p *VTerm) dispatch(c byte) {
+	if p.private == '?' {
+		if c == 'h' || c == 'l' {
+			for i := range p.params {
+				p.setMode(p.params[i], c == 'h')
+			}
+		}
+		return
+	} else if p.private != 0 {
+		return
+	}
+
+	n := p.param(0, 1)
+	switch c {
+	case '@':
+		p.insertChars(n)
+	case 'A':
+		p.moveTo(p.x, max(p.y-n, 0))
+	case 'B', 'e':
+		p.moveTo(p.x, min(p.y+n, p.rows-1))
+	case 'C', 'a':
+		p.moveTo(min(p.x+n, p.cols-1), p.y)
+	case 'D':
+		p.moveTo(max(p.x-n, 0), p.y)
+	case 'E':
+		p.moveTo(0, min(p.y+n, p.rows-1))
+	case 'F':
+		p.moveTo(0, max(p.y-n, 0))
+	case 'G', '`':
+		p.moveTo(n-1, p.y)
+	case 'H', 'f':
+		p.moveTo(p.param(1, 1)-1, n-1)
+	case 'J':
+		p.eraseDisplay(p.param(0, 0))
+	case 'K':
+		p.eraseLine(p.param(0, 0))
+	case 'L':
+		if p.y >= p.top && p.y <= p.bottom {
+			p.scrollDown(p.y, p.bottom, n)
+			p.x = 0
+		}
+	case 'M':
+		if p.y >= p.top && p.y <= p.bottom {
+			p.scrollUp(p.y, p.bottom, n)
+			p.x = 0
+		}
+	case 'P':
+		p.deleteChars(n)
+	case 'S':
+		p.scrollUp(p.top, p.bottom, n)
+	case 'T':
+		p.scrollDown(p.top, p.bottom, n)
+	case 'X':
+		p.eraseCells(p.y, p.x, min(p.x+n, p.cols))
+	case 'd':
+		p.moveTo(p.x, n-1)
+	case 'm':
+		p.setAttr()
+	case 'r':
+		top, bottom := p.param(0, 1)-1, p.param(1, p.rows)-1
+		if top < bottom && bottom < p.rows {
+			p.top, p.bottom = top, bottom
+			p.moveTo(0, 0)
+		}
+	case 's':
+		p.saveCursor()
+	case 'u':
+		p.restoreCursor()
+	}
+}
+
+func (p *VTerm) setMode(mode int, on bool) {
+	switch mode {
+	case 7:
+		p.autowrap = on
+	case 25:
+		p.cursorVisible = on
+	case 47, 1047, 1049:
+		if on == p.isAlt {
+			return
+		}
+		if mode == 1049 && on {
+			p.saveCursor()
+		}
+		p.isAlt = on
+		if on {
+			for i := range p.alt {
+				p.alt[i] = newVTLine(p.cols)
+			}
+		}
+		if mode == 1049 && !on {
+			p.restoreCursor()
+		}
+		p.wrapNext = false
+	}
+}
+
+func (p *VTerm) setAttr() {
+	if len(p.params) == 0 {
+		p.attr = vtDefaultAttr
+		return
+	}
+
+	for i := 0; i < len(p.params); i++ {
+		switch v := p.params[i]; {
+		case v == 0:
+			p.attr = vtDefaultAttr
+		case v >= 1 && v <= 9 && v != 6:
+			p.attr.Flags |= []uint16{
+				0, VTFlagBold, VTFlagDim, VTFlagItalic, VTFlagUnderline, VTFlagBlink,
+				0, VTFlagReverse, VTFlagHidden, VTFlagStrike,
+			}[v]
+		case v == 22:
+			p.attr.Flags &^= VTFlagBold | VTFlagDim
+		case v >= 23 && v <= 29 && v != 26:
+			p.attr.Flags &^= []uint16{
+				VTFlagItalic, VTFlagUnderline, VTFlagBlink, 0, VTFlagReverse, VTFlagHidden, VTFlagStrike,
+			}[v-23]
+		case v >= 30 && v <= 37:
+			p.attr.FG = int32(v - 30)
+		case v >= 40 && v <= 47:
+			p.attr.BG = int32(v - 40)
+		case v >= 90 && v <= 97:
+			p.attr.FG = int32(v - 90 + 8)
+		case v >= 100 && v <= 107:
+			p.attr.BG = int32(v - 100 + 8)
+		case v == 39:
+			p.attr.FG = VTColorDefault
+		case v == 49:
+			p.attr.BG = VTColorDefault
+		case v == 38 || v == 48:
+			color := int32(VTColorDefault)
+			if i+2 < len(p.params) && p.params[i+1] == 5 {
+				color = int32(p.params[i+2] & 0xFF)
+				i += 2
+			} else if i+4 < len(p.params) && p.params[i+1] == 2 {
+				color = VTColorRGB | int32(p.params[i+2]&0xFF)<<16 |
+					int32(p.params[i+3]&0xFF)<<8 | int32(p.params[i+4]&0xFF)
+				i += 4
+			} else {
+				return
+			}
+			if v == 38 {
+				p.attr.FG = color
+			} else {
+				p.attr.BG = color
+			}
+		}
+	}
+}
+
+func (p *VTerm) moveTo(x int, y int) {
+	p.x = min(max(x, 0), p.cols-1)
+	p.y = min(max(y, 0), p.rows-1)
+	p.wrapNext = false
+}
+
+func (p *VTerm) saveCursor() {
+	p.saved = vtCursor{x: p.x, y: p.y, attr: p.attr}
+}
+
+func (p *VTerm) restoreCursor() {
+	p.moveTo(p.saved.x, p.saved.y)
+	p.attr = p.saved.attr
+}
+
+func (p *VTerm) print(r rune) {
+	width := 1
+	if isWideRune(r) {
+		width = 2
+	} else if r >= 0x300 && (unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Me, r) || r == 0x200B) {
+		// the combining marks are not kept
+		return
+	}
+
+	lines := p.lines()
+	if p.wrapNext || (width == 2 && p.x == p.cols-1) {
+		if p.autowrap {
+			lines[p.y].wrapped = true
+			p.x = 0
+			p.index()
+		} else if width == 2 {
+			return
+		}
+		p.wrapNext = false
+	}
+
+	cells := lines[p.y].cells
+	if width > p.cols {
+		return
+	}
+	if cells[p.x].Char == vtWideTail && p.x > 0 {
+		cells[p.x-1] = VTCell{Attr: p.attr}
+	}
+	if p.x+width < p.cols && cells[p.x+width].Char == vtWideTail {
+		cells[p.x+width] = VTCell{Attr: p.attr}
+	}
+	cells[p.x] = VTCell{Char: r, Attr: p.attr}
+	if width == 2 {
+		cells[p.x+1] = VTCell{Char: vtWideTail, Attr: p.attr}
+	}
+
+	if p.x+width >= p.cols {
+		p.x = p.cols - 1
+		p.wrapNext = p.autowrap
+	} else {
+		p.x += width
+	}
+}
+
+func (p *VTerm) index() {
+	p.wrapNext = false
+	if p.y == p.bottom {
+		p.scrollUp(p.top, p.bottom, 1)
+	} else if p.y < p.rows-1 {
+		p.y++
+	}
+}
+
+func (p *VTerm) reverseIndex() {
+	p.wrapNext = false
+	if p.y == p.top {
+		p.scrollDown(p.top, p.bottom, 1)
+	} else if p.y > 0 {
+		p.y--
+	}
+}
+
+// scrollUp moves the lines from top to bottom up, the lines that leave the
+// top of the main screen go to the scrollback
+func (p *VTerm) scrollUp(top int, bottom int, n int) {
+	lines := p.lines()
+	n = min(n, bottom-top+1)
+	for i := 0; i < n; i++ {
+		if !p.isAlt && top == 0 && p.maxScrollback > 0 {
+			p.scrollback = append(p.scrollback, lines[top])
+		}
+		copy(lines[top:bottom], lines[top+1:bottom+1])
+		lines[bottom] = newVTLine(p.cols)
+	}
+	// reslicing keeps a full scrollback cheap, append moves the lines to a
+	// new array when the capacity runs out
+	if over := len(p.scrollback) - p.maxScrollback; over > 0 {
+		p.scrollback = p.scrollback[over:]
+	}
+}
+
+func (p *VTerm) scrollDown(top int, bottom int, n int) {
+	lines := p.lines()
+	n = min(n, bottom-top+1)
+	for i := 0; i < n; i++ {
+		copy(lines[top+1:bottom+1], lines[top:bottom])
+		lines[top] = newVTLine(p.cols)
+	}
+}
+
+func (p *VTerm) eraseCells(y int, from int, to int) {
+	line := p.lines()[y]
+	for i := from; i < to; i++ {
+		line.cells[i] = VTCell{Attr: VTAttr{FG: VTColorDefault, BG: p.attr.BG}}
+	}
+	if to >= p.cols {
+		line.wrapped = false
+	}
+}
+
+func (p *VTerm) eraseLine(mode int) {
+	switch mode {
+	case 0:
+		p.eraseCells(p.y, p.x, p.cols)
+	case 1:
+		p.eraseCells(p.y, 0, p.x+1)
+	case 2:
+		p.eraseCells(p.y, 0, p.cols)
+	}
+	p.wrapNext = false
+}
+
+func (p *VTerm) eraseDisplay(mode int) {
+	switch mode {
+	case 0:
+		p.eraseCells(p.y, p.x, p.cols)
+		for y := p.y + 1; y < p.rows; y++ {
+			p.eraseCells(y, 0, p.cols)
+		}
+	case 1:
+		for y := 0; y < p.y; y++ {
+			p.eraseCells(y, 0, p.cols)
+		}
+		p.eraseCells(p.y, 0, p.x+1)
+	case 2:
+		for y := 0; y < p.rows; y++ {
+			p.eraseCells(y, 0, p.cols)
+		}
+	case 3:
+		p.scrollback = nil
+	}
+	p.wrapNext = false
+}
+
+func (p *VTerm) insertChars(n int) {
+	cells := p.lines()[p.y].cells
+	n = min(n, p.cols-p.x)
+	copy(cells[p.x+n:], cells[p.x:p.cols-n])
+	p.eraseCells(p.y, p.x, p.x+n)
+	p.wrapNext = false
+}
+
+func (p *VTerm) deleteChars(n int) {
+	cells := p.lines()[p.y].cells
+	n = min(n, p.cols-p.x)
+	copy(cells[p.x:], cells[p.x+n:])
+	p.eraseCells(p.y, p.cols-n, p.cols)
+	p.wrapNext = false
+}
+
+// Resize changes the size of the screen. The lines are not reflowed, when
+// the screen gets shorter the blank lines below the cursor are removed first
+// and then the lines at the top go to the scrollback.
+func (p *VTerm) Resize(rows int, cols int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rows, cols = max(rows, 1), max(cols, 1)
+	if rows == p.rows && cols == p.cols {
+		return
+	}
+
+	for _, lines := range [][]*vtLine{p.main, p.alt, p.scrollback} {
+		for _, line := range lines {
+			line.resize(cols)
+		}
+	}
+
+	for ; p.rows > rows; p.rows-- {
+		if last := p.rows - 1; last > p.y && p.main[last].String() == "" {
+			p.main, p.alt = p.main[:last], p.alt[:last]
+		} else {
+			if p.maxScrollback > 0 {
+				p.scrollback = append(p.scrollback, p.main[0])
+			}
+			p.main, p.alt = p.main[1:], p.alt[1:]
+			p.y = max(p.y-1, 0)
+			p.saved.y = max(p.saved.y-1, 0)
+		}
+	}
+	for ; p.rows < rows; p.rows++ {
+		p.main, p.alt = append(p.main, newVTLine(cols)), append(p.alt, newVTLine(cols))
+	}
+	if over := len(p.scrollback) - p.maxScrollback; over > 0 {
+		p.scrollback = append(p.scrollback[:0:0], p.scrollback[over:]...)
+	}
+
+	p.cols = cols
+	p.top, p.bottom = 0, rows-1
+	p.moveTo(p.x, p.y)
+	p.saved.x, p.saved.y = min(p.saved.x, cols-1), min(p.saved.y, rows-1)
+}
+
+// Size returns the rows and the cols of the screen
+func (p *VTerm) Size() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.rows, p.cols
+}
+
+// Cursor returns the position of the cursor, both start from 0
+func (p *VTerm) Cursor() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.y, p.x
+}
+
+// Snapshot returns the text of the screen, one string for each row
+func (p *VTerm) Snapshot() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ret := make([]string, 0, p.rows)
+	for _, line := range p.lines() {
+		ret = append(ret, line.String())
+	}
+	return ret
+}
+
+// Scrollback returns the text of the lines that have scrolled out of the
+// main screen, from the oldest one
+func (p *VTerm) Scrollback() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ret := make([]string, 0, len(p.scrollback))
+	for _, line := range p.scrollback {
+		ret = append(ret, line.String())
+	}
+	return ret
+}
+
+// Search returns the lines of the scrollback and the main screen that
+// contain the text, the case is ignored
+func (p *VTerm) Search(text string) []VTMatch {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ret := make([]VTMatch, 0)
+	text = strings.ToLower(text)
+	for i, line := range append(append([]*vtLine(nil), p.scrollback...), p.main...) {
+		if s := line.String(); strings.Contains(strings.ToLower(s), text) {
+			ret = append(ret, VTMatch{Line: i, Text: s})
+		}
+	}
+	return ret
+}
+
+func writeVTColor(buf *bytes.Buffer, color int32, base int, brightBase int, ext int) {
+	switch {
+	case color == VTColorDefault:
+		return
+	case color&VTColorRGB != 0:
+		_, _ = fmt.Fprintf(buf, ";%d;2;%d;%d;%d", ext, color>>16&0xFF, color>>8&0xFF, color&0xFF)
+	case color < 8:
+		_, _ = fmt.Fprintf(buf, ";%d", base+int(color))
+	case color < 16:
+		_, _ = fmt.Fprintf(buf, ";%d", brightBase+int(color)-8)
+	default:
+		_, _ = fmt.Fprintf(buf, ";%d;5;%d", ext, color)
+	}
+}
+
+func writeVTAttr(buf *bytes.Buffer, attr VTAttr) {
+	buf.WriteString("\x1b[0")
+	for i, code := range []int{1, 2, 3, 4, 5, 7, 8, 9} {
+		if attr.Flags&(1<<uint(i)) != 0 {
+			_, _ = fmt.Fprintf(buf, ";%d", code)
+		}
+	}
+	writeVTColor(buf, attr.FG, 30, 90, 38)
+	writeVTColor(buf, attr.BG, 40, 100, 48)
+	buf.WriteByte('m')
+}
+
+func writeVTLines(buf *bytes.Buffer, lines []*vtLine, attr *VTAttr) {
+	for i, line := range lines {
+		if i > 0 {
+			buf.WriteString("\r\n")
+		}
+
+		end := len(line.cells)
+		for end > 0 && line.cells[end-1] == (VTCell{Attr: vtDefaultAttr}) {
+			end--
+		}
+		for _, cell := range line.cells[:end] {
+			if cell.Char == vtWideTail {
+				continue
+			}
+			if cell.Attr != *attr {
+				*attr = cell.Attr
+				writeVTAttr(buf, cell.Attr)
+			}
+			if cell.Char == 0 {
+				buf.WriteByte(' ')
+			} else {
+				buf.WriteRune(cell.Char)
+			}
+		}
+	}
+}
+
+// Render returns the output that draws the scrollback and the screen on a
+// new terminal of the same size, it is sent when a user reattaches
+func (p *VTerm) Render() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	buf := bytes.NewBuffer(nil)
+	attr := vtDefaultAttr
+	buf.WriteString("\x1b[0m\x1b[H\x1b[2J\x1b[3J")
+	writeVTLines(buf, append(append([]*vtLine(nil), p.scrollback...), p.main...), &attr)
+
+	if p.isAlt {
+		buf.WriteString("\x1b[0m\x1b[?1049h\x1b[H\x1b[2J")
+		attr = vtDefaultAttr
+		writeVTLines(buf, p.alt, &attr)
+	}
+
+	if p.top != 0 || p.bottom != p.rows-1 {
+		_, _ = fmt.Fprintf(buf, "\x1b[%d;%dr", p.top+1, p.bottom+1)
+	}
+	writeVTAttr(buf, p.attr)
+	_, _ = fmt.Fprintf(buf, "\x1b[%d;%dH", p.y+1, p.x+1)
+	if !p.autowrap {
+		buf.WriteString("\x1b[?7l")
+	}
+	if !p.cursorVisible {
+		buf.WriteString("\x1b[?25l")
+	}
+	return buf.Bytes()
+}
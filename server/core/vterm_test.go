@@ -0,0 +1,139 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/rpccloud/assert"
+)
+
+func TestVTerm_Write(t *testing.T) {
+	t.Run("text and cursor", func(t *testing.T) {
+		assert := assert.New(t)
+		vt := NewVTerm(3, 10, 100)
+		_, _ = vt.Write([]byte("hello\r\nworld\x1b[1;3HX"))
+		assert(vt.Snapshot()).Equals([]string{"heXlo", "world", ""})
+		assert(vt.Cursor()).Equals(0, 3)
+	})
+
+	t.Run("wrap and scroll", func(t *testing.T) {
+		assert := assert.New(t)
+		vt := NewVTerm(2, 4, 100)
+		_, _ = vt.Write([]byte("abcdefgh\r\nij"))
+		assert(vt.Snapshot()).Equals([]string{"efgh", "ij"})
+		assert(vt.Scrollback()).Equals([]string{"abcd"})
+	})
+
+	t.Run("utf8 split across writes", func(t *testing.T) {
+		assert := assert.New(t)
+		vt := NewVTerm(2, 10, 100)
+		data := []byte("中文ok")
+		_, _ = vt.Write(data[:2])
+		_, _ = vt.Write(data[2:4])
+		_, _ = vt.Write(data[4:])
+		assert(vt.Snapshot()).Equals([]string{"中文ok", ""})
+		assert(vt.Cursor()).Equals(0, 6)
+	})
+
+	t.Run("erase", func(t *testing.T) {
+		assert := assert.New(t)
+		vt := NewVTerm(3, 10, 100)
+		_, _ = vt.Write([]byte("aaaa\r\nbbbb\r\ncccc\x1b[2;3H\x1b[K\x1b[1;2H\x1b[1K"))
+		assert(vt.Snapshot()).Equals([]string{"  aa", "bb", "cccc"})
+		_, _ = vt.Write([]byte("\x1b[2J"))
+		assert(vt.Snapshot()).Equals([]string{"", "", ""})
+	})
+
+	t.Run("insert and delete", func(t *testing.T) {
+		assert := assert.New(t)
+		vt := NewVTerm(3, 10, 100)
+		_, _ = vt.Write([]byte("abcdef\x1b[1;2H\x1b[2P\x1b[1@"))
+		assert(vt.Snapshot()[0]).Equals("a def")
+		_, _ = vt.Write([]byte("\r\nline2\r\nline3\x1b[2;1H\x1b[L"))
+		assert(vt.Snapshot()).Equals([]string{"a def", "", "line2"})
+		_, _ = vt.Write([]byte("\x1b[M"))
+		assert(vt.Snapshot()).Equals([]string{"a def", "line2", ""})
+	})
+
+	t.Run("scroll region", func(t *testing.T) {
+		assert := assert.New(t)
+		vt := NewVTerm(4, 10, 100)
+		_, _ = vt.Write([]byte("top\x1b[2;3r\x1b[2;1Ha\r\nb\r\nc\x1b[r"))
+		assert(vt.Snapshot()).Equals([]string{"top", "b", "c", ""})
+		assert(vt.Scrollback()).Equals([]string{})
+	})
+
+	t.Run("alternate screen", func(t *testing.T) {
+		assert := assert.New(t)
+		vt := NewVTerm(2, 10, 100)
+		_, _ = vt.Write([]byte("shell\x1b[?1049h\x1b[Hvim"))
+		assert(vt.Snapshot()).Equals([]string{"vim", ""})
+		_, _ = vt.Write([]byte("\x1b[?1049l"))
+		assert(vt.Snapshot()).Equals([]string{"shell", ""})
+		assert(vt.Cursor()).Equals(0, 5)
+	})
+
+	t.Run("osc and unknown sequences", func(t *testing.T) {
+		assert := assert.New(t)
+		vt := NewVTerm(2, 20, 100)
+		_, _ = vt.Write([]byte("\x1b]0;title\x07a\x1b]133;A\x1b\\b\x1b[>0cc\x1b(Bd\x1bPq#0\x1b\\e"))
+		assert(vt.Snapshot()[0]).Equals("abcde")
+	})
+}
+
+func TestVTerm_Resize(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		vt := NewVTerm(4, 10, 100)
+		_, _ = vt.Write([]byte("1\r\n2\r\n3"))
+		vt.Resize(2, 5)
+		assert(vt.Size()).Equals(2, 5)
+		assert(vt.Snapshot()).Equals([]string{"2", "3"})
+		assert(vt.Scrollback()).Equals([]string{"1"})
+		assert(vt.Cursor()).Equals(1, 1)
+
+		vt.Resize(3, 1)
+		assert(vt.Snapshot()).Equals([]string{"2", "3", ""})
+		assert(vt.Cursor()).Equals(1, 0)
+	})
+}
+
+func TestVTerm_Search(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		vt := NewVTerm(2, 20, 2)
+		_, _ = vt.Write([]byte("one error\r\ntwo\r\nthree Error\r\nfour\r\nfive"))
+		assert(vt.Scrollback()).Equals([]string{"two", "three Error"})
+		assert(vt.Search("error")).Equals([]VTMatch{{Line: 1, Text: "three Error"}})
+		assert(vt.Search("f")).Equals([]VTMatch{
+			{Line: 2, Text: "four"}, {Line: 3, Text: "five"},
+		})
+	})
+}
+
+func TestVTerm_Render(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		vt := NewVTerm(3, 10, 100)
+		_, _ = vt.Write([]byte("a\x1b[1;31mb\x1b[0m\r\n\x1b[38;2;1;2;3mc\x1b[?25l"))
+
+		other := NewVTerm(3, 10, 100)
+		_, _ = other.Write(vt.Render())
+		assert(other.Snapshot()).Equals(vt.Snapshot())
+		assert(other.Cursor()).Equals(vt.Cursor())
+		assert(other.main[0].cells[1].Attr).Equals(VTAttr{FG: 1, BG: -1, Flags: VTFlagBold})
+		assert(other.main[1].cells[0].Attr).
+			Equals(VTAttr{FG: VTColorRGB | 0x010203, BG: -1})
+		assert(other.cursorVisible).IsFalse()
+	})
+
+	t.Run("alternate screen", func(t *testing.T) {
+		assert := assert.New(t)
+		vt := NewVTerm(2, 10, 100)
+		_, _ = vt.Write([]byte("shell\x1b[?1049h\x1b[Hvim"))
+		other := NewVTerm(2, 10, 100)
+		_, _ = other.Write(vt.Render())
+		assert(other.Snapshot()).Equals([]string{"vim", ""})
+		_, _ = other.Write([]byte("\x1b[?1049l"))
+		assert(other.Snapshot()[0]).Equals("shell")
+	})
+}
@@ -0,0 +1,787 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ZModemDownload = 1
+	ZModemUpload   = 2
+)
+
+const (
+	zPAD   = '*'
+	zDLE   = 0x18
+	zBIN   = 'A'
+	zHEX   = 'B'
+	zBIN32 = 'C'
+	zRUB0  = 'l'
+	zRUB1  = 'm'
+	zCRCE  = 'h'
+	zCRCG  = 'i'
+	zCRCQ  = 'j'
+	zCRCW  = 'k'
+)
+
+const (
+	zRQINIT = 0
+	zRINIT  = 1
+	zSINIT  = 2
+	zACK    = 3
+	zFILE   = 4
+	zSKIP   = 5
+	zNAK    = 6
+	zABORT  = 7
+	zFIN    = 8
+	zRPOS   = 9
+	zDATA   = 10
+	zEOF    = 11
+	zFERR   = 12
+	zCAN    = 16
+)
+
+const (
+	zCANFDX  = 0x01
+	zCANOVIO = 0x02
+	zCANFC32 = 0x20
+)
+
+const (
+	zMaxSubpacket = 8192
+	zBlockSize    = 1024
+	// zCancelCount is the number of consecutive ZDLE (CAN) that aborts
+	zCancelCount = 5
+)
+
+var (
+	zModemDownloadStart = []byte("**\x18B00")
+	zModemUploadStart   = []byte("**\x18B01")
+	trzszStart          = []byte("::TRZSZ:TRANSFER:")
+	zCancelSequence     = []byte(
+		"\x18\x18\x18\x18\x18\x18\x18\x18\x18\x18\x08\x08\x08\x08\x08\x08\x08\x08\x08\x08",
+	)
+)
+
+// DetectZModem returns the index of the start sequence of ZMODEM in the
+// output and the direction of the transfer, the index is -1 if there is no
+// start sequence. A ZRQINIT from sz starts a download and a ZRINIT from rz
+// starts an upload.
+func DetectZModem(output []byte) (int, int) {
+	download := bytes.Index(output, zModemDownloadStart)
+	upload := bytes.Index(output, zModemUploadStart)
+	if download >= 0 && (upload < 0 || download < upload) {
+		return download, ZModemDownload
+	} else if upload >= 0 {
+		return upload, ZModemUpload
+	} else {
+		return -1, 0
+	}
+}
+
+// DetectTrzsz reports whether the output has the start sequence of trzsz
+func DetectTrzsz(output []byte) bool {
+	return bytes.Contains(output, trzszStart)
+}
+
+func zCRC16(data []byte) uint16 {
+	crc := uint16(0)
+	for _, c := range data {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// zHeader is the type and the 4 bytes of a header, the bytes are a
+// position (little endian) or the flags (ZF0 is the last byte)
+type zHeader struct {
+	Type byte
+	Data [4]byte
+}
+
+func newPosHeader(t byte, pos int64) zHeader {
+	ret := zHeader{Type: t}
+	binary.LittleEndian.PutUint32(ret.Data[:], uint32(pos))
+	return ret
+}
+
+func newFlagsHeader(t byte, f0 byte) zHeader {
+	return zHeader{Type: t, Data: [4]byte{0, 0, 0, f0}}
+}
+
+func (p zHeader) Pos() int64 {
+	return int64(binary.LittleEndian.Uint32(p.Data[:]))
+}
+
+func (p zHeader) F0() byte {
+	return p.Data[3]
+}
+
+func (p zHeader) bytes() []byte {
+	return append([]byte{p.Type}, p.Data[:]...)
+}
+
+func zEscape(buf []byte, data []byte) []byte {
+	for _, c := range data {
+		switch c {
+		case zDLE, 0x10, 0x11, 0x13, 0x0d, 0x90, 0x91, 0x93, 0x8d:
+			buf = append(buf, zDLE, c^0x40)
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return buf
+}
+
+func encodeHexHeader(h zHeader) []byte {
+	data := h.bytes()
+	crc := zCRC16(data)
+	ret := append([]byte{zPAD, zPAD, zDLE, zHEX}, []byte(hex.EncodeToString(data))...)
+	ret = append(ret, []byte(fmt.Sprintf("%04x", crc))...)
+	ret = append(ret, '\r', 0x8a)
+	if h.Type != zFIN && h.Type != zACK {
+		ret = append(ret, 0x11)
+	}
+	return ret
+}
+
+func encodeBinHeader(h zHeader, useCRC32 bool) []byte {
+	data := h.bytes()
+	if useCRC32 {
+		crc := make([]byte, 4)
+		binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(data))
+		return zEscape([]byte{zPAD, zDLE, zBIN32}, append(data, crc...))
+	}
+	crc := zCRC16(data)
+	return zEscape([]byte{zPAD, zDLE, zBIN}, append(data, byte(crc>>8), byte(crc)))
+}
+
+func encodeSubpacket(data []byte, end byte, useCRC32 bool) []byte {
+	ret := zEscape(make([]byte, 0, len(data)+16), data)
+	ret = append(ret, zDLE, end)
+	if useCRC32 {
+		crc := make([]byte, 4)
+		binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(append(append([]byte{}, data...), end)))
+		ret = zEscape(ret, crc)
+	} else {
+		crc := zCRC16(append(append([]byte{}, data...), end))
+		ret = zEscape(ret, []byte{byte(crc >> 8), byte(crc)})
+	}
+	if end == zCRCW {
+		ret = append(ret, 0x11)
+	}
+	return ret
+}
+
+const (
+	zParserIdle = iota
+	zParserPad
+	zParserDLE
+	zParserHexHeader
+	zParserBinHeader
+	zParserData
+	zParserCRC
+)
+
+// zFrame is a header or a data subpacket that has been parsed
+type zFrame struct {
+	header  *zHeader
+	isHex   bool
+	data    []byte
+	end     byte
+	crcFail bool
+}
+
+// zParser decodes the headers and the data subpackets from the output of
+// the remote side, it is fed byte by byte
+type zParser struct {
+	state    int
+	kind     byte
+	buf      []byte
+	data     []byte
+	end      byte
+	escape   bool
+	useCRC32 bool
+	cancels  int
+}
+
+// expectData makes the parser read data subpackets after the last header
+func (p *zParser) expectData() {
+	p.state, p.data, p.escape = zParserData, p.data[:0], false
+}
+
+// unescape decodes a byte of the binary header, the data or the crc. It
+// returns the byte, whether a byte is ready and the end of a subpacket.
+func (p *zParser) unescape(c byte) (byte, bool, byte) {
+	if p.escape {
+		p.escape = false
+		switch {
+		case c == zCRCE || c == zCRCG || c == zCRCQ || c == zCRCW:
+			return 0, false, c
+		case c == zRUB0:
+			return 0x7f, true, 0
+		case c == zRUB1:
+			return 0xff, true, 0
+		case c&0x60 == 0x40:
+			return c ^ 0x40, true, 0
+		default:
+			return 0, false, 0
+		}
+	}
+
+	switch c {
+	case zDLE:
+		p.escape = true
+		return 0, false, 0
+	case 0x11, 0x13, 0x91, 0x93:
+		return 0, false, 0
+	default:
+		return c, true, 0
+	}
+}
+
+func (p *zParser) reset() {
+	p.state, p.buf, p.escape = zParserIdle, p.buf[:0], false
+}
+
+// push returns a frame when it is complete, the error is returned when the
+// remote side has cancelled the transfer
+func (p *zParser) push(c byte) (*zFrame, error) {
+	if c == zDLE {
+		p.cancels++
+		if p.cancels >= zCancelCount {
+			return nil, fmt.Errorf("transfer cancelled by the remote side")
+		}
+	} else {
+		p.cancels = 0
+	}
+
+	switch p.state {
+	case zParserIdle:
+		if c == zPAD {
+			p.state = zParserPad
+		}
+	case zParserPad:
+		if c == zDLE {
+			p.state = zParserDLE
+		} else if c != zPAD {
+			p.state = zParserIdle
+		}
+	case zParserDLE:
+		p.buf, p.escape, p.kind = p.buf[:0], false, c
+		if c == zHEX {
+			p.state = zParserHexHeader
+		} else if c == zBIN || c == zBIN32 {
+			p.state = zParserBinHeader
+		} else {
+			p.state = zParserIdle
+		}
+	case zParserHexHeader:
+		p.buf = append(p.buf, c)
+		if len(p.buf) == 14 {
+			raw, e := hex.DecodeString(strings.ToLower(string(p.buf)))
+			p.reset()
+			if e == nil && zCRC16(raw[:5]) == uint16(raw[5])<<8|uint16(raw[6]) {
+				p.useCRC32 = false
+				return &zFrame{
+					header: &zHeader{Type: raw[0], Data: [4]byte{raw[1], raw[2], raw[3], raw[4]}},
+					isHex:  true,
+				}, nil
+			}
+		}
+	case zParserBinHeader:
+		v, ok, end := p.unescape(c)
+		if end != 0 {
+			p.reset()
+		} else if ok {
+			p.buf = append(p.buf, v)
+			size := 7
+			if p.kind == zBIN32 {
+				size = 9
+			}
+			if len(p.buf) == size {
+				raw, useCRC32 := p.buf, p.kind == zBIN32
+				p.reset()
+				isValid := false
+				if useCRC32 {
+					isValid = crc32.ChecksumIEEE(raw[:5]) == binary.LittleEndian.Uint32(raw[5:])
+				} else {
+					isValid = zCRC16(raw[:5]) == uint16(raw[5])<<8|uint16(raw[6])
+				}
+				if isValid {
+					p.useCRC32 = useCRC32
+					return &zFrame{header: &zHeader{Type: raw[0], Data: [4]byte{raw[1], raw[2], raw[3], raw[4]}}}, nil
+				}
+			}
+		}
+	case zParserData:
+		v, ok, end := p.unescape(c)
+		if end != 0 {
+			p.state, p.end, p.buf = zParserCRC, end, p.buf[:0]
+		} else if ok {
+			if len(p.data) >= zMaxSubpacket {
+				p.reset()
+				return &zFrame{crcFail: true}, nil
+			}
+			p.data = append(p.data, v)
+		}
+	case zParserCRC:
+		v, ok, end := p.unescape(c)
+		if end != 0 {
+			p.reset()
+			return &zFrame{crcFail: true}, nil
+		} else if ok {
+			p.buf = append(p.buf, v)
+			if p.useCRC32 && len(p.buf) == 4 || !p.useCRC32 && len(p.buf) == 2 {
+				checked := append(append([]byte{}, p.data...), p.end)
+				isValid := false
+				if p.useCRC32 {
+					isValid = crc32.ChecksumIEEE(checked) == binary.LittleEndian.Uint32(p.buf)
+				} else {
+					isValid = zCRC16(checked) == uint16(p.buf[0])<<8|uint16(p.buf[1])
+				}
+
+				frame := &zFrame{data: append([]byte{}, p.data...), end: p.end, crcFail: !isValid}
+				if !isValid || p.end == zCRCE || p.end == zCRCW {
+					p.reset()
+				} else {
+					p.state, p.data = zParserData, p.data[:0]
+				}
+				return frame, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// ZModemEvent is reported to the user of the terminal. The types are
+// "file" (a file starts), "data" (data of a download), "progress" (data of
+// an upload has been sent), "fileEnd", "next" (an upload waits for the next
+// file) and "end" (the transfer is over, with an error if it has failed).
+type ZModemEvent struct {
+	Type   string
+	Name   string
+	Size   int64
+	Offset int64
+	Data   []byte
+	Error  string
+}
+
+const (
+	zStateRunning = iota
+	zStateWaitFile
+	zStateWaitPos
+	zStateSending
+	zStateWaitEnd
+	zStateWaitFin
+	zStateWaitOO
+	zStateDone
+)
+
+// ZModem runs a ZMODEM transfer with rz or sz on the remote side, the
+// output of the remote side is fed to it and it writes its frames to the
+// input of the remote side. The files of a download are reported as events
+// and the files of an upload are given by SendFile.
+type ZModem struct {
+	direction int
+	parser    zParser
+	write     func(data []byte) error
+	fnEvent   func(event *ZModemEvent)
+	state     int
+	useCRC32  bool
+	inData    bool
+	inFile    bool
+	inInit    bool
+	name      string
+	size      int64
+	offset    int64
+	reader    io.ReadCloser
+	numOfO    int
+	trailer   int
+	writeMu   sync.Mutex
+	mu        sync.Mutex
+}
+
+func NewZModem(direction int, write func(data []byte) error, fnEvent func(event *ZModemEvent)) *ZModem {
+	return &ZModem{
+		direction: direction,
+		write:     write,
+		fnEvent:   fnEvent,
+	}
+}
+
+func (p *ZModem) send(data []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	return p.write(data)
+}
+
+func (p *ZModem) sendHex(h zHeader) error {
+	return p.send(encodeHexHeader(h))
+}
+
+// finish ends the transfer, it must be called with the lock held
+func (p *ZModem) finish(e error, events []*ZModemEvent) []*ZModemEvent {
+	if p.state == zStateDone {
+		return events
+	}
+	p.state = zStateDone
+	if p.reader != nil {
+		_ = p.reader.Close()
+		p.reader = nil
+	}
+
+	event := &ZModemEvent{Type: "end"}
+	if e != nil {
+		event.Error = e.Error()
+	}
+	return append(events, event)
+}
+
+func (p *ZModem) emit(events []*ZModemEvent) {
+	for _, event := range events {
+		p.fnEvent(event)
+	}
+}
+
+// Feed processes the output of the remote side. When the transfer is over
+// it returns true and the output that follows the transfer.
+func (p *ZModem) Feed(output []byte) ([]byte, bool) {
+	p.mu.Lock()
+	events := make([]*ZModemEvent, 0)
+	rest, done := []byte(nil), false
+
+	for i, c := range output {
+		if p.trailer > 0 {
+			// the line end and XON after a hex header
+			p.trailer--
+			if c == '\r' || c == '\n' || c == 0x8a || c == 0x11 {
+				continue
+			}
+			p.trailer = 0
+		}
+
+		if p.state == zStateWaitOO {
+			if c == 'O' && p.numOfO < 2 {
+				p.numOfO++
+				continue
+			}
+			events = p.finish(nil, events)
+		}
+
+		if p.state == zStateDone {
+			rest, done = output[i:], true
+			break
+		}
+
+		frame, e := p.parser.push(c)
+		if e != nil {
+			events = p.finish(e, events)
+		} else if frame != nil {
+			if frame.isHex {
+				p.trailer = 3
+			}
+			if p.direction == ZModemDownload {
+				events = p.onDownloadFrame(frame, events)
+			} else {
+				events = p.onUploadFrame(frame, events)
+			}
+		}
+	}
+	if p.state == zStateDone && !done {
+		rest, done = []byte{}, true
+	}
+	p.mu.Unlock()
+
+	p.emit(events)
+	if done {
+		rest = bytes.TrimLeft(rest, "\x18\x08")
+	}
+	return rest, done
+}
+
+func (p *ZModem) fail(e error, events []*ZModemEvent) []*ZModemEvent {
+	_ = p.send(zCancelSequence)
+	return p.finish(e, events)
+}
+
+func (p *ZModem) onDownloadFrame(frame *zFrame, events []*ZModemEvent) []*ZModemEvent {
+	if frame.header == nil {
+		if frame.crcFail {
+			p.inData = false
+			if p.inFile {
+				_ = p.sendHex(newPosHeader(zRPOS, p.offset))
+			} else {
+				_ = p.sendHex(newFlagsHeader(zNAK, 0))
+			}
+			return events
+		}
+
+		if p.inInit {
+			p.inInit = false
+			_ = p.sendHex(newPosHeader(zACK, 0))
+		} else if !p.inFile {
+			// the data subpacket of ZFILE
+			name, size := parseZFileInfo(frame.data)
+			p.inFile, p.name, p.size, p.offset = true, name, size, 0
+			events = append(events, &ZModemEvent{Type: "file", Name: name, Size: size})
+			_ = p.sendHex(newPosHeader(zRPOS, 0))
+		} else if p.inData {
+			p.offset += int64(len(frame.data))
+			events = append(events, &ZModemEvent{
+				Type: "data", Name: p.name, Size: p.size, Offset: p.offset, Data: frame.data,
+			})
+			if frame.end == zCRCQ || frame.end == zCRCW {
+				_ = p.sendHex(newPosHeader(zACK, p.offset))
+			}
+		}
+		return events
+	}
+
+	switch frame.header.Type {
+	case zRQINIT:
+		_ = p.sendHex(newFlagsHeader(zRINIT, zCANFDX|zCANOVIO|zCANFC32))
+	case zSINIT:
+		p.inInit = true
+		p.parser.expectData()
+	case zFILE:
+		p.inFile = false
+		p.parser.expectData()
+	case zDATA:
+		if !p.inFile {
+			return events
+		} else if frame.header.Pos() != p.offset {
+			p.inData = false
+			_ = p.sendHex(newPosHeader(zRPOS, p.offset))
+		} else {
+			p.inData = true
+			p.parser.expectData()
+		}
+	case zEOF:
+		if p.inFile && frame.header.Pos() == p.offset {
+			p.inFile, p.inData = false, false
+			events = append(events, &ZModemEvent{Type: "fileEnd", Name: p.name, Size: p.size, Offset: p.offset})
+			_ = p.sendHex(newFlagsHeader(zRINIT, zCANFDX|zCANOVIO|zCANFC32))
+		}
+	case zFIN:
+		_ = p.sendHex(newPosHeader(zFIN, 0))
+		p.state = zStateWaitOO
+	case zABORT, zFERR:
+		events = p.finish(fmt.Errorf("transfer aborted by the remote side"), events)
+	}
+	return events
+}
+
+// parseZFileInfo parses the name and the size from the data of ZFILE
+func parseZFileInfo(data []byte) (string, int64) {
+	parts := bytes.SplitN(data, []byte{0}, 2)
+	name := string(parts[0])
+	if idx := strings.LastIndexAny(name, "/\\"); idx >= 0 {
+		name = name[idx+1:]
+	}
+
+	size := int64(-1)
+	if len(parts) == 2 {
+		if fields := strings.Fields(string(bytes.TrimRight(parts[1], "\x00"))); len(fields) > 0 {
+			if v, e := strconv.ParseInt(fields[0], 10, 64); e == nil {
+				size = v
+			}
+		}
+	}
+	return name, size
+}
+
+func (p *ZModem) onUploadFrame(frame *zFrame, events []*ZModemEvent) []*ZModemEvent {
+	if frame.header == nil {
+		return events
+	}
+
+	switch frame.header.Type {
+	case zRINIT:
+		p.useCRC32 = frame.header.F0()&zCANFC32 != 0
+		if p.state == zStateRunning {
+			p.state = zStateWaitFile
+			events = append(events, &ZModemEvent{Type: "next"})
+		} else if p.state == zStateWaitEnd {
+			// the end of the file has been received
+			p.state = zStateWaitFile
+			events = append(events, &ZModemEvent{Type: "fileEnd", Name: p.name, Size: p.size, Offset: p.size})
+			events = append(events, &ZModemEvent{Type: "next"})
+		}
+	case zRPOS:
+		if p.state == zStateWaitPos {
+			p.state = zStateSending
+			go p.sendData(p.reader, frame.header.Pos())
+		} else if p.state == zStateSending || p.state == zStateWaitEnd {
+			events = p.fail(fmt.Errorf(
+				"retransmission from %d is not supported", frame.header.Pos(),
+			), events)
+		}
+	case zSKIP:
+		if p.state == zStateWaitPos {
+			_ = p.reader.Close()
+			p.reader = nil
+			p.state = zStateWaitFile
+			events = append(events, &ZModemEvent{Type: "fileEnd", Name: p.name, Size: p.size, Error: "skipped"})
+			events = append(events, &ZModemEvent{Type: "next"})
+		}
+	case zFIN:
+		if p.state == zStateWaitFin {
+			_ = p.send([]byte("OO"))
+			events = p.finish(nil, events)
+		}
+	case zABORT, zFERR, zCAN:
+		events = p.finish(fmt.Errorf("transfer aborted by the remote side"), events)
+	}
+	return events
+}
+
+// sendData streams the file from the position, the bytes before the
+// position are skipped because the reader can not seek
+func (p *ZModem) sendData(reader io.ReadCloser, pos int64) {
+	events := make([]*ZModemEvent, 0)
+	e := error(nil)
+	defer func() {
+		p.mu.Lock()
+		if p.reader == reader {
+			_ = reader.Close()
+			p.reader = nil
+		}
+		if e != nil {
+			events = p.fail(e, events)
+		}
+		p.mu.Unlock()
+		p.emit(events)
+	}()
+
+	if _, e = io.CopyN(io.Discard, reader, pos); e != nil {
+		return
+	}
+
+	p.mu.Lock()
+	useCRC32, name, size := p.useCRC32, p.name, p.size
+	p.mu.Unlock()
+
+	if e = p.send(encodeBinHeader(newPosHeader(zDATA, pos), useCRC32)); e != nil {
+		return
+	}
+
+	buf := make([]byte, zBlockSize)
+	lastProgress := time.Now()
+	for offset := pos; offset < size; {
+		n := 0
+		if n, e = io.ReadFull(reader, buf[:minInt64(int64(len(buf)), size-offset)]); e != nil {
+			return
+		}
+		offset += int64(n)
+
+		end := byte(zCRCG)
+		if offset == size {
+			end = zCRCE
+		}
+		if e = p.send(encodeSubpacket(buf[:n], end, useCRC32)); e != nil {
+			return
+		}
+
+		if offset == size || time.Since(lastProgress) > 200*time.Millisecond {
+			lastProgress = time.Now()
+			p.fnEvent(&ZModemEvent{Type: "progress", Name: name, Size: size, Offset: offset})
+		}
+	}
+	if pos >= size {
+		if e = p.send(encodeSubpacket(nil, zCRCE, useCRC32)); e != nil {
+			return
+		}
+	}
+
+	p.mu.Lock()
+	if p.reader == reader {
+		_ = reader.Close()
+		p.reader = nil
+	}
+	if p.state == zStateSending {
+		p.state = zStateWaitEnd
+	}
+	p.mu.Unlock()
+	e = p.send(encodeHexHeader(newPosHeader(zEOF, size)))
+}
+
+func minInt64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// SendFile sends the file to rz, it must be called after the event "next"
+func (p *ZModem) SendFile(name string, size int64, reader io.ReadCloser) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.direction != ZModemUpload || p.state != zStateWaitFile {
+		_ = reader.Close()
+		return fmt.Errorf("transfer is not waiting for a file")
+	} else if size < 0 {
+		_ = reader.Close()
+		return fmt.Errorf("file size must not be negative")
+	}
+
+	p.name, p.size, p.reader, p.state = name, size, reader, zStateWaitPos
+	info := []byte(fmt.Sprintf("%s\x00%d %o 100644\x00", name, size, time.Now().Unix()))
+	if e := p.send(encodeBinHeader(newFlagsHeader(zFILE, 0), p.useCRC32)); e != nil {
+		return e
+	}
+	return p.send(encodeSubpacket(info, zCRCW, p.useCRC32))
+}
+
+// Finish tells rz that there are no more files
+func (p *ZModem) Finish() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.direction != ZModemUpload || p.state != zStateWaitFile {
+		return fmt.Errorf("transfer is not waiting for a file")
+	}
+	p.state = zStateWaitFin
+	return p.sendHex(newPosHeader(zFIN, 0))
+}
+
+// Cancel aborts the transfer on both sides
+func (p *ZModem) Cancel() {
+	p.mu.Lock()
+	events := make([]*ZModemEvent, 0)
+	if p.state != zStateDone {
+		events = p.fail(fmt.Errorf("transfer cancelled"), events)
+	}
+	p.mu.Unlock()
+	p.emit(events)
+}
+
+// Direction returns ZModemDownload or ZModemUpload
+func (p *ZModem) Direction() int {
+	return p.direction
+}
+
+// IsDone reports whether the transfer is over
+func (p *ZModem) IsDone() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.state == zStateDone
+}
@@ -0,0 +1,217 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rpccloud/assert"
+)
+
+type testZModemPeer struct {
+	written bytes.Buffer
+	events  []*ZModemEvent
+	mu      sync.Mutex
+}
+
+func (p *testZModemPeer) write(data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.written.Write(data)
+	return nil
+}
+
+func (p *testZModemPeer) onEvent(event *ZModemEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, event)
+}
+
+// frames decodes the frames that have been written to the remote side
+func (p *testZModemPeer) frames() []*zFrame {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ret := make([]*zFrame, 0)
+	parser := &zParser{}
+	for _, c := range p.written.Bytes() {
+		if frame, _ := parser.push(c); frame != nil {
+			ret = append(ret, frame)
+			if frame.header != nil && (frame.header.Type == zFILE || frame.header.Type == zDATA) {
+				parser.expectData()
+			}
+		}
+	}
+	return ret
+}
+
+func (p *testZModemPeer) eventTypes() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ret := make([]string, 0)
+	for _, event := range p.events {
+		ret = append(ret, event.Type)
+	}
+	return ret
+}
+
+func feedInChunks(z *ZModem, data []byte, size int) ([]byte, bool) {
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		if rest, done := z.Feed(data[:n]); done {
+			return append(rest, data[n:]...), true
+		}
+		data = data[n:]
+	}
+	return nil, false
+}
+
+func TestDetectZModem(t *testing.T) {
+	t.Run("test", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(DetectZModem([]byte("ls\r\n"))).Equals(-1, 0)
+		assert(DetectZModem([]byte("rz\r**\x18B00000000000000\r\x8a\x11"))).Equals(3, ZModemDownload)
+		assert(DetectZModem([]byte("**\x18B0100000023be50\r\x8a\x11"))).Equals(0, ZModemUpload)
+		assert(DetectTrzsz([]byte("\x1b7\x07::TRZSZ:TRANSFER:R:1.1.5:1\r\n"))).IsTrue()
+	})
+}
+
+func TestZModem_Download(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		peer := &testZModemPeer{}
+		z := NewZModem(ZModemDownload, peer.write, peer.onEvent)
+		content := []byte("hello \x18\x11\x13\x0d\x7f\xff\x90 world")
+
+		stream := encodeHexHeader(newPosHeader(zRQINIT, 0))
+		stream = append(stream, encodeBinHeader(newFlagsHeader(zFILE, 0), true)...)
+		stream = append(stream, encodeSubpacket([]byte("/tmp/a.txt\x0019 14271234 100644\x00"), zCRCW, true)...)
+		stream = append(stream, encodeBinHeader(newPosHeader(zDATA, 0), true)...)
+		stream = append(stream, encodeSubpacket(content[:8], zCRCG, true)...)
+		stream = append(stream, encodeSubpacket(content[8:], zCRCE, true)...)
+		stream = append(stream, encodeHexHeader(newPosHeader(zEOF, int64(len(content))))...)
+		stream = append(stream, encodeHexHeader(newPosHeader(zFIN, 0))...)
+		stream = append(stream, []byte("OO\r\n$ ")...)
+
+		rest, done := feedInChunks(z, stream, 3)
+		assert(string(rest), done, z.IsDone()).Equals("\r\n$ ", true, true)
+		assert(peer.eventTypes()).Equals([]string{"file", "data", "data", "fileEnd", "end"})
+		assert(peer.events[0].Name, peer.events[0].Size).Equals("a.txt", int64(19))
+		assert(append(peer.events[1].Data, peer.events[2].Data...)).Equals(content)
+		assert(peer.events[2].Offset, peer.events[4].Error).Equals(int64(19), "")
+
+		types := make([]byte, 0)
+		for _, frame := range peer.frames() {
+			types = append(types, frame.header.Type)
+		}
+		assert(types).Equals([]byte{zRINIT, zRPOS, zRINIT, zFIN})
+	})
+
+	t.Run("crc error", func(t *testing.T) {
+		assert := assert.New(t)
+		peer := &testZModemPeer{}
+		z := NewZModem(ZModemDownload, peer.write, peer.onEvent)
+
+		stream := encodeBinHeader(newFlagsHeader(zFILE, 0), false)
+		stream = append(stream, encodeSubpacket([]byte("a.txt\x005\x00"), zCRCW, false)...)
+		stream = append(stream, encodeBinHeader(newPosHeader(zDATA, 0), false)...)
+		packet := encodeSubpacket([]byte("hello"), zCRCE, false)
+		packet[0] = 'j'
+		stream = append(stream, packet...)
+		_, done := z.Feed(stream)
+		assert(done).IsFalse()
+
+		frames := peer.frames()
+		last := frames[len(frames)-1].header
+		assert(last.Type, last.Pos()).Equals(byte(zRPOS), int64(0))
+		assert(peer.eventTypes()).Equals([]string{"file"})
+	})
+
+	t.Run("cancelled by remote", func(t *testing.T) {
+		assert := assert.New(t)
+		peer := &testZModemPeer{}
+		z := NewZModem(ZModemDownload, peer.write, peer.onEvent)
+		rest, done := z.Feed(zCancelSequence)
+		assert(string(rest), done).Equals("", true)
+		assert(peer.events[0].Error).Equals("transfer cancelled by the remote side")
+	})
+}
+
+func TestZModem_Upload(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		peer := &testZModemPeer{}
+		z := NewZModem(ZModemUpload, peer.write, peer.onEvent)
+		content := bytes.Repeat([]byte("abc\x18\x11\x0d\x7f"), 400)
+
+		assert(z.Finish()).IsNotNil()
+		_, done := z.Feed(encodeHexHeader(newFlagsHeader(zRINIT, zCANFDX|zCANOVIO|zCANFC32)))
+		assert(done, peer.eventTypes()).Equals(false, []string{"next"})
+
+		assert(z.SendFile("b.bin", int64(len(content)), ioutil.NopCloser(bytes.NewReader(content)))).IsNil()
+		_, _ = z.Feed(encodeHexHeader(newPosHeader(zRPOS, 0)))
+
+		frames := []*zFrame(nil)
+		for i := 0; i < 200; i++ {
+			frames = peer.frames()
+			if last := frames[len(frames)-1]; last.header != nil && last.header.Type == zEOF {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert(frames[0].header.Type, string(frames[1].data[:6])).Equals(byte(zFILE), "b.bin\x00")
+		assert(frames[2].header.Type, frames[2].header.Pos()).Equals(byte(zDATA), int64(0))
+		received := make([]byte, 0)
+		for _, frame := range frames[3 : len(frames)-1] {
+			assert(frame.crcFail).IsFalse()
+			received = append(received, frame.data...)
+		}
+		assert(received).Equals(content)
+		assert(frames[len(frames)-2].end, frames[len(frames)-1].header.Pos()).
+			Equals(byte(zCRCE), int64(len(content)))
+
+		_, _ = z.Feed(encodeHexHeader(newFlagsHeader(zRINIT, zCANFC32)))
+		assert(z.Finish()).IsNil()
+		rest, done := z.Feed(append(encodeHexHeader(newPosHeader(zFIN, 0)), '$'))
+		assert(string(rest), done).Equals("$", true)
+		assert(bytes.HasSuffix(peer.written.Bytes(), []byte("OO"))).IsTrue()
+		types := peer.eventTypes()
+		assert(types[len(types)-3:]).Equals([]string{"fileEnd", "next", "end"})
+	})
+
+	t.Run("skip and resume", func(t *testing.T) {
+		assert := assert.New(t)
+		peer := &testZModemPeer{}
+		z := NewZModem(ZModemUpload, peer.write, peer.onEvent)
+		_, _ = z.Feed(encodeHexHeader(newFlagsHeader(zRINIT, 0)))
+
+		reader, writer := io.Pipe()
+		assert(z.SendFile("a", 3, reader)).IsNil()
+		assert(z.SendFile("a", 3, reader)).IsNotNil()
+		_, _ = z.Feed(encodeHexHeader(newPosHeader(zSKIP, 0)))
+		_, e := writer.Write([]byte("abc"))
+		assert(e).Equals(io.ErrClosedPipe)
+		assert(peer.eventTypes()).Equals([]string{"next", "fileEnd", "next"})
+
+		assert(z.SendFile("b", 5, ioutil.NopCloser(bytes.NewReader([]byte("hello"))))).IsNil()
+		_, _ = z.Feed(encodeHexHeader(newPosHeader(zRPOS, 3)))
+		frames := peer.frames()
+		for i := 0; i < 200 && (frames[len(frames)-1].header == nil || frames[len(frames)-1].header.Type != zEOF); i++ {
+			time.Sleep(10 * time.Millisecond)
+			frames = peer.frames()
+		}
+		assert(frames[len(frames)-3].header.Pos(), string(frames[len(frames)-2].data)).
+			Equals(int64(3), "lo")
+
+		z.Cancel()
+		assert(z.IsDone()).IsTrue()
+		assert(bytes.HasSuffix(peer.written.Bytes(), zCancelSequence)).IsTrue()
+	})
+}
@@ -0,0 +1,551 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+const (
+	accessCheckInterval = 5 * time.Second
+	accessMaxDuration   = 24 * time.Hour
+	// accessRequestRetention is the time that the decided requests are
+	// kept after their decision or their expiration
+	accessRequestRetention = 30 * 24 * time.Hour
+	accessTrimInterval     = time.Hour
+)
+
+var AccessService = rpc.NewService(rpc.Map{
+	"expirer":   NewPeriodicTask(runAccessExpiration),
+	"retention": NewPeriodicTask(runAccessRetention),
+}).
+	On("$onTimer", onAccessTimer).
+	On("SetPolicy", setAccessPolicy).
+	On("GetPolicy", getAccessPolicy).
+	On("Request", requestAccess).
+	On("Grant", grantAccess).
+	On("Deny", denyAccess).
+	On("Revoke", revokeAccess).
+	On("List", listAccessRequests)
+
+type accessWindow struct {
+	Weekdays []int  `json:"weekdays"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+// accessPolicy is stored as "access.<serverID>.policy". If JIT is true a
+// user needs a granted request to open a session on the server. If there
+// are windows, the server is only accessible in them.
+type accessPolicy struct {
+	JIT     bool            `json:"jit"`
+	Windows []*accessWindow `json:"windows"`
+}
+
+// accessRequest is stored as "accessRequest.<20 digits id>" and is kept
+// after it has been decided as the record of the access. A granted request
+// is indexed as "accessGrant.<user>.<target>.<20 digits id>" with the time
+// that it expires, the index is removed when it expires or is revoked.
+type accessRequest struct {
+	ID        string `json:"id"`
+	User      string `json:"user"`
+	Target    string `json:"target"`
+	Duration  int64  `json:"duration"`
+	Reason    string `json:"reason"`
+	State     string `json:"state"`
+	CreatedAt int64  `json:"createdAt"`
+	Approver  string `json:"approver"`
+	Comment   string `json:"comment"`
+	DecidedAt int64  `json:"decidedAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+func getMillisecond(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func formatAccessRequestKey(id string) []byte {
+	seq, _ := strconv.ParseUint(id, 10, 64)
+	return core.DBKey("accessRequest.%020d", seq)
+}
+
+func formatAccessGrantKey(request *accessRequest) []byte {
+	seq, _ := strconv.ParseUint(request.ID, 10, 64)
+	return core.DBKey("accessGrant.%s.%s.%020d", request.User, request.Target, seq)
+}
+
+// dbPutAccessRequest writes the request and keeps the grant index in step
+// with its state
+func dbPutAccessRequest(b *bolt.Bucket, request *accessRequest) error {
+	if request.State == "granted" {
+		expiresAt := []byte(strconv.FormatInt(request.ExpiresAt, 10))
+		if e := b.Put(formatAccessGrantKey(request), expiresAt); e != nil {
+			return e
+		}
+	} else if e := b.Delete(formatAccessGrantKey(request)); e != nil {
+		return e
+	}
+	return dbPutJSON(b, formatAccessRequestKey(request.ID), request)
+}
+
+// dbHasAccessGrant checks the grants of the user on the target that have not
+// expired at the time
+func dbHasAccessGrant(b *bolt.Bucket, user string, target string, now time.Time) bool {
+	c := b.Cursor()
+	prefix := core.DBKey("accessGrant.%s.%s.", user, target)
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if expiresAt, e := strconv.ParseInt(string(v), 10, 64); e == nil && expiresAt > getMillisecond(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// dbListAccessGrantGroups returns the groups that the user has grants on
+func dbListAccessGrantGroups(b *bolt.Bucket, user string) []string {
+	ret := make([]string, 0)
+	c := b.Cursor()
+	prefix := core.DBKey("accessGrant.%s.@", user)
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		// the key ends with ".<20 digits id>"
+		if target := string(k[len(prefix)-1 : len(k)-21]); len(ret) == 0 || ret[len(ret)-1] != target {
+			ret = append(ret, target)
+		}
+	}
+	return ret
+}
+
+func dbGetAccessPolicy(b *bolt.Bucket, id string) *accessPolicy {
+	ret := &accessPolicy{}
+	if data := b.Get(core.DBKey("access.%s.policy", id)); data != nil {
+		_ = json.Unmarshal(data, ret)
+	}
+	return ret
+}
+
+// dbCheckServerAccess returns an error if the user can not open a session
+// on the server at the time
+func dbCheckServerAccess(db *core.DB, bucket string, id string, user string, now time.Time) error {
+	policy := (*accessPolicy)(nil)
+	needsGrant := false
+	groups := make([]string, 0)
+	if e := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if b.Get(core.DBKey("servers.%s", id)) == nil {
+			return fmt.Errorf("server \"%s\" does not exist", id)
+		}
+
+		policy = dbGetAccessPolicy(b, id)
+		if policy.JIT && !dbHasAccessGrant(b, user, id, now) {
+			needsGrant = true
+			for _, group := range dbListAccessGrantGroups(b, user) {
+				if dbHasAccessGrant(b, user, group, now) {
+					groups = append(groups, group)
+				}
+			}
+		}
+		return nil
+	}); e != nil {
+		return e
+	}
+
+	if len(policy.Windows) > 0 {
+		inWindow := false
+		for _, window := range policy.Windows {
+			inWindow = inWindow || isInTimeWindow(window.Weekdays, window.From, window.To, now)
+		}
+		if !inWindow {
+			return fmt.Errorf("server \"%s\" is not accessible at this time", id)
+		}
+	}
+
+	if !needsGrant {
+		return nil
+	}
+
+	for _, group := range groups {
+		// the members of a group are resolved at the time of the check
+		if ids, e := dbResolveServers(db, bucket, []string{group}); e == nil {
+			for _, v := range ids {
+				if v == id {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("access to server \"%s\" needs to be granted", id)
+}
+
+// dbExpireAccessGrants marks the expired grants, it returns the number of
+// the grants that have expired. The grants are checked in a read-only
+// transaction, the bucket is only written if one of them has expired.
+func dbExpireAccessGrants(db *core.DB, bucket string, now time.Time) (int, error) {
+	ids := make([]string, 0)
+	if e := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+
+		c := b.Cursor()
+		prefix := []byte("accessGrant.")
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if expiresAt, e := strconv.ParseInt(string(v), 10, 64); e != nil || expiresAt <= getMillisecond(now) {
+				// the key ends with ".<20 digits id>"
+				seq, _ := strconv.ParseUint(string(k[len(k)-20:]), 10, 64)
+				ids = append(ids, strconv.FormatUint(seq, 10))
+			}
+		}
+		return nil
+	}); e != nil || len(ids) == 0 {
+		return 0, e
+	}
+
+	ret := 0
+	return ret, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		for _, id := range ids {
+			request := &accessRequest{}
+			if data := b.Get(formatAccessRequestKey(id)); data == nil {
+				continue
+			} else if e := json.Unmarshal(data, request); e != nil {
+				return e
+			} else if request.State != "granted" || request.ExpiresAt > getMillisecond(now) {
+				// it has been revoked or changed meanwhile
+				continue
+			}
+
+			request.State = "expired"
+			if e := dbPutAccessRequest(b, request); e != nil {
+				return e
+			}
+			ret++
+		}
+		return nil
+	})
+}
+
+// dbTrimAccessRequests removes the requests that have been denied, revoked
+// or have expired before the time, it returns the number of the removed
+// requests
+func dbTrimAccessRequests(db *core.DB, bucket string, before time.Time) (int, error) {
+	keys := make([][]byte, 0)
+	if e := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+
+		return dbListJSON(b, "accessRequest.", func(data []byte) error {
+			request := &accessRequest{}
+			if e := json.Unmarshal(data, request); e != nil {
+				return e
+			}
+			endAt := request.DecidedAt
+			if request.State == "expired" {
+				endAt = request.ExpiresAt
+			}
+			if request.State != "pending" && request.State != "granted" && endAt < getMillisecond(before) {
+				keys = append(keys, formatAccessRequestKey(request.ID))
+			}
+			return nil
+		})
+	}); e != nil || len(keys) == 0 {
+		return 0, e
+	}
+
+	return len(keys), db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		for _, key := range keys {
+			if e := b.Delete(key); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+// runAccessExpiration expires the grants and closes the sessions that are
+// not allowed any more
+func runAccessExpiration(db *core.DB) {
+	buckets, e := db.ListBuckets("-")
+	if e != nil {
+		return
+	}
+
+	for _, bucket := range buckets {
+		_, _ = dbExpireAccessGrants(db, bucket, time.Now())
+	}
+
+	for _, session := range gSessionRegistry.List() {
+		if e := dbCheckServerAccess(
+			db, session.bucket, session.serverID, session.user, time.Now(),
+		); e != nil {
+			gSessionRegistry.Close(session.id, "session closed: "+e.Error())
+		}
+	}
+}
+
+func runAccessRetention(db *core.DB) {
+	buckets, e := db.ListBuckets("-")
+	if e != nil {
+		return
+	}
+
+	for _, bucket := range buckets {
+		if n, e := dbTrimAccessRequests(db, bucket, time.Now().Add(-accessRequestRetention)); e != nil {
+			log.Print(e)
+		} else if n > 0 {
+			log.Printf("access: %d requests of %s have expired", n, bucket)
+		}
+	}
+}
+
+func onAccessTimer(rt rpc.Runtime, seq uint64) rpc.Return {
+	if expirer, e := getPeriodicTask(rt, "expirer"); e != nil {
+		return rt.Reply(e)
+	} else if retention, e := getPeriodicTask(rt, "retention"); e != nil {
+		return rt.Reply(e)
+	} else {
+		expirer.OnTimer(accessCheckInterval)
+		retention.OnTimer(accessTrimInterval)
+	}
+
+	return rt.Reply(nil)
+}
+
+func dbSetAccessPolicy(db *core.DB, bucket string, id string, policy *accessPolicy) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if b.Get(core.DBKey("servers.%s", id)) == nil {
+			return fmt.Errorf("server \"%s\" does not exist", id)
+		} else {
+			return dbPutJSON(b, core.DBKey("access.%s.policy", id), policy)
+		}
+	})
+}
+
+func setAccessPolicy(
+	rt rpc.Runtime, sessionID string, serverID string, jit bool, windows rpc.Array,
+) rpc.Return {
+	policy := &accessPolicy{JIT: jit, Windows: make([]*accessWindow, 0)}
+	for _, v := range windows {
+		window, ok := v.(rpc.Map)
+		if !ok {
+			return rt.Reply(fmt.Errorf("invalid window \"%v\"", v))
+		}
+
+		weekdays, _ := window["weekdays"].(rpc.Array)
+		from, _ := window["from"].(string)
+		to, _ := window["to"].(string)
+		if days, e := checkTimeWindow(weekdays, from, to); e != nil {
+			return rt.Reply(e)
+		} else {
+			policy.Windows = append(policy.Windows, &accessWindow{
+				Weekdays: days,
+				From:     from,
+				To:       to,
+			})
+		}
+	}
+
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := dbSetAccessPolicy(db, bucket, serverID, policy); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(true)
+	}
+}
+
+func dbGetAccessPolicyMap(db *core.DB, bucket string, id string) (rpc.Map, error) {
+	ret := rpc.Map{}
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if b.Get(core.DBKey("servers.%s", id)) == nil {
+			return fmt.Errorf("server \"%s\" does not exist", id)
+		} else {
+			ret = toMap(dbGetAccessPolicy(b, id))
+			return nil
+		}
+	})
+}
+
+func getAccessPolicy(rt rpc.Runtime, sessionID string, serverID string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if ret, e := dbGetAccessPolicyMap(db, bucket, serverID); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(ret)
+	}
+}
+
+func dbCreateAccessRequest(
+	db *core.DB, bucket string, user string, target string, duration time.Duration, reason string, now time.Time,
+) (string, error) {
+	if duration <= 0 || duration > accessMaxDuration {
+		return "", fmt.Errorf("invalid duration %s", duration)
+	} else if reason == "" {
+		return "", fmt.Errorf("reason is empty")
+	} else if _, e := dbResolveServers(db, bucket, []string{target}); e != nil {
+		return "", e
+	}
+
+	ret := ""
+	return ret, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if seq, e := b.NextSequence(); e != nil {
+			return e
+		} else {
+			ret = strconv.FormatUint(seq, 10)
+			return dbPutJSON(b, formatAccessRequestKey(ret), &accessRequest{
+				ID:        ret,
+				User:      user,
+				Target:    target,
+				Duration:  int64(duration / time.Second),
+				Reason:    reason,
+				State:     "pending",
+				CreatedAt: getMillisecond(now),
+			})
+		}
+	})
+}
+
+func requestAccess(
+	rt rpc.Runtime, sessionID string, target string, duration int64, reason string,
+) rpc.Return {
+	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if id, e := dbCreateAccessRequest(
+		db, bucket, userName, target, time.Duration(duration)*time.Second, reason, time.Now(),
+	); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(id)
+	}
+}
+
+// dbDecideAccessRequest moves the request from one of the states in from to
+// the state, the approver can not decide the own request
+func dbDecideAccessRequest(
+	db *core.DB, bucket string, id string, approver string, comment string,
+	from []string, state string, now time.Time,
+) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+
+		request := &accessRequest{}
+		if data := b.Get(formatAccessRequestKey(id)); data == nil {
+			return fmt.Errorf("access request \"%s\" does not exist", id)
+		} else if e := json.Unmarshal(data, request); e != nil {
+			return e
+		} else if request.User == approver {
+			return fmt.Errorf("access request \"%s\" can not be decided by its requester", id)
+		}
+
+		found := false
+		for _, v := range from {
+			found = found || request.State == v
+		}
+		if !found {
+			return fmt.Errorf("access request \"%s\" is %s", id, request.State)
+		}
+
+		request.State = state
+		request.Approver = approver
+		request.Comment = comment
+		request.DecidedAt = getMillisecond(now)
+		if state == "granted" {
+			request.ExpiresAt = getMillisecond(now.Add(time.Duration(request.Duration) * time.Second))
+		}
+		return dbPutAccessRequest(b, request)
+	})
+}
+
+func decideAccess(
+	rt rpc.Runtime, sessionID string, id string, comment string, from []string, state string,
+) rpc.Return {
+	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := dbDecideAccessRequest(
+		db, bucket, id, userName, comment, from, state, time.Now(),
+	); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(true)
+	}
+}
+
+func grantAccess(rt rpc.Runtime, sessionID string, id string, comment string) rpc.Return {
+	return decideAccess(rt, sessionID, id, comment, []string{"pending"}, "granted")
+}
+
+func denyAccess(rt rpc.Runtime, sessionID string, id string, comment string) rpc.Return {
+	return decideAccess(rt, sessionID, id, comment, []string{"pending"}, "denied")
+}
+
+// revokeAccess ends a grant before it expires, the open sessions are closed
+// by the next run of the expirer
+func revokeAccess(rt rpc.Runtime, sessionID string, id string, comment string) rpc.Return {
+	return decideAccess(rt, sessionID, id, comment, []string{"granted"}, "revoked")
+}
+
+func dbListAccessRequests(db *core.DB, bucket string, state string) (rpc.Array, error) {
+	ret := rpc.Array{}
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+
+		c := b.Cursor()
+		p := []byte("accessRequest.")
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if item := jsonToMap(v); item != nil && (state == "" || item["state"] == state) {
+				ret = append(ret, item)
+			}
+		}
+		return nil
+	})
+}
+
+func listAccessRequests(rt rpc.Runtime, sessionID string, state string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if ret, e := dbListAccessRequests(db, bucket, state); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(ret)
+	}
+}
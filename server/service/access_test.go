@@ -0,0 +1,116 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestDBCheckServerAccess(t *testing.T) {
+	newTestDB := func() *core.DB {
+		db, _ := core.NewDB("test.db")
+		_ = db.CreateBucketIsNotExist("-test")
+		_ = dbCreateServer(db, "-test", "1", "10.0.0.1", "22", "root", "", "", "web", "")
+		_ = dbCreateServer(db, "-test", "2", "10.0.0.2", "22", "root", "", "", "db", "")
+		_ = dbCreateGroup(db, "-test", "web", "name:web")
+		return db
+	}
+
+	t.Run("time windows", func(t *testing.T) {
+		assert := assert.New(t)
+		db := newTestDB()
+		defer func() {
+			os.Remove("test.db")
+		}()
+
+		now, _ := time.ParseInLocation("2006-01-02 15:04", "2023-11-14 10:00", time.Local)
+		assert(dbCheckServerAccess(db, "-test", "1", "alice", now)).IsNil()
+		assert(dbSetAccessPolicy(db, "-test", "1", &accessPolicy{
+			Windows: []*accessWindow{{From: "09:00", To: "18:00", Weekdays: []int{1, 2, 3, 4, 5}}},
+		})).IsNil()
+		assert(dbCheckServerAccess(db, "-test", "1", "alice", now)).IsNil()
+		assert(dbCheckServerAccess(db, "-test", "1", "alice", now.Add(9*time.Hour))).
+			Equals(errors.New("server \"1\" is not accessible at this time"))
+		assert(dbCheckServerAccess(db, "-test", "3", "alice", now)).
+			Equals(errors.New("server \"3\" does not exist"))
+	})
+
+	t.Run("grants", func(t *testing.T) {
+		assert := assert.New(t)
+		db := newTestDB()
+		defer func() {
+			os.Remove("test.db")
+		}()
+
+		now := time.Unix(1700000000, 0)
+		_ = dbSetAccessPolicy(db, "-test", "1", &accessPolicy{JIT: true})
+		_ = dbSetAccessPolicy(db, "-test", "2", &accessPolicy{JIT: true})
+		needGrant := errors.New("access to server \"1\" needs to be granted")
+		assert(dbCheckServerAccess(db, "-test", "1", "alice", now)).Equals(needGrant)
+
+		assert(dbCreateAccessRequest(db, "-test", "alice", "@web", 0, "fix", now)).
+			Equals("", errors.New("invalid duration 0s"))
+		assert(dbCreateAccessRequest(db, "-test", "alice", "@web", time.Hour, "", now)).
+			Equals("", errors.New("reason is empty"))
+		id, e := dbCreateAccessRequest(db, "-test", "alice", "@web", time.Hour, "fix", now)
+		assert(e).IsNil()
+		assert(dbCheckServerAccess(db, "-test", "1", "alice", now)).Equals(needGrant)
+
+		assert(dbDecideAccessRequest(db, "-test", id, "alice", "", []string{"pending"}, "granted", now)).
+			Equals(errors.New("access request \"1\" can not be decided by its requester"))
+		assert(dbDecideAccessRequest(db, "-test", id, "bob", "ok", []string{"pending"}, "granted", now)).
+			IsNil()
+		assert(dbDecideAccessRequest(db, "-test", id, "bob", "", []string{"pending"}, "denied", now)).
+			Equals(errors.New("access request \"1\" is granted"))
+
+		assert(dbCheckServerAccess(db, "-test", "1", "alice", now)).IsNil()
+		assert(dbCheckServerAccess(db, "-test", "1", "bob", now)).Equals(needGrant)
+		assert(dbCheckServerAccess(db, "-test", "2", "alice", now)).
+			Equals(errors.New("access to server \"2\" needs to be granted"))
+
+		assert(dbExpireAccessGrants(db, "-test", now.Add(59*time.Minute))).Equals(0, nil)
+		assert(dbExpireAccessGrants(db, "-test", now.Add(time.Hour))).Equals(1, nil)
+		assert(dbCheckServerAccess(db, "-test", "1", "alice", now)).Equals(needGrant)
+
+		requests, _ := dbListAccessRequests(db, "-test", "expired")
+		assert(len(requests)).Equals(1)
+		assert(dbExpireAccessGrants(db, "-test", now.Add(2*time.Hour))).Equals(0, nil)
+
+		id, _ = dbCreateAccessRequest(db, "-test", "alice", "1", time.Hour, "fix", now)
+		_ = dbDecideAccessRequest(db, "-test", id, "bob", "", []string{"pending"}, "granted", now)
+		assert(dbCheckServerAccess(db, "-test", "1", "alice", now)).IsNil()
+		assert(dbDecideAccessRequest(db, "-test", id, "bob", "", []string{"granted"}, "revoked", now)).
+			IsNil()
+		assert(dbCheckServerAccess(db, "-test", "1", "alice", now)).Equals(needGrant)
+		assert(dbExpireAccessGrants(db, "-test", now.Add(2*time.Hour))).Equals(0, nil)
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		assert := assert.New(t)
+		db := newTestDB()
+		defer func() {
+			os.Remove("test.db")
+		}()
+
+		now := time.Unix(1700000000, 0)
+		for _, state := range []string{"pending", "granted", "denied"} {
+			id, _ := dbCreateAccessRequest(db, "-test", "alice", "1", time.Hour, "fix", now)
+			if state != "pending" {
+				_ = dbDecideAccessRequest(db, "-test", id, "bob", "", []string{"pending"}, state, now)
+			}
+		}
+		assert(dbTrimAccessRequests(db, "-test", now)).Equals(0, nil)
+		assert(dbTrimAccessRequests(db, "-test", now.Add(time.Minute))).Equals(1, nil)
+		_, _ = dbExpireAccessGrants(db, "-test", now.Add(time.Hour))
+		assert(dbTrimAccessRequests(db, "-test", now.Add(time.Hour))).Equals(0, nil)
+		assert(dbTrimAccessRequests(db, "-test", now.Add(2*time.Hour))).Equals(1, nil)
+
+		requests, _ := dbListAccessRequests(db, "-test", "")
+		assert(len(requests), requests[0].(rpc.Map)["state"]).Equals(1, "pending")
+	})
+}
@@ -0,0 +1,903 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+const alertEventRetention = 30 * 24 * time.Hour
+
+var AlertService = rpc.NewService(rpc.Map{
+	"evaluator": NewPeriodicTask(runAlertEvaluation),
+	"retention": NewPeriodicTask(runNotificationRetention),
+}).
+	On("$onTimer", onAlertTimer).
+	On("CreateRule", createAlertRule).
+	On("ListRules", listAlertRules).
+	On("DeleteRule", deleteAlertRule).
+	On("CreateChannel", createAlertChannel).
+	On("ListChannels", listAlertChannels).
+	On("DeleteChannel", deleteAlertChannel).
+	On("TestChannel", testAlertChannel).
+	On("CreateSilence", createAlertSilence).
+	On("CreateMaintenance", createAlertMaintenance).
+	On("ListSilences", listAlertSilences).
+	On("DeleteSilence", deleteAlertSilence).
+	On("List", listAlerts).
+	On("Events", listAlertEvents).
+	On("Notifications", listNotifications)
+
+// alertCondition is parsed from expressions like "disk > 90% for 10m" or
+// "unreachable for 3 checks"
+type alertCondition struct {
+	field     string
+	op        string
+	threshold float64
+	duration  time.Duration
+	checks    int
+}
+
+func parseAlertCondition(expr string) (*alertCondition, error) {
+	tokens := strings.Fields(expr)
+	if len(tokens) == 4 && tokens[0] == "unreachable" && tokens[1] == "for" &&
+		(tokens[3] == "checks" || tokens[3] == "check") {
+		if checks, e := strconv.Atoi(tokens[2]); e != nil || checks <= 0 {
+			return nil, fmt.Errorf("invalid number of checks \"%s\"", tokens[2])
+		} else {
+			return &alertCondition{field: "unreachable", checks: checks}, nil
+		}
+	}
+
+	// the disk metric is collected for the root mount point
+	if len(tokens) > 1 && tokens[0] == "disk" && tokens[1] == "/" {
+		tokens = append(tokens[:1], tokens[2:]...)
+	}
+
+	if len(tokens) != 3 && len(tokens) != 5 {
+		return nil, fmt.Errorf("invalid condition \"%s\"", expr)
+	}
+
+	ret := &alertCondition{field: tokens[0], op: tokens[1]}
+	if getMetricFieldIndex(ret.field) < 0 {
+		return nil, fmt.Errorf("unknown metric \"%s\"", ret.field)
+	}
+
+	switch ret.op {
+	case ">", ">=", "<", "<=":
+	default:
+		return nil, fmt.Errorf("unknown operator \"%s\"", ret.op)
+	}
+
+	threshold, e := strconv.ParseFloat(strings.TrimSuffix(tokens[2], "%"), 64)
+	if e != nil {
+		return nil, fmt.Errorf("invalid threshold \"%s\"", tokens[2])
+	}
+	ret.threshold = threshold
+
+	if len(tokens) == 5 {
+		if tokens[3] != "for" {
+			return nil, fmt.Errorf("invalid condition \"%s\"", expr)
+		} else if ret.duration, e = time.ParseDuration(tokens[4]); e != nil {
+			return nil, fmt.Errorf("invalid duration \"%s\"", tokens[4])
+		}
+	}
+
+	return ret, nil
+}
+
+func (p *alertCondition) isMatch(value float64) bool {
+	switch p.op {
+	case ">":
+		return value > p.threshold
+	case ">=":
+		return value >= p.threshold
+	case "<":
+		return value < p.threshold
+	default:
+		return value <= p.threshold
+	}
+}
+
+func getMetricFieldIndex(field string) int {
+	for i, v := range metricFields {
+		if v == field {
+			return i
+		}
+	}
+	return -1
+}
+
+type alertRule struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Target    string   `json:"target"`
+	Condition string   `json:"condition"`
+	Channels  []string `json:"channels"`
+}
+
+type alertChannel struct {
+	Name   string            `json:"name"`
+	Kind   string            `json:"kind"`
+	Config map[string]string `json:"config"`
+}
+
+// alertSilence suppresses the notifications of the matched alerts. A silence
+// is active between Start and End (unix milliseconds). A maintenance window
+// has From and To ("HH:MM") and is active on the Weekdays (0 is Sunday, all
+// the days if empty) every week.
+type alertSilence struct {
+	ID       string `json:"id"`
+	RuleID   string `json:"ruleID"`
+	Target   string `json:"target"`
+	Start    int64  `json:"start"`
+	End      int64  `json:"end"`
+	Weekdays []int  `json:"weekdays"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Comment  string `json:"comment"`
+}
+
+func (p *alertSilence) isActive(t time.Time) bool {
+	if p.From == "" {
+		ms := t.UnixNano() / int64(time.Millisecond)
+		return p.Start <= ms && ms < p.End
+	}
+
+	return isInTimeWindow(p.Weekdays, p.From, p.To, t)
+}
+
+// isInTimeWindow reports whether t is between from and to ("HH:MM") on one
+// of the weekdays (0 is Sunday, all the days if empty). A window that passes
+// midnight belongs to the weekday it starts on.
+// checkTimeWindow validates the window and returns the weekdays
+func checkTimeWindow(weekdays rpc.Array, from string, to string) ([]int, error) {
+	days := make([]int, 0, len(weekdays))
+	for _, v := range weekdays {
+		if day, ok := v.(int64); !ok || day < 0 || day > 6 {
+			return nil, fmt.Errorf("invalid weekday \"%v\"", v)
+		} else {
+			days = append(days, int(day))
+		}
+	}
+
+	if _, e := time.Parse("15:04", from); e != nil {
+		return nil, fmt.Errorf("invalid time \"%s\"", from)
+	} else if _, e := time.Parse("15:04", to); e != nil {
+		return nil, fmt.Errorf("invalid time \"%s\"", to)
+	} else {
+		return days, nil
+	}
+}
+
+func isInTimeWindow(weekdays []int, from string, to string, t time.Time) bool {
+	clock := t.Format("15:04")
+	weekday, inWindow := t.Weekday(), false
+	if from <= to {
+		inWindow = from <= clock && clock < to
+	} else if clock >= from {
+		inWindow = true
+	} else if clock < to {
+		inWindow, weekday = true, t.Add(-24*time.Hour).Weekday()
+	}
+
+	if !inWindow {
+		return false
+	} else if len(weekdays) == 0 {
+		return true
+	}
+
+	for _, v := range weekdays {
+		if time.Weekday(v) == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+type alertState struct {
+	State string  `json:"state"`
+	Since int64   `json:"since"`
+	Value float64 `json:"value"`
+}
+
+type alertEvent struct {
+	RuleID     string  `json:"ruleID"`
+	RuleName   string  `json:"ruleName"`
+	ServerID   string  `json:"serverID"`
+	ServerName string  `json:"serverName"`
+	State      string  `json:"state"`
+	Value      float64 `json:"value"`
+	Time       int64   `json:"time"`
+	Silenced   bool    `json:"silenced"`
+}
+
+func dbPutJSON(b *bolt.Bucket, key []byte, v interface{}) error {
+	if data, e := json.Marshal(v); e != nil {
+		return e
+	} else {
+		return b.Put(key, data)
+	}
+}
+
+func dbListJSON(b *bolt.Bucket, prefix string, fn func(data []byte) error) error {
+	c := b.Cursor()
+	p := []byte(prefix)
+	for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+		if e := fn(v); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func toMap(v interface{}) rpc.Map {
+	ret := rpc.Map{}
+	data, _ := json.Marshal(v)
+	_ = json.Unmarshal(data, &ret)
+	return ret
+}
+
+func toStringList(arr rpc.Array) ([]string, error) {
+	ret := make([]string, 0, len(arr))
+	for _, v := range arr {
+		if s, ok := v.(string); !ok {
+			return nil, fmt.Errorf("\"%v\" is not a string", v)
+		} else {
+			ret = append(ret, s)
+		}
+	}
+	return ret, nil
+}
+
+// getAlertValue returns the current value of the condition and whether the
+// value is available
+func getAlertValue(b *bolt.Bucket, id string, cond *alertCondition, now time.Time) (float64, bool) {
+	c := b.Cursor()
+	if cond.field == "unreachable" {
+		prefix := core.DBKey("health.%s.history.", id)
+		failed := 0
+		c.Seek(append(append([]byte{}, prefix...), 0xFF))
+		for k, v := c.Prev(); k != nil && bytes.HasPrefix(k, prefix) && failed < cond.checks; k, v = c.Prev() {
+			if strings.HasPrefix(string(v), "true,") {
+				break
+			}
+			failed++
+		}
+		return float64(failed), true
+	}
+
+	prefix := core.DBKey("metric.%s.raw.", id)
+	c.Seek(append(append([]byte{}, prefix...), 0xFF))
+	k, v := c.Prev()
+	if k == nil || !bytes.HasPrefix(k, prefix) {
+		return 0, false
+	}
+
+	// the latest sample is too old to tell the current state
+	t, _ := strconv.ParseInt(string(k[len(prefix):]), 10, 64)
+	if now.Unix()-t > int64(3*core.GetConfig().GetMetricsInterval()/time.Second) {
+		return 0, false
+	}
+
+	_, values := decodeMetricPoint(v)
+	if idx := getMetricFieldIndex(cond.field); idx < len(values) {
+		return values[idx], true
+	}
+	return 0, false
+}
+
+// nextAlertState moves the state machine of a rule on a server, it returns
+// the new state (nil if the alert is inactive) and the event to publish
+func nextAlertState(
+	old *alertState, cond *alertCondition, value float64, ok bool, now time.Time,
+) (*alertState, string) {
+	ms := now.UnixNano() / int64(time.Millisecond)
+	isMatch := ok && cond.isMatch(value)
+	if cond.field == "unreachable" {
+		isMatch = ok && value >= float64(cond.checks)
+	}
+
+	switch {
+	case !isMatch && old != nil && old.State == "firing":
+		return nil, "resolved"
+	case !isMatch:
+		return nil, ""
+	case old == nil && cond.duration > 0:
+		return &alertState{State: "pending", Since: ms, Value: value}, ""
+	case old == nil:
+		return &alertState{State: "firing", Since: ms, Value: value}, "firing"
+	case old.State == "pending" && ms-old.Since >= cond.duration.Milliseconds():
+		return &alertState{State: "firing", Since: ms, Value: value}, "firing"
+	default:
+		return &alertState{State: old.State, Since: old.Since, Value: value}, ""
+	}
+}
+
+func dbIsAlertSilenced(
+	db *core.DB, bucket string, silences []*alertSilence, ruleID string, serverID string, now time.Time,
+) bool {
+	for _, silence := range silences {
+		if silence.RuleID != "" && silence.RuleID != ruleID {
+			continue
+		} else if !silence.isActive(now) {
+			continue
+		} else if silence.Target == "" || silence.Target == serverID {
+			return true
+		} else if ids, e := dbResolveServers(db, bucket, []string{silence.Target}); e == nil {
+			for _, id := range ids {
+				if id == serverID {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// dbDeleteAlertStates deletes the states of the rule except the ones of the
+// servers in keep
+func dbDeleteAlertStates(b *bolt.Bucket, ruleID string, keep map[string]bool) error {
+	keys := make([][]byte, 0)
+	c := b.Cursor()
+	p := core.DBKey("alertState.%s.", ruleID)
+	for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+		if !keep[string(k[len(p):])] {
+			keys = append(keys, append([]byte{}, k...))
+		}
+	}
+
+	for _, k := range keys {
+		if e := b.Delete(k); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func dbEvaluateAlerts(db *core.DB, bucket string, now time.Time) ([]*alertEvent, error) {
+	rules := make([]*alertRule, 0)
+	silences := make([]*alertSilence, 0)
+	if e := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if e := dbListJSON(b, "alertRule.", func(data []byte) error {
+			rule := &alertRule{}
+			rules = append(rules, rule)
+			return json.Unmarshal(data, rule)
+		}); e != nil {
+			return e
+		} else {
+			return dbListJSON(b, "alertSilence.", func(data []byte) error {
+				silence := &alertSilence{}
+				silences = append(silences, silence)
+				return json.Unmarshal(data, silence)
+			})
+		}
+	}); e != nil {
+		return nil, e
+	}
+
+	events := make([]*alertEvent, 0)
+	for _, rule := range rules {
+		cond, e := parseAlertCondition(rule.Condition)
+		if e != nil {
+			continue
+		}
+		ids, e := dbResolveServers(db, bucket, []string{rule.Target})
+		if e != nil {
+			continue
+		}
+
+		if e := db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucket))
+			if b.Get(core.DBKey("alertRule.%s", rule.ID)) == nil {
+				// the rule has been deleted
+				return nil
+			}
+
+			// the servers have been deleted or have left the group
+			keep := make(map[string]bool)
+			for _, id := range ids {
+				keep[id] = true
+			}
+			if e := dbDeleteAlertStates(b, rule.ID, keep); e != nil {
+				return e
+			}
+
+			for _, id := range ids {
+				key := core.DBKey("alertState.%s.%s", rule.ID, id)
+				var old *alertState
+				if data := b.Get(key); data != nil {
+					old = &alertState{}
+					_ = json.Unmarshal(data, old)
+				}
+
+				value, ok := getAlertValue(b, id, cond, now)
+				state, kind := nextAlertState(old, cond, value, ok, now)
+				if state == nil {
+					if e := b.Delete(key); e != nil {
+						return e
+					}
+				} else if e := dbPutJSON(b, key, state); e != nil {
+					return e
+				}
+
+				if kind != "" {
+					events = append(events, &alertEvent{
+						RuleID:     rule.ID,
+						RuleName:   rule.Name,
+						ServerID:   id,
+						ServerName: string(b.Get(core.DBKey("ssh.%s.name", id))),
+						State:      kind,
+						Value:      value,
+						Time:       now.UnixNano() / int64(time.Millisecond),
+					})
+				}
+			}
+			return nil
+		}); e != nil {
+			return nil, e
+		}
+	}
+
+	for _, event := range events {
+		event.Silenced = dbIsAlertSilenced(db, bucket, silences, event.RuleID, event.ServerID, now)
+	}
+
+	return events, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		for i, event := range events {
+			key := core.DBKey("alertEvent.%020d.%04d", now.UnixNano(), i)
+			if e := dbPutJSON(b, key, event); e != nil {
+				return e
+			}
+		}
+
+		c := b.Cursor()
+		prefix := []byte("alertEvent.")
+		end := core.DBKey("alertEvent.%020d", now.Add(-alertEventRetention).UnixNano())
+		for k, _ := c.Seek(prefix); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Seek(prefix) {
+			if e := b.Delete(k); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+func dbGetAlertChannel(db *core.DB, bucket string, name string) (*alertChannel, error) {
+	data, e := db.Get(bucket, fmt.Sprintf("alertChannel.%s", name))
+	if e != nil {
+		return nil, fmt.Errorf("channel \"%s\" does not exist", name)
+	}
+
+	ret := &alertChannel{}
+	return ret, json.Unmarshal(data, ret)
+}
+
+func sendNotification(db *core.DB, bucket string, channelName string, notification *Notification) error {
+	if channel, e := dbGetAlertChannel(db, bucket, channelName); e != nil {
+		return e
+	} else if notifier, e := newNotifier(channel.Kind, channel.Config); e != nil {
+		return e
+	} else {
+		return notifier.Notify(db, bucket, notification)
+	}
+}
+
+func dbNotifyAlertEvents(db *core.DB, bucket string, events []*alertEvent) {
+	for _, event := range events {
+		if event.Silenced {
+			continue
+		}
+
+		data, e := db.Get(bucket, fmt.Sprintf("alertRule.%s", event.RuleID))
+		rule := &alertRule{}
+		if e != nil || json.Unmarshal(data, rule) != nil {
+			continue
+		}
+
+		notification := &Notification{
+			Title: fmt.Sprintf(
+				"[%s] %s on %s", strings.ToUpper(event.State), event.RuleName, event.ServerName,
+			),
+			Message: fmt.Sprintf(
+				"rule \"%s\" (%s) is %s on server \"%s\", current value is %g",
+				rule.Name, rule.Condition, event.State, event.ServerName, event.Value,
+			),
+			State: event.State,
+			Time:  event.Time,
+		}
+		for _, channel := range rule.Channels {
+			_ = sendNotification(db, bucket, channel, notification)
+		}
+	}
+}
+
+// runAlertEvaluation evaluates the rules of all the users
+func runAlertEvaluation(db *core.DB) {
+	buckets, e := db.ListBuckets("-")
+	if e != nil {
+		return
+	}
+
+	for _, bucket := range buckets {
+		if events, e := dbEvaluateAlerts(db, bucket, time.Now()); e == nil {
+			dbNotifyAlertEvents(db, bucket, events)
+		}
+	}
+}
+
+func onAlertTimer(rt rpc.Runtime, seq uint64) rpc.Return {
+	if evaluator, e := getPeriodicTask(rt, "evaluator"); e != nil {
+		return rt.Reply(e)
+	} else if retention, e := getPeriodicTask(rt, "retention"); e != nil {
+		return rt.Reply(e)
+	} else {
+		evaluator.OnTimer(core.GetConfig().GetAlertInterval())
+		retention.OnTimer(notificationTrimInterval)
+	}
+
+	return rt.Reply(nil)
+}
+
+func dbCreateObject(db *core.DB, bucket string, prefix string, fn func(id string) interface{}) (string, error) {
+	ret := ""
+	return ret, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if seq, e := b.NextSequence(); e != nil {
+			return e
+		} else {
+			ret = fmt.Sprintf("%d", seq)
+			return dbPutJSON(b, core.DBKey("%s.%s", prefix, ret), fn(ret))
+		}
+	})
+}
+
+func dbListObjects(db *core.DB, bucket string, prefix string, fn func(data []byte) rpc.Map) (rpc.Array, error) {
+	ret := rpc.Array{}
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+		return dbListJSON(b, prefix+".", func(data []byte) error {
+			if v := fn(data); v != nil {
+				ret = append(ret, v)
+			}
+			return nil
+		})
+	})
+}
+
+func dbDeleteObject(db *core.DB, bucket string, prefix string, id string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+		return b.Delete(core.DBKey("%s.%s", prefix, id))
+	})
+}
+
+// dbDeleteAlertRule deletes the rule and its states
+func dbDeleteAlertRule(db *core.DB, bucket string, id string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if e := dbDeleteAlertStates(b, id, nil); e != nil {
+			return e
+		} else {
+			return b.Delete(core.DBKey("alertRule.%s", id))
+		}
+	})
+}
+
+func jsonToMap(data []byte) rpc.Map {
+	ret := rpc.Map{}
+	if json.Unmarshal(data, &ret) != nil {
+		return nil
+	}
+	return ret
+}
+
+func createAlertRule(
+	rt rpc.Runtime, sessionID string, name string, target string, condition string, channels rpc.Array,
+) rpc.Return {
+	if _, e := parseAlertCondition(condition); e != nil {
+		return rt.Reply(e)
+	} else if channelList, e := toStringList(channels); e != nil {
+		return rt.Reply(e)
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleOperator).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if _, e := dbResolveServers(db, bucket, []string{target}); e != nil {
+		return rt.Reply(e)
+	} else if id, e := dbCreateObject(db, bucket, "alertRule", func(id string) interface{} {
+		return &alertRule{
+			ID:        id,
+			Name:      name,
+			Target:    target,
+			Condition: condition,
+			Channels:  channelList,
+		}
+	}); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(id)
+	}
+}
+
+func listAlertRules(rt rpc.Runtime, sessionID string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if ret, e := dbListObjects(db, bucket, "alertRule", jsonToMap); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(ret)
+	}
+}
+
+func deleteAlertRule(rt rpc.Runtime, sessionID string, id string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleOperator).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := dbDeleteAlertRule(db, bucket, id); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(true)
+	}
+}
+
+func createAlertChannel(
+	rt rpc.Runtime, sessionID string, name string, kind string, config rpc.Map,
+) rpc.Return {
+	configMap := make(map[string]string)
+	for key, value := range config {
+		configMap[key] = fmt.Sprintf("%v", value)
+	}
+
+	if !groupNameRegex.MatchString(name) {
+		return rt.Reply(fmt.Errorf("invalid channel name \"%s\"", name))
+	} else if _, e := newNotifier(kind, configMap); e != nil {
+		return rt.Reply(e)
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+		return dbPutJSON(b, core.DBKey("alertChannel.%s", name), &alertChannel{
+			Name:   name,
+			Kind:   kind,
+			Config: configMap,
+		})
+	}); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(true)
+	}
+}
+
+func listAlertChannels(rt rpc.Runtime, sessionID string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if ret, e := dbListObjects(db, bucket, "alertChannel", func(data []byte) rpc.Map {
+		channel := &alertChannel{}
+		if json.Unmarshal(data, channel) != nil {
+			return nil
+		}
+		if _, ok := channel.Config["password"]; ok {
+			channel.Config["password"] = "******"
+		}
+		return toMap(channel)
+	}); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(ret)
+	}
+}
+
+func deleteAlertChannel(rt rpc.Runtime, sessionID string, name string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := dbDeleteObject(db, bucket, "alertChannel", name); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(true)
+	}
+}
+
+func testAlertChannel(rt rpc.Runtime, sessionID string, name string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := sendNotification(db, bucket, name, &Notification{
+		Title:   "vbot test notification",
+		Message: fmt.Sprintf("channel \"%s\" works", name),
+		State:   "test",
+		Time:    time.Now().UnixNano() / int64(time.Millisecond),
+	}); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(true)
+	}
+}
+
+func createAlertSilence(
+	rt rpc.Runtime, sessionID string, ruleID string, target string, start int64, end int64, comment string,
+) rpc.Return {
+	if end <= start {
+		return rt.Reply(fmt.Errorf("silence ends before it starts"))
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleOperator).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if id, e := dbCreateObject(db, bucket, "alertSilence", func(id string) interface{} {
+		return &alertSilence{
+			ID:      id,
+			RuleID:  ruleID,
+			Target:  target,
+			Start:   start,
+			End:     end,
+			Comment: comment,
+		}
+	}); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(id)
+	}
+}
+
+func createAlertMaintenance(
+	rt rpc.Runtime, sessionID string, target string, weekdays rpc.Array, from string, to string, comment string,
+) rpc.Return {
+	days, e := checkTimeWindow(weekdays, from, to)
+	if e != nil {
+		return rt.Reply(e)
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleOperator).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if id, e := dbCreateObject(db, bucket, "alertSilence", func(id string) interface{} {
+		return &alertSilence{
+			ID:       id,
+			Target:   target,
+			Weekdays: days,
+			From:     from,
+			To:       to,
+			Comment:  comment,
+		}
+	}); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(id)
+	}
+}
+
+func listAlertSilences(rt rpc.Runtime, sessionID string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if ret, e := dbListObjects(db, bucket, "alertSilence", jsonToMap); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(ret)
+	}
+}
+
+func deleteAlertSilence(rt rpc.Runtime, sessionID string, id string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleOperator).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := dbDeleteObject(db, bucket, "alertSilence", id); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(true)
+	}
+}
+
+func dbListAlerts(db *core.DB, bucket string) (rpc.Array, error) {
+	ret := rpc.Array{}
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+
+		c := b.Cursor()
+		p := []byte("alertState.")
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			ids := strings.SplitN(string(k[len(p):]), ".", 2)
+			if state := jsonToMap(v); state != nil && len(ids) == 2 {
+				state["ruleID"], state["serverID"] = ids[0], ids[1]
+				ret = append(ret, state)
+			}
+		}
+		return nil
+	})
+}
+
+func listAlerts(rt rpc.Runtime, sessionID string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if ret, e := dbListAlerts(db, bucket); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(ret)
+	}
+}
+
+// dbListSince returns the json values of the keys "<prefix>.<unix nano>..."
+// that are created since the time (unix milliseconds)
+func dbListSince(db *core.DB, bucket string, prefix string, since int64) (rpc.Array, error) {
+	ret := rpc.Array{}
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+
+		c := b.Cursor()
+		p := []byte(prefix + ".")
+		start := core.DBKey("%s.%020d", prefix, since*int64(time.Millisecond))
+		for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if item := jsonToMap(v); item != nil {
+				ret = append(ret, item)
+			}
+		}
+		return nil
+	})
+}
+
+func listAlertEvents(rt rpc.Runtime, sessionID string, since int64) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if ret, e := dbListSince(db, bucket, "alertEvent", since); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(ret)
+	}
+}
+
+func listNotifications(rt rpc.Runtime, sessionID string, since int64) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if ret, e := dbListSince(db, bucket, "notification", since); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(ret)
+	}
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestParseAlertCondition(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(parseAlertCondition("disk / > 90% for 10m")).Equals(&alertCondition{
+			field: "disk", op: ">", threshold: 90, duration: 10 * time.Minute,
+		}, nil)
+		assert(parseAlertCondition("load1 >= 4")).Equals(&alertCondition{
+			field: "load1", op: ">=", threshold: 4,
+		}, nil)
+		assert(parseAlertCondition("unreachable for 3 checks")).Equals(&alertCondition{
+			field: "unreachable", checks: 3,
+		}, nil)
+	})
+
+	t.Run("test error", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(parseAlertCondition("unreachable for 0 checks")).
+			Equals(nil, errors.New("invalid number of checks \"0\""))
+		assert(parseAlertCondition("swap > 10")).
+			Equals(nil, errors.New("unknown metric \"swap\""))
+		assert(parseAlertCondition("cpu == 10")).
+			Equals(nil, errors.New("unknown operator \"==\""))
+		assert(parseAlertCondition("cpu > high")).
+			Equals(nil, errors.New("invalid threshold \"high\""))
+		assert(parseAlertCondition("cpu > 10 for ever")).
+			Equals(nil, errors.New("invalid duration \"ever\""))
+		assert(parseAlertCondition("cpu > 10 since 1m")).
+			Equals(nil, errors.New("invalid condition \"cpu > 10 since 1m\""))
+	})
+}
+
+func TestAlertSilenceIsActive(t *testing.T) {
+	t.Run("silence", func(t *testing.T) {
+		assert := assert.New(t)
+		silence := &alertSilence{Start: 1000, End: 2000}
+		assert(silence.isActive(time.Unix(0, 999*int64(time.Millisecond)))).IsFalse()
+		assert(silence.isActive(time.Unix(1, 0))).IsTrue()
+		assert(silence.isActive(time.Unix(2, 0))).IsFalse()
+	})
+
+	t.Run("maintenance window", func(t *testing.T) {
+		assert := assert.New(t)
+		// 2023-11-14 is a Tuesday
+		tuesday := func(clock string) time.Time {
+			t, _ := time.ParseInLocation("2006-01-02 15:04", "2023-11-14 "+clock, time.Local)
+			return t
+		}
+		window := &alertSilence{From: "02:00", To: "04:00", Weekdays: []int{2}}
+		assert(window.isActive(tuesday("01:59"))).IsFalse()
+		assert(window.isActive(tuesday("02:00"))).IsTrue()
+		assert(window.isActive(tuesday("04:00"))).IsFalse()
+		assert(window.isActive(tuesday("02:00").Add(24 * time.Hour))).IsFalse()
+
+		// the window of monday night ends on tuesday
+		window = &alertSilence{From: "23:00", To: "01:00", Weekdays: []int{1}}
+		assert(window.isActive(tuesday("00:30"))).IsTrue()
+		assert(window.isActive(tuesday("23:30"))).IsFalse()
+		window.Weekdays = nil
+		assert(window.isActive(tuesday("23:30"))).IsTrue()
+	})
+}
+
+func TestDBEvaluateAlerts(t *testing.T) {
+	newTestDB := func() *core.DB {
+		db, _ := core.NewDB("test.db")
+		_ = db.CreateBucketIsNotExist("-test")
+		_ = dbCreateServer(db, "-test", "1", "10.0.0.1", "22", "root", "", "", "web", "")
+		_ = dbCreateServer(db, "-test", "2", "10.0.0.2", "22", "root", "", "", "db", "")
+		_ = dbCreateGroup(db, "-test", "all", "*")
+		return db
+	}
+	getStates := func(events []*alertEvent, e error) []string {
+		ret := make([]string, 0)
+		if e != nil {
+			return append(ret, e.Error())
+		}
+		for _, event := range events {
+			state := event.State
+			if event.Silenced {
+				state += "(silenced)"
+			}
+			ret = append(ret, event.ServerID+":"+state)
+		}
+		return ret
+	}
+
+	t.Run("metric rule", func(t *testing.T) {
+		assert := assert.New(t)
+		db := newTestDB()
+		defer func() {
+			os.Remove("test.db")
+		}()
+
+		ruleID, _ := dbCreateObject(db, "-test", "alertRule", func(id string) interface{} {
+			return &alertRule{ID: id, Name: "disk full", Target: "@all", Condition: "disk / > 90% for 10m"}
+		})
+
+		now := time.Unix(1700000000, 0)
+		save := func(id string, disk float64) {
+			_ = dbSaveMetricSample(db, "-test", id, now, []float64{0, 0, 0, 0, 0, disk, 0, 0})
+		}
+
+		save("1", 95)
+		save("2", 50)
+		assert(getStates(dbEvaluateAlerts(db, "-test", now))).Equals([]string{})
+		alerts, _ := dbListAlerts(db, "-test")
+		assert(len(alerts)).Equals(1)
+		assert(alerts[0].(rpc.Map)["state"], alerts[0].(rpc.Map)["serverID"]).Equals("pending", "1")
+
+		now = now.Add(10 * time.Minute)
+		save("1", 96)
+		save("2", 50)
+		assert(getStates(dbEvaluateAlerts(db, "-test", now))).Equals([]string{"1:firing"})
+		assert(getStates(dbEvaluateAlerts(db, "-test", now))).Equals([]string{})
+
+		// the samples are too old to tell the state
+		now = now.Add(time.Hour)
+		assert(getStates(dbEvaluateAlerts(db, "-test", now))).Equals([]string{"1:resolved"})
+		alerts, _ = dbListAlerts(db, "-test")
+		assert(len(alerts)).Equals(0)
+
+		// the states are deleted with the rule
+		save("1", 99)
+		_, _ = dbEvaluateAlerts(db, "-test", now)
+		assert(dbDeleteAlertRule(db, "-test", ruleID)).IsNil()
+		alerts, _ = dbListAlerts(db, "-test")
+		assert(len(alerts)).Equals(0)
+	})
+
+	t.Run("unreachable rule with silence", func(t *testing.T) {
+		assert := assert.New(t)
+		db := newTestDB()
+		defer func() {
+			os.Remove("test.db")
+		}()
+
+		_, _ = dbCreateObject(db, "-test", "alertRule", func(id string) interface{} {
+			return &alertRule{ID: id, Name: "down", Target: "@all", Condition: "unreachable for 2 checks"}
+		})
+		now := time.Unix(1700000000, 0)
+		_, _ = dbCreateObject(db, "-test", "alertSilence", func(id string) interface{} {
+			return &alertSilence{ID: id, Target: "2", Start: 0, End: now.Add(time.Hour).Unix() * 1000}
+		})
+
+		check := func(ok1 bool, ok2 bool) {
+			now = now.Add(time.Minute)
+			_ = dbSaveHealthResults(db, "-test", []*healthResult{
+				{id: "1", ok: ok1, time: now},
+				{id: "2", ok: ok2, time: now},
+			}, time.Hour)
+		}
+
+		check(false, false)
+		assert(getStates(dbEvaluateAlerts(db, "-test", now))).Equals([]string{})
+		check(false, false)
+		assert(getStates(dbEvaluateAlerts(db, "-test", now))).
+			Equals([]string{"1:firing", "2:firing(silenced)"})
+		check(true, false)
+		assert(getStates(dbEvaluateAlerts(db, "-test", now))).Equals([]string{"1:resolved"})
+
+		events, _ := dbListSince(db, "-test", "alertEvent", 0)
+		assert(len(events)).Equals(3)
+	})
+}
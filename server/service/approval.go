@@ -0,0 +1,362 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+const (
+	approvalCheckInterval  = 10 * time.Second
+	approvalDefaultTimeout = time.Hour
+)
+
+var ApprovalService = rpc.NewService(rpc.Map{
+	"expirer": NewPeriodicTask(runApprovalExpiration),
+}).
+	On("$onTimer", onApprovalTimer).
+	On("CreatePolicy", createApprovalPolicy).
+	On("ListPolicies", listApprovalPolicies).
+	On("DeletePolicy", deleteApprovalPolicy).
+	On("List", listApprovalRequests).
+	On("Approve", approveRequest).
+	On("Reject", rejectRequest)
+
+// approvalOperations run the operations after they have been approved, add
+// an item here to route a new kind of operation into the approval queue
+var approvalOperations = map[string]func(db *core.DB, bucket string, request *approvalRequest) (rpc.Array, error){
+	"exec": func(db *core.DB, bucket string, request *approvalRequest) (rpc.Array, error) {
+		return dbExecOnServers(db, bucket, request.User, request.Servers, request.Command)
+	},
+}
+
+// approvalPolicy requires the operations on the servers of the target to be
+// approved by another member that has the role. Pending requests expire
+// after the timeout (seconds).
+type approvalPolicy struct {
+	ID      string `json:"id"`
+	Target  string `json:"target"`
+	Role    string `json:"role"`
+	Timeout int64  `json:"timeout"`
+}
+
+// approvalRequest keeps the servers that the targets have been resolved to
+// when it was created, the operation runs on them even if the groups have
+// changed meanwhile.
+type approvalRequest struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Operation string    `json:"operation"`
+	Targets   []string  `json:"targets"`
+	Servers   []string  `json:"servers"`
+	Command   string    `json:"command"`
+	Role      string    `json:"role"`
+	State     string    `json:"state"`
+	CreatedAt int64     `json:"createdAt"`
+	ExpiresAt int64     `json:"expiresAt"`
+	Approver  string    `json:"approver"`
+	Comment   string    `json:"comment"`
+	DecidedAt int64     `json:"decidedAt"`
+	Results   []rpc.Map `json:"results"`
+	Error     string    `json:"error"`
+}
+
+func formatApprovalRequestKey(id string) []byte {
+	seq, _ := strconv.ParseUint(id, 10, 64)
+	return core.DBKey("approvalRequest.%020d", seq)
+}
+
+// dbMatchApprovalPolicy returns the policy that applies to the servers, the
+// policies that share a server are merged into the strictest one. It returns
+// nil if no approval is needed.
+func dbMatchApprovalPolicy(db *core.DB, bucket string, ids []string) (*approvalPolicy, error) {
+	policies := make([]*approvalPolicy, 0)
+	if e := db.View(func(tx *bolt.Tx) error {
+		return dbListJSON(tx.Bucket([]byte(bucket)), "approvalPolicy.", func(data []byte) error {
+			policy := &approvalPolicy{}
+			policies = append(policies, policy)
+			return json.Unmarshal(data, policy)
+		})
+	}); e != nil {
+		return nil, e
+	}
+
+	targetIDs := make(map[string]bool)
+	for _, id := range ids {
+		targetIDs[id] = true
+	}
+
+	var ret *approvalPolicy
+	for _, policy := range policies {
+		// a policy of a deleted server or group matches nothing
+		policyIDs, _ := dbResolveServers(db, bucket, []string{policy.Target})
+		for _, id := range policyIDs {
+			if !targetIDs[id] {
+				continue
+			}
+
+			if ret == nil {
+				ret = &approvalPolicy{Role: policy.Role, Timeout: policy.Timeout}
+			} else {
+				if roleLevels[policy.Role] > roleLevels[ret.Role] {
+					ret.Role = policy.Role
+				}
+				if policy.Timeout < ret.Timeout {
+					ret.Timeout = policy.Timeout
+				}
+			}
+			break
+		}
+	}
+	return ret, nil
+}
+
+func dbCreateApprovalRequest(
+	db *core.DB, bucket string, user string, operation string, targets []string, servers []string,
+	command string, policy *approvalPolicy, now time.Time,
+) (string, error) {
+	ret := ""
+	return ret, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if seq, e := b.NextSequence(); e != nil {
+			return e
+		} else {
+			ret = strconv.FormatUint(seq, 10)
+			return dbPutJSON(b, formatApprovalRequestKey(ret), &approvalRequest{
+				ID:        ret,
+				User:      user,
+				Operation: operation,
+				Targets:   targets,
+				Servers:   servers,
+				Command:   command,
+				Role:      policy.Role,
+				State:     "pending",
+				CreatedAt: getMillisecond(now),
+				ExpiresAt: getMillisecond(now.Add(time.Duration(policy.Timeout) * time.Second)),
+			})
+		}
+	})
+}
+
+func dbGetApprovalRequest(db *core.DB, bucket string, id string) (*approvalRequest, error) {
+	ret := &approvalRequest{}
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if data := b.Get(formatApprovalRequestKey(id)); data == nil {
+			return fmt.Errorf("approval request \"%s\" does not exist", id)
+		} else {
+			return json.Unmarshal(data, ret)
+		}
+	})
+}
+
+// dbDecideApprovalRequest approves or rejects the pending request. An
+// approved operation runs immediately and its results are recorded in the
+// request.
+func dbDecideApprovalRequest(
+	db *core.DB, bucket string, id string, approver string, comment string, approve bool, now time.Time,
+) (*approvalRequest, error) {
+	request, e := dbGetApprovalRequest(db, bucket, id)
+	if e != nil {
+		return nil, e
+	} else if e := dbCheckWorkspaceRole(db, bucket[1:], approver, request.Role); e != nil {
+		return nil, e
+	}
+
+	// the decision is recorded before the operation starts, so that the
+	// request can not be decided twice
+	if e := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if e := json.Unmarshal(b.Get(formatApprovalRequestKey(id)), request); e != nil {
+			return e
+		} else if request.State != "pending" {
+			return fmt.Errorf("approval request \"%s\" is %s", id, request.State)
+		} else if request.ExpiresAt <= getMillisecond(now) {
+			return fmt.Errorf("approval request \"%s\" has expired", id)
+		} else if request.User == approver {
+			return fmt.Errorf("approval request \"%s\" can not be decided by its requester", id)
+		}
+
+		request.State = "rejected"
+		if approve {
+			request.State = "approved"
+		}
+		request.Approver = approver
+		request.Comment = comment
+		request.DecidedAt = getMillisecond(now)
+		return dbPutJSON(b, formatApprovalRequestKey(id), request)
+	}); e != nil {
+		return nil, e
+	} else if !approve {
+		return request, nil
+	}
+
+	request.State = "done"
+	if fn, ok := approvalOperations[request.Operation]; !ok {
+		request.State, request.Error = "failed", fmt.Sprintf("unknown operation \"%s\"", request.Operation)
+	} else if results, e := fn(db, bucket, request); e != nil {
+		request.State, request.Error = "failed", e.Error()
+	} else {
+		request.Results = make([]rpc.Map, 0, len(results))
+		for _, v := range results {
+			request.Results = append(request.Results, v.(rpc.Map))
+		}
+	}
+	return request, db.Update(func(tx *bolt.Tx) error {
+		return dbPutJSON(tx.Bucket([]byte(bucket)), formatApprovalRequestKey(id), request)
+	})
+}
+
+func decideApprovalRequest(
+	rt rpc.Runtime, sessionID string, id string, comment string, approve bool,
+) rpc.Return {
+	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if request, e := dbDecideApprovalRequest(
+		db, bucket, id, userName, comment, approve, time.Now(),
+	); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(toMap(request))
+	}
+}
+
+func approveRequest(rt rpc.Runtime, sessionID string, id string, comment string) rpc.Return {
+	return decideApprovalRequest(rt, sessionID, id, comment, true)
+}
+
+func rejectRequest(rt rpc.Runtime, sessionID string, id string, comment string) rpc.Return {
+	return decideApprovalRequest(rt, sessionID, id, comment, false)
+}
+
+func dbExpireApprovalRequests(db *core.DB, bucket string, now time.Time) (int, error) {
+	ret := 0
+	return ret, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+
+		expired := make([]*approvalRequest, 0)
+		if e := dbListJSON(b, "approvalRequest.", func(data []byte) error {
+			request := &approvalRequest{}
+			if e := json.Unmarshal(data, request); e != nil {
+				return e
+			}
+			if request.State == "pending" && request.ExpiresAt <= getMillisecond(now) {
+				expired = append(expired, request)
+			}
+			return nil
+		}); e != nil {
+			return e
+		}
+
+		for _, request := range expired {
+			request.State = "expired"
+			if e := dbPutJSON(b, formatApprovalRequestKey(request.ID), request); e != nil {
+				return e
+			}
+		}
+		ret = len(expired)
+		return nil
+	})
+}
+
+func runApprovalExpiration(db *core.DB) {
+	buckets, e := db.ListBuckets("-")
+	if e != nil {
+		return
+	}
+
+	for _, bucket := range buckets {
+		_, _ = dbExpireApprovalRequests(db, bucket, time.Now())
+	}
+}
+
+func onApprovalTimer(rt rpc.Runtime, seq uint64) rpc.Return {
+	if expirer, e := getPeriodicTask(rt, "expirer"); e != nil {
+		return rt.Reply(e)
+	} else {
+		expirer.OnTimer(approvalCheckInterval)
+	}
+
+	return rt.Reply(nil)
+}
+
+func listApprovalRequests(rt rpc.Runtime, sessionID string, state string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if ret, e := dbListObjects(db, bucket, "approvalRequest", func(data []byte) rpc.Map {
+		if item := jsonToMap(data); item != nil && (state == "" || item["state"] == state) {
+			return item
+		}
+		return nil
+	}); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(ret)
+	}
+}
+
+func createApprovalPolicy(
+	rt rpc.Runtime, sessionID string, target string, role string, timeout int64,
+) rpc.Return {
+	if timeout <= 0 {
+		timeout = int64(approvalDefaultTimeout / time.Second)
+	}
+
+	if _, ok := roleLevels[role]; !ok {
+		return rt.Reply(fmt.Errorf("unknown role \"%s\"", role))
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if _, e := dbResolveServers(db, bucket, []string{target}); e != nil {
+		return rt.Reply(e)
+	} else if id, e := dbCreateObject(db, bucket, "approvalPolicy", func(id string) interface{} {
+		return &approvalPolicy{ID: id, Target: target, Role: role, Timeout: timeout}
+	}); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(id)
+	}
+}
+
+func listApprovalPolicies(rt rpc.Runtime, sessionID string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if ret, e := dbListObjects(db, bucket, "approvalPolicy", jsonToMap); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(ret)
+	}
+}
+
+func deleteApprovalPolicy(rt rpc.Runtime, sessionID string, id string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := dbDeleteObject(db, bucket, "approvalPolicy", id); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(true)
+	}
+}
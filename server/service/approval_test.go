@@ -0,0 +1,80 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestDBDecideApprovalRequest(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		server := startTestSSHServer("pwd", func(cmd string) (string, uint32) {
+			return "rebooting\n", 0
+		})
+		defer server.Close()
+
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-test")
+		_ = db.CreateBucketIsNotExist("auth")
+		for user, role := range map[string]string{"alice": roleOperator, "bob": roleAdmin, "carol": roleOperator} {
+			_ = db.Put("auth", "workspace.test.member."+user, []byte(role))
+		}
+		fields := server.Fields("pwd")
+		_ = dbCreateServer(db, "-test", "1", fields["host"], fields["port"], "root", "pwd", "", "web", "")
+		_ = dbCreateServer(db, "-test", "2", "127.0.0.1", "1", "root", "", "", "db", "")
+		_ = dbCreateGroup(db, "-test", "prod", "name:web")
+
+		assert(dbMatchApprovalPolicy(db, "-test", []string{"1"})).Equals(nil, nil)
+		_, _ = dbCreateObject(db, "-test", "approvalPolicy", func(id string) interface{} {
+			return &approvalPolicy{ID: id, Target: "@prod", Role: roleOperator, Timeout: 600}
+		})
+		_, _ = dbCreateObject(db, "-test", "approvalPolicy", func(id string) interface{} {
+			return &approvalPolicy{ID: id, Target: "1", Role: roleAdmin, Timeout: 3600}
+		})
+		assert(dbMatchApprovalPolicy(db, "-test", []string{"2"})).Equals(nil, nil)
+		ids, _ := dbResolveServers(db, "-test", []string{"@prod"})
+		policy, e := dbMatchApprovalPolicy(db, "-test", ids)
+		assert(policy, e).Equals(&approvalPolicy{Role: roleAdmin, Timeout: 600}, nil)
+
+		now := time.Unix(1700000000, 0)
+		id, e := dbCreateApprovalRequest(db, "-test", "alice", "exec", []string{"@prod"}, ids, "reboot", policy, now)
+		assert(e).IsNil()
+		// the request runs on the servers of the group when it was created
+		_ = dbCreateGroup(db, "-test", "prod", "*")
+		assert(dbDecideApprovalRequest(db, "-test", id, "alice", "", true, now)).
+			Equals(nil, errors.New("user \"alice\" needs role \"admin\" in workspace \"test\""))
+		assert(dbDecideApprovalRequest(db, "-test", id, "carol", "", true, now)).
+			Equals(nil, errors.New("user \"carol\" needs role \"admin\" in workspace \"test\""))
+		assert(dbDecideApprovalRequest(db, "-test", id, "bob", "", true, now.Add(time.Hour))).
+			Equals(nil, errors.New("approval request \"3\" has expired"))
+
+		request, e := dbDecideApprovalRequest(db, "-test", id, "bob", "ok", true, now)
+		assert(e).IsNil()
+		assert(request.State, request.Approver, request.Comment).Equals("done", "bob", "ok")
+		assert(request.Servers, len(request.Results)).Equals([]string{"1"}, 1)
+		assert(request.Results[0]["output"], request.Results[0]["exitStatus"]).
+			Equals("rebooting\n", int64(0))
+		assert(dbDecideApprovalRequest(db, "-test", id, "bob", "", false, now)).
+			Equals(nil, errors.New("approval request \"3\" is done"))
+
+		id, _ = dbCreateApprovalRequest(
+			db, "-test", "alice", "exec", []string{"1"}, []string{"1"}, "reboot", policy, now,
+		)
+		assert(dbExpireApprovalRequests(db, "-test", now.Add(599*time.Second))).Equals(0, nil)
+		assert(dbExpireApprovalRequests(db, "-test", now.Add(600*time.Second))).Equals(1, nil)
+		request, _ = dbGetApprovalRequest(db, "-test", id)
+		assert(request.State).Equals("expired")
+
+		ret, _ := dbListObjects(db, "-test", "approvalRequest", jsonToMap)
+		assert(len(ret), ret[0].(rpc.Map)["state"]).Equals(2, "done")
+	})
+}
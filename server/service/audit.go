@@ -0,0 +1,360 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+const (
+	auditBucket        = "audit"
+	auditTrimInterval  = time.Hour
+	auditMaxArgLength  = 256
+	auditDefaultLimit  = 1000
+	auditRedactedValue = "***"
+)
+
+var AuditService = rpc.NewService(rpc.Map{
+	"retention": NewPeriodicTask(runAuditRetention),
+}).
+	On("$onTimer", onAuditTimer).
+	On("Query", queryAudit).
+	On("Export", exportAudit).
+	On("Commands", searchCommands)
+
+// auditRecord is a record of the audit log, it is written for every call of
+// the public actions of the user and server services, and when a terminal is
+// opened or closed. The method is "<service>:<action>" or "terminal:open" and
+// "terminal:close".
+type auditRecord struct {
+	Time      int64         `json:"time"`
+	User      string        `json:"user"`
+	Workspace string        `json:"workspace"`
+	Method    string        `json:"method"`
+	Target    string        `json:"target"`
+	Args      []interface{} `json:"args,omitempty"`
+	Result    string        `json:"result"`
+	Error     string        `json:"error,omitempty"`
+	Duration  int64         `json:"duration"`
+	BytesIn   int64         `json:"bytesIn,omitempty"`
+	BytesOut  int64         `json:"bytesOut,omitempty"`
+	start     time.Time
+}
+
+func newAuditRecord(method string, user string, workspace string, target string, start time.Time) *auditRecord {
+	return &auditRecord{
+		Time:      getMillisecond(start),
+		User:      user,
+		Workspace: workspace,
+		Method:    method,
+		Target:    target,
+		Result:    "ok",
+		start:     start,
+	}
+}
+
+func (p *auditRecord) setResult(value interface{}) {
+	if e, ok := value.(error); ok && e != nil {
+		p.Result = "error"
+		p.Error = e.Error()
+	} else {
+		p.Result = "ok"
+		p.Error = ""
+	}
+}
+
+// getAuditArgs returns the arguments to record, the redacted ones are
+// replaced and the long ones are truncated
+func getAuditArgs(values []interface{}, redacted []int) []interface{} {
+	ret := make([]interface{}, len(values))
+	for i, value := range values {
+		ret[i] = value
+		for _, idx := range redacted {
+			if idx == i {
+				ret[i] = auditRedactedValue
+			}
+		}
+
+		if ret[i] == auditRedactedValue {
+			continue
+		} else if v, ok := value.(rpc.Bytes); ok {
+			ret[i] = fmt.Sprintf("(%d bytes)", len(v))
+		} else if v, ok := value.(string); ok && len(v) > auditMaxArgLength {
+			ret[i] = v[:auditMaxArgLength] + "..."
+		}
+	}
+	return ret
+}
+
+// newAuditCallRecord makes the record of a call. The first argument is the
+// session of the caller, except for the user service where it is the name of
+// the user because its actions run before login. The target is the argument
+// after the session.
+func newAuditCallRecord(method string, values []interface{}, redacted []int, start time.Time) *auditRecord {
+	args := getAuditArgs(values, redacted)
+	ret := newAuditRecord(method, "", "", "", start)
+	ret.Args = args
+
+	if len(values) == 0 {
+		return ret
+	} else if strings.HasPrefix(method, "user:") {
+		name, _ := values[0].(string)
+		ret.User, ret.Workspace, ret.Target = name, name, name
+		return ret
+	}
+
+	if sessionID, ok := values[0].(string); ok {
+		if user, ok := gUserManager.GetUser(sessionID); ok {
+			ret.User, ret.Workspace = user.name, user.workspace
+		}
+		args[0] = auditRedactedValue
+	}
+	if len(values) > 1 && args[1] != auditRedactedValue {
+		if target, ok := values[1].(string); ok {
+			ret.Target = target
+		}
+	}
+	return ret
+}
+
+var returnType = reflect.TypeOf(rpc.Return(nil))
+
+// auditAction makes the handler of a public action that writes every call
+// to the audit log. The handler takes the runtime and the arguments of the
+// action and returns the result or an error, the action records the outcome
+// and replies it. The redacted indexes count the arguments after the
+// runtime.
+func auditAction(method string, handler interface{}, redacted ...int) interface{} {
+	fn := reflect.ValueOf(handler)
+	in := make([]reflect.Type, 0, fn.Type().NumIn())
+	for i := 0; i < fn.Type().NumIn(); i++ {
+		in = append(in, fn.Type().In(i))
+	}
+
+	actionType := reflect.FuncOf(in, []reflect.Type{returnType}, false)
+	return reflect.MakeFunc(actionType, func(args []reflect.Value) []reflect.Value {
+		rt := args[0].Interface().(rpc.Runtime)
+		values := make([]interface{}, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			values = append(values, arg.Interface())
+		}
+
+		record := newAuditCallRecord(method, values, redacted, time.Now())
+		defer writeAuditRecord(record)
+
+		out := fn.Call(args)
+		ret := out[0].Interface()
+		if e, _ := out[1].Interface().(error); e != nil {
+			ret = e
+		}
+		record.setResult(ret)
+		return []reflect.Value{reflect.ValueOf(rt.Reply(ret))}
+	}).Interface()
+}
+
+// writeTerminalAudit records the open or the close of a terminal in the
+// workspace that it has been opened in
+func writeTerminalAudit(p *terminal, method string, bytesIn int64, bytesOut int64, e error) {
+	record := newAuditRecord(method, p.user.name, p.workspace, p.session.serverID, p.session.startTime)
+	record.BytesIn, record.BytesOut = bytesIn, bytesOut
+	record.setResult(e)
+	writeAuditRecord(record)
+}
+
+func writeAuditRecord(record *auditRecord) {
+	record.Duration = getMillisecond(time.Now()) - record.Time
+	if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		log.Print(e)
+	} else if e := dbAppendAudit(db, record); e != nil {
+		log.Print(e)
+	}
+}
+
+func dbAppendAudit(db *core.DB, record *auditRecord) error {
+	if data, e := json.Marshal(record); e != nil {
+		return e
+	} else {
+		return db.AppendLog(auditBucket, record.start, data)
+	}
+}
+
+type auditFilter struct {
+	Workspace string
+	User      string
+	Method    string
+	Target    string
+	Result    string
+	Since     int64
+	Until     int64
+	Limit     int
+}
+
+func parseAuditFilter(filter rpc.Map) (*auditFilter, error) {
+	ret := &auditFilter{Limit: auditDefaultLimit}
+	for key, value := range filter {
+		switch key {
+		case "user", "method", "target", "result":
+			v, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid audit filter \"%s\"", key)
+			}
+			switch key {
+			case "user":
+				ret.User = v
+			case "method":
+				ret.Method = v
+			case "target":
+				ret.Target = v
+			default:
+				ret.Result = v
+			}
+		case "since", "until", "limit":
+			v, ok := value.(int64)
+			if !ok || v < 0 {
+				return nil, fmt.Errorf("invalid audit filter \"%s\"", key)
+			}
+			switch key {
+			case "since":
+				ret.Since = v
+			case "until":
+				ret.Until = v
+			default:
+				ret.Limit = int(v)
+			}
+		default:
+			return nil, fmt.Errorf("unknown audit filter \"%s\"", key)
+		}
+	}
+	return ret, nil
+}
+
+// isMatch checks the record, a method without action like "server" matches
+// all the actions of the service
+func (p *auditFilter) isMatch(record *auditRecord) bool {
+	if p.Workspace != "" && record.Workspace != p.Workspace {
+		return false
+	} else if p.User != "" && record.User != p.User {
+		return false
+	} else if p.Method != "" && record.Method != p.Method &&
+		!strings.HasPrefix(record.Method, p.Method+":") {
+		return false
+	} else if p.Target != "" && record.Target != p.Target {
+		return false
+	} else if p.Result != "" && record.Result != p.Result {
+		return false
+	} else {
+		return true
+	}
+}
+
+// dbQueryAudit returns the latest records that match the filter in the
+// order of time, the data is the stored JSON of the records
+func dbQueryAudit(db *core.DB, filter *auditFilter) ([]*auditRecord, [][]byte, error) {
+	start, end := time.Time{}, time.Time{}
+	if filter.Since > 0 {
+		start = time.Unix(0, filter.Since*int64(time.Millisecond))
+	}
+	if filter.Until > 0 {
+		end = time.Unix(0, filter.Until*int64(time.Millisecond))
+	}
+
+	records := make([]*auditRecord, 0)
+	dataList := make([][]byte, 0)
+	e := db.ScanLog(auditBucket, start, end, func(value []byte) bool {
+		record := &auditRecord{}
+		if e := json.Unmarshal(value, record); e == nil && filter.isMatch(record) {
+			records = append(records, record)
+			dataList = append(dataList, append([]byte(nil), value...))
+			if filter.Limit > 0 && len(records) > filter.Limit {
+				records, dataList = records[1:], dataList[1:]
+			}
+		}
+		return true
+	})
+	return records, dataList, e
+}
+
+func runAuditRetention(db *core.DB) {
+	retention := core.GetConfig().GetAuditRetention()
+	if retention <= 0 {
+		return
+	}
+
+	if n, e := db.TrimLog(auditBucket, time.Now().Add(-retention)); e != nil {
+		log.Print(e)
+	} else if n > 0 {
+		log.Printf("audit: %d records have expired", n)
+	}
+	if n, e := db.TrimLog(commandLogBucket, time.Now().Add(-retention)); e != nil {
+		log.Print(e)
+	} else if n > 0 {
+		log.Printf("audit: %d commands have expired", n)
+	}
+	if n, e := db.TrimLog(commandMatchBucket, time.Now().Add(-retention)); e != nil {
+		log.Print(e)
+	} else if n > 0 {
+		log.Printf("audit: %d command matches have expired", n)
+	}
+}
+
+func onAuditTimer(rt rpc.Runtime, seq uint64) rpc.Return {
+	if retention, e := getPeriodicTask(rt, "retention"); e != nil {
+		return rt.Reply(e)
+	} else {
+		retention.OnTimer(auditTrimInterval)
+	}
+
+	return rt.Reply(nil)
+}
+
+// getAuditQuery checks that the user is an admin of the current workspace
+// and returns the filter restricted to the workspace
+func getAuditQuery(rt rpc.Runtime, sessionID string, filter rpc.Map) (*core.DB, *auditFilter, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, nil, e
+	} else if v, e := parseAuditFilter(filter); e != nil {
+		return nil, nil, e
+	} else {
+		v.Workspace = strings.TrimPrefix(bucket, "-")
+		return db, v, nil
+	}
+}
+
+func queryAudit(rt rpc.Runtime, sessionID string, filter rpc.Map) rpc.Return {
+	if db, v, e := getAuditQuery(rt, sessionID, filter); e != nil {
+		return rt.Reply(e)
+	} else if records, _, e := dbQueryAudit(db, v); e != nil {
+		return rt.Reply(e)
+	} else {
+		ret := make(rpc.Array, 0, len(records))
+		for _, record := range records {
+			ret = append(ret, toMap(record))
+		}
+		return rt.Reply(ret)
+	}
+}
+
+// exportAudit returns the records as JSON lines
+func exportAudit(rt rpc.Runtime, sessionID string, filter rpc.Map) rpc.Return {
+	if db, v, e := getAuditQuery(rt, sessionID, filter); e != nil {
+		return rt.Reply(e)
+	} else if _, dataList, e := dbQueryAudit(db, v); e != nil {
+		return rt.Reply(e)
+	} else {
+		buf := bytes.NewBuffer(nil)
+		for _, data := range dataList {
+			buf.Write(data)
+			buf.WriteByte('\n')
+		}
+		return rt.Reply(buf.String())
+	}
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestNewAuditCallRecord(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		gUserManager.AddUser(NewUser("alice", "audit-session"))
+		now := time.Now()
+
+		record := newAuditCallRecord("server:Create", []interface{}{
+			"audit-session", "10.0.0.1", "22", "root", "secret",
+		}, []int{4}, now)
+		assert(record.User, record.Workspace, record.Target).
+			Equals("alice", "alice", "10.0.0.1")
+		assert(record.Args).Equals([]interface{}{"***", "10.0.0.1", "22", "root", "***"})
+
+		record = newAuditCallRecord("server:ImportBundle", []interface{}{
+			"unknown", "passphrase", rpc.Bytes{1, 2, 3}, strings.Repeat("a", 300),
+		}, []int{1}, now)
+		assert(record.User, record.Target).Equals("", "")
+		assert(record.Args).Equals([]interface{}{
+			"***", "***", "(3 bytes)", strings.Repeat("a", auditMaxArgLength) + "...",
+		})
+
+		record = newAuditCallRecord("user:Login", []interface{}{"bob", "pass"}, []int{1}, now)
+		assert(record.User, record.Workspace, record.Target).Equals("bob", "bob", "bob")
+		assert(record.Args).Equals([]interface{}{"bob", "***"})
+	})
+}
+
+func TestAuditAction(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		core.GetConfig().SetDBFile("audit_test.db")
+		defer func() {
+			core.GetConfig().SetDBFile("./vbot.db")
+			os.Remove("audit_test.db")
+		}()
+		db, _ := core.GetManager().GetDB("audit_test.db")
+		gUserManager.AddUser(NewUser("alice", "audit-session"))
+
+		fn := auditAction("server:Delete", func(rt rpc.Runtime, sessionID string, serverID string) (interface{}, error) {
+			return nil, errors.New("server \"1\" does not exist")
+		}).(func(rpc.Runtime, string, string) rpc.Return)
+		fn(rpc.Runtime{}, "audit-session", "1")
+
+		records, _, e := dbQueryAudit(db, &auditFilter{})
+		assert(e, len(records)).Equals(nil, 1)
+		assert(records[0].User, records[0].Method, records[0].Target).
+			Equals("alice", "server:Delete", "1")
+		assert(records[0].Result, records[0].Error).
+			Equals("error", "server \"1\" does not exist")
+	})
+
+	t.Run("result", func(t *testing.T) {
+		assert := assert.New(t)
+		core.GetConfig().SetDBFile("audit_result_test.db")
+		defer func() {
+			core.GetConfig().SetDBFile("./vbot.db")
+			os.Remove("audit_result_test.db")
+		}()
+		db, _ := core.GetManager().GetDB("audit_result_test.db")
+		gUserManager.AddUser(NewUser("alice", "audit-session"))
+
+		fn := auditAction("server:List", func(rt rpc.Runtime, sessionID string) (interface{}, error) {
+			return rpc.Array{}, nil
+		}).(func(rpc.Runtime, string) rpc.Return)
+		fn(rpc.Runtime{}, "audit-session")
+
+		records, _, e := dbQueryAudit(db, &auditFilter{})
+		assert(e, len(records)).Equals(nil, 1)
+		assert(records[0].Method, records[0].Result, records[0].Error).Equals("server:List", "ok", "")
+	})
+}
+
+func TestParseAuditFilter(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(parseAuditFilter(rpc.Map{"user": "alice", "limit": int64(10)})).
+			Equals(&auditFilter{User: "alice", Limit: 10}, nil)
+		assert(parseAuditFilter(rpc.Map{"user": int64(1)})).
+			Equals(nil, errors.New("invalid audit filter \"user\""))
+		assert(parseAuditFilter(rpc.Map{"since": int64(-1)})).
+			Equals(nil, errors.New("invalid audit filter \"since\""))
+		assert(parseAuditFilter(rpc.Map{"color": "red"})).
+			Equals(nil, errors.New("unknown audit filter \"color\""))
+	})
+}
+
+func TestDBQueryAudit(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+
+		base := time.Unix(1000, 0)
+		for i, v := range []struct {
+			method    string
+			user      string
+			workspace string
+			e         error
+		}{
+			{"server:Create", "alice", "ops", nil},
+			{"server:Delete", "alice", "ops", errors.New("error")},
+			{"terminal:open", "bob", "ops", nil},
+			{"terminal:close", "bob", "ops", nil},
+			{"server:List", "carol", "dev", nil},
+		} {
+			record := newAuditRecord(v.method, v.user, v.workspace, "1", base.Add(time.Duration(i)*time.Second))
+			record.setResult(v.e)
+			assert(dbAppendAudit(db, record)).IsNil()
+		}
+
+		getMethods := func(filter *auditFilter) []string {
+			records, dataList, e := dbQueryAudit(db, filter)
+			assert(e, len(dataList)).Equals(nil, len(records))
+			ret := make([]string, 0)
+			for _, record := range records {
+				ret = append(ret, record.Method)
+			}
+			return ret
+		}
+		assert(getMethods(&auditFilter{Workspace: "ops"})).
+			Equals([]string{"server:Create", "server:Delete", "terminal:open", "terminal:close"})
+		assert(getMethods(&auditFilter{Method: "server"})).
+			Equals([]string{"server:Create", "server:Delete", "server:List"})
+		assert(getMethods(&auditFilter{User: "bob", Method: "terminal:open"})).
+			Equals([]string{"terminal:open"})
+		assert(getMethods(&auditFilter{Result: "error"})).
+			Equals([]string{"server:Delete"})
+		assert(getMethods(&auditFilter{Since: 1001000, Until: 1003000})).
+			Equals([]string{"server:Delete", "terminal:open"})
+		assert(getMethods(&auditFilter{Limit: 2})).
+			Equals([]string{"terminal:close", "server:List"})
+
+		assert(db.TrimLog(auditBucket, base.Add(2*time.Second))).Equals(2, nil)
+		assert(getMethods(&auditFilter{})).
+			Equals([]string{"terminal:open", "terminal:close", "server:List"})
+	})
+}
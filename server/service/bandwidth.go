@@ -0,0 +1,170 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+// bandwidthLimits are the throughput caps of the terminal sessions in bytes
+// per second, zero means no limit. The per user cap is shared by the
+// terminals of the user in the workspace, or by the terminals of the user on
+// the server if the server overrides it. Exec sessions are not limited.
+type bandwidthLimits struct {
+	PerSession      int64
+	PerUser         int64
+	isServerPerUser bool
+}
+
+// getBandwidthLimits returns the limits of the server, the config is used
+// for the limits that the server does not override
+func getBandwidthLimits(fields map[string]string) *bandwidthLimits {
+	ret := &bandwidthLimits{
+		PerSession: core.GetConfig().GetBandwidthPerSession(),
+		PerUser:    core.GetConfig().GetBandwidthPerUser(),
+	}
+	if v, e := strconv.ParseInt(fields["bandwidthPerSession"], 10, 64); e == nil {
+		ret.PerSession = v
+	}
+	if v, e := strconv.ParseInt(fields["bandwidthPerUser"], 10, 64); e == nil {
+		ret.PerUser, ret.isServerPerUser = v, true
+	}
+	return ret
+}
+
+// dbSetServerBandwidth overrides the limits of the config on the server, a
+// negative limit removes the override
+func dbSetServerBandwidth(db *core.DB, bucket string, id string, perSession int64, perUser int64) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if b.Get(core.DBKey("servers.%s", id)) == nil {
+			return fmt.Errorf("server \"%s\" does not exist", id)
+		}
+
+		for name, value := range map[string]int64{
+			"bandwidthPerSession": perSession,
+			"bandwidthPerUser":    perUser,
+		} {
+			key := core.DBKey("ssh.%s.%s", id, name)
+			if value < 0 {
+				if e := b.Delete(key); e != nil {
+					return e
+				}
+			} else if e := b.Put(key, []byte(strconv.FormatInt(value, 10))); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+func setServerBandwidth(
+	rt rpc.Runtime, sessionID string, serverID string, perSession int64, perUser int64,
+) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if e := dbSetServerBandwidth(db, bucket, serverID, perSession, perUser); e != nil {
+		return nil, e
+	} else {
+		return true, nil
+	}
+}
+
+// userBandwidth is the token bucket of a user and the number of the
+// sessions that share it
+type userBandwidth struct {
+	bucket *core.TokenBucket
+	refs   int
+}
+
+// bandwidthManager keeps the token buckets of the users, they are shared by
+// the sessions of a user and removed with the last session
+type bandwidthManager struct {
+	users map[string]*userBandwidth
+	mu    sync.Mutex
+}
+
+var gBandwidthManager = &bandwidthManager{users: make(map[string]*userBandwidth)}
+
+// GetUserBucket returns the bucket of the key, the rate of an existing
+// bucket is updated. ReleaseUserBucket must be called when the session is
+// closed.
+func (p *bandwidthManager) GetUserBucket(key string, rate int64) *core.TokenBucket {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if user, ok := p.users[key]; ok {
+		if user.bucket.Rate() != rate {
+			user.bucket.SetRate(rate)
+		}
+		user.refs++
+		return user.bucket
+	}
+
+	ret := core.NewTokenBucket(rate)
+	p.users[key] = &userBandwidth{bucket: ret, refs: 1}
+	return ret
+}
+
+// ReleaseUserBucket removes the bucket of the key when its last session is
+// closed
+func (p *bandwidthManager) ReleaseUserBucket(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if user, ok := p.users[key]; ok {
+		if user.refs--; user.refs <= 0 {
+			delete(p.users, key)
+		}
+	}
+}
+
+// setBandwidth sets the token buckets that limit the throughput of the
+// session
+func (p *Session) setBandwidth(limits *bandwidthLimits) {
+	p.limits = limits
+	p.buckets = nil
+	if limits.PerSession > 0 {
+		p.buckets = append(p.buckets, core.NewTokenBucket(limits.PerSession))
+	}
+	if limits.PerUser > 0 {
+		key := p.bucket + "/" + p.user
+		if limits.isServerPerUser {
+			key += "@" + p.serverID
+		}
+		p.userKey = key
+		p.buckets = append(p.buckets, gBandwidthManager.GetUserBucket(key, limits.PerUser))
+	}
+}
+
+// releaseBandwidth releases the bucket of the user, it is called once when
+// the session leaves the registry
+func (p *Session) releaseBandwidth() {
+	if p.userKey != "" {
+		gBandwidthManager.ReleaseUserBucket(p.userKey)
+		p.userKey = ""
+	}
+}
+
+// Throttle waits until n bytes are within the limits of the session, the
+// bytes of both directions are counted
+func (p *Session) Throttle(n int) {
+	now, wait := time.Now(), time.Duration(0)
+	for _, bucket := range p.buckets {
+		if v := bucket.Reserve(n, now); v > wait {
+			wait = v
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
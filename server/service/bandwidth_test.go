@@ -0,0 +1,113 @@
+package service
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestGetBandwidthLimits(t *testing.T) {
+	t.Run("test", func(t *testing.T) {
+		assert := assert.New(t)
+		core.GetConfig().SetBandwidthPerSession(1000)
+		core.GetConfig().SetBandwidthPerUser(2000)
+		defer func() {
+			core.GetConfig().SetBandwidthPerSession(0)
+			core.GetConfig().SetBandwidthPerUser(0)
+		}()
+		db, _ := core.NewDB("test.db")
+		defer os.Remove("test.db")
+		_ = db.CreateBucketIsNotExist("-test")
+		_ = dbCreateServer(db, "-test", "1", "10.0.0.1", "22", "root", "pwd", "", "web", "")
+
+		fields, _ := dbGetServer(db, "-test", "1")
+		assert(getBandwidthLimits(fields)).Equals(&bandwidthLimits{PerSession: 1000, PerUser: 2000})
+
+		assert(dbSetServerBandwidth(db, "-test", "2", 0, 0)).IsNotNil()
+		assert(dbSetServerBandwidth(db, "-test", "1", 0, 500)).IsNil()
+		fields, _ = dbGetServer(db, "-test", "1")
+		assert(getBandwidthLimits(fields)).
+			Equals(&bandwidthLimits{PerSession: 0, PerUser: 500, isServerPerUser: true})
+
+		assert(dbSetServerBandwidth(db, "-test", "1", -1, -1)).IsNil()
+		fields, _ = dbGetServer(db, "-test", "1")
+		assert(getBandwidthLimits(fields)).Equals(&bandwidthLimits{PerSession: 1000, PerUser: 2000})
+	})
+}
+
+func TestSession_Throttle(t *testing.T) {
+	t.Run("shared by the user", func(t *testing.T) {
+		assert := assert.New(t)
+		s1 := &Session{user: "alice", bucket: "-throttle", serverID: "1"}
+		s1.setBandwidth(&bandwidthLimits{PerSession: 1 << 20, PerUser: 1 << 20})
+		s2 := &Session{user: "alice", bucket: "-throttle", serverID: "2"}
+		s2.setBandwidth(&bandwidthLimits{PerUser: 1 << 20})
+		assert(len(s1.buckets), len(s2.buckets), s1.buckets[1] == s2.buckets[0]).
+			Equals(2, 1, true)
+
+		start := time.Now()
+		s1.Throttle(1 << 20)
+		assert(time.Since(start) < 50*time.Millisecond).IsTrue()
+		s2.Throttle(100 * 1024)
+		assert(time.Since(start) >= 80*time.Millisecond).IsTrue()
+
+		s3 := &Session{user: "alice", bucket: "-throttle", serverID: "3"}
+		s3.setBandwidth(&bandwidthLimits{PerUser: 1 << 20, isServerPerUser: true})
+		assert(s3.buckets[0] == s2.buckets[0]).IsFalse()
+	})
+
+	t.Run("released with the last session", func(t *testing.T) {
+		assert := assert.New(t)
+		s1 := &Session{user: "bob", bucket: "-throttle", serverID: "1"}
+		s1.setBandwidth(&bandwidthLimits{PerUser: 1 << 20})
+		s2 := &Session{user: "bob", bucket: "-throttle", serverID: "2"}
+		s2.setBandwidth(&bandwidthLimits{PerUser: 1 << 20})
+		id1, _ := gSessionRegistry.Add(s1, nil)
+		id2, _ := gSessionRegistry.Add(s2, nil)
+
+		gSessionRegistry.Remove(id1)
+		gSessionRegistry.Remove(id1)
+		gBandwidthManager.mu.Lock()
+		_, ok := gBandwidthManager.users["-throttle/bob"]
+		gBandwidthManager.mu.Unlock()
+		assert(ok).IsTrue()
+
+		gSessionRegistry.Close(id2, "")
+		gBandwidthManager.mu.Lock()
+		_, ok = gBandwidthManager.users["-throttle/bob"]
+		gBandwidthManager.mu.Unlock()
+		assert(ok).IsFalse()
+	})
+}
+
+func TestTerminal_bandwidth(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		withTestBridgeDB(func(db *core.DB) {
+			content := bytes.Repeat([]byte("0123456789abcdef0123456789abcdef\r\n"), 4096)
+			server := startTestCatServer(content)
+			defer server.Close()
+
+			core.GetConfig().SetBandwidthPerSession(64 * 1024)
+			term, ws, _, fnClose := openTestBridge(db, server, false)
+			core.GetConfig().SetBandwidthPerSession(0)
+			defer fnClose()
+
+			start := time.Now()
+			assert(ws.WriteMessage(websocket.BinaryMessage, []byte("\x00cat\r"))).IsNil()
+			_, output := readTestBridge(ws, "#EOF#")
+			assert(bytes.Contains([]byte(output), []byte("#EOF#"))).IsTrue()
+			// the first 64KB pass at once, the other 72KB take more than a second
+			assert(time.Since(start) >= time.Second).IsTrue()
+
+			info := term.session.ToMap()
+			assert(info["maxRatePerSession"], info["rateOut"].(int64) > 0).
+				Equals(int64(64*1024), true)
+		})
+	})
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// terminalReadSize is the size of a read of the shell output
+	terminalReadSize = 32 * 1024
+	// terminalCoalesceSize of pending output is sent without waiting for
+	// more output
+	terminalCoalesceSize = 32 * 1024
+	// terminalMaxPending of output that the websocket has not taken yet
+	// pauses the reading of the shell output
+	terminalMaxPending = 256 * 1024
+	// terminalCompressSize is the size from which the messages to the
+	// websocket are compressed
+	terminalCompressSize = 512
+	// terminalMaxInputFrame is the size limit of an input message, a paste
+	// up to the limit is written to the shell as one input
+	terminalMaxInputFrame = 1024 * 1024
+)
+
+// terminalCoalesceInterval is how long the output is collected before it
+// is sent to the websocket as one message
+var terminalCoalesceInterval = 5 * time.Millisecond
+
+var (
+	gReadBufferPool = sync.Pool{
+		New: func() interface{} {
+			return new([terminalReadSize]byte)
+		},
+	}
+	gBridgeBufferPool = sync.Pool{
+		New: func() interface{} {
+			return &bytes.Buffer{}
+		},
+	}
+)
+
+func getBridgeBuffer() *bytes.Buffer {
+	return gBridgeBufferPool.Get().(*bytes.Buffer)
+}
+
+func putBridgeBuffer(buf *bytes.Buffer) {
+	buf.Reset()
+	gBridgeBufferPool.Put(buf)
+}
+
+// readFrame reads the rest of a websocket message into a pooled buffer, ok
+// is false if the message is larger than the limit. The buffer must be put
+// back after use.
+func readFrame(reader io.Reader, limit int64) (*bytes.Buffer, bool, error) {
+	ret := getBridgeBuffer()
+	n, e := ret.ReadFrom(io.LimitReader(reader, limit+1))
+	if e != nil {
+		putBridgeBuffer(ret)
+		return nil, false, e
+	}
+	return ret, n <= limit, nil
+}
+
+// WriteOutput writes the output of the shell, the small messages are not
+// worth compressing
+func (p *wsConn) WriteOutput(data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.conn.EnableWriteCompression(len(data) >= terminalCompressSize)
+	return p.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	_ = ws.SetCompressionLevel(flate.BestSpeed)
+	return &wsConn{conn: ws}
+}
+
+// waitOutput waits while the websocket is behind, so that the reading of
+// the shell output pauses. The caller must hold the lock.
+func (p *terminal) waitOutput() {
+	for p.conn != nil && p.pending.Len() >= terminalMaxPending {
+		p.cond.Wait()
+	}
+}
+
+// pushOutput queues the data to the attached websocket, the caller must
+// hold the lock
+func (p *terminal) pushOutput(data []byte) {
+	p.pending.Write(data)
+	p.cond.Broadcast()
+}
+
+// dropOutput discards the queued data when the websocket changes, the
+// caller must hold the lock
+func (p *terminal) dropOutput() {
+	p.pending.Reset()
+	p.cond.Broadcast()
+}
+
+// flushOutput sends the queued data to the websocket until the terminal is
+// closed, the output of a short interval is sent as one message
+func (p *terminal) flushOutput() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		for !p.isClosed && p.pending.Len() == 0 {
+			p.cond.Wait()
+		}
+		if p.isClosed {
+			return
+		}
+
+		if terminalCoalesceInterval > 0 && p.pending.Len() < terminalCoalesceSize {
+			p.mu.Unlock()
+			time.Sleep(terminalCoalesceInterval)
+			p.mu.Lock()
+		}
+
+		data, conn := p.pending, p.conn
+		p.pending = getBridgeBuffer()
+		p.cond.Broadcast()
+		p.mu.Unlock()
+
+		if conn != nil && data.Len() > 0 {
+			if e := conn.WriteOutput(data.Bytes()); e != nil {
+				log.Print(e)
+			}
+		}
+		putBridgeBuffer(data)
+		p.mu.Lock()
+	}
+}
@@ -0,0 +1,309 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/vbot/server/core"
+	"golang.org/x/crypto/ssh"
+)
+
+// countConn counts the bytes that are read from the connection
+type countConn struct {
+	net.Conn
+	count int64
+}
+
+func (p *countConn) Read(b []byte) (int, error) {
+	n, e := p.Conn.Read(b)
+	atomic.AddInt64(&p.count, int64(n))
+	return n, e
+}
+
+// startTestCatServer starts a ssh server with a shell that writes the
+// content followed by "#EOF#" when "cat" is entered, and the number of
+// bytes of any other line
+func startTestCatServer(content []byte) *testSSHServer {
+	server := startTestSSHServer("pwd", nil)
+	server.fnShell = func(channel ssh.Channel) {
+		buf, line := make([]byte, 64*1024), make([]byte, 0)
+		for {
+			n, e := channel.Read(buf)
+			if e != nil {
+				return
+			}
+			for _, c := range buf[:n] {
+				if c != '\r' {
+					line = append(line, c)
+				} else if string(line) == "cat" {
+					for i := 0; i < len(content); i += 4096 {
+						_, _ = channel.Write(content[i:minInt(i+4096, len(content))])
+					}
+					_, _ = channel.Write([]byte("#EOF#"))
+					line = line[:0]
+				} else {
+					_, _ = channel.Write([]byte(fmt.Sprintf("got %d\r\n", len(line))))
+					line = line[:0]
+				}
+			}
+		}
+	}
+	return server
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// openTestBridge opens a terminal on the server and attaches a websocket
+// client to it
+func openTestBridge(
+	db *core.DB, server *testSSHServer, compress bool,
+) (*terminal, *websocket.Conn, *countConn, func()) {
+	term, e := openTerminal(db, NewUser("alice", "bridge-session"), "-test", "1", server.Fields("pwd"), "127.0.0.1")
+	if e != nil {
+		panic(e)
+	}
+
+	ws, counter, fnClose := attachTestBridge(term, compress)
+	return term, ws, counter, func() {
+		fnClose()
+		term.Close("")
+	}
+}
+
+// attachTestBridge attaches a websocket client to the terminal, the
+// terminal is detached when the client is closed
+func attachTestBridge(term *terminal, compress bool) (*websocket.Conn, *countConn, func()) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, e := upgrader.Upgrade(w, r, nil)
+		if e != nil {
+			return
+		}
+		defer ws.Close()
+		conn := newWSConn(ws)
+		if e := term.Attach(conn); e == nil {
+			defer term.Detach(conn)
+			term.serve(ws)
+		}
+	}))
+
+	counter := (*countConn)(nil)
+	dialer := &websocket.Dialer{
+		EnableCompression: compress,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, e := net.Dial(network, addr)
+			counter = &countConn{Conn: conn}
+			return counter, e
+		},
+	}
+	ws, _, e := dialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if e != nil {
+		panic(e)
+	}
+
+	return ws, counter, func() {
+		_ = ws.Close()
+		httpServer.Close()
+	}
+}
+
+// readTestBridge reads the output from the websocket until the text, it
+// returns the number of the messages
+func readTestBridge(ws *websocket.Conn, text string) (int, string) {
+	messages, output := 0, make([]byte, 0)
+	_ = ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		_, data, e := ws.ReadMessage()
+		if e != nil {
+			return messages, string(output)
+		}
+		messages++
+		output = append(output, data...)
+		if len(output) > 64*1024 {
+			output = output[len(output)-64*1024:]
+		}
+		if bytes.Contains(output, []byte(text)) {
+			return messages, string(output)
+		}
+	}
+}
+
+func withTestBridgeDB(fn func(db *core.DB)) {
+	core.GetConfig().SetDBFile("bridge_test.db")
+	defer func() {
+		core.GetConfig().SetDBFile("./vbot.db")
+		os.Remove("bridge_test.db")
+	}()
+	db, _ := core.GetManager().GetDB("bridge_test.db")
+	_ = db.CreateBucketIsNotExist("-test")
+	fn(db)
+}
+
+func TestTerminal_bridge(t *testing.T) {
+	t.Run("paste and coalesce", func(t *testing.T) {
+		assert := assert.New(t)
+		withTestBridgeDB(func(db *core.DB) {
+			content := bytes.Repeat([]byte("0123456789abcdef0123456789abcdef\r\n"), 8192)
+			server := startTestCatServer(content)
+			defer server.Close()
+			_, ws, _, fnClose := openTestBridge(db, server, true)
+			defer fnClose()
+
+			paste := append([]byte{0}, bytes.Repeat([]byte("a"), 5000)...)
+			assert(ws.WriteMessage(websocket.BinaryMessage, append(paste, '\r'))).IsNil()
+			_, output := readTestBridge(ws, "got 5000")
+			assert(strings.Contains(output, "got 5000")).IsTrue()
+
+			assert(ws.WriteMessage(websocket.BinaryMessage, []byte("\x00cat\r"))).IsNil()
+			messages, output := readTestBridge(ws, "#EOF#")
+			assert(strings.Contains(output, "#EOF#")).IsTrue()
+			// the output of 68 reads is sent in fewer messages
+			assert(messages < len(content)/4096).IsTrue()
+		})
+	})
+
+	t.Run("input too large", func(t *testing.T) {
+		assert := assert.New(t)
+		withTestBridgeDB(func(db *core.DB) {
+			server := startTestCatServer(nil)
+			defer server.Close()
+			_, ws, _, fnClose := openTestBridge(db, server, false)
+			defer fnClose()
+
+			paste := make([]byte, terminalMaxInputFrame+2)
+			assert(ws.WriteMessage(websocket.BinaryMessage, paste)).IsNil()
+			_, output := readTestBridge(ws, "dropped")
+			assert(strings.Contains(output, "larger than 1MB")).IsTrue()
+		})
+	})
+
+	t.Run("backpressure", func(t *testing.T) {
+		assert := assert.New(t)
+		withTestBridgeDB(func(db *core.DB) {
+			content := bytes.Repeat([]byte("0123456789abcdef0123456789abcdef\r\n"), 256*1024)
+			server := startTestCatServer(content)
+			defer server.Close()
+			term, ws, _, fnClose := openTestBridge(db, server, false)
+			defer fnClose()
+
+			// the client does not read, the queued output stays bounded
+			assert(ws.WriteMessage(websocket.BinaryMessage, []byte("\x00cat\r"))).IsNil()
+			time.Sleep(300 * time.Millisecond)
+			term.mu.Lock()
+			pending, bytesOut := term.pending.Len(), atomic.LoadInt64(&term.session.bytesOut)
+			term.mu.Unlock()
+			assert(pending <= terminalMaxPending+terminalReadSize).IsTrue()
+			assert(bytesOut < int64(len(content))).IsTrue()
+
+			_, output := readTestBridge(ws, "#EOF#")
+			assert(strings.Contains(output, "#EOF#")).IsTrue()
+		})
+	})
+}
+
+// BenchmarkTerminal_cat measures the output of cat on a 4MB file from the
+// ssh server to the websocket client. "direct" sends the queued output as
+// soon as possible, "coalesce" collects the output of a short interval into
+// one message and "deflate" also compresses the messages.
+func BenchmarkTerminal_cat(b *testing.B) {
+	content := make([]byte, 0, 4*1024*1024)
+	for i := 0; len(content) < cap(content)-80; i++ {
+		content = append(content, fmt.Sprintf("%08d %-69x\r\n", i, i*7919)...)
+	}
+	for _, item := range []struct {
+		name     string
+		interval time.Duration
+		compress bool
+	}{
+		{"direct", 0, false},
+		{"coalesce", terminalCoalesceInterval, false},
+		{"deflate", terminalCoalesceInterval, true},
+	} {
+		b.Run(item.name, func(b *testing.B) {
+			withTestBridgeDB(func(db *core.DB) {
+				interval := terminalCoalesceInterval
+				terminalCoalesceInterval = item.interval
+				defer func() {
+					terminalCoalesceInterval = interval
+				}()
+
+				server := startTestCatServer(content)
+				defer server.Close()
+				_, ws, counter, fnClose := openTestBridge(db, server, item.compress)
+				defer fnClose()
+				readTestBridge(ws, "\x1b[H")
+
+				messages := 0
+				start := atomic.LoadInt64(&counter.count)
+				b.SetBytes(int64(len(content)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_ = ws.WriteMessage(websocket.BinaryMessage, []byte("\x00cat\r"))
+					n, _ := readTestBridge(ws, "#EOF#")
+					messages += n
+				}
+				b.StopTimer()
+				b.ReportMetric(float64(messages)/float64(b.N), "msgs/op")
+				b.ReportMetric(float64(atomic.LoadInt64(&counter.count)-start)/float64(b.N), "wire-B/op")
+			})
+		})
+	}
+}
+
+func TestTerminal_detach(t *testing.T) {
+	t.Run("reattach", func(t *testing.T) {
+		assert := assert.New(t)
+		timeout := core.GetConfig().GetTerminalDetachTimeout()
+		core.GetConfig().SetTerminalDetachTimeout(300 * time.Millisecond)
+		defer core.GetConfig().SetTerminalDetachTimeout(timeout)
+		waitDetached := func(term *terminal) {
+			for i := 0; i < 200; i++ {
+				term.mu.Lock()
+				isDetached := term.conn == nil
+				term.mu.Unlock()
+				if isDetached {
+					return
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+		isOpen := func(term *terminal) bool {
+			_, ok := gTerminalManager.Get(term.session.id)
+			return ok
+		}
+
+		withTestBridgeDB(func(db *core.DB) {
+			server := startTestEchoServer()
+			defer server.Close()
+			term, ws, _, fnClose := openTestBridge(db, server, false)
+			defer fnClose()
+
+			_ = ws.Close()
+			waitDetached(term)
+			time.Sleep(150 * time.Millisecond)
+			_, _, fnDetach := attachTestBridge(term, false)
+			fnDetach()
+			waitDetached(term)
+
+			// the timer of the first detach must not close the terminal
+			time.Sleep(200 * time.Millisecond)
+			assert(isOpen(term)).IsTrue()
+			time.Sleep(300 * time.Millisecond)
+			assert(isOpen(term)).IsFalse()
+		})
+	})
+}
@@ -0,0 +1,251 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/rpccloud/rpc"
+)
+
+// broadcastGroup is a set of terminals of a user that share the keyboard
+// input, the input of an included member is written to every included
+// member while the output of every terminal stays separate
+type broadcastGroup struct {
+	id      string
+	seq     uint64
+	user    string
+	bucket  string
+	members map[string]bool
+}
+
+func (p *broadcastGroup) ToMap() rpc.Map {
+	ids := make([]string, 0, len(p.members))
+	for id := range p.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	members := rpc.Array{}
+	for _, id := range ids {
+		members = append(members, rpc.Map{"terminalID": id, "included": p.members[id]})
+	}
+	return rpc.Map{"id": p.id, "members": members}
+}
+
+type broadcastManager struct {
+	groups     map[string]*broadcastGroup
+	byTerminal map[string]*broadcastGroup
+	seq        uint64
+	mu         sync.Mutex
+}
+
+var gBroadcastManager = newBroadcastManager()
+
+func newBroadcastManager() *broadcastManager {
+	return &broadcastManager{
+		groups:     make(map[string]*broadcastGroup),
+		byTerminal: make(map[string]*broadcastGroup),
+	}
+}
+
+// Create opens a group over the terminals of the user in the workspace, a
+// terminal can be in one group only
+func (p *broadcastManager) Create(user string, bucket string, terminalIDs []string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	group := &broadcastGroup{user: user, bucket: bucket, members: make(map[string]bool)}
+	for _, id := range terminalIDs {
+		if t, ok := gTerminalManager.Get(id); !ok || t.session.user != user || t.session.bucket != bucket {
+			return "", fmt.Errorf("terminal \"%s\" does not exist", id)
+		} else if v, ok := p.byTerminal[id]; ok {
+			return "", fmt.Errorf("terminal \"%s\" is already in broadcast group \"%s\"", id, v.id)
+		}
+		group.members[id] = true
+	}
+	if len(group.members) < 2 {
+		return "", fmt.Errorf("broadcast group needs at least two terminals")
+	}
+
+	p.seq++
+	group.id, group.seq = fmt.Sprintf("%d", p.seq), p.seq
+	p.groups[group.id] = group
+	for id := range group.members {
+		p.byTerminal[id] = group
+	}
+	return group.id, nil
+}
+
+func (p *broadcastManager) getGroup(user string, bucket string, id string) (*broadcastGroup, error) {
+	if group, ok := p.groups[id]; !ok || group.user != user || group.bucket != bucket {
+		return nil, fmt.Errorf("broadcast group \"%s\" does not exist", id)
+	} else {
+		return group, nil
+	}
+}
+
+// SetMember includes the terminal in the broadcast or excludes it, an
+// excluded terminal keeps its own input
+func (p *broadcastManager) SetMember(
+	user string, bucket string, id string, terminalID string, included bool,
+) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if group, e := p.getGroup(user, bucket, id); e != nil {
+		return e
+	} else if _, ok := group.members[terminalID]; !ok {
+		return fmt.Errorf("terminal \"%s\" is not in broadcast group \"%s\"", terminalID, id)
+	} else {
+		group.members[terminalID] = included
+		return nil
+	}
+}
+
+// List returns the groups of the user in the workspace
+func (p *broadcastManager) List(user string, bucket string) rpc.Array {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	groups := make([]*broadcastGroup, 0)
+	for _, group := range p.groups {
+		if group.user == user && group.bucket == bucket {
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].seq < groups[j].seq
+	})
+
+	ret := rpc.Array{}
+	for _, group := range groups {
+		ret = append(ret, group.ToMap())
+	}
+	return ret
+}
+
+func (p *broadcastManager) Close(user string, bucket string, id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	group, e := p.getGroup(user, bucket, id)
+	if e != nil {
+		return e
+	}
+	for terminalID := range group.members {
+		delete(p.byTerminal, terminalID)
+	}
+	delete(p.groups, id)
+	return nil
+}
+
+// RemoveTerminal removes the closed terminal from its group, the group is
+// closed when less than two members are left
+func (p *broadcastManager) RemoveTerminal(terminalID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if group, ok := p.byTerminal[terminalID]; ok {
+		delete(p.byTerminal, terminalID)
+		delete(group.members, terminalID)
+		if len(group.members) < 2 {
+			for id := range group.members {
+				delete(p.byTerminal, id)
+			}
+			delete(p.groups, group.id)
+		}
+	}
+}
+
+// Targets returns the terminals that receive the input of the terminal, it
+// returns nil if the input is not broadcast
+func (p *broadcastManager) Targets(terminalID string) []*terminal {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	group, ok := p.byTerminal[terminalID]
+	if !ok || !group.members[terminalID] {
+		return nil
+	}
+
+	ret := make([]*terminal, 0, len(group.members))
+	for id, included := range group.members {
+		if t, ok := gTerminalManager.Get(id); ok && included {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+// input writes the input typed into the terminal, to the members of its
+// broadcast group if it has one. A member that is transferring a file is
+// skipped, the errors of the other members are shown on their own screens.
+func (p *terminal) input(data []byte) error {
+	targets := gBroadcastManager.Targets(p.session.id)
+	if targets == nil {
+		return p.write(data)
+	}
+
+	ret := error(nil)
+	for _, t := range targets {
+		if t.getTransfer() != nil {
+			continue
+		} else if e := t.write(data); e != nil && t == p {
+			ret = e
+		} else if e != nil {
+			t.notice(fmt.Sprintf("\r\n[vbot] broadcast input failed: %s\r\n", e.Error()))
+		}
+	}
+	return ret
+}
+
+func createBroadcast(rt rpc.Runtime, sessionID string, terminalIDs rpc.Array) (interface{}, error) {
+	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return nil, e
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleOperator).ToString(); e != nil {
+		return nil, e
+	} else if ids, e := toStringList(terminalIDs); e != nil {
+		return nil, e
+	} else if id, e := gBroadcastManager.Create(userName, bucket, ids); e != nil {
+		return nil, e
+	} else {
+		return id, nil
+	}
+}
+
+func setBroadcastMember(
+	rt rpc.Runtime, sessionID string, id string, terminalID string, included bool,
+) (interface{}, error) {
+	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return nil, e
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleOperator).ToString(); e != nil {
+		return nil, e
+	} else if e := gBroadcastManager.SetMember(userName, bucket, id, terminalID, included); e != nil {
+		return nil, e
+	} else {
+		return true, nil
+	}
+}
+
+func listBroadcasts(rt rpc.Runtime, sessionID string) (interface{}, error) {
+	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return nil, e
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return nil, e
+	} else {
+		return gBroadcastManager.List(userName, bucket), nil
+	}
+}
+
+func closeBroadcast(rt rpc.Runtime, sessionID string, id string) (interface{}, error) {
+	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return nil, e
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleOperator).ToString(); e != nil {
+		return nil, e
+	} else if e := gBroadcastManager.Close(userName, bucket, id); e != nil {
+		return nil, e
+	} else {
+		return true, nil
+	}
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func addTestBroadcastTerminal(user string, bucket string) (*terminal, *bytes.Buffer) {
+	stdin := &bytes.Buffer{}
+	encoder, _ := core.NewCharsetEncoder(core.CharsetUTF8)
+	t := &terminal{stdin: stdin, encoder: encoder}
+	t.session = &Session{kind: "terminal", user: user, bucket: bucket, fnClose: t.Close}
+	_, _ = gSessionRegistry.Add(t.session, nil)
+	gTerminalManager.Add(t)
+	return t, stdin
+}
+
+func TestBroadcastManager(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		manager := newBroadcastManager()
+		t1, _ := addTestBroadcastTerminal("alice", "-ops")
+		t2, _ := addTestBroadcastTerminal("alice", "-ops")
+		t3, _ := addTestBroadcastTerminal("alice", "-ops")
+		t4, _ := addTestBroadcastTerminal("bob", "-ops")
+		defer func() {
+			for _, v := range []*terminal{t1, t2, t3, t4} {
+				gSessionRegistry.Remove(v.session.id)
+				gTerminalManager.Remove(v.session.id)
+			}
+		}()
+		id1, id2, id3 := t1.session.id, t2.session.id, t3.session.id
+
+		assert(manager.Create("alice", "-ops", []string{id1})).
+			Equals("", errors.New("broadcast group needs at least two terminals"))
+		assert(manager.Create("alice", "-ops", []string{id1, t4.session.id})).
+			Equals("", errors.New("terminal \""+t4.session.id+"\" does not exist"))
+		id, e := manager.Create("alice", "-ops", []string{id1, id2, id3})
+		assert(e).IsNil()
+		assert(manager.Create("alice", "-ops", []string{id1, id2})).
+			Equals("", errors.New("terminal \""+id1+"\" is already in broadcast group \""+id+"\""))
+
+		assert(len(manager.Targets(id1))).Equals(3)
+		assert(manager.Targets(t4.session.id) == nil).IsTrue()
+		assert(manager.SetMember("bob", "-ops", id, id3, false)).
+			Equals(errors.New("broadcast group \"" + id + "\" does not exist"))
+		assert(manager.SetMember("alice", "-ops", id, t4.session.id, false)).
+			Equals(errors.New("terminal \"" + t4.session.id + "\" is not in broadcast group \"" + id + "\""))
+		assert(manager.SetMember("alice", "-ops", id, id3, false)).IsNil()
+		assert(len(manager.Targets(id1))).Equals(2)
+		assert(manager.Targets(id3) == nil).IsTrue()
+
+		list := manager.List("alice", "-ops")
+		assert(len(list), list[0].(rpc.Map)["id"]).Equals(1, id)
+
+		manager.RemoveTerminal(id2)
+		assert(len(manager.Targets(id1))).Equals(1)
+		manager.RemoveTerminal(id3)
+		assert(manager.Targets(id1) == nil).IsTrue()
+		assert(manager.Close("alice", "-ops", id)).
+			Equals(errors.New("broadcast group \"" + id + "\" does not exist"))
+	})
+}
+
+func TestTerminal_input(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		t1, in1 := addTestBroadcastTerminal("alice", "-ops")
+		t2, in2 := addTestBroadcastTerminal("alice", "-ops")
+		t3, in3 := addTestBroadcastTerminal("alice", "-ops")
+		defer func() {
+			for _, v := range []*terminal{t1, t2, t3} {
+				gSessionRegistry.Remove(v.session.id)
+				gTerminalManager.Remove(v.session.id)
+			}
+		}()
+
+		assert(t1.input([]byte("a"))).IsNil()
+		id, _ := gBroadcastManager.Create("alice", "-ops", []string{t1.session.id, t2.session.id, t3.session.id})
+		defer gBroadcastManager.Close("alice", "-ops", id)
+		assert(t1.input([]byte("b"))).IsNil()
+		_ = gBroadcastManager.SetMember("alice", "-ops", id, t3.session.id, false)
+		assert(t2.input([]byte("c"))).IsNil()
+		assert(t3.input([]byte("d"))).IsNil()
+
+		assert(in1.String(), in2.String(), in3.String()).Equals("abc", "bc", "bd")
+		assert(t2.session.bytesIn).Equals(int64(2))
+
+		// the input would corrupt a file transfer
+		t2.transfer = core.NewZModem(core.ZModemDownload, nil, nil)
+		assert(t1.input([]byte("e"))).IsNil()
+		assert(in1.String(), in2.String()).Equals("abce", "bc")
+	})
+
+	t.Run("members typing at the same time", func(t *testing.T) {
+		assert := assert.New(t)
+		t1, in1 := addTestBroadcastTerminal("alice", "-ops")
+		t2, in2 := addTestBroadcastTerminal("alice", "-ops")
+		defer func() {
+			for _, v := range []*terminal{t1, t2} {
+				gSessionRegistry.Remove(v.session.id)
+				gTerminalManager.Remove(v.session.id)
+			}
+		}()
+		for _, v := range []*terminal{t1, t2} {
+			policy, _ := core.NewCommandPolicy(nil, []string{"^ls"})
+			v.guard = core.NewCommandGuard(policy)
+		}
+		id, _ := gBroadcastManager.Create("alice", "-ops", []string{t1.session.id, t2.session.id})
+		defer gBroadcastManager.Close("alice", "-ops", id)
+
+		wg := sync.WaitGroup{}
+		for _, v := range []*terminal{t1, t2} {
+			wg.Add(1)
+			go func(v *terminal) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					_ = v.input([]byte("ls\r"))
+				}
+			}(v)
+		}
+		wg.Wait()
+		assert(in1.String()).Equals(string(bytes.Repeat([]byte("ls\r"), 200)))
+		assert(in2.String()).Equals(in1.String())
+	})
+}
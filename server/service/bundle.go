@@ -0,0 +1,269 @@
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+const bundleVersion = 1
+
+// bundle is the plain content of an inventory backup. Each server is kept as
+// the map of its "ssh.<id>.<field>" values, so credentials, tags and known
+// host keys travel with it and ids are reassigned on import.
+type bundle struct {
+	Version int                 `json:"version"`
+	Servers []map[string]string `json:"servers"`
+	Groups  map[string]string   `json:"groups"`
+}
+
+func dbExportBundle(db *core.DB, bucket string) (*bundle, error) {
+	ret := &bundle{
+		Version: bundleVersion,
+		Servers: make([]map[string]string, 0),
+		Groups:  make(map[string]string),
+	}
+
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+
+		c := b.Cursor()
+		p := []byte("servers.")
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			fields := make(map[string]string)
+			fc := b.Cursor()
+			fp := core.DBKey("ssh.%s.", string(v))
+			for fk, fv := fc.Seek(fp); fk != nil && bytes.HasPrefix(fk, fp); fk, fv = fc.Next() {
+				fields[string(fk[len(fp):])] = string(fv)
+			}
+			ret.Servers = append(ret.Servers, fields)
+		}
+
+		p = []byte("groups.")
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			ret.Groups[string(k[len(p):])] = string(v)
+		}
+
+		return nil
+	})
+}
+
+func exportBundle(rt rpc.Runtime, sessionID string, passphrase string) (interface{}, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase is empty")
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if v, e := dbExportBundle(db, bucket); e != nil {
+		return nil, e
+	} else if data, e := json.Marshal(v); e != nil {
+		return nil, e
+	} else if ret, e := core.Encrypt([]byte(passphrase), data); e != nil {
+		return nil, e
+	} else {
+		return rpc.Bytes(ret), nil
+	}
+}
+
+func dbPutServerFields(b *bolt.Bucket, id string, fields map[string]string) error {
+	if e := b.Put(core.DBKey("servers.%s", id), []byte(id)); e != nil {
+		return e
+	}
+
+	for field, value := range fields {
+		if e := b.Put(core.DBKey("ssh.%s.%s", id, field), []byte(value)); e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// dbImportBundle restores the bundle. In "replace" mode all the servers and
+// groups are deleted first. In "merge" mode a server that has the same name
+// as an existing one overwrites it, and other servers are created.
+func dbImportBundle(db *core.DB, bucket string, v *bundle, mode string) (rpc.Map, error) {
+	if mode != "merge" && mode != "replace" {
+		return nil, fmt.Errorf("unknown import mode \"%s\"", mode)
+	} else if v.Version != bundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", v.Version)
+	}
+
+	created, updated, deleted := 0, 0, 0
+	if e := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+
+		names := make(map[string]string)
+		ids := make([]string, 0)
+		c := b.Cursor()
+		p := []byte("servers.")
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			ids = append(ids, string(v))
+			names[string(b.Get(core.DBKey("ssh.%s.name", string(v))))] = string(v)
+		}
+
+		if mode == "replace" {
+			for _, id := range ids {
+				dbDeleteServerInBucket(b, id)
+				deleted++
+			}
+			names = make(map[string]string)
+
+			p = []byte("groups.")
+			for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Seek(p) {
+				_ = b.Delete(k)
+			}
+		}
+
+		for _, fields := range v.Servers {
+			if id, ok := names[fields["name"]]; ok {
+				dbDeleteServerInBucket(b, id)
+				if e := dbPutServerFields(b, id, fields); e != nil {
+					return e
+				}
+				updated++
+			} else if seq, e := b.NextSequence(); e != nil {
+				return e
+			} else if e := dbPutServerFields(b, fmt.Sprintf("%d", seq), fields); e != nil {
+				return e
+			} else {
+				names[fields["name"]] = fmt.Sprintf("%d", seq)
+				created++
+			}
+		}
+
+		for name, expr := range v.Groups {
+			if e := b.Put(core.DBKey("groups.%s", name), []byte(expr)); e != nil {
+				return e
+			}
+		}
+
+		return nil
+	}); e != nil {
+		return nil, e
+	}
+
+	return rpc.Map{
+		"created": created,
+		"updated": updated,
+		"deleted": deleted,
+	}, nil
+}
+
+func importBundle(
+	rt rpc.Runtime, sessionID string, passphrase string, data rpc.Bytes, mode string,
+) (interface{}, error) {
+	v := &bundle{}
+	if len(data) <= 32 {
+		return nil, fmt.Errorf("bundle is corrupted")
+	} else if plain, e := core.Decrypt([]byte(passphrase), data); e != nil {
+		return nil, fmt.Errorf("passphrase is wrong or bundle is corrupted")
+	} else if e := json.Unmarshal(plain, v); e != nil {
+		return nil, e
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if ret, e := dbImportBundle(db, bucket, v, mode); e != nil {
+		return nil, e
+	} else {
+		return ret, nil
+	}
+}
+
+// dbImportCSV creates servers from a host list with the columns
+// "name,host,port,user,tags", tags are separated by spaces. The header row
+// is optional. Rows that conflict with existing servers are skipped.
+func dbImportCSV(db *core.DB, bucket string, content string, preview bool) (rpc.Array, error) {
+	ret := rpc.Array{}
+	reader := csv.NewReader(strings.NewReader(content))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	for line := 1; ; line++ {
+		record, e := reader.Read()
+		if e == io.EOF {
+			return ret, nil
+		} else if e != nil {
+			return nil, e
+		} else if line == 1 && len(record) > 1 && strings.EqualFold(record[1], "host") {
+			continue
+		}
+
+		for len(record) < 5 {
+			record = append(record, "")
+		}
+		name, host, port, user := record[0], record[1], record[2], record[3]
+		tags := strings.Fields(record[4])
+		if host == "" {
+			return nil, fmt.Errorf("line %d: host is empty", line)
+		}
+		if port == "" {
+			port = "22"
+		}
+		if name == "" {
+			name = fmt.Sprintf("%s@%s", user, host)
+		}
+		for _, tag := range tags {
+			if !serverTagRegex.MatchString(tag) {
+				return nil, fmt.Errorf("line %d: invalid tag \"%s\"", line, tag)
+			}
+		}
+
+		conflict := ""
+		if e := db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucket))
+			if b == nil {
+				return fmt.Errorf("bucket \"%s\" not exist", bucket)
+			}
+			conflict = dbFindServerConflict(b, name, host, port, user)
+			return nil
+		}); e != nil {
+			return nil, e
+		}
+
+		id := ""
+		if !preview && conflict == "" {
+			if id, e = dbAddServer(db, bucket, host, port, user, "", "", name, ""); e != nil {
+				return nil, e
+			} else if e = dbSetServerTags(db, bucket, id, tags); e != nil {
+				return nil, e
+			}
+		}
+
+		ret = append(ret, rpc.Map{
+			"id":       id,
+			"name":     name,
+			"host":     host,
+			"port":     port,
+			"user":     user,
+			"conflict": conflict,
+		})
+	}
+}
+
+func importCSV(rt rpc.Runtime, sessionID string, content string, preview bool) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if ret, e := dbImportCSV(db, bucket, content, preview); e != nil {
+		return nil, e
+	} else {
+		return ret, nil
+	}
+}
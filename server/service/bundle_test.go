@@ -0,0 +1,111 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestDBImportBundle(t *testing.T) {
+	prepareBundle := func() *bundle {
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-test")
+		_ = dbCreateServer(db, "-test", "1", "10.0.0.1", "22", "root", "pwd", "", "web", "")
+		_ = dbCreateServer(db, "-test", "2", "10.0.0.2", "22", "root", "", "KEY", "db", "")
+		_ = dbSetServerTags(db, "-test", "2", []string{"prod"})
+		_ = dbCreateGroup(db, "-test", "prod", "tag:prod")
+		ret, _ := dbExportBundle(db, "-test")
+		return ret
+	}
+
+	t.Run("unknown mode", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(dbImportBundle(nil, "-test", prepareBundle(), "none")).
+			Equals(nil, errors.New("unknown import mode \"none\""))
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		assert := assert.New(t)
+		v := prepareBundle()
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-test")
+		_ = dbCreateServer(db, "-test", "1", "10.0.0.9", "22", "admin", "", "", "web", "")
+		_ = dbCreateServer(db, "-test", "5", "10.0.0.5", "22", "admin", "", "", "mail", "")
+		_, _ = db.GetBucketID("-test")
+		assert(dbImportBundle(db, "-test", v, "merge")).Equals(rpc.Map{
+			"created": 1,
+			"updated": 1,
+			"deleted": 0,
+		}, nil)
+		servers, _ := dbListServers(db, "-test", false)
+		summary := make([]string, 0)
+		for _, v := range servers {
+			server := v.(rpc.Map)
+			summary = append(summary, fmt.Sprintf(
+				"%s %s %s@%s %t %v",
+				server["id"], server["name"], server["user"],
+				server["host"], server["auto"], server["tags"],
+			))
+		}
+		assert(summary).Equals([]string{
+			"1 web root@10.0.0.1 false []",
+			"2 db root@10.0.0.2 true [prod]",
+			"5 mail admin@10.0.0.5 false []",
+		})
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		assert := assert.New(t)
+		v := prepareBundle()
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-test")
+		_, _ = dbAddServer(db, "-test", "10.0.0.5", "22", "admin", "", "", "mail", "")
+		_ = dbCreateGroup(db, "-test", "old", "tag:old")
+		assert(dbImportBundle(db, "-test", v, "replace")).Equals(rpc.Map{
+			"created": 2,
+			"updated": 0,
+			"deleted": 1,
+		}, nil)
+		assert(dbListGroups(db, "-test")).Equals(rpc.Array{
+			rpc.Map{"name": "prod", "expr": "tag:prod"},
+		}, nil)
+		assert(dbResolveServers(db, "-test", []string{"@prod"})).
+			Equals([]string{"3"}, nil)
+	})
+}
+
+func TestDBImportCSV(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-test")
+		ret, e := dbImportCSV(
+			db, "-test",
+			"name,host,port,user,tags\nweb,10.0.0.1,,root,prod web\n,10.0.0.2,2222,admin\nweb,10.0.0.3\n",
+			false,
+		)
+		assert(e).IsNil()
+		assert(ret).Equals(rpc.Array{
+			rpc.Map{"id": "1", "name": "web", "host": "10.0.0.1", "port": "22", "user": "root", "conflict": ""},
+			rpc.Map{"id": "2", "name": "admin@10.0.0.2", "host": "10.0.0.2", "port": "2222", "user": "admin", "conflict": ""},
+			rpc.Map{"id": "", "name": "web", "host": "10.0.0.3", "port": "22", "user": "", "conflict": "server \"1\" has the same name"},
+		})
+	})
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func dbSetServerCharset(db *core.DB, bucket string, id string, charset string) error {
+	if e := core.CheckCharset(charset); e != nil {
+		return e
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if b.Get(core.DBKey("servers.%s", id)) == nil {
+			return fmt.Errorf("server \"%s\" does not exist", id)
+		} else {
+			return b.Put(core.DBKey("ssh.%s.charset", id), []byte(charset))
+		}
+	})
+}
+
+// setServerCharset sets the charset of the terminals of the server, it
+// applies to the terminals that are opened after
+func setServerCharset(rt rpc.Runtime, sessionID string, serverID string, charset string) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if e := dbSetServerCharset(db, bucket, serverID, charset); e != nil {
+		return nil, e
+	} else {
+		return true, nil
+	}
+}
+
+// writeInput encodes the input in the charset of the server and writes it
+// to the shell
+func (p *terminal) writeInput(input []byte) error {
+	p.mu.Lock()
+	input = p.encoder.Encode(input)
+	p.mu.Unlock()
+
+	n, e := p.stdin.Write(input)
+	p.session.AddBytesIn(n)
+	p.session.Throttle(n)
+	return e
+}
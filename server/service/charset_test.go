@@ -0,0 +1,50 @@
+package service
+
+import (
+	"os"
+	"testing"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestDbSetServerCharset(t *testing.T) {
+	t.Run("test", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := core.NewDB("test.db")
+		defer os.Remove("test.db")
+		_ = db.CreateBucketIsNotExist("-test")
+		_ = dbCreateServer(db, "-test", "1", "10.0.0.1", "22", "root", "pwd", "", "web", "")
+
+		assert(dbSetServerCharset(db, "-test", "1", "big5")).IsNotNil()
+		assert(dbSetServerCharset(db, "-test", "2", core.CharsetGBK)).IsNotNil()
+		assert(dbSetServerCharset(db, "-test", "1", core.CharsetGBK)).IsNil()
+		fields, _ := dbGetServer(db, "-test", "1")
+		assert(fields["charset"]).Equals("gbk")
+	})
+}
+
+func TestTerminal_charset(t *testing.T) {
+	t.Run("gbk", func(t *testing.T) {
+		assert := assert.New(t)
+		core.GetConfig().SetDBFile("charset_test.db")
+		defer func() {
+			core.GetConfig().SetDBFile("./vbot.db")
+			os.Remove("charset_test.db")
+		}()
+		db, _ := core.GetManager().GetDB("charset_test.db")
+		_ = db.CreateBucketIsNotExist("-test")
+		server := startTestEchoServer()
+		defer server.Close()
+
+		fields := server.Fields("pwd")
+		fields["charset"] = core.CharsetGBK
+		term, e := openTerminal(db, NewUser("alice", "charset-session"), "-test", "1", fields, "127.0.0.1")
+		assert(e).IsNil()
+		defer term.Close("")
+
+		assert(term.write([]byte("中文"))).IsNil()
+		assert(waitTerminalScreen(term, "中文")).IsTrue()
+		assert(term.session.bytesIn).Equals(int64(4))
+	})
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+const (
+	// commandLogBucket keeps the commands of all the terminals, it is
+	// trimmed with the audit log
+	commandLogBucket = "commands"
+	// commandMaxOutput is the size of the output that is kept for a command
+	commandMaxOutput = 4096
+	// commandDefaultLimit is the number of the commands that a search
+	// returns by default
+	commandDefaultLimit = 100
+)
+
+var gPromptPattern = regexp.MustCompile(core.DefaultPromptPattern)
+
+// commandRecord is a command that a user has run in a terminal, the exit
+// code is null if the shell does not report it
+type commandRecord struct {
+	Time      int64  `json:"time"`
+	Duration  int64  `json:"duration"`
+	User      string `json:"user"`
+	Workspace string `json:"workspace"`
+	ServerID  string `json:"serverID"`
+	SessionID string `json:"sessionID"`
+	Command   string `json:"command"`
+	ExitCode  *int   `json:"exitCode"`
+	Output    string `json:"output"`
+	Truncated bool   `json:"truncated"`
+}
+
+type commandFilter struct {
+	Workspace string
+	User      string
+	ServerID  string
+	Text      string
+	Since     int64
+	Until     int64
+	Limit     int
+}
+
+func parseCommandFilter(filter rpc.Map) (*commandFilter, error) {
+	ret := &commandFilter{Limit: commandDefaultLimit}
+	for key, value := range filter {
+		switch key {
+		case "user", "serverID", "text":
+			v, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid command filter \"%s\"", key)
+			}
+			switch key {
+			case "user":
+				ret.User = v
+			case "serverID":
+				ret.ServerID = v
+			default:
+				ret.Text = strings.ToLower(v)
+			}
+		case "since", "until", "limit":
+			v, ok := value.(int64)
+			if !ok || v < 0 {
+				return nil, fmt.Errorf("invalid command filter \"%s\"", key)
+			}
+			switch key {
+			case "since":
+				ret.Since = v
+			case "until":
+				ret.Until = v
+			default:
+				ret.Limit = int(v)
+			}
+		default:
+			return nil, fmt.Errorf("unknown command filter \"%s\"", key)
+		}
+	}
+	return ret, nil
+}
+
+// isMatch checks the record, the text is searched in the command and its
+// output and the case is ignored
+func (p *commandFilter) isMatch(record *commandRecord) bool {
+	if p.Workspace != "" && record.Workspace != p.Workspace {
+		return false
+	} else if p.User != "" && record.User != p.User {
+		return false
+	} else if p.ServerID != "" && record.ServerID != p.ServerID {
+		return false
+	} else if p.Text != "" &&
+		!strings.Contains(strings.ToLower(record.Command), p.Text) &&
+		!strings.Contains(strings.ToLower(record.Output), p.Text) {
+		return false
+	} else {
+		return true
+	}
+}
+
+func dbAppendCommand(db *core.DB, record *commandRecord, start time.Time) error {
+	if data, e := json.Marshal(record); e != nil {
+		return e
+	} else {
+		return db.AppendLog(commandLogBucket, start, data)
+	}
+}
+
+// dbSearchCommands returns the latest commands that match the filter in the
+// order of time
+func dbSearchCommands(db *core.DB, filter *commandFilter) ([]*commandRecord, error) {
+	start, end := time.Time{}, time.Time{}
+	if filter.Since > 0 {
+		start = time.Unix(0, filter.Since*int64(time.Millisecond))
+	}
+	if filter.Until > 0 {
+		end = time.Unix(0, filter.Until*int64(time.Millisecond))
+	}
+
+	ret := make([]*commandRecord, 0)
+	return ret, db.ScanLog(commandLogBucket, start, end, func(value []byte) bool {
+		record := &commandRecord{}
+		if e := json.Unmarshal(value, record); e == nil && filter.isMatch(record) {
+			ret = append(ret, record)
+			if filter.Limit > 0 && len(ret) > filter.Limit {
+				ret = ret[1:]
+			}
+		}
+		return true
+	})
+}
+
+// recordCommands follows the output of the terminal and returns the
+// commands that have finished, the caller must hold the lock
+func (p *terminal) recordCommands(output []byte, now time.Time) []*commandRecord {
+	ret := make([]*commandRecord, 0)
+	if p.recorder == nil {
+		return ret
+	}
+
+	for _, command := range p.recorder.Feed(output, now) {
+		ret = append(ret, &commandRecord{
+			Time:      getMillisecond(command.Start),
+			Duration:  getMillisecond(command.End) - getMillisecond(command.Start),
+			User:      p.user.name,
+			Workspace: p.workspace,
+			ServerID:  p.session.serverID,
+			SessionID: p.session.id,
+			Command:   command.Command,
+			ExitCode:  command.ExitCode,
+			Output:    command.Output,
+			Truncated: command.Truncated,
+		})
+	}
+	return ret
+}
+
+// saveCommands writes the commands to the command log, it is called without
+// the lock
+func (p *terminal) saveCommands(records []*commandRecord) {
+	for _, record := range records {
+		start := time.Unix(0, record.Time*int64(time.Millisecond))
+		if e := dbAppendCommand(p.db, record, start); e != nil {
+			log.Print(e)
+		}
+	}
+}
+
+// searchCommands returns the commands of the terminals in the current
+// workspace, the filter has user, serverID, text, since, until and limit
+func searchCommands(rt rpc.Runtime, sessionID string, filter rpc.Map) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if v, e := parseCommandFilter(filter); e != nil {
+		return rt.Reply(e)
+	} else {
+		v.Workspace = strings.TrimPrefix(bucket, "-")
+		if records, e := dbSearchCommands(db, v); e != nil {
+			return rt.Reply(e)
+		} else {
+			ret := make(rpc.Array, 0, len(records))
+			for _, record := range records {
+				ret = append(ret, toMap(record))
+			}
+			return rt.Reply(ret)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseCommandFilter(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(parseCommandFilter(rpc.Map{"user": "alice", "text": "RM", "limit": int64(5)})).
+			Equals(&commandFilter{User: "alice", Text: "rm", Limit: 5}, nil)
+		assert(parseCommandFilter(rpc.Map{"limit": "5"})).
+			Equals((*commandFilter)(nil), errors.New("invalid command filter \"limit\""))
+		assert(parseCommandFilter(rpc.Map{"host": "web"})).
+			Equals((*commandFilter)(nil), errors.New("unknown command filter \"host\""))
+	})
+}
+
+func TestTerminal_recordCommands(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		core.GetConfig().SetDBFile("cmdlog_test.db")
+		defer func() {
+			core.GetConfig().SetDBFile("./vbot.db")
+			os.Remove("cmdlog_test.db")
+		}()
+		db, _ := core.GetManager().GetDB("cmdlog_test.db")
+		_ = db.CreateBucketIsNotExist("-test")
+
+		// the shell echoes the input and answers a line with its length
+		server := startTestSSHServer("pwd", nil)
+		server.fnShell = func(channel ssh.Channel) {
+			_, _ = channel.Write([]byte("Welcome\r\nroot@web:~# "))
+			line, buf := []byte(nil), make([]byte, 1024)
+			for {
+				n, e := channel.Read(buf)
+				if e != nil {
+					return
+				}
+				for _, c := range buf[:n] {
+					if c != '\r' {
+						line = append(line, c)
+						_, _ = channel.Write([]byte{c})
+					} else if string(line) == "exit" {
+						return
+					} else {
+						_, _ = channel.Write([]byte("\r\nlength " + string(rune('0'+len(line))) + "\r\nroot@web:~# "))
+						line = line[:0]
+					}
+				}
+			}
+		}
+		defer server.Close()
+
+		term, e := openTerminal(db, NewUser("alice", "cmdlog-session"), "-test", "1", server.Fields("pwd"), "")
+		assert(e).IsNil()
+		assert(waitTerminalScreen(term, "Welcome")).IsTrue()
+		for _, command := range []string{"uptime\r", "ls -l\r", "exit\r"} {
+			for _, c := range command {
+				assert(term.write([]byte(string(c)))).IsNil()
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		closed := []*auditRecord(nil)
+		for i := 0; i < 200 && len(closed) == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+			closed, _, _ = dbQueryAudit(db, &auditFilter{Method: "terminal:close"})
+		}
+		assert(len(closed)).Equals(1)
+
+		records := []*commandRecord(nil)
+		for i := 0; i < 200 && len(records) < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+			records, e = dbSearchCommands(db, &commandFilter{User: "alice", ServerID: "1"})
+		}
+		assert(e, len(records)).Equals(nil, 2)
+		assert(records[0].Command, records[0].Output, records[0].ExitCode).
+			Equals("uptime", "length 6\n", (*int)(nil))
+		assert(records[1].Workspace, records[1].SessionID).Equals("test", term.session.id)
+
+		records, _ = dbSearchCommands(db, &commandFilter{Text: "length 5"})
+		assert(len(records), records[0].Command).Equals(1, "ls -l")
+		records, _ = dbSearchCommands(db, &commandFilter{User: "bob"})
+		assert(len(records)).Equals(0)
+	})
+}
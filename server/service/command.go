@@ -0,0 +1,174 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+// commandMatchBucket keeps the matches of the command policies in all the
+// workspaces, it is trimmed with the audit log
+const commandMatchBucket = "commandMatches"
+
+// commandPolicy is stored as "command.<serverID>.policy"
+type commandPolicy struct {
+	Deny  []core.CommandRule `json:"deny"`
+	Allow []string           `json:"allow"`
+}
+
+func dbGetCommandPolicy(db *core.DB, bucket string, id string) (*commandPolicy, error) {
+	ret := &commandPolicy{Deny: make([]core.CommandRule, 0), Allow: make([]string, 0)}
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if data := b.Get(core.DBKey("command.%s.policy", id)); data == nil {
+			return nil
+		} else {
+			return json.Unmarshal(data, ret)
+		}
+	})
+}
+
+// dbGetCommandGuard returns the guard of the terminal on the server, it
+// returns nil if the server has no command policy
+func dbGetCommandGuard(db *core.DB, bucket string, id string) (*core.CommandGuard, error) {
+	if policy, e := dbGetCommandPolicy(db, bucket, id); e != nil {
+		return nil, e
+	} else if len(policy.Deny) == 0 && len(policy.Allow) == 0 {
+		return nil, nil
+	} else if v, e := core.NewCommandPolicy(policy.Deny, policy.Allow); e != nil {
+		return nil, e
+	} else {
+		return core.NewCommandGuard(v), nil
+	}
+}
+
+func dbLogCommandMatch(
+	db *core.DB, bucket string, user string, id string, match *core.CommandMatch, t time.Time,
+) error {
+	data, e := json.Marshal(rpc.Map{
+		"workspace": strings.TrimPrefix(bucket, "-"),
+		"user":      user,
+		"serverID":  id,
+		"line":      match.Line,
+		"pattern":   match.Pattern,
+		"action":    match.Action,
+		"time":      getMillisecond(t),
+	})
+	if e != nil {
+		return e
+	}
+	return db.AppendLog(commandMatchBucket, t, data)
+}
+
+// dbListCommandMatches returns the matches in the workspace of the bucket
+// since the time (unix milliseconds)
+func dbListCommandMatches(db *core.DB, bucket string, since int64) (rpc.Array, error) {
+	start := time.Time{}
+	if since > 0 {
+		start = time.Unix(0, since*int64(time.Millisecond))
+	}
+
+	workspace := strings.TrimPrefix(bucket, "-")
+	ret := rpc.Array{}
+	return ret, db.ScanLog(commandMatchBucket, start, time.Time{}, func(value []byte) bool {
+		if item := jsonToMap(value); item != nil && item["workspace"] == workspace {
+			ret = append(ret, item)
+		}
+		return true
+	})
+}
+
+func getCommandNotice(match *core.CommandMatch) string {
+	switch match.Action {
+	case core.CommandActionBlock:
+		return fmt.Sprintf("\r\n[vbot] command blocked by policy \"%s\"\r\n", match.Pattern)
+	case core.CommandActionConfirm:
+		return fmt.Sprintf(
+			"\r\n[vbot] command matches policy \"%s\", press Enter to run it or any other key to cancel\r\n",
+			match.Pattern,
+		)
+	case core.CommandActionCancelled:
+		return "\r\n[vbot] command cancelled\r\n"
+	default:
+		return ""
+	}
+}
+
+func dbSetCommandPolicy(db *core.DB, bucket string, id string, policy *commandPolicy) error {
+	if _, e := core.NewCommandPolicy(policy.Deny, policy.Allow); e != nil {
+		return e
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if b.Get(core.DBKey("servers.%s", id)) == nil {
+			return fmt.Errorf("server \"%s\" does not exist", id)
+		} else {
+			return dbPutJSON(b, core.DBKey("command.%s.policy", id), policy)
+		}
+	})
+}
+
+func setCommandPolicy(
+	rt rpc.Runtime, sessionID string, serverID string, deny rpc.Array, allow rpc.Array,
+) (interface{}, error) {
+	policy := &commandPolicy{Deny: make([]core.CommandRule, 0)}
+	for _, v := range deny {
+		rule, ok := v.(rpc.Map)
+		if !ok {
+			return nil, fmt.Errorf("invalid command rule \"%v\"", v)
+		}
+		pattern, _ := rule["pattern"].(string)
+		action, _ := rule["action"].(string)
+		policy.Deny = append(policy.Deny, core.CommandRule{Pattern: pattern, Action: action})
+	}
+
+	allowList, e := toStringList(allow)
+	if e != nil {
+		return nil, e
+	}
+	policy.Allow = allowList
+
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if e := dbSetCommandPolicy(db, bucket, serverID, policy); e != nil {
+		return nil, e
+	} else {
+		return true, nil
+	}
+}
+
+func getCommandPolicy(rt rpc.Runtime, sessionID string, serverID string) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if policy, e := dbGetCommandPolicy(db, bucket, serverID); e != nil {
+		return nil, e
+	} else {
+		return toMap(policy), nil
+	}
+}
+
+func listCommandMatches(rt rpc.Runtime, sessionID string, since int64) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if ret, e := dbListCommandMatches(db, bucket, since); e != nil {
+		return nil, e
+	} else {
+		return ret, nil
+	}
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestDBGetCommandGuard(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-test")
+		_ = dbCreateServer(db, "-test", "1", "10.0.0.1", "22", "root", "", "", "web", "")
+
+		assert(dbGetCommandGuard(db, "-test", "1")).Equals(nil, nil)
+		assert(dbSetCommandPolicy(db, "-test", "1", &commandPolicy{
+			Deny: []core.CommandRule{{Pattern: "(", Action: core.CommandActionBlock}},
+		})).Equals(errors.New("invalid command pattern \"(\""))
+		assert(dbSetCommandPolicy(db, "-test", "2", &commandPolicy{})).
+			Equals(errors.New("server \"2\" does not exist"))
+
+		assert(dbSetCommandPolicy(db, "-test", "1", &commandPolicy{
+			Deny: []core.CommandRule{{Pattern: "^shutdown", Action: core.CommandActionBlock}},
+		})).IsNil()
+		guard, e := dbGetCommandGuard(db, "-test", "1")
+		assert(e).IsNil()
+		input, matches := guard.Feed([]byte("shutdown -h now\r"))
+		assert(string(input), len(matches)).Equals("shutdown -h now\x15", 1)
+	})
+}
+
+func TestDBLogCommandMatch(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+
+		base := time.Unix(1700000000, 0)
+		match := &core.CommandMatch{Line: "rm -rf /", Pattern: "rm -rf", Action: core.CommandActionBlock}
+		assert(dbLogCommandMatch(db, "-ops", "alice", "1", match, base)).IsNil()
+		assert(dbLogCommandMatch(db, "-ops", "alice", "1", match, base.Add(time.Minute))).IsNil()
+		assert(dbLogCommandMatch(db, "-dev", "bob", "2", match, base.Add(time.Minute))).IsNil()
+
+		ret, e := dbListCommandMatches(db, "-ops", 0)
+		assert(e, len(ret)).Equals(nil, 2)
+		assert(ret[0].(rpc.Map)["user"], ret[0].(rpc.Map)["line"]).Equals("alice", "rm -rf /")
+		ret, _ = dbListCommandMatches(db, "-ops", getMillisecond(base.Add(time.Second)))
+		assert(len(ret)).Equals(1)
+
+		assert(db.TrimLog(commandMatchBucket, base.Add(time.Second))).Equals(1, nil)
+		ret, _ = dbListCommandMatches(db, "-ops", 0)
+		assert(len(ret)).Equals(1)
+	})
+}
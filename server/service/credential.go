@@ -0,0 +1,139 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+var CredentialService = rpc.NewService(nil).
+	On("Set", auditAction("credential:Set", setCredential, 2)).
+	On("List", auditAction("credential:List", listCredentials)).
+	On("Delete", auditAction("credential:Delete", deleteCredential))
+
+// credential is a secret of a workspace, the secret is encrypted with the
+// credential key and it is never replied to the client
+type credential struct {
+	Name      string `json:"name"`
+	Secret    []byte `json:"secret"`
+	UpdatedBy string `json:"updatedBy"`
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+func (p *credential) ToMap() rpc.Map {
+	return rpc.Map{
+		"name":      p.Name,
+		"updatedBy": p.UpdatedBy,
+		"updatedAt": p.UpdatedAt,
+	}
+}
+
+func dbSetCredential(db *core.DB, bucket string, name string, secret string, user string) error {
+	if name == "" {
+		return fmt.Errorf("credential name is empty")
+	} else if secret == "" {
+		return fmt.Errorf("credential secret is empty")
+	}
+
+	data, e := core.EncryptCredential([]byte(secret))
+	if e != nil {
+		return e
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+		return dbPutJSON(b, core.DBKey("credential.%s", name), &credential{
+			Name:      name,
+			Secret:    data,
+			UpdatedBy: user,
+			UpdatedAt: getMillisecond(time.Now()),
+		})
+	})
+}
+
+func dbGetCredential(db *core.DB, bucket string, name string) (*credential, error) {
+	ret := &credential{}
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if data := b.Get(core.DBKey("credential.%s", name)); data == nil {
+			return fmt.Errorf("credential \"%s\" does not exist", name)
+		} else {
+			return json.Unmarshal(data, ret)
+		}
+	})
+}
+
+// dbGetCredentialSecret returns the decrypted secret of the credential
+func dbGetCredentialSecret(db *core.DB, bucket string, name string) (string, error) {
+	if v, e := dbGetCredential(db, bucket, name); e != nil {
+		return "", e
+	} else if secret, e := core.DecryptCredential(v.Secret); e != nil {
+		return "", fmt.Errorf("credential \"%s\" can not be decrypted", name)
+	} else {
+		return string(secret), nil
+	}
+}
+
+func dbListCredentials(db *core.DB, bucket string) (rpc.Array, error) {
+	return dbListObjects(db, bucket, "credential", func(data []byte) rpc.Map {
+		v := &credential{}
+		if e := json.Unmarshal(data, v); e != nil {
+			return nil
+		}
+		return v.ToMap()
+	})
+}
+
+func dbDeleteCredential(db *core.DB, bucket string, name string) error {
+	if _, e := dbGetCredential(db, bucket, name); e != nil {
+		return e
+	}
+	return dbDeleteObject(db, bucket, "credential", name)
+}
+
+func setCredential(rt rpc.Runtime, sessionID string, name string, secret string) (interface{}, error) {
+	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return nil, e
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if e := dbSetCredential(db, bucket, name, secret, userName); e != nil {
+		return nil, e
+	} else {
+		return true, nil
+	}
+}
+
+func listCredentials(rt rpc.Runtime, sessionID string) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if ret, e := dbListCredentials(db, bucket); e != nil {
+		return nil, e
+	} else {
+		return ret, nil
+	}
+}
+
+func deleteCredential(rt rpc.Runtime, sessionID string, name string) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if e := dbDeleteCredential(db, bucket, name); e != nil {
+		return nil, e
+	} else {
+		return true, nil
+	}
+}
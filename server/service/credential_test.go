@@ -0,0 +1,46 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestDBSetCredential(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		core.GetConfig().SetCredentialKeyFile("test.key")
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			core.GetConfig().SetCredentialKeyFile("./vbot.key")
+			os.Remove("test.key")
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-ops")
+
+		assert(dbSetCredential(db, "-ops", "", "pwd", "alice")).
+			Equals(errors.New("credential name is empty"))
+		assert(dbSetCredential(db, "-ops", "sudo", "", "alice")).
+			Equals(errors.New("credential secret is empty"))
+		assert(dbSetCredential(db, "-ops", "sudo", "s3cret", "alice")).IsNil()
+
+		v, e := dbGetCredential(db, "-ops", "sudo")
+		assert(e).IsNil()
+		assert(string(v.Secret) == "s3cret").IsFalse()
+		assert(dbGetCredentialSecret(db, "-ops", "sudo")).Equals("s3cret", nil)
+
+		list, e := dbListCredentials(db, "-ops")
+		assert(e, len(list)).Equals(nil, 1)
+		assert(list[0].(rpc.Map)["name"], list[0].(rpc.Map)["secret"]).Equals("sudo", nil)
+
+		assert(dbDeleteCredential(db, "-ops", "sudo")).IsNil()
+		assert(dbGetCredentialSecret(db, "-ops", "sudo")).
+			Equals("", errors.New("credential \"sudo\" does not exist"))
+		assert(dbDeleteCredential(db, "-ops", "sudo")).
+			Equals(errors.New("credential \"sudo\" does not exist"))
+	})
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+	"golang.org/x/crypto/ssh"
+)
+
+const execConcurrency = 16
+
+// dbExecOnServers runs the command on the servers as the user and returns
+// the result of every server in the order of the ids
+func dbExecOnServers(db *core.DB, bucket string, user string, ids []string, command string) (rpc.Array, error) {
+	limits, e := dbGetSessionLimits(db, bucket)
+	if e != nil {
+		return nil, e
+	}
+
+	ret := make(rpc.Array, len(ids))
+	waitCH := make(chan bool, execConcurrency)
+	wg := sync.WaitGroup{}
+	for i, id := range ids {
+		wg.Add(1)
+		waitCH <- true
+		go func(i int, id string) {
+			defer func() {
+				<-waitCH
+				wg.Done()
+			}()
+
+			result := rpc.Map{"id": id, "output": "", "exitStatus": int64(-1), "error": ""}
+			ret[i] = result
+			fields, e := dbGetServer(db, bucket, id)
+			if e != nil {
+				result["error"] = e.Error()
+				return
+			}
+			result["name"] = fields["name"]
+
+			if e := dbCheckServerAccess(db, bucket, id, user, time.Now()); e != nil {
+				result["error"] = e.Error()
+			} else if output, e := runExecSession(db, bucket, id, user, fields, command, limits); e == nil {
+				result["output"], result["exitStatus"] = output, int64(0)
+			} else if exitError, ok := e.(*ssh.ExitError); ok {
+				result["output"], result["exitStatus"] = output, int64(exitError.ExitStatus())
+			} else {
+				result["output"], result["error"] = output, e.Error()
+			}
+		}(i, id)
+	}
+	wg.Wait()
+
+	return ret, nil
+}
+
+// runExecSession runs the command on a pooled connection in a session of the
+// registry, so that it is counted by the limits and can be terminated
+func runExecSession(
+	db *core.DB, bucket string, id string, user string, fields map[string]string, command string,
+	limits *sessionLimits,
+) (string, error) {
+	closeReason := ""
+	sshSession := (*ssh.Session)(nil)
+	mu := sync.Mutex{}
+
+	session := &Session{
+		kind:      "exec",
+		user:      user,
+		bucket:    bucket,
+		serverID:  id,
+		startTime: time.Now(),
+		fnClose: func(reason string) {
+			mu.Lock()
+			defer mu.Unlock()
+			closeReason = reason
+			if sshSession != nil {
+				_ = sshSession.Close()
+			}
+		},
+	}
+	sessionID, e := gSessionRegistry.Add(session, limits)
+	if e != nil {
+		return "", e
+	}
+	defer gSessionRegistry.Remove(sessionID)
+
+	session.AddBytesIn(len(command))
+	return gSSHPool.run(bucket+"/"+id, fields, dbTrustHostKey(db, bucket, id), command, func(client *ssh.Client, cmd string) (string, error) {
+		mu.Lock()
+		if closeReason != "" {
+			mu.Unlock()
+			return "", &sessionClosedError{reason: closeReason}
+		}
+		v, e := client.NewSession()
+		if e != nil {
+			mu.Unlock()
+			return "", &newSessionError{err: e}
+		}
+		sshSession = v
+		mu.Unlock()
+		defer v.Close()
+
+		output, e := v.CombinedOutput(cmd)
+		session.AddBytesOut(len(output))
+
+		mu.Lock()
+		defer mu.Unlock()
+		if closeReason != "" {
+			return string(output), &sessionClosedError{reason: closeReason}
+		}
+		return string(output), e
+	})
+}
+
+// execCommand runs the command on the targets (server ids and "@group"s).
+// If an approval policy matches the servers, an approval request is created
+// and the command runs after it has been approved.
+func execCommand(rt rpc.Runtime, sessionID string, targets rpc.Array, command string) (interface{}, error) {
+	if command == "" {
+		return nil, fmt.Errorf("command is empty")
+	} else if len(targets) == 0 {
+		return nil, fmt.Errorf("target is empty")
+	} else if targetList, e := toStringList(targets); e != nil {
+		return nil, e
+	} else if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return nil, e
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleOperator).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if ids, e := dbResolveServers(db, bucket, targetList); e != nil {
+		return nil, e
+	} else if policy, e := dbMatchApprovalPolicy(db, bucket, ids); e != nil {
+		return nil, e
+	} else if policy != nil {
+		if id, e := dbCreateApprovalRequest(
+			db, bucket, userName, "exec", targetList, ids, command, policy, time.Now(),
+		); e != nil {
+			return nil, e
+		} else {
+			return rpc.Map{"state": "pending", "approval": id}, nil
+		}
+	} else if results, e := dbExecOnServers(db, bucket, userName, ids, command); e != nil {
+		return nil, e
+	} else {
+		return rpc.Map{"state": "done", "results": results}, nil
+	}
+}
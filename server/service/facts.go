@@ -0,0 +1,256 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+const factsConcurrency = 8
+
+// factsScript only runs read-only commands, the output of each command
+// follows a "@@<section>" marker line
+var factsScript = strings.Join([]string{
+	"echo '@@hostname'; hostname 2>/dev/null",
+	"echo '@@uname'; uname -srm 2>/dev/null",
+	"echo '@@os-release'; cat /etc/os-release 2>/dev/null",
+	"echo '@@nproc'; nproc 2>/dev/null",
+	"echo '@@free'; free -b 2>/dev/null",
+	"echo '@@df'; df -P -k / 2>/dev/null",
+	"echo '@@ip'; hostname -I 2>/dev/null || ip -o addr show 2>/dev/null",
+	"echo '@@uptime'; cat /proc/uptime 2>/dev/null",
+	"exit 0",
+}, "\n")
+
+func splitScriptSections(output string) map[string][]string {
+	ret := make(map[string][]string)
+	section := ""
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "@@") {
+			section = line[2:]
+			ret[section] = make([]string, 0)
+		} else if section != "" && strings.TrimSpace(line) != "" {
+			ret[section] = append(ret[section], line)
+		}
+	}
+	return ret
+}
+
+// parseFacts converts the output of factsScript to facts, all the sizes
+// are in bytes and uptime is in seconds
+func parseFacts(output string) map[string]string {
+	ret := make(map[string]string)
+	sections := splitScriptSections(output)
+
+	if lines := sections["hostname"]; len(lines) > 0 {
+		ret["hostname"] = strings.TrimSpace(lines[0])
+	}
+
+	if lines := sections["uname"]; len(lines) > 0 {
+		if fields := strings.Fields(lines[0]); len(fields) == 3 {
+			ret["kernelName"], ret["kernel"], ret["arch"] = fields[0], fields[1], fields[2]
+		}
+	}
+
+	for _, line := range sections["os-release"] {
+		if idx := strings.Index(line, "="); idx > 0 {
+			value := strings.Trim(strings.TrimSpace(line[idx+1:]), "\"'")
+			switch line[:idx] {
+			case "ID":
+				ret["os"] = value
+			case "VERSION_ID":
+				ret["osVersion"] = value
+			case "PRETTY_NAME":
+				ret["osName"] = value
+			}
+		}
+	}
+
+	if lines := sections["nproc"]; len(lines) > 0 {
+		ret["cpus"] = strings.TrimSpace(lines[0])
+	}
+
+	for _, line := range sections["free"] {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "Mem:" {
+			ret["memTotal"] = fields[1]
+			if len(fields) >= 7 {
+				ret["memAvailable"] = fields[6]
+			}
+		} else if len(fields) >= 2 && fields[0] == "Swap:" {
+			ret["swapTotal"] = fields[1]
+		}
+	}
+
+	if lines := sections["df"]; len(lines) > 1 {
+		if fields := strings.Fields(lines[len(lines)-1]); len(fields) >= 6 {
+			total, e1 := strconv.ParseInt(fields[1], 10, 64)
+			used, e2 := strconv.ParseInt(fields[2], 10, 64)
+			if e1 == nil && e2 == nil {
+				ret["diskTotal"] = strconv.FormatInt(total*1024, 10)
+				ret["diskUsed"] = strconv.FormatInt(used*1024, 10)
+				ret["diskUsage"] = fields[4]
+			}
+		}
+	}
+
+	ips := make([]string, 0)
+	for _, line := range sections["ip"] {
+		fields := strings.Fields(line)
+		if len(sections["ip"]) == 1 && !strings.Contains(line, "inet") {
+			// the output of "hostname -I"
+			ips = append(ips, fields...)
+			continue
+		}
+		for i := 0; i+1 < len(fields); i++ {
+			if (fields[i] == "inet" || fields[i] == "inet6") &&
+				!strings.HasPrefix(fields[i+1], "127.") &&
+				!strings.HasPrefix(fields[i+1], "::1/") {
+				ips = append(ips, strings.SplitN(fields[i+1], "/", 2)[0])
+			}
+		}
+	}
+	if len(ips) > 0 {
+		ret["ips"] = strings.Join(ips, ",")
+	}
+
+	if lines := sections["uptime"]; len(lines) > 0 {
+		if fields := strings.Fields(lines[0]); len(fields) > 0 {
+			if v, e := strconv.ParseFloat(fields[0], 64); e == nil {
+				ret["uptime"] = strconv.FormatInt(int64(v), 10)
+			}
+		}
+	}
+
+	return ret
+}
+
+func collectFacts(
+	poolKey string, fields map[string]string, trust func(hostKey string) error,
+) (map[string]string, error) {
+	output, e := gSSHPool.RunCommand(poolKey, fields, trust, factsScript)
+	if e != nil {
+		return nil, e
+	}
+	return parseFacts(output), nil
+}
+
+// dbSaveFacts replaces the facts of the server, if err is not nil the old
+// facts are kept and only the error is recorded
+func dbSaveFacts(
+	db *core.DB, bucket string, id string, facts map[string]string, t time.Time, err error,
+) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if b.Get(core.DBKey("servers.%s", id)) == nil {
+			return fmt.Errorf("server \"%s\" does not exist", id)
+		}
+
+		if err != nil {
+			return b.Put(core.DBKey("factMeta.%s.error", id), []byte(err.Error()))
+		}
+
+		c := b.Cursor()
+		p := core.DBKey("fact.%s.", id)
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Seek(p) {
+			if e := b.Delete(k); e != nil {
+				return e
+			}
+		}
+
+		for key, value := range facts {
+			if e := b.Put(core.DBKey("fact.%s.%s", id, key), []byte(value)); e != nil {
+				return e
+			}
+		}
+
+		if e := b.Put(core.DBKey("factMeta.%s.error", id), []byte("")); e != nil {
+			return e
+		}
+		return b.Put(
+			core.DBKey("factMeta.%s.time", id),
+			[]byte(strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)),
+		)
+	})
+}
+
+func dbGetFacts(b *bolt.Bucket, id string) rpc.Map {
+	facts := rpc.Map{}
+	c := b.Cursor()
+	p := core.DBKey("fact.%s.", id)
+	for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+		facts[string(k[len(p):])] = string(v)
+	}
+
+	updateTime, _ := strconv.ParseInt(string(b.Get(core.DBKey("factMeta.%s.time", id))), 10, 64)
+	return rpc.Map{
+		"values": facts,
+		"time":   updateTime,
+		"error":  string(b.Get(core.DBKey("factMeta.%s.error", id))),
+	}
+}
+
+// runFactsCollection refreshes the facts of all the servers of all the users
+func runFactsCollection(db *core.DB) {
+	buckets, e := db.ListBuckets("-")
+	if e != nil {
+		return
+	}
+
+	for _, bucket := range buckets {
+		ids, e := dbListServerIDs(db, bucket)
+		if e != nil {
+			continue
+		}
+
+		waitCH := make(chan bool, factsConcurrency)
+		wg := sync.WaitGroup{}
+		for _, id := range ids {
+			wg.Add(1)
+			waitCH <- true
+			go func(id string) {
+				defer func() {
+					<-waitCH
+					wg.Done()
+				}()
+
+				if fields, e := dbGetServer(db, bucket, id); e == nil && !isLocalServer(fields) {
+					facts, e := collectFacts(bucket+"/"+id, fields, dbTrustHostKey(db, bucket, id))
+					_ = dbSaveFacts(db, bucket, id, facts, time.Now(), e)
+				}
+			}(id)
+		}
+		wg.Wait()
+	}
+}
+
+func refreshFacts(rt rpc.Runtime, sessionID string, serverID string) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleOperator).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if fields, e := dbGetServer(db, bucket, serverID); e != nil {
+		return nil, e
+	} else if facts, e := collectFacts(bucket+"/"+serverID, fields, dbTrustHostKey(db, bucket, serverID)); e != nil {
+		_ = dbSaveFacts(db, bucket, serverID, nil, time.Now(), e)
+		return nil, e
+	} else if e := dbSaveFacts(db, bucket, serverID, facts, time.Now(), nil); e != nil {
+		return nil, e
+	} else {
+		ret := rpc.Map{}
+		for key, value := range facts {
+			ret[key] = value
+		}
+		return ret, nil
+	}
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+const testFactsOutput = `@@hostname
+web-1
+@@uname
+Linux 5.15.0-91-generic x86_64
+@@os-release
+NAME="Ubuntu"
+VERSION_ID="22.04"
+ID=ubuntu
+PRETTY_NAME="Ubuntu 22.04.3 LTS"
+@@nproc
+4
+@@free
+               total        used        free      shared  buff/cache   available
+Mem:      8233017344  1185226752  5108535296     1638400  1939255296  6759030784
+Swap:     2147479552           0  2147479552
+@@df
+Filesystem     1024-blocks     Used Available Capacity Mounted on
+/dev/sda1         40581564 10240000  28246620      27% /
+@@ip
+10.2.0.8 172.17.0.1
+@@uptime
+35102.51 138290.17
+`
+
+func TestParseFacts(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(parseFacts(testFactsOutput)).Equals(map[string]string{
+			"hostname":     "web-1",
+			"kernelName":   "Linux",
+			"kernel":       "5.15.0-91-generic",
+			"arch":         "x86_64",
+			"os":           "ubuntu",
+			"osVersion":    "22.04",
+			"osName":       "Ubuntu 22.04.3 LTS",
+			"cpus":         "4",
+			"memTotal":     "8233017344",
+			"memAvailable": "6759030784",
+			"swapTotal":    "2147479552",
+			"diskTotal":    "41555521536",
+			"diskUsed":     "10485760000",
+			"diskUsage":    "27%",
+			"ips":          "10.2.0.8,172.17.0.1",
+			"uptime":       "35102",
+		})
+	})
+
+	t.Run("ip addr output", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(parseFacts("@@ip\n" +
+			"1: lo    inet 127.0.0.1/8 scope host lo\n" +
+			"2: eth0    inet 10.0.0.5/24 brd 10.0.0.255 scope global eth0\n" +
+			"2: eth0    inet6 fe80::1/64 scope link\n",
+		)).Equals(map[string]string{"ips": "10.0.0.5,fe80::1"})
+	})
+}
+
+func TestCollectFacts(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		server := startTestSSHServer("pwd", func(cmd string) (string, uint32) {
+			assert(cmd).Equals(factsScript)
+			return testFactsOutput, 0
+		})
+		defer server.Close()
+
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-test")
+		fields := server.Fields("pwd")
+		_ = dbCreateServer(
+			db, "-test", "1", fields["host"], fields["port"], "root", "pwd", "", "web", "",
+		)
+		runFactsCollection(db)
+
+		_ = dbCreateGroup(db, "-test", "ubuntu", "os:ubuntu AND ips:172.17.*")
+		assert(dbResolveServers(db, "-test", []string{"@ubuntu"})).
+			Equals([]string{"1"}, nil)
+
+		_ = db.View(func(tx *bolt.Tx) error {
+			facts := dbGetFacts(tx.Bucket([]byte("-test")), "1")
+			assert(facts["values"].(rpc.Map)["hostname"]).Equals("web-1")
+			assert(facts["error"]).Equals("")
+			assert(facts["time"].(int64) > 0).IsTrue()
+			return nil
+		})
+
+		// a failed collection keeps the old facts
+		server.Close()
+		_, e := collectFacts("-test/2", fields, nil)
+		assert(e).IsNotNil()
+		assert(dbSaveFacts(db, "-test", "1", nil, time.Now(), e)).IsNil()
+		_ = db.View(func(tx *bolt.Tx) error {
+			facts := dbGetFacts(tx.Bucket([]byte("-test")), "1")
+			assert(facts["values"].(rpc.Map)["os"]).Equals("ubuntu")
+			assert(facts["error"]).Equals(e.Error())
+			return nil
+		})
+	})
+}
@@ -0,0 +1,213 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+var (
+	groupNameRegex = regexp.MustCompile(`^[-_0-9a-zA-Z]+$`)
+)
+
+var GroupService = rpc.NewService(nil).
+	On("Create", createGroup).
+	On("List", listGroups).
+	On("Delete", deleteGroup).
+	On("Resolve", resolveGroup)
+
+func dbMatchServer(b *bolt.Bucket, id string, query *core.Query) bool {
+	return query.Match(func(key string, pattern string) bool {
+		switch key {
+		case "id":
+			return core.MatchPattern(pattern, id)
+		case "":
+			return core.MatchPattern(pattern, string(b.Get(core.DBKey("ssh.%s.name", id)))) ||
+				core.MatchPattern(pattern, string(b.Get(core.DBKey("ssh.%s.host", id))))
+		case "name", "host", "port", "user", "comment":
+			return core.MatchPattern(pattern, string(b.Get(core.DBKey("ssh.%s.%s", id, key))))
+		case "tag":
+			for _, tag := range dbGetServerTags(b, id) {
+				if core.MatchPattern(pattern, tag) {
+					return true
+				}
+			}
+			return false
+		case "ips":
+			for _, ip := range strings.Split(string(b.Get(core.DBKey("fact.%s.ips", id))), ",") {
+				if ip != "" && core.MatchPattern(pattern, ip) {
+					return true
+				}
+			}
+			return false
+		default:
+			v := b.Get(core.DBKey("fact.%s.%s", id, key))
+			return v != nil && core.MatchPattern(pattern, string(v))
+		}
+	})
+}
+
+func dbQueryServers(b *bolt.Bucket, query *core.Query) []string {
+	ret := make([]string, 0)
+	c := b.Cursor()
+	p := []byte("servers.")
+	for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+		if dbMatchServer(b, string(v), query) {
+			ret = append(ret, string(v))
+		}
+	}
+	return ret
+}
+
+// dbResolveServers expands targets into server ids. A target that starts with
+// "@" is the name of a group and its query is evaluated at the time of the
+// call, any other target is a server id.
+func dbResolveServers(db *core.DB, bucket string, targets []string) ([]string, error) {
+	ret := make([]string, 0)
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+
+		exists := make(map[string]bool)
+		for _, target := range targets {
+			ids := []string{target}
+			if strings.HasPrefix(target, "@") {
+				expr := b.Get(core.DBKey("groups.%s", target[1:]))
+				if expr == nil {
+					return fmt.Errorf("group \"%s\" does not exist", target[1:])
+				} else if query, e := core.ParseQuery(string(expr)); e != nil {
+					return e
+				} else {
+					ids = dbQueryServers(b, query)
+				}
+			} else if b.Get(core.DBKey("servers.%s", target)) == nil {
+				return fmt.Errorf("server \"%s\" does not exist", target)
+			}
+
+			for _, id := range ids {
+				if !exists[id] {
+					exists[id] = true
+					ret = append(ret, id)
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func dbCreateGroup(db *core.DB, bucket string, name string, expr string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+		return b.Put(core.DBKey("groups.%s", name), []byte(expr))
+	})
+}
+
+func createGroup(rt rpc.Runtime, sessionID string, name string, expr string) rpc.Return {
+	if !groupNameRegex.MatchString(name) {
+		return rt.Reply(fmt.Errorf("invalid group name \"%s\"", name))
+	} else if _, e := core.ParseQuery(expr); e != nil {
+		return rt.Reply(e)
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := dbCreateGroup(db, bucket, name, expr); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(true)
+	}
+}
+
+func dbListGroups(db *core.DB, bucket string) (rpc.Array, error) {
+	ret := rpc.Array{}
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+
+		c := b.Cursor()
+		p := []byte("groups.")
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			ret = append(ret, rpc.Map{
+				"name": string(k[len(p):]),
+				"expr": string(v),
+			})
+		}
+
+		return nil
+	})
+}
+
+func listGroups(rt rpc.Runtime, sessionID string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if ret, e := dbListGroups(db, bucket); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(ret)
+	}
+}
+
+func dbDeleteGroup(db *core.DB, bucket string, name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+		return b.Delete(core.DBKey("groups.%s", name))
+	})
+}
+
+func deleteGroup(rt rpc.Runtime, sessionID string, name string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := dbDeleteGroup(db, bucket, name); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(true)
+	}
+}
+
+func dbResolveGroup(db *core.DB, bucket string, name string) (rpc.Array, error) {
+	ret := rpc.Array{}
+	ids, e := dbResolveServers(db, bucket, []string{"@" + name})
+	if e != nil {
+		return ret, e
+	}
+
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		for _, id := range ids {
+			ret = append(ret, dbServerToMap(b, id, false))
+		}
+		return nil
+	})
+}
+
+func resolveGroup(rt rpc.Runtime, sessionID string, name string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if ret, e := dbResolveGroup(db, bucket, name); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(ret)
+	}
+}
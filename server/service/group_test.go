@@ -0,0 +1,70 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestDBResolveServers(t *testing.T) {
+	prepareDB := func() *core.DB {
+		db, _ := core.NewDB("test.db")
+		_ = db.CreateBucketIsNotExist("-test")
+		_ = dbCreateServer(db, "-test", "1", "10.2.0.1", "22", "root", "", "", "web1", "")
+		_ = dbCreateServer(db, "-test", "2", "10.2.0.2", "22", "root", "", "", "web2", "")
+		_ = dbCreateServer(db, "-test", "3", "10.3.0.1", "22", "root", "", "", "db1", "")
+		_ = dbSetServerTags(db, "-test", "1", []string{"prod", "web"})
+		_ = dbSetServerTags(db, "-test", "2", []string{"dev", "web"})
+		_ = dbSetServerTags(db, "-test", "3", []string{"prod", "db"})
+		_ = db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("-test")).Put([]byte("fact.3.os"), []byte("ubuntu"))
+		})
+		return db
+	}
+
+	t.Run("group does not exist", func(t *testing.T) {
+		assert := assert.New(t)
+		db := prepareDB()
+		defer func() {
+			os.Remove("test.db")
+		}()
+		assert(dbResolveServers(db, "-test", []string{"@none"})).
+			Equals([]string{}, errors.New("group \"none\" does not exist"))
+	})
+
+	t.Run("server does not exist", func(t *testing.T) {
+		assert := assert.New(t)
+		db := prepareDB()
+		defer func() {
+			os.Remove("test.db")
+		}()
+		assert(dbResolveServers(db, "-test", []string{"9"})).
+			Equals([]string{}, errors.New("server \"9\" does not exist"))
+	})
+
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		db := prepareDB()
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = dbCreateGroup(db, "-test", "prod", "tag:prod")
+		_ = dbCreateGroup(db, "-test", "web", "tag:web AND host:10.2.*")
+		_ = dbCreateGroup(db, "-test", "ubuntu", "os:ubuntu")
+		assert(dbResolveServers(db, "-test", []string{"@prod"})).
+			Equals([]string{"1", "3"}, nil)
+		assert(dbResolveServers(db, "-test", []string{"@web", "3"})).
+			Equals([]string{"1", "2", "3"}, nil)
+		assert(dbResolveServers(db, "-test", []string{"@ubuntu", "@prod"})).
+			Equals([]string{"3", "1"}, nil)
+
+		// groups are evaluated at the time of the call
+		_ = dbSetServerTags(db, "-test", "2", []string{"prod"})
+		assert(dbResolveServers(db, "-test", []string{"@prod"})).
+			Equals([]string{"1", "2", "3"}, nil)
+	})
+}
@@ -0,0 +1,274 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+const (
+	healthProbeTimeout     = 5 * time.Second
+	healthProbeConcurrency = 32
+)
+
+type healthResult struct {
+	id      string
+	ok      bool
+	latency time.Duration
+	err     string
+	time    time.Time
+}
+
+// probeServer connects to the server and reads the ssh identification line
+func probeServer(host string, port string) (time.Duration, error) {
+	start := time.Now()
+	conn, e := net.DialTimeout("tcp", net.JoinHostPort(host, port), healthProbeTimeout)
+	if e != nil {
+		return 0, e
+	}
+	defer conn.Close()
+
+	latency := time.Since(start)
+	_ = conn.SetReadDeadline(time.Now().Add(healthProbeTimeout))
+	line, e := bufio.NewReaderSize(conn, 256).ReadString('\n')
+	if e != nil {
+		return latency, e
+	} else if !strings.HasPrefix(line, "SSH-") {
+		return latency, errors.New("ssh banner not found")
+	} else {
+		return latency, nil
+	}
+}
+
+// runHealthChecks probes all the servers of all the users
+func runHealthChecks(db *core.DB) {
+	buckets, e := db.ListBuckets("-")
+	if e != nil {
+		return
+	}
+
+	for _, bucket := range buckets {
+		targets := make(map[string][2]string)
+		_ = db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucket))
+			c := b.Cursor()
+			prefix := []byte("servers.")
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				if string(b.Get(core.DBKey("ssh.%s.type", string(v)))) == serverTypeLocal {
+					continue
+				}
+				targets[string(v)] = [2]string{
+					string(b.Get(core.DBKey("ssh.%s.host", string(v)))),
+					string(b.Get(core.DBKey("ssh.%s.port", string(v)))),
+				}
+			}
+			return nil
+		})
+
+		results := make([]*healthResult, 0, len(targets))
+		resultsMu := sync.Mutex{}
+		waitCH := make(chan bool, healthProbeConcurrency)
+		wg := sync.WaitGroup{}
+		for id, target := range targets {
+			wg.Add(1)
+			waitCH <- true
+			go func(id string, host string, port string) {
+				defer func() {
+					<-waitCH
+					wg.Done()
+				}()
+
+				result := &healthResult{id: id, time: time.Now()}
+				latency, e := probeServer(host, port)
+				result.ok, result.latency = e == nil, latency
+				if e != nil {
+					result.err = e.Error()
+				}
+
+				resultsMu.Lock()
+				results = append(results, result)
+				resultsMu.Unlock()
+			}(id, target[0], target[1])
+		}
+		wg.Wait()
+
+		_ = dbSaveHealthResults(
+			db,
+			bucket,
+			results,
+			core.GetConfig().GetHealthHistoryRetention(),
+		)
+	}
+}
+
+func formatHealthKey(id string, t time.Time) []byte {
+	return core.DBKey("health.%s.history.%020d", id, t.UnixNano())
+}
+
+func dbSaveHealthResults(
+	db *core.DB, bucket string, results []*healthResult, retention time.Duration,
+) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+
+		for _, result := range results {
+			// the server may be deleted while it is being probed
+			if b.Get(core.DBKey("servers.%s", result.id)) == nil {
+				continue
+			}
+
+			status := "offline"
+			if result.ok {
+				status = "online"
+				if e := b.Put(
+					core.DBKey("health.%s.lastSeen", result.id),
+					[]byte(strconv.FormatInt(result.time.UnixNano()/int64(time.Millisecond), 10)),
+				); e != nil {
+					return e
+				}
+			}
+
+			if e := b.Put(core.DBKey("health.%s.status", result.id), []byte(status)); e != nil {
+				return e
+			} else if e := b.Put(
+				core.DBKey("health.%s.latency", result.id),
+				[]byte(strconv.FormatInt(result.latency.Milliseconds(), 10)),
+			); e != nil {
+				return e
+			} else if e := b.Put(
+				formatHealthKey(result.id, result.time),
+				[]byte(fmt.Sprintf("%t,%d,%s", result.ok, result.latency.Milliseconds(), result.err)),
+			); e != nil {
+				return e
+			}
+
+			// remove the history that is older than retention
+			c := b.Cursor()
+			prefix := core.DBKey("health.%s.history.", result.id)
+			end := formatHealthKey(result.id, result.time.Add(-retention))
+			for k, _ := c.Seek(prefix); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Seek(prefix) {
+				if e := b.Delete(k); e != nil {
+					return e
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func getHealthStatus(b *bolt.Bucket, id string) rpc.Map {
+	status := string(b.Get(core.DBKey("health.%s.status", id)))
+	if status == "" {
+		status = "unknown"
+	}
+	latency, _ := strconv.ParseInt(string(b.Get(core.DBKey("health.%s.latency", id))), 10, 64)
+	lastSeen, _ := strconv.ParseInt(string(b.Get(core.DBKey("health.%s.lastSeen", id))), 10, 64)
+	return rpc.Map{
+		"status":   status,
+		"latency":  latency,
+		"lastSeen": lastSeen,
+	}
+}
+
+// dbGetHealthHistory returns the checks since the time (unix milliseconds),
+// and the uptime percentages for the last hour, day and week
+func dbGetHealthHistory(db *core.DB, bucket string, id string, since int64, now time.Time) (rpc.Map, error) {
+	history := rpc.Array{}
+	windows := []struct {
+		name  string
+		start time.Time
+		total int
+		ok    int
+	}{
+		{name: "1h", start: now.Add(-time.Hour)},
+		{name: "24h", start: now.Add(-24 * time.Hour)},
+		{name: "7d", start: now.Add(-7 * 24 * time.Hour)},
+	}
+
+	e := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if b.Get(core.DBKey("servers.%s", id)) == nil {
+			return fmt.Errorf("server \"%s\" does not exist", id)
+		}
+
+		c := b.Cursor()
+		prefix := core.DBKey("health.%s.history.", id)
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			nano, e := strconv.ParseInt(string(k[len(prefix):]), 10, 64)
+			if e != nil {
+				continue
+			}
+			t := time.Unix(0, nano)
+			items := strings.SplitN(string(v), ",", 3)
+			if len(items) != 3 {
+				continue
+			}
+			ok := items[0] == "true"
+			latency, _ := strconv.ParseInt(items[1], 10, 64)
+
+			for i := range windows {
+				if !t.Before(windows[i].start) {
+					windows[i].total++
+					if ok {
+						windows[i].ok++
+					}
+				}
+			}
+
+			if ms := nano / int64(time.Millisecond); ms >= since {
+				history = append(history, rpc.Map{
+					"time":    ms,
+					"ok":      ok,
+					"latency": latency,
+					"error":   items[2],
+				})
+			}
+		}
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	uptime := rpc.Map{}
+	for _, window := range windows {
+		if window.total == 0 {
+			uptime[window.name] = float64(0)
+		} else {
+			uptime[window.name] = float64(window.ok) * 100 / float64(window.total)
+		}
+	}
+
+	return rpc.Map{
+		"history": history,
+		"uptime":  uptime,
+	}, nil
+}
+
+func getServerHealth(rt rpc.Runtime, sessionID string, serverID string, since int64) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if ret, e := dbGetHealthHistory(db, bucket, serverID, since, time.Now()); e != nil {
+		return nil, e
+	} else {
+		return ret, nil
+	}
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestProbeServer(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		server := startTestSSHServer("pwd", nil)
+		fields := server.Fields("pwd")
+		_, e := probeServer(fields["host"], fields["port"])
+		assert(e).IsNil()
+		server.Close()
+		_, e = probeServer(fields["host"], fields["port"])
+		assert(e).IsNotNil()
+	})
+}
+
+func TestDBSaveHealthResults(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-test")
+		_ = dbCreateServer(db, "-test", "1", "10.0.0.1", "22", "root", "", "", "web", "")
+
+		now := time.Now()
+		for i := 0; i < 10; i++ {
+			assert(dbSaveHealthResults(db, "-test", []*healthResult{{
+				id:      "1",
+				ok:      i%2 == 0,
+				latency: time.Duration(i) * time.Millisecond,
+				time:    now.Add(time.Duration(i-9) * time.Hour),
+			}}, 5*time.Hour)).IsNil()
+		}
+
+		ret, e := dbGetHealthHistory(db, "-test", "1", 0, now)
+		assert(e).IsNil()
+		assert(len(ret["history"].(rpc.Array))).Equals(6)
+		assert(ret["uptime"]).Equals(rpc.Map{
+			"1h":  float64(50),
+			"24h": float64(50),
+			"7d":  float64(50),
+		})
+
+		_ = db.View(func(tx *bolt.Tx) error {
+			status := getHealthStatus(tx.Bucket([]byte("-test")), "1")
+			assert(status["status"]).Equals("offline")
+			assert(status["latency"]).Equals(int64(9))
+			assert(status["lastSeen"]).
+				Equals(now.Add(-time.Hour).UnixNano() / int64(time.Millisecond))
+			return nil
+		})
+
+		// health keys are removed with the server
+		assert(dbDeleteServer(db, "-test", "1")).IsNil()
+		assert(db.Search("-test", "health.")).Equals(map[string][]byte{}, nil)
+	})
+}
@@ -0,0 +1,239 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+const (
+	hookEventPreConnect     = "preConnect"
+	hookEventPostConnect    = "postConnect"
+	hookEventPostDisconnect = "postDisconnect"
+
+	// hookTimeout stops a script that does not finish, a pre-connect hook
+	// delays the opening of the terminal
+	hookTimeout = 5 * time.Second
+)
+
+// sessionHook is stored as "sessionHook.<id>", the target is a server id or
+// "@group". The script runs on the event of a session on the target with
+// the metadata of the session in the global "session". A pre-connect script
+// vetoes the connection by returning false or throwing, a string returned by
+// a post-connect script is shown as a banner in the terminal.
+type sessionHook struct {
+	ID     string `json:"id"`
+	Target string `json:"target"`
+	Event  string `json:"event"`
+	Script string `json:"script"`
+}
+
+func checkSessionHook(db *core.DB, bucket string, hook *sessionHook) error {
+	switch hook.Event {
+	case hookEventPreConnect, hookEventPostConnect, hookEventPostDisconnect:
+	default:
+		return fmt.Errorf("unknown hook event \"%s\"", hook.Event)
+	}
+
+	if strings.TrimSpace(hook.Script) == "" {
+		return errors.New("hook script is empty")
+	}
+	_, e := dbResolveServers(db, bucket, []string{hook.Target})
+	return e
+}
+
+// dbMatchSessionHooks returns the hooks of the event that apply to the
+// server
+func dbMatchSessionHooks(db *core.DB, bucket string, serverID string, event string) ([]*sessionHook, error) {
+	hooks := make([]*sessionHook, 0)
+	if e := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+		return dbListJSON(b, "sessionHook.", func(data []byte) error {
+			hook := &sessionHook{}
+			if e := json.Unmarshal(data, hook); e != nil {
+				return e
+			} else if hook.Event == event {
+				hooks = append(hooks, hook)
+			}
+			return nil
+		})
+	}); e != nil {
+		return nil, e
+	}
+
+	ret := make([]*sessionHook, 0)
+	for _, hook := range hooks {
+		// a hook of a deleted server or group matches nothing
+		ids, _ := dbResolveServers(db, bucket, []string{hook.Target})
+		for _, id := range ids {
+			if id == serverID {
+				ret = append(ret, hook)
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+// runSessionHook runs the script of the hook with the metadata of the
+// session. The script can call log(message) and notify(channel, title,
+// message), an empty channel sends an in-app notification.
+func runSessionHook(db *core.DB, bucket string, hook *sessionHook, meta rpc.Map) (interface{}, error) {
+	ctx, e := core.NewScriptContext(fmt.Sprintf("hook-%s.js", hook.ID))
+	if e != nil {
+		return nil, e
+	}
+	defer ctx.Close()
+
+	if e := ctx.SetGlobal("session", meta); e != nil {
+		return nil, e
+	} else if e := ctx.SetFunction("log", func(args []string) string {
+		log.Printf("hook %s: %s", hook.ID, strings.Join(args, " "))
+		return ""
+	}); e != nil {
+		return nil, e
+	} else if e := ctx.SetFunction("notify", func(args []string) string {
+		return hookNotify(db, bucket, args)
+	}); e != nil {
+		return nil, e
+	} else {
+		return ctx.Run(hook.Script, hookTimeout)
+	}
+}
+
+// hookNotify sends the notification of notify(channel, title, message) and
+// returns the error message to the script
+func hookNotify(db *core.DB, bucket string, args []string) string {
+	for len(args) < 3 {
+		args = append(args, "")
+	}
+
+	notification := &Notification{
+		Title:   args[1],
+		Message: args[2],
+		State:   "info",
+		Time:    getMillisecond(time.Now()),
+	}
+	e := error(nil)
+	if args[0] == "" {
+		e = (&inAppNotifier{}).Notify(db, bucket, notification)
+	} else {
+		e = sendNotification(db, bucket, args[0], notification)
+	}
+	if e != nil {
+		return e.Error()
+	}
+	return ""
+}
+
+// hookMeta returns the metadata of the session that the scripts see
+func (p *terminal) hookMeta(event string) rpc.Map {
+	ret := p.session.ToMap()
+	ret["workspace"] = p.workspace
+	ret["serverName"] = p.serverName
+	ret["serverHost"] = p.serverHost
+	ret["event"] = event
+	if event == hookEventPostDisconnect {
+		ret["duration"] = getMillisecond(time.Now()) - getMillisecond(p.session.startTime)
+	}
+	return ret
+}
+
+// runHooks runs the hooks of the event on the server of the terminal, every
+// run is written to the audit log. It returns the banners of the
+// post-connect hooks, and the veto of the first pre-connect hook that
+// rejects the connection.
+func (p *terminal) runHooks(event string) ([]string, error) {
+	hooks, e := dbMatchSessionHooks(p.db, p.session.bucket, p.session.serverID, event)
+	if e != nil {
+		return nil, e
+	}
+
+	banners := make([]string, 0)
+	for _, hook := range hooks {
+		start := time.Now()
+		result, e := runSessionHook(p.db, p.session.bucket, hook, p.hookMeta(event))
+		if e == nil && event == hookEventPreConnect && result == false {
+			e = fmt.Errorf("connection is rejected by hook \"%s\"", hook.ID)
+		} else if e != nil && event == hookEventPreConnect {
+			e = fmt.Errorf("connection is rejected by hook \"%s\": %s", hook.ID, e.Error())
+		}
+
+		record := newAuditRecord("hook:"+event, p.user.name, p.workspace, p.session.serverID, start)
+		record.Args = []interface{}{hook.ID, p.session.id}
+		record.setResult(e)
+		writeAuditRecord(record)
+
+		if e != nil && event == hookEventPreConnect {
+			return nil, e
+		} else if banner, ok := result.(string); ok && e == nil && banner != "" {
+			banners = append(banners, banner)
+		}
+	}
+	return banners, nil
+}
+
+// showBanners writes the banners to the screen before the shell output, the
+// websocket gets them with the screen when it attaches
+func (p *terminal) showBanners(banners []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, banner := range banners {
+		_, _ = p.vt.Write([]byte(strings.ReplaceAll(banner, "\n", "\r\n") + "\r\n"))
+	}
+}
+
+func createSessionHook(
+	rt rpc.Runtime, sessionID string, target string, event string, script string,
+) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if e := checkSessionHook(db, bucket, &sessionHook{
+		Target: target, Event: event, Script: script,
+	}); e != nil {
+		return nil, e
+	} else if id, e := dbCreateObject(db, bucket, "sessionHook", func(id string) interface{} {
+		return &sessionHook{ID: id, Target: target, Event: event, Script: script}
+	}); e != nil {
+		return nil, e
+	} else {
+		return id, nil
+	}
+}
+
+func listSessionHooks(rt rpc.Runtime, sessionID string) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if ret, e := dbListObjects(db, bucket, "sessionHook", jsonToMap); e != nil {
+		return nil, e
+	} else {
+		return ret, nil
+	}
+}
+
+func deleteSessionHook(rt rpc.Runtime, sessionID string, id string) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if e := dbDeleteObject(db, bucket, "sessionHook", id); e != nil {
+		return nil, e
+	} else {
+		return true, nil
+	}
+}
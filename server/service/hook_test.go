@@ -0,0 +1,183 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestDBMatchSessionHooks(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-test")
+		_ = dbCreateServer(db, "-test", "1", "10.0.0.1", "22", "root", "", "", "web1", "")
+		_ = dbCreateServer(db, "-test", "2", "10.0.0.2", "22", "root", "", "", "db1", "")
+		_ = dbCreateGroup(db, "-test", "web", "name:web1")
+		_ = dbCreateGroup(db, "-test", "gone", "*")
+		for _, hook := range []*sessionHook{
+			{Target: "1", Event: hookEventPreConnect, Script: "true"},
+			{Target: "@web", Event: hookEventPreConnect, Script: "true"},
+			{Target: "@web", Event: hookEventPostConnect, Script: "true"},
+			{Target: "2", Event: hookEventPreConnect, Script: "true"},
+			{Target: "@gone", Event: hookEventPreConnect, Script: "true"},
+		} {
+			assert(checkSessionHook(db, "-test", hook)).IsNil()
+			_, e := dbCreateObject(db, "-test", "sessionHook", func(id string) interface{} {
+				hook.ID = id
+				return hook
+			})
+			assert(e).IsNil()
+		}
+		_ = dbDeleteGroup(db, "-test", "gone")
+
+		hooks, e := dbMatchSessionHooks(db, "-test", "1", hookEventPreConnect)
+		assert(e, len(hooks)).Equals(nil, 2)
+		assert(hooks[0].Target, hooks[1].Target).Equals("1", "@web")
+		hooks, e = dbMatchSessionHooks(db, "-test", "2", hookEventPostConnect)
+		assert(e, len(hooks)).Equals(nil, 0)
+	})
+
+	t.Run("check", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-test")
+		_ = dbCreateServer(db, "-test", "1", "10.0.0.1", "22", "root", "", "", "web1", "")
+
+		assert(checkSessionHook(db, "-test", &sessionHook{Target: "1", Event: "onOpen", Script: "true"})).
+			IsNotNil()
+		assert(checkSessionHook(db, "-test", &sessionHook{Target: "1", Event: hookEventPreConnect, Script: " "})).
+			IsNotNil()
+		assert(checkSessionHook(db, "-test", &sessionHook{Target: "@none", Event: hookEventPreConnect, Script: "true"})).
+			IsNotNil()
+	})
+}
+
+func TestTerminal_hooks(t *testing.T) {
+	withHooks := func(fn func(t *testing.T, db *core.DB), hooks ...*sessionHook) func(t *testing.T) {
+		return func(t *testing.T) {
+			file := strings.ReplaceAll(t.Name(), "/", "_") + "_test.db"
+			core.GetConfig().SetDBFile(file)
+			defer func() {
+				core.GetConfig().SetDBFile("./vbot.db")
+				os.Remove(file)
+			}()
+			db, _ := core.GetManager().GetDB(file)
+			_ = db.CreateBucketIsNotExist("-test")
+			_ = dbCreateServer(db, "-test", "1", "10.0.0.1", "22", "root", "pwd", "", "web1", "")
+			for _, hook := range hooks {
+				_, _ = dbCreateObject(db, "-test", "sessionHook", func(id string) interface{} {
+					hook.ID = id
+					return hook
+				})
+			}
+			fn(t, db)
+		}
+	}
+
+	t.Run("veto", withHooks(func(t *testing.T, db *core.DB) {
+		assert := assert.New(t)
+		server := startTestEchoServer()
+		defer server.Close()
+
+		sessions := len(gSessionRegistry.List())
+		_, e := openTerminal(db, NewUser("alice", "hook-session"), "-test", "1", server.Fields("pwd"), "127.0.0.1")
+		assert(e).IsNotNil()
+		assert(strings.Contains(e.Error(), "CHG-1 is required")).IsTrue()
+		assert(len(gSessionRegistry.List())).Equals(sessions)
+		records, _, _ := dbQueryAudit(db, &auditFilter{Method: "hook"})
+		assert(len(records), records[0].Result).Equals(1, "error")
+	}, &sessionHook{
+		Target: "1",
+		Event:  hookEventPreConnect,
+		Script: "if (session.user === 'alice') { throw new Error('CHG-1 is required') }",
+	}, &sessionHook{
+		Target: "1",
+		Event:  hookEventPreConnect,
+		Script: "false",
+	}))
+
+	t.Run("closed while connecting", withHooks(func(t *testing.T, db *core.DB) {
+		assert := assert.New(t)
+		server := startTestEchoServer()
+		defer server.Close()
+
+		go func() {
+			for i := 0; i < 200; i++ {
+				for _, session := range gSessionRegistry.List() {
+					if session.user == "bob" {
+						gSessionRegistry.Close(session.id, "")
+						return
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		}()
+		_, e := openTerminal(db, NewUser("bob", "hook-session"), "-test", "1", server.Fields("pwd"), "127.0.0.1")
+		assert(e).IsNotNil()
+		for _, session := range gSessionRegistry.List() {
+			assert(session.user != "bob").IsTrue()
+		}
+	}, &sessionHook{
+		Target: "1",
+		Event:  hookEventPreConnect,
+		Script: "var start = Date.now(); while (Date.now() - start < 300) {}; true",
+	}))
+
+	t.Run("banner and disconnect", withHooks(func(t *testing.T, db *core.DB) {
+		assert := assert.New(t)
+		server := startTestEchoServer()
+		defer server.Close()
+
+		fields := server.Fields("pwd")
+		fields["name"] = "web1"
+		term, e := openTerminal(db, NewUser("alice", "hook-session"), "-test", "1", fields, "127.0.0.1")
+		assert(e).IsNil()
+		assert(term.vt.Snapshot()[0]).Equals("welcome alice to web1 in test")
+		term.Close("")
+
+		// the hook runs after the close, its audit is the last write
+		records := []*auditRecord(nil)
+		for i := 0; i < 200 && len(records) == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+			records, _, _ = dbQueryAudit(db, &auditFilter{Method: "hook:postDisconnect"})
+		}
+		assert(len(records), records[0].Result).Equals(1, "ok")
+
+		notification := (*Notification)(nil)
+		for i := 0; i < 200 && notification == nil; i++ {
+			_ = db.View(func(tx *bolt.Tx) error {
+				return dbListJSON(tx.Bucket([]byte("-test")), "notification.", func(data []byte) error {
+					notification = &Notification{}
+					return json.Unmarshal(data, notification)
+				})
+			})
+		}
+		assert(notification).IsNotNil()
+		assert(notification.Title, notification.Message).Equals("closed", "alice on web1")
+	}, &sessionHook{
+		Target: "1",
+		Event:  hookEventPreConnect,
+		Script: "session.serverID === '1'",
+	}, &sessionHook{
+		Target: "1",
+		Event:  hookEventPostConnect,
+		Script: "'welcome ' + session.user + ' to ' + session.serverName + ' in ' + session.workspace",
+	}, &sessionHook{
+		Target: "1",
+		Event:  hookEventPostDisconnect,
+		Script: "notify('', 'closed', session.user + ' on ' + session.serverName)",
+	}))
+}
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func getSSHConfigFile(files rpc.Map, path string) (string, bool) {
+	for _, name := range []string{path, "~/.ssh/" + path} {
+		if v, ok := files[name]; ok {
+			switch v := v.(type) {
+			case string:
+				return v, true
+			case rpc.Bytes:
+				return string(v), true
+			}
+		}
+	}
+	return "", false
+}
+
+func dbFindServerConflict(b *bolt.Bucket, name string, host string, port string, user string) string {
+	c := b.Cursor()
+	p := []byte("servers.")
+	for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+		id := string(v)
+		if string(b.Get(core.DBKey("ssh.%s.name", id))) == name {
+			return fmt.Sprintf("server \"%s\" has the same name", id)
+		}
+
+		if string(b.Get(core.DBKey("ssh.%s.host", id))) == host &&
+			string(b.Get(core.DBKey("ssh.%s.port", id))) == port &&
+			string(b.Get(core.DBKey("ssh.%s.user", id))) == user {
+			return fmt.Sprintf("server \"%s\" has the same address", id)
+		}
+	}
+	return ""
+}
+
+func dbImportSSHConfig(
+	db *core.DB, bucket string, content string, files rpc.Map, preview bool,
+) (rpc.Map, error) {
+	warnings := rpc.Array{}
+	fnInclude := func(pattern string) ([]string, error) {
+		names := make([]string, 0)
+		for name := range files {
+			if core.MatchPattern(pattern, name) ||
+				core.MatchPattern("~/.ssh/"+pattern, name) {
+				names = append(names, name)
+			}
+		}
+
+		if len(names) == 0 {
+			warnings = append(warnings, fmt.Sprintf("include \"%s\" matches no file", pattern))
+		}
+
+		// included files are read in lexical order like OpenSSH does
+		sort.Strings(names)
+		ret := make([]string, 0, len(names))
+		for _, name := range names {
+			v, _ := getSSHConfigFile(files, name)
+			ret = append(ret, v)
+		}
+		return ret, nil
+	}
+
+	hosts, parseWarnings, e := core.ParseSSHConfig(content, fnInclude)
+	if e != nil {
+		return nil, e
+	}
+	for _, v := range parseWarnings {
+		warnings = append(warnings, v)
+	}
+
+	servers := rpc.Array{}
+	for _, host := range hosts {
+		privateKey := ""
+		if host.IdentityFile != "" {
+			if v, ok := getSSHConfigFile(files, host.IdentityFile); ok {
+				privateKey = v
+			} else {
+				warnings = append(warnings, fmt.Sprintf(
+					"identity file \"%s\" of host \"%s\" is not provided",
+					host.IdentityFile,
+					host.Alias,
+				))
+			}
+		}
+
+		conflict := ""
+		if e := db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucket))
+			if b == nil {
+				return fmt.Errorf("bucket \"%s\" not exist", bucket)
+			}
+			conflict = dbFindServerConflict(b, host.Alias, host.HostName, host.Port, host.User)
+			return nil
+		}); e != nil {
+			return nil, e
+		} else if conflict == "" && host.ProxyJump != "" {
+			// the servers are dialed directly, a jump host is not supported
+			conflict = fmt.Sprintf("proxy jump \"%s\" is not supported", host.ProxyJump)
+		}
+
+		id := ""
+		if !preview && conflict == "" {
+			if id, e = dbAddServer(
+				db, bucket, host.HostName, host.Port, host.User, "",
+				privateKey, host.Alias, "imported from ssh_config",
+			); e != nil {
+				return nil, e
+			}
+		}
+
+		servers = append(servers, rpc.Map{
+			"id":        id,
+			"name":      host.Alias,
+			"host":      host.HostName,
+			"port":      host.Port,
+			"user":      host.User,
+			"proxyJump": host.ProxyJump,
+			"auto":      privateKey != "",
+			"conflict":  conflict,
+		})
+	}
+
+	return rpc.Map{
+		"servers":  servers,
+		"warnings": warnings,
+	}, nil
+}
+
+// importSSHConfig creates servers from the content of a ssh_config file.
+// files contains the included files and the identity files, keyed by the
+// path that is written in the config. Servers that conflict with existing
+// ones or need a ProxyJump are reported and skipped, nothing is created when
+// preview is true.
+func importSSHConfig(
+	rt rpc.Runtime, sessionID string, content string, files rpc.Map, preview bool,
+) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if ret, e := dbImportSSHConfig(db, bucket, content, files, preview); e != nil {
+		return nil, e
+	} else {
+		return ret, nil
+	}
+}
+
+func dbExportSSHConfig(db *core.DB, bucket string) (string, error) {
+	hosts := make([]*core.SSHConfigHost, 0)
+	e := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+
+		c := b.Cursor()
+		p := []byte("servers.")
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			id := string(v)
+			alias := strings.Join(strings.Fields(string(b.Get(core.DBKey("ssh.%s.name", id)))), "-")
+			if alias == "" {
+				alias = "server-" + id
+			}
+			hosts = append(hosts, &core.SSHConfigHost{
+				Alias:    alias,
+				HostName: string(b.Get(core.DBKey("ssh.%s.host", id))),
+				User:     string(b.Get(core.DBKey("ssh.%s.user", id))),
+				Port:     string(b.Get(core.DBKey("ssh.%s.port", id))),
+			})
+		}
+
+		return nil
+	})
+
+	return core.FormatSSHConfig(hosts), e
+}
+
+func exportSSHConfig(rt rpc.Runtime, sessionID string) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if ret, e := dbExportSSHConfig(db, bucket); e != nil {
+		return nil, e
+	} else {
+		return ret, nil
+	}
+}
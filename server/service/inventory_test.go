@@ -0,0 +1,62 @@
+package service
+
+import (
+	"os"
+	"testing"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestDBImportSSHConfig(t *testing.T) {
+	content := "Include conf.d/*\n" +
+		"Host web\n  HostName 10.0.0.1\n  User root\n  IdentityFile ~/.ssh/id_web\n"
+	files := rpc.Map{
+		"~/.ssh/conf.d/db": "Host db\n  HostName 10.0.0.2\n  ProxyJump web\n",
+		"~/.ssh/id_web":    "KEY",
+	}
+
+	t.Run("preview", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-test")
+		ret, e := dbImportSSHConfig(db, "-test", content, files, true)
+		assert(e).IsNil()
+		assert(len(ret["servers"].(rpc.Array))).Equals(2)
+		assert(ret["servers"].(rpc.Array)[0].(rpc.Map)["conflict"]).
+			Equals("proxy jump \"web\" is not supported")
+		assert(dbListServers(db, "-test", false)).Equals(rpc.Array{}, nil)
+	})
+
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-test")
+		_, _ = dbAddServer(db, "-test", "10.0.0.2", "22", "", "", "", "old", "")
+		ret, e := dbImportSSHConfig(db, "-test", content, files, false)
+		assert(e).IsNil()
+		assert(ret["servers"]).Equals(rpc.Array{
+			rpc.Map{
+				"id": "", "name": "db", "host": "10.0.0.2", "port": "22",
+				"user": "", "proxyJump": "web", "auto": false,
+				"conflict": "server \"1\" has the same address",
+			},
+			rpc.Map{
+				"id": "2", "name": "web", "host": "10.0.0.1", "port": "22",
+				"user": "root", "proxyJump": "", "auto": true, "conflict": "",
+			},
+		})
+		assert(dbExportSSHConfig(db, "-test")).Equals(
+			"Host old\n    HostName 10.0.0.2\n\n"+
+				"Host web\n    HostName 10.0.0.1\n    User root\n",
+			nil,
+		)
+	})
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+// serverTypeLocal is the type of the servers that open a shell on the vbot
+// host instead of dialing ssh
+const serverTypeLocal = "local"
+
+func isLocalServer(fields map[string]string) bool {
+	return fields["type"] == serverTypeLocal
+}
+
+func checkLocalShellEnabled() error {
+	if !core.GetConfig().GetLocalShellEnabled() {
+		return errors.New("local shell is disabled")
+	}
+	return nil
+}
+
+func dbAddLocalServer(db *core.DB, bucket string, name string, comment string) (string, error) {
+	if name == "" {
+		name = "localhost"
+	}
+
+	if id, e := dbAddServer(db, bucket, "localhost", "", "", "", "", name, comment); e != nil {
+		return "", e
+	} else if e := db.Put(bucket, fmt.Sprintf("ssh.%s.type", id), []byte(serverTypeLocal)); e != nil {
+		return "", e
+	} else {
+		return id, nil
+	}
+}
+
+// createLocalServer saves a server that opens a shell on the vbot host, the
+// local shell must be enabled in the config
+func createLocalServer(rt rpc.Runtime, sessionID string, name string, comment string) (interface{}, error) {
+	if e := checkLocalShellEnabled(); e != nil {
+		return nil, e
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if id, e := dbAddLocalServer(db, bucket, name, comment); e != nil {
+		return nil, e
+	} else {
+		return id, nil
+	}
+}
+
+// startLocal starts the shell of a local server under the configured
+// account
+func (p *terminal) startLocal() error {
+	if e := checkLocalShellEnabled(); e != nil {
+		return e
+	}
+
+	config := core.GetConfig()
+	shell, e := core.StartLocalShell(
+		config.GetLocalShell(), config.GetLocalShellUser(), terminalRows, terminalCols,
+	)
+	if e != nil {
+		return e
+	}
+
+	return p.setShell(shell, shell, shell)
+}
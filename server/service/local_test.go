@@ -0,0 +1,77 @@
+package service
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestOpenLocalTerminal(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		assert := assert.New(t)
+		core.GetConfig().SetDBFile("local_disabled_test.db")
+		defer func() {
+			core.GetConfig().SetDBFile("./vbot.db")
+			os.Remove("local_disabled_test.db")
+		}()
+		db, _ := core.GetManager().GetDB("local_disabled_test.db")
+		_ = db.CreateBucketIsNotExist("-test")
+		id, e := dbAddLocalServer(db, "-test", "", "")
+		assert(e).IsNil()
+		fields, _ := dbGetServer(db, "-test", id)
+		assert(fields["name"], isLocalServer(fields)).Equals("localhost", true)
+
+		_, e = dialServer(fields, nil)
+		assert(e).IsNotNil()
+		_, e = openTerminal(db, NewUser("alice", "local-session"), "-test", id, fields, "127.0.0.1")
+		assert(e).IsNotNil()
+	})
+
+	t.Run("test ok", func(t *testing.T) {
+		if os.Getuid() != 0 {
+			t.Skip("needs root to switch the user")
+		}
+		assert := assert.New(t)
+		config := core.GetConfig()
+		config.SetLocalShellEnabled(true)
+		config.SetLocalShellUser("nobody")
+		config.SetLocalShell("/bin/sh")
+		config.SetDBFile("local_test.db")
+		defer func() {
+			config.SetLocalShellEnabled(false)
+			config.SetLocalShellUser("")
+			config.SetLocalShell("/bin/bash")
+			config.SetDBFile("./vbot.db")
+			os.Remove("local_test.db")
+		}()
+		db, _ := core.GetManager().GetDB("local_test.db")
+		_ = db.CreateBucketIsNotExist("-test")
+		id, _ := dbAddLocalServer(db, "-test", "local", "")
+		fields, _ := dbGetServer(db, "-test", id)
+
+		term, e := openTerminal(db, NewUser("alice", "local-session"), "-test", id, fields, "127.0.0.1")
+		assert(e).IsNil()
+		assert(term.resize(10, 40)).IsNil()
+		assert(term.write([]byte("echo local-$((1+1))\n"))).IsNil()
+		found := false
+		for i := 0; i < 200 && !found; i++ {
+			time.Sleep(10 * time.Millisecond)
+			term.mu.Lock()
+			found = len(term.vt.Search("local-2")) > 0
+			term.mu.Unlock()
+		}
+		assert(found).IsTrue()
+
+		assert(term.write([]byte("exit\n"))).IsNil()
+		records := []*auditRecord(nil)
+		for i := 0; i < 200 && len(records) < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+			records, _, e = dbQueryAudit(db, &auditFilter{Method: "terminal"})
+		}
+		assert(e, len(records)).Equals(nil, 2)
+		assert(records[1].Method, records[1].Target).Equals("terminal:close", id)
+	})
+}
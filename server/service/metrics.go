@@ -0,0 +1,341 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+const metricsConcurrency = 16
+
+// metricFields is the order of the values in a stored sample. cpu, mem and
+// disk are percentages, netRx and netTx are bytes per second.
+var metricFields = []string{
+	"cpu", "mem", "load1", "load5", "load15", "disk", "netRx", "netTx",
+}
+
+// metricTiers are the resolutions of the time-series. Every sample is
+// written to the "raw" tier and averaged into the coarser tiers.
+var metricTiers = []struct {
+	name      string
+	step      time.Duration
+	retention time.Duration
+}{
+	{name: "raw", step: 0, retention: 24 * time.Hour},
+	{name: "5m", step: 5 * time.Minute, retention: 7 * 24 * time.Hour},
+	{name: "1h", step: time.Hour, retention: 90 * 24 * time.Hour},
+}
+
+// metricsScript reads the counters twice to get the cpu and network rates
+var metricsScript = strings.Join([]string{
+	"echo '@@stat1'; head -n 1 /proc/stat",
+	"echo '@@net1'; cat /proc/net/dev",
+	"sleep 1",
+	"echo '@@stat2'; head -n 1 /proc/stat",
+	"echo '@@net2'; cat /proc/net/dev",
+	"echo '@@meminfo'; cat /proc/meminfo",
+	"echo '@@loadavg'; cat /proc/loadavg",
+	"echo '@@df'; df -P -k / 2>/dev/null",
+	"exit 0",
+}, "\n")
+
+var MetricsService = rpc.NewService(rpc.Map{
+	"collector": NewPeriodicTask(runMetricsCollection),
+}).
+	On("$onTimer", onMetricsTimer).
+	On("Query", queryMetrics)
+
+func parseCPUStat(lines []string) (float64, float64) {
+	if len(lines) == 0 {
+		return 0, 0
+	}
+
+	fields := strings.Fields(lines[0])
+	total, idle := float64(0), float64(0)
+	for i := 1; i < len(fields); i++ {
+		v, _ := strconv.ParseFloat(fields[i], 64)
+		total += v
+		// idle and iowait
+		if i == 4 || i == 5 {
+			idle += v
+		}
+	}
+	return total, idle
+}
+
+func parseNetDev(lines []string) (float64, float64) {
+	rx, tx := float64(0), float64(0)
+	for _, line := range lines {
+		idx := strings.Index(line, ":")
+		if idx < 0 || strings.TrimSpace(line[:idx]) == "lo" {
+			continue
+		}
+		if fields := strings.Fields(line[idx+1:]); len(fields) >= 9 {
+			r, _ := strconv.ParseFloat(fields[0], 64)
+			t, _ := strconv.ParseFloat(fields[8], 64)
+			rx, tx = rx+r, tx+t
+		}
+	}
+	return rx, tx
+}
+
+// parseMetrics converts the output of metricsScript to values in the order
+// of metricFields
+func parseMetrics(output string) []float64 {
+	ret := make([]float64, len(metricFields))
+	sections := splitScriptSections(output)
+
+	total1, idle1 := parseCPUStat(sections["stat1"])
+	total2, idle2 := parseCPUStat(sections["stat2"])
+	if total2 > total1 {
+		ret[0] = ((total2 - total1) - (idle2 - idle1)) * 100 / (total2 - total1)
+	}
+
+	memInfo := make(map[string]float64)
+	for _, line := range sections["meminfo"] {
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			memInfo[strings.TrimSuffix(fields[0], ":")], _ = strconv.ParseFloat(fields[1], 64)
+		}
+	}
+	if memInfo["MemTotal"] > 0 {
+		ret[1] = (memInfo["MemTotal"] - memInfo["MemAvailable"]) * 100 / memInfo["MemTotal"]
+	}
+
+	if lines := sections["loadavg"]; len(lines) > 0 {
+		if fields := strings.Fields(lines[0]); len(fields) >= 3 {
+			ret[2], _ = strconv.ParseFloat(fields[0], 64)
+			ret[3], _ = strconv.ParseFloat(fields[1], 64)
+			ret[4], _ = strconv.ParseFloat(fields[2], 64)
+		}
+	}
+
+	if lines := sections["df"]; len(lines) > 1 {
+		if fields := strings.Fields(lines[len(lines)-1]); len(fields) >= 5 {
+			ret[5], _ = strconv.ParseFloat(strings.TrimSuffix(fields[4], "%"), 64)
+		}
+	}
+
+	rx1, tx1 := parseNetDev(sections["net1"])
+	rx2, tx2 := parseNetDev(sections["net2"])
+	ret[6], ret[7] = math.Max(rx2-rx1, 0), math.Max(tx2-tx1, 0)
+
+	return ret
+}
+
+// a stored point is the sample count followed by the values, all encoded
+// as big endian 32 bits numbers
+func encodeMetricPoint(count uint32, values []float64) []byte {
+	ret := make([]byte, 4+4*len(values))
+	binary.BigEndian.PutUint32(ret, count)
+	for i, v := range values {
+		binary.BigEndian.PutUint32(ret[4+4*i:], math.Float32bits(float32(v)))
+	}
+	return ret
+}
+
+func decodeMetricPoint(data []byte) (uint32, []float64) {
+	if len(data) < 4 {
+		return 0, nil
+	}
+
+	values := make([]float64, (len(data)-4)/4)
+	for i := range values {
+		values[i] = float64(math.Float32frombits(binary.BigEndian.Uint32(data[4+4*i:])))
+	}
+	return binary.BigEndian.Uint32(data), values
+}
+
+func formatMetricKey(id string, tier string, t time.Time) []byte {
+	return core.DBKey("metric.%s.%s.%012d", id, tier, t.Unix())
+}
+
+func dbSaveMetricSample(db *core.DB, bucket string, id string, t time.Time, values []float64) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if b.Get(core.DBKey("servers.%s", id)) == nil {
+			return fmt.Errorf("server \"%s\" does not exist", id)
+		}
+
+		for _, tier := range metricTiers {
+			key := formatMetricKey(id, tier.name, t)
+			point := encodeMetricPoint(1, values)
+
+			if tier.step > 0 {
+				key = formatMetricKey(id, tier.name, t.Truncate(tier.step))
+				// update the running average of the slot
+				if count, old := decodeMetricPoint(b.Get(key)); count > 0 && len(old) == len(values) {
+					avg := make([]float64, len(values))
+					for i := range values {
+						avg[i] = (old[i]*float64(count) + values[i]) / float64(count+1)
+					}
+					point = encodeMetricPoint(count+1, avg)
+				}
+			}
+
+			if e := b.Put(key, point); e != nil {
+				return e
+			}
+
+			c := b.Cursor()
+			prefix := core.DBKey("metric.%s.%s.", id, tier.name)
+			end := formatMetricKey(id, tier.name, t.Add(-tier.retention))
+			for k, _ := c.Seek(prefix); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Seek(prefix) {
+				if e := b.Delete(k); e != nil {
+					return e
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// dbQueryMetrics returns the points between start and end (unix seconds).
+// If tier is empty, the finest tier that covers the range is used.
+func dbQueryMetrics(
+	db *core.DB, bucket string, id string, start int64, end int64, tier string, now time.Time,
+) (rpc.Map, error) {
+	if tier == "" {
+		for _, v := range metricTiers {
+			tier = v.name
+			if now.Add(-v.retention).Unix() <= start {
+				break
+			}
+		}
+	}
+
+	found := false
+	for _, v := range metricTiers {
+		found = found || v.name == tier
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown resolution \"%s\"", tier)
+	}
+
+	points := rpc.Array{}
+	e := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if b.Get(core.DBKey("servers.%s", id)) == nil {
+			return fmt.Errorf("server \"%s\" does not exist", id)
+		}
+
+		c := b.Cursor()
+		prefix := core.DBKey("metric.%s.%s.", id, tier)
+		last := formatMetricKey(id, tier, time.Unix(end, 0))
+		for k, v := c.Seek(formatMetricKey(id, tier, time.Unix(start, 0))); k != nil &&
+			bytes.HasPrefix(k, prefix) && bytes.Compare(k, last) <= 0; k, v = c.Next() {
+			t, e := strconv.ParseInt(string(k[len(prefix):]), 10, 64)
+			if e != nil {
+				continue
+			}
+			_, values := decodeMetricPoint(v)
+			point := rpc.Array{t}
+			for _, value := range values {
+				point = append(point, value)
+			}
+			points = append(points, point)
+		}
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	fields := rpc.Array{"time"}
+	for _, v := range metricFields {
+		fields = append(fields, v)
+	}
+
+	return rpc.Map{
+		"resolution": tier,
+		"fields":     fields,
+		"points":     points,
+	}, nil
+}
+
+func collectMetrics(
+	poolKey string, fields map[string]string, trust func(hostKey string) error,
+) ([]float64, error) {
+	output, e := gSSHPool.RunCommand(poolKey, fields, trust, metricsScript)
+	if e != nil {
+		return nil, e
+	}
+	return parseMetrics(output), nil
+}
+
+// runMetricsCollection samples all the servers of all the users
+func runMetricsCollection(db *core.DB) {
+	buckets, e := db.ListBuckets("-")
+	if e != nil {
+		return
+	}
+
+	for _, bucket := range buckets {
+		ids, e := dbListServerIDs(db, bucket)
+		if e != nil {
+			continue
+		}
+
+		waitCH := make(chan bool, metricsConcurrency)
+		wg := sync.WaitGroup{}
+		for _, id := range ids {
+			wg.Add(1)
+			waitCH <- true
+			go func(id string) {
+				defer func() {
+					<-waitCH
+					wg.Done()
+				}()
+
+				if fields, e := dbGetServer(db, bucket, id); e != nil || isLocalServer(fields) {
+					return
+				} else if values, e := collectMetrics(bucket+"/"+id, fields, dbTrustHostKey(db, bucket, id)); e != nil {
+					return
+				} else {
+					_ = dbSaveMetricSample(db, bucket, id, time.Now(), values)
+				}
+			}(id)
+		}
+		wg.Wait()
+	}
+}
+
+func queryMetrics(
+	rt rpc.Runtime, sessionID string, serverID string, start int64, end int64, resolution string,
+) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if ret, e := dbQueryMetrics(
+		db, bucket, serverID, start, end, resolution, time.Now(),
+	); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(ret)
+	}
+}
+
+func onMetricsTimer(rt rpc.Runtime, seq uint64) rpc.Return {
+	if collector, e := getPeriodicTask(rt, "collector"); e != nil {
+		return rt.Reply(e)
+	} else {
+		collector.OnTimer(core.GetConfig().GetMetricsInterval())
+		gSSHPool.OnTimer(core.GetConfig().GetSSHPoolIdleTimeout())
+	}
+
+	return rt.Reply(nil)
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+const testMetricsOutput = `@@stat1
+cpu  1000 0 1000 7000 1000 0 0 0 0 0
+@@net1
+Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:  500000    100    0    0    0     0          0         0   500000     100    0    0    0     0       0          0
+  eth0: 1000000   1000    0    0    0     0          0         0  2000000    1000    0    0    0     0       0          0
+@@stat2
+cpu  1100 0 1100 7700 1100 0 0 0 0 0
+@@net2
+    lo:  900000    100    0    0    0     0          0         0   900000     100    0    0    0     0       0          0
+  eth0: 1004096   1000    0    0    0     0          0         0  2001024    1000    0    0    0     0       0          0
+@@meminfo
+MemTotal:        8000000 kB
+MemFree:         1000000 kB
+MemAvailable:    6000000 kB
+@@loadavg
+0.50 0.25 0.10 1/200 12345
+@@df
+Filesystem     1024-blocks     Used Available Capacity Mounted on
+/dev/sda1         40581564 10240000  28246620      27% /
+`
+
+func TestParseMetrics(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(parseMetrics(testMetricsOutput)).Equals([]float64{
+			20, 25, 0.5, 0.25, 0.1, 27, 4096, 1024,
+		})
+	})
+}
+
+func TestDBQueryMetrics(t *testing.T) {
+	t.Run("unknown resolution", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(dbQueryMetrics(nil, "-test", "1", 0, 0, "1s", time.Now())).
+			Equals(nil, errors.New("unknown resolution \"1s\""))
+	})
+
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-test")
+		_ = dbCreateServer(db, "-test", "1", "10.0.0.1", "22", "root", "", "", "web", "")
+
+		now := time.Unix(1700000000, 0).Truncate(time.Hour)
+		for i := 0; i < 10; i++ {
+			values := []float64{float64(i), 0, 0, 0, 0, 0, 0, 0}
+			assert(dbSaveMetricSample(db, "-test", "1", now.Add(time.Duration(i)*time.Minute), values)).
+				IsNil()
+		}
+
+		ret, e := dbQueryMetrics(db, "-test", "1", now.Unix(), now.Add(time.Hour).Unix(), "", now)
+		assert(e).IsNil()
+		assert(ret["resolution"]).Equals("raw")
+		assert(len(ret["points"].(rpc.Array))).Equals(10)
+
+		ret, e = dbQueryMetrics(db, "-test", "1", now.Unix(), now.Add(time.Hour).Unix(), "5m", now)
+		assert(e).IsNil()
+		assert(ret["points"]).Equals(rpc.Array{
+			rpc.Array{now.Unix(), float64(2), float64(0), float64(0), float64(0), float64(0), float64(0), float64(0), float64(0)},
+			rpc.Array{now.Unix() + 300, float64(7), float64(0), float64(0), float64(0), float64(0), float64(0), float64(0), float64(0)},
+		})
+
+		// old ranges are served by the coarse tiers
+		ret, _ = dbQueryMetrics(db, "-test", "1", now.Add(-30*24*time.Hour).Unix(), now.Unix(), "", now)
+		assert(ret["resolution"]).Equals("1h")
+
+		// the raw samples expire after one day
+		values := []float64{0, 0, 0, 0, 0, 0, 0, 0}
+		_ = dbSaveMetricSample(db, "-test", "1", now.Add(25*time.Hour), values)
+		ret, _ = dbQueryMetrics(db, "-test", "1", 0, now.Add(48*time.Hour).Unix(), "raw", now)
+		assert(len(ret["points"].(rpc.Array))).Equals(1)
+	})
+}
+
+func TestCollectMetrics(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		count := 0
+		server := startTestSSHServer("pwd", func(cmd string) (string, uint32) {
+			count++
+			return testMetricsOutput, 0
+		})
+		defer server.Close()
+		fields := server.Fields("pwd")
+		for i := 0; i < 3; i++ {
+			values, e := collectMetrics("-test/1", fields, nil)
+			assert(e).IsNil()
+			assert(values[0]).Equals(float64(20))
+		}
+		assert(count).Equals(3)
+		gSSHPool.Remove("-test/1")
+	})
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+const (
+	notifierTimeout = 10 * time.Second
+
+	// notificationRetention is the time that the in-app notifications are
+	// kept, they are trimmed by the alert service
+	notificationRetention    = 30 * 24 * time.Hour
+	notificationTrimInterval = time.Hour
+)
+
+// Notification is the message that is delivered to a channel
+type Notification struct {
+	Title   string `json:"title"`
+	Message string `json:"message"`
+	State   string `json:"state"`
+	Time    int64  `json:"time"`
+}
+
+// Notifier delivers notifications to a kind of channel
+type Notifier interface {
+	Notify(db *core.DB, bucket string, notification *Notification) error
+}
+
+// notifierFactories create notifiers from the config of channels, add an
+// item here to support a new kind of channel
+var notifierFactories = map[string]func(config map[string]string) (Notifier, error){
+	"webhook": newWebhookNotifier,
+	"email":   newEmailNotifier,
+	"inapp":   newInAppNotifier,
+}
+
+func newNotifier(kind string, config map[string]string) (Notifier, error) {
+	if fn, ok := notifierFactories[kind]; !ok {
+		return nil, fmt.Errorf("unknown channel type \"%s\"", kind)
+	} else {
+		return fn(config)
+	}
+}
+
+type webhookNotifier struct {
+	url string
+}
+
+func newWebhookNotifier(config map[string]string) (Notifier, error) {
+	if !core.IsRemoteFile(config["url"]) {
+		return nil, fmt.Errorf("invalid webhook url \"%s\"", config["url"])
+	}
+	return &webhookNotifier{url: config["url"]}, nil
+}
+
+func (p *webhookNotifier) Notify(_ *core.DB, _ string, notification *Notification) error {
+	data, e := json.Marshal(notification)
+	if e != nil {
+		return e
+	}
+
+	client := &http.Client{Timeout: notifierTimeout}
+	resp, e := client.Post(p.url, "application/json", bytes.NewReader(data))
+	if e != nil {
+		return e
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type emailNotifier struct {
+	addr     string
+	from     string
+	to       []string
+	username string
+	password string
+}
+
+func newEmailNotifier(config map[string]string) (Notifier, error) {
+	to := make([]string, 0)
+	for _, v := range strings.Split(config["to"], ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			to = append(to, v)
+		}
+	}
+
+	if _, _, e := net.SplitHostPort(config["addr"]); e != nil {
+		return nil, fmt.Errorf("invalid smtp address \"%s\"", config["addr"])
+	} else if config["from"] == "" {
+		return nil, fmt.Errorf("email sender is empty")
+	} else if len(to) == 0 {
+		return nil, fmt.Errorf("email recipient is empty")
+	} else {
+		return &emailNotifier{
+			addr:     config["addr"],
+			from:     config["from"],
+			to:       to,
+			username: config["username"],
+			password: config["password"],
+		}, nil
+	}
+}
+
+func (p *emailNotifier) Notify(_ *core.DB, _ string, notification *Notification) error {
+	var auth smtp.Auth
+	if p.username != "" {
+		host, _, _ := net.SplitHostPort(p.addr)
+		auth = smtp.PlainAuth("", p.username, p.password, host)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + p.from,
+		"To: " + strings.Join(p.to, ", "),
+		// a line break in the title would start a new header
+		"Subject: " + strings.NewReplacer("\r", " ", "\n", " ").Replace(notification.Title),
+		"Date: " + time.Unix(0, notification.Time*int64(time.Millisecond)).Format(time.RFC1123Z),
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		notification.Message,
+	}, "\r\n")
+
+	return smtp.SendMail(p.addr, auth, p.from, p.to, []byte(msg))
+}
+
+// inAppNotifier stores the notification in the bucket of the user, the web
+// ui reads them with alert:Notifications
+type inAppNotifier struct{}
+
+func newInAppNotifier(_ map[string]string) (Notifier, error) {
+	return &inAppNotifier{}, nil
+}
+
+func (p *inAppNotifier) Notify(db *core.DB, bucket string, notification *Notification) error {
+	data, e := json.Marshal(notification)
+	if e != nil {
+		return e
+	}
+
+	return db.Put(
+		bucket,
+		fmt.Sprintf("notification.%020d", time.Now().UnixNano()),
+		data,
+	)
+}
+
+// dbTrimNotifications deletes the in-app notifications of the bucket that
+// have been created before the time
+func dbTrimNotifications(db *core.DB, bucket string, before time.Time) (int, error) {
+	ret := 0
+	return ret, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+
+		c := b.Cursor()
+		prefix := []byte("notification.")
+		end := core.DBKey("notification.%020d", before.UnixNano())
+		for k, _ := c.Seek(prefix); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Seek(prefix) {
+			if e := b.Delete(k); e != nil {
+				return e
+			}
+			ret++
+		}
+		return nil
+	})
+}
+
+func runNotificationRetention(db *core.DB) {
+	buckets, e := db.ListBuckets("-")
+	if e != nil {
+		return
+	}
+
+	for _, bucket := range buckets {
+		if n, e := dbTrimNotifications(db, bucket, time.Now().Add(-notificationRetention)); e != nil {
+			log.Print(e)
+		} else if n > 0 {
+			log.Printf("notification: %d notifications of %s have expired", n, bucket)
+		}
+	}
+}
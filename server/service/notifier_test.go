@@ -0,0 +1,150 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+// startTestSMTPServer accepts one mail and sends its data to the channel
+func startTestSMTPServer() (net.Listener, chan string) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	ch := make(chan string, 1)
+	go func() {
+		conn, e := ln.Accept()
+		if e != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		reply := func(s string) { _, _ = conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost")
+		for {
+			line, e := reader.ReadString('\n')
+			if e != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line + " ")[0]); cmd {
+			case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+				reply("250 ok")
+			case "DATA":
+				reply("354 go ahead")
+				data := ""
+				for line, e = reader.ReadString('\n'); e == nil && line != ".\r\n"; line, e = reader.ReadString('\n') {
+					data += line
+				}
+				ch <- data
+				reply("250 ok")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("502 unknown")
+			}
+		}
+	}()
+	return ln, ch
+}
+
+func TestNewNotifier(t *testing.T) {
+	t.Run("test error", func(t *testing.T) {
+		assert := assert.New(t)
+		assert(newNotifier("sms", nil)).
+			Equals(nil, errors.New("unknown channel type \"sms\""))
+		assert(newNotifier("webhook", map[string]string{"url": "ftp://a"})).
+			Equals(nil, errors.New("invalid webhook url \"ftp://a\""))
+		assert(newNotifier("email", map[string]string{"addr": "localhost"})).
+			Equals(nil, errors.New("invalid smtp address \"localhost\""))
+		assert(newNotifier("email", map[string]string{"addr": "localhost:25", "from": "a@b.c"})).
+			Equals(nil, errors.New("email recipient is empty"))
+	})
+}
+
+func TestNotifier_Notify(t *testing.T) {
+	notification := &Notification{Title: "title", Message: "message", State: "firing", Time: 1700000000000}
+
+	t.Run("webhook", func(t *testing.T) {
+		assert := assert.New(t)
+		received := &Notification{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data, _ := ioutil.ReadAll(r.Body)
+			_ = json.Unmarshal(data, received)
+			if received.State == "error" {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+		defer server.Close()
+
+		notifier, _ := newNotifier("webhook", map[string]string{"url": server.URL})
+		assert(notifier.Notify(nil, "", notification)).IsNil()
+		assert(received).Equals(notification)
+		assert(notifier.Notify(nil, "", &Notification{State: "error"})).
+			Equals(errors.New("webhook responded with status 500"))
+	})
+
+	t.Run("email", func(t *testing.T) {
+		assert := assert.New(t)
+		ln, ch := startTestSMTPServer()
+		defer ln.Close()
+
+		notifier, _ := newNotifier("email", map[string]string{
+			"addr": ln.Addr().String(),
+			"from": "vbot@example.com",
+			"to":   "a@example.com, b@example.com",
+		})
+		assert(notifier.Notify(nil, "", notification)).IsNil()
+		data := <-ch
+		assert(strings.Contains(data, "Subject: title\r\n")).IsTrue()
+		assert(strings.Contains(data, "To: a@example.com, b@example.com\r\n")).IsTrue()
+		assert(strings.HasSuffix(data, "\r\nmessage\r\n")).IsTrue()
+	})
+
+	t.Run("email subject", func(t *testing.T) {
+		assert := assert.New(t)
+		ln, ch := startTestSMTPServer()
+		defer ln.Close()
+
+		notifier, _ := newNotifier("email", map[string]string{
+			"addr": ln.Addr().String(),
+			"from": "vbot@example.com",
+			"to":   "a@example.com",
+		})
+		assert(notifier.Notify(nil, "", &Notification{Title: "title\r\nBcc: c@example.com", Time: 1700000000000})).
+			IsNil()
+		data := <-ch
+		assert(strings.Contains(data, "Subject: title  Bcc: c@example.com\r\n")).IsTrue()
+		assert(strings.Contains(data, "\r\nBcc:")).IsFalse()
+	})
+
+	t.Run("inapp", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-test")
+
+		notifier, _ := newNotifier("inapp", nil)
+		assert(notifier.Notify(db, "-test", notification)).IsNil()
+		ret, e := dbListSince(db, "-test", "notification", 0)
+		assert(e).IsNil()
+		assert(len(ret)).Equals(1)
+
+		assert(dbTrimNotifications(db, "-test", time.Now().Add(-time.Hour))).Equals(0, nil)
+		assert(dbTrimNotifications(db, "-test", time.Now())).Equals(1, nil)
+		ret, _ = dbListSince(db, "-test", "notification", 0)
+		assert(len(ret)).Equals(0)
+	})
+}
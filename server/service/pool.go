@@ -0,0 +1,186 @@
+package service
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var gSSHPool = NewSSHPool()
+
+type sshPoolItem struct {
+	client   *ssh.Client
+	settings string
+	lastUsed time.Time
+	users    int
+	retired  bool
+}
+
+// SSHPool keeps ssh connections alive so that background jobs do not
+// handshake on every run. A connection is replaced when the settings of the
+// server have been changed, the old one is closed after its last user.
+type SSHPool struct {
+	items map[string]*sshPoolItem
+	mu    sync.Mutex
+}
+
+func NewSSHPool() *SSHPool {
+	return &SSHPool{
+		items: make(map[string]*sshPoolItem),
+	}
+}
+
+func getSSHSettings(fields map[string]string) string {
+	hash := sha256.New()
+	for _, key := range []string{"host", "port", "user", "password", "privateKey", "hostKey"} {
+		_, _ = hash.Write([]byte(fields[key]))
+		_, _ = hash.Write([]byte{0})
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// retire removes the item from the pool, its connection is closed when it
+// has no user. The caller must hold the lock.
+func (p *SSHPool) retire(key string, item *sshPoolItem) {
+	if p.items[key] == item {
+		delete(p.items, key)
+	}
+	item.retired = true
+	if item.users == 0 {
+		_ = item.client.Close()
+	}
+}
+
+// get returns the item of the key and counts a user of it, trust is passed
+// to dialServer when a new connection is dialed. release must be called when
+// the connection is no longer used.
+func (p *SSHPool) get(
+	key string, fields map[string]string, trust func(hostKey string) error,
+) (*sshPoolItem, error) {
+	settings := getSSHSettings(fields)
+
+	p.mu.Lock()
+	if item, ok := p.items[key]; ok {
+		if item.settings == settings {
+			item.lastUsed = time.Now()
+			item.users++
+			p.mu.Unlock()
+			return item, nil
+		}
+		p.retire(key, item)
+	}
+	p.mu.Unlock()
+
+	client, e := dialServer(fields, trust)
+	if e != nil {
+		return nil, e
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if item, ok := p.items[key]; ok {
+		if item.settings == settings {
+			// another goroutine has dialed at the same time
+			_ = client.Close()
+			item.lastUsed = time.Now()
+			item.users++
+			return item, nil
+		}
+		// another goroutine has dialed with the old settings
+		p.retire(key, item)
+	}
+	ret := &sshPoolItem{
+		client:   client,
+		settings: settings,
+		lastUsed: time.Now(),
+		users:    1,
+	}
+	p.items[key] = ret
+	return ret, nil
+}
+
+// release ends a use of the item, a retired item is closed by its last user
+func (p *SSHPool) release(item *sshPoolItem) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if item.users--; item.users == 0 && item.retired {
+		_ = item.client.Close()
+	}
+}
+
+func (p *SSHPool) Remove(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if item, ok := p.items[key]; ok {
+		p.retire(key, item)
+	}
+}
+
+// OnTimer closes the connections that have been idle for the timeout, a
+// connection that is in use is kept
+func (p *SSHPool) OnTimer(idleTimeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for key, item := range p.items {
+		if item.users == 0 && now.Sub(item.lastUsed) > idleTimeout {
+			p.retire(key, item)
+		}
+	}
+}
+
+// newSessionError is returned when a session could not be opened on a pooled
+// connection, nothing has been sent so the command can be run again on a new
+// connection
+type newSessionError struct {
+	err error
+}
+
+func (p *newSessionError) Error() string {
+	return p.err.Error()
+}
+
+// RunCommand runs the command on a pooled connection, a broken connection
+// is dialed again once if the session could not be opened
+func (p *SSHPool) RunCommand(
+	key string, fields map[string]string, trust func(hostKey string) error, cmd string,
+) (string, error) {
+	return p.run(key, fields, trust, cmd, runCommand)
+}
+
+// run runs fn on a pooled connection, the command is run again on a new
+// connection only if fn returns a newSessionError, a command that has been
+// sent is never repeated
+func (p *SSHPool) run(
+	key string, fields map[string]string, trust func(hostKey string) error, cmd string,
+	fn func(client *ssh.Client, cmd string) (string, error),
+) (string, error) {
+	for i := 0; ; i++ {
+		item, e := p.get(key, fields, trust)
+		if e != nil {
+			return "", e
+		}
+
+		output, e := fn(item.client, cmd)
+		p.release(item)
+		v, ok := e.(*newSessionError)
+		if !ok {
+			return output, e
+		} else if i > 0 {
+			return output, v.err
+		}
+
+		// the broken connection is dropped, unless it has been replaced
+		p.mu.Lock()
+		if !item.retired {
+			p.retire(key, item)
+		}
+		p.mu.Unlock()
+	}
+}
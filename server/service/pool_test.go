@@ -0,0 +1,70 @@
+package service
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/vbot/server/core"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHPool_run(t *testing.T) {
+	t.Run("settings changed while in use", func(t *testing.T) {
+		assert := assert.New(t)
+		fnExec := func(cmd string) (string, uint32) { return cmd, 0 }
+		server1 := startTestSSHServer("pwd", fnExec)
+		defer server1.Close()
+		server2 := startTestSSHServer("pwd", fnExec)
+		defer server2.Close()
+		pool := NewSSHPool()
+
+		used := (*ssh.Client)(nil)
+		output, e := pool.run("-test/1", server1.Fields("pwd"), nil, "hostname", func(client *ssh.Client, cmd string) (string, error) {
+			used = client
+			assert(pool.RunCommand("-test/1", server2.Fields("pwd"), nil, "uptime")).Equals("uptime", nil)
+			// the old connection is retired but kept for its user
+			return runCommand(client, cmd)
+		})
+		assert(output, e).Equals("hostname", nil)
+		_, e = runCommand(used, "hostname")
+		assert(e).IsNotNil()
+
+		output, e = pool.run("-test/1", server2.Fields("pwd"), nil, "hostname", func(client *ssh.Client, cmd string) (string, error) {
+			used = client
+			pool.Remove("-test/1")
+			return runCommand(client, cmd)
+		})
+		assert(output, e).Equals("hostname", nil)
+		_, e = runCommand(used, "hostname")
+		assert(e).IsNotNil()
+	})
+
+	t.Run("connection dropped after the command starts", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-test")
+		count := int32(0)
+		server := startTestSSHServer("pwd", nil)
+		defer server.Close()
+		server.fnExec = func(cmd string) (string, uint32) {
+			atomic.AddInt32(&count, 1)
+			if cmd == "reboot" {
+				server.DropConnections()
+			}
+			return cmd, 0
+		}
+		defer gSSHPool.Remove("-test/drop")
+
+		_, e := runExecSession(db, "-test", "drop", "alice", server.Fields("pwd"), "reboot", nil)
+		assert(e != nil, atomic.LoadInt32(&count)).Equals(true, int32(1))
+
+		// the broken connection is replaced before the next command is sent
+		output, e := runExecSession(db, "-test", "drop", "alice", server.Fields("pwd"), "uptime", nil)
+		assert(output, e, atomic.LoadInt32(&count)).Equals("uptime", nil, int32(2))
+	})
+}
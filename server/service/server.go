@@ -3,16 +3,61 @@ package service
 import (
 	"bytes"
 	"fmt"
+	"regexp"
+	"strings"
 
 	"github.com/boltdb/bolt"
 	"github.com/rpccloud/rpc"
 	"github.com/rpccloud/vbot/server/core"
 )
 
-var ServerService = rpc.NewService(nil).
-	On("Create", createServer).
-	On("List", listServers).
-	On("Delete", deleteServer)
+var (
+	serverTagRegex = regexp.MustCompile(`^[-_.0-9a-zA-Z]+$`)
+
+	// all the keys of a server start with one of these prefixes
+	serverKeyPrefixes = []string{
+		"ssh.%s.", "health.%s.", "fact.%s.", "factMeta.%s.", "metric.%s.", "access.%s.",
+		"command.%s.", "trigger.%s.",
+	}
+)
+
+var ServerService = rpc.NewService(rpc.Map{
+	"health": NewPeriodicTask(runHealthChecks),
+	"facts":  NewPeriodicTask(runFactsCollection),
+}).
+	On("$onTimer", onServerTimer).
+	On("Create", auditAction("server:Create", createServer, 4)).
+	On("CreateLocal", auditAction("server:CreateLocal", createLocalServer)).
+	On("Test", auditAction("server:Test", testConnection, 5)).
+	On("List", auditAction("server:List", listServers)).
+	On("Delete", auditAction("server:Delete", deleteServer)).
+	On("SetTags", auditAction("server:SetTags", setServerTags)).
+	On("SetCharset", auditAction("server:SetCharset", setServerCharset)).
+	On("SetBandwidth", auditAction("server:SetBandwidth", setServerBandwidth)).
+	On("ImportSSHConfig", auditAction("server:ImportSSHConfig", importSSHConfig, 2)).
+	On("ExportSSHConfig", auditAction("server:ExportSSHConfig", exportSSHConfig)).
+	On("ExportBundle", auditAction("server:ExportBundle", exportBundle, 1)).
+	On("ImportBundle", auditAction("server:ImportBundle", importBundle, 1)).
+	On("ImportCSV", auditAction("server:ImportCSV", importCSV, 1)).
+	On("Health", auditAction("server:Health", getServerHealth)).
+	On("RefreshFacts", auditAction("server:RefreshFacts", refreshFacts)).
+	On("Exec", auditAction("server:Exec", execCommand)).
+	On("SetCommandPolicy", auditAction("server:SetCommandPolicy", setCommandPolicy)).
+	On("GetCommandPolicy", auditAction("server:GetCommandPolicy", getCommandPolicy)).
+	On("CommandMatches", auditAction("server:CommandMatches", listCommandMatches)).
+	On("Terminals", auditAction("server:Terminals", listTerminals)).
+	On("TerminalSnapshot", auditAction("server:TerminalSnapshot", getTerminalSnapshot)).
+	On("SearchTerminal", auditAction("server:SearchTerminal", searchTerminal)).
+	On("CreateTrigger", auditAction("server:CreateTrigger", createTrigger, 4)).
+	On("ListTriggers", auditAction("server:ListTriggers", listTriggers)).
+	On("DeleteTrigger", auditAction("server:DeleteTrigger", deleteTrigger)).
+	On("CreateBroadcast", auditAction("server:CreateBroadcast", createBroadcast)).
+	On("SetBroadcastMember", auditAction("server:SetBroadcastMember", setBroadcastMember)).
+	On("ListBroadcasts", auditAction("server:ListBroadcasts", listBroadcasts)).
+	On("CloseBroadcast", auditAction("server:CloseBroadcast", closeBroadcast)).
+	On("CreateHook", auditAction("server:CreateHook", createSessionHook)).
+	On("ListHooks", auditAction("server:ListHooks", listSessionHooks)).
+	On("DeleteHook", auditAction("server:DeleteHook", deleteSessionHook))
 
 func dbCreateServer(
 	db *core.DB, bucket string, id string,
@@ -42,25 +87,125 @@ func dbCreateServer(
 	})
 }
 
+func dbAddServer(
+	db *core.DB, bucket string,
+	host string, port string, user string, password string, privateKey string, name string, comment string,
+) (string, error) {
+	if id, e := db.GetBucketID(bucket); e != nil {
+		return "", e
+	} else if e = dbCreateServer(db, bucket, fmt.Sprintf("%d", id), host, port, user, password, privateKey, name, comment); e != nil {
+		return "", e
+	} else {
+		return fmt.Sprintf("%d", id), nil
+	}
+}
+
+// createServer saves the server, when test is true the connection is tested
+// first and the server is saved with its host key only if the test passes.
 func createServer(
 	rt rpc.Runtime, sessionID string,
-	host string, port string, user string, password string, name string, comment string, auto bool,
-) rpc.Return {
+	host string, port string, user string, password string, name string, comment string, auto bool, test bool,
+) (interface{}, error) {
 	if name == "" {
 		name = fmt.Sprintf("%s@%s", user, host)
 	}
 
-	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
-		return rt.Reply(e)
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
 	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
-		return rt.Reply(e)
-	} else if id, e := db.GetBucketID("-" + userName); e != nil {
-		return rt.Reply(e)
-	} else if e = dbCreateServer(db, "-"+userName, fmt.Sprintf("%d", id), host, port, user, password, "", name, comment); e != nil {
-		return rt.Reply(e)
+		return nil, e
+	} else if hostKey, e := testNewServer(test, host, port, user, password); e != nil {
+		return nil, e
+	} else if id, e := dbAddServer(db, bucket, host, port, user, password, "", name, comment); e != nil {
+		return nil, e
+	} else if e := dbSetServerHostKey(db, bucket, id, hostKey); e != nil {
+		return nil, e
+	} else {
+		return true, nil
+	}
+}
+
+// testNewServer tests the settings of a new server when test is set, and
+// returns the host key that it has shown
+func testNewServer(test bool, host string, port string, user string, password string) (string, error) {
+	if !test {
+		return "", nil
+	}
+
+	ret := testServer(map[string]string{
+		"host": host, "port": port, "user": user, "password": password,
+	})
+	if ret["ok"] != true {
+		return "", getTestError(ret)
+	}
+	return ret["hostKey"].(string), nil
+}
+
+func dbGetServerTags(b *bolt.Bucket, id string) []string {
+	ret := make([]string, 0)
+	for _, tag := range strings.Split(string(b.Get(core.DBKey("ssh.%s.tags", id))), ",") {
+		if tag != "" {
+			ret = append(ret, tag)
+		}
+	}
+	return ret
+}
+
+func dbServerToMap(b *bolt.Bucket, id string, detail bool) rpc.Map {
+	tags := rpc.Array{}
+	for _, tag := range dbGetServerTags(b, id) {
+		tags = append(tags, tag)
+	}
+
+	serverType := string(b.Get(core.DBKey("ssh.%s.type", id)))
+	if serverType == "" {
+		serverType = "ssh"
+	}
+
+	ret := rpc.Map{
+		"id":   id,
+		"type": serverType,
+		"name": string(b.Get(core.DBKey("ssh.%s.name", id))),
+		"user": string(b.Get(core.DBKey("ssh.%s.user", id))),
+		"port": string(b.Get(core.DBKey("ssh.%s.port", id))),
+		"host": string(b.Get(core.DBKey("ssh.%s.host", id))),
+		"auto": string(b.Get(core.DBKey("ssh.%s.privateKey", id))) != "",
+		"tags": tags,
+	}
+
+	if charset := string(b.Get(core.DBKey("ssh.%s.charset", id))); charset != "" {
+		ret["charset"] = charset
 	} else {
-		return rt.Reply(true)
+		ret["charset"] = core.CharsetUTF8
 	}
+
+	for key, value := range getHealthStatus(b, id) {
+		ret[key] = value
+	}
+
+	if detail {
+		ret["comment"] = string(b.Get(core.DBKey("ssh.%s.comment", id)))
+		ret["facts"] = dbGetFacts(b, id)
+	}
+
+	return ret
+}
+
+func dbListServerIDs(db *core.DB, bucket string) ([]string, error) {
+	ret := make([]string, 0)
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+
+		c := b.Cursor()
+		p := []byte("servers.")
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			ret = append(ret, string(v))
+		}
+		return nil
+	})
 }
 
 func dbListServers(db *core.DB, bucket string, detail bool) (rpc.Array, error) {
@@ -74,45 +219,36 @@ func dbListServers(db *core.DB, bucket string, detail bool) (rpc.Array, error) {
 		c := b.Cursor()
 		p := []byte("servers.")
 		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
-			id := string(v)
-			if !detail {
-				ret = append(ret, rpc.Map{
-					"id":   id,
-					"name": string(b.Get(core.DBKey("ssh.%s.name", id))),
-					"user": string(b.Get(core.DBKey("ssh.%s.user", id))),
-					"port": string(b.Get(core.DBKey("ssh.%s.port", id))),
-					"host": string(b.Get(core.DBKey("ssh.%s.host", id))),
-					"auto": string(b.Get(core.DBKey("ssh.%s.privateKey", id))) != "",
-				})
-			} else {
-				ret = append(ret, rpc.Map{
-					"id":      id,
-					"name":    string(b.Get(core.DBKey("ssh.%s.name", id))),
-					"user":    string(b.Get(core.DBKey("ssh.%s.user", id))),
-					"port":    string(b.Get(core.DBKey("ssh.%s.port", id))),
-					"host":    string(b.Get(core.DBKey("ssh.%s.host", id))),
-					"auto":    string(b.Get(core.DBKey("ssh.%s.privateKey", id))) != "",
-					"comment": string(b.Get(core.DBKey("ssh.%s.comment", id))),
-				})
-			}
+			ret = append(ret, dbServerToMap(b, string(v), detail))
 		}
 
 		return nil
 	})
 }
 
-func listServers(rt rpc.Runtime, sessionID string, detail bool) rpc.Return {
-	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
-		return rt.Reply(e)
+func listServers(rt rpc.Runtime, sessionID string, detail bool) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return nil, e
 	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
-		return rt.Reply(e)
-	} else if ret, e := dbListServers(db, "-"+userName, detail); e != nil {
-		return rt.Reply(e)
+		return nil, e
+	} else if ret, e := dbListServers(db, bucket, detail); e != nil {
+		return nil, e
 	} else {
-		return rt.Reply(ret)
+		return ret, nil
 	}
 }
 
+func dbDeleteServerInBucket(b *bolt.Bucket, id string) {
+	c := b.Cursor()
+	for _, prefix := range serverKeyPrefixes {
+		p := core.DBKey(prefix, id)
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Seek(p) {
+			_ = b.Delete(k)
+		}
+	}
+	_ = b.Delete(core.DBKey("servers.%s", id))
+}
+
 func dbDeleteServer(db *core.DB, bucket string, id string) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucket))
@@ -120,25 +256,53 @@ func dbDeleteServer(db *core.DB, bucket string, id string) error {
 			return fmt.Errorf("bucket \"%s\" not exist", bucket)
 		}
 
-		c := b.Cursor()
-		p := core.DBKey("ssh.%s", id)
-		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
-			fmt.Printf("delete %s\n", string(k))
-			_ = b.Delete(k)
-		}
-
-		_ = b.Delete(core.DBKey("servers.%s", id))
+		dbDeleteServerInBucket(b, id)
 		return nil
 	})
 }
-func deleteServer(rt rpc.Runtime, sessionID string, serverID string) rpc.Return {
-	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
-		return rt.Reply(e)
+
+func deleteServer(rt rpc.Runtime, sessionID string, serverID string) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if e := dbDeleteServer(db, bucket, serverID); e != nil {
+		return nil, e
+	} else {
+		return true, nil
+	}
+}
+
+func dbSetServerTags(db *core.DB, bucket string, id string, tags []string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if b.Get(core.DBKey("servers.%s", id)) == nil {
+			return fmt.Errorf("server \"%s\" does not exist", id)
+		} else {
+			return b.Put(core.DBKey("ssh.%s.tags", id), []byte(strings.Join(tags, ",")))
+		}
+	})
+}
+
+func setServerTags(rt rpc.Runtime, sessionID string, serverID string, tags rpc.Array) (interface{}, error) {
+	tagList := make([]string, 0, len(tags))
+	for _, v := range tags {
+		if tag, ok := v.(string); !ok || !serverTagRegex.MatchString(tag) {
+			return nil, fmt.Errorf("invalid tag \"%v\"", v)
+		} else {
+			tagList = append(tagList, tag)
+		}
+	}
+
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
 	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
-		return rt.Reply(e)
-	} else if e := dbDeleteServer(db, "-"+userName, serverID); e != nil {
-		return rt.Reply(e)
+		return nil, e
+	} else if e := dbSetServerTags(db, bucket, serverID, tagList); e != nil {
+		return nil, e
 	} else {
-		return rt.Reply(true)
+		return true, nil
 	}
 }
@@ -34,6 +34,7 @@ func TestDebug(t *testing.T) {
 			"name"+rand,
 			"sshComment",
 			false,
+			false,
 		)
 		listRet, err := client.Send(5*time.Second, "#.server:List", user["sessionID"], false)
 		fmt.Println(listRet, err)
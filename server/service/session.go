@@ -0,0 +1,311 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+var gSessionRegistry = NewSessionRegistry()
+
+var SessionService = rpc.NewService(nil).
+	On("List", listSessions).
+	On("Terminate", terminateSession).
+	On("SetLimits", setSessionLimits).
+	On("GetLimits", getSessionLimits)
+
+// Session is a live connection of a user to a server, the kind is
+// "terminal" or "exec". The throughput of a terminal is limited by the
+// token buckets of the session and of the user.
+type Session struct {
+	id        string
+	kind      string
+	user      string
+	bucket    string
+	serverID  string
+	clientIP  string
+	startTime time.Time
+	bytesIn   int64
+	bytesOut  int64
+	rateIn    core.RateMeter
+	rateOut   core.RateMeter
+	limits    *bandwidthLimits
+	buckets   []*core.TokenBucket
+	userKey   string
+	fnClose   func(reason string)
+}
+
+// AddBytesIn counts the bytes sent from the user to the server
+func (p *Session) AddBytesIn(n int) {
+	atomic.AddInt64(&p.bytesIn, int64(n))
+	p.rateIn.Add(n, time.Now())
+}
+
+// AddBytesOut counts the bytes sent from the server to the user
+func (p *Session) AddBytesOut(n int) {
+	atomic.AddInt64(&p.bytesOut, int64(n))
+	p.rateOut.Add(n, time.Now())
+}
+
+func (p *Session) ToMap() rpc.Map {
+	now := time.Now()
+	ret := rpc.Map{
+		"id":        p.id,
+		"kind":      p.kind,
+		"user":      p.user,
+		"serverID":  p.serverID,
+		"clientIP":  p.clientIP,
+		"startTime": getMillisecond(p.startTime),
+		"bytesIn":   atomic.LoadInt64(&p.bytesIn),
+		"bytesOut":  atomic.LoadInt64(&p.bytesOut),
+		"rateIn":    p.rateIn.Rate(now),
+		"rateOut":   p.rateOut.Rate(now),
+	}
+	if p.limits != nil {
+		ret["maxRatePerSession"] = p.limits.PerSession
+		ret["maxRatePerUser"] = p.limits.PerUser
+	}
+	return ret
+}
+
+// sessionClosedError is returned by a session that has been closed from the
+// registry, the session must not be retried
+type sessionClosedError struct {
+	reason string
+}
+
+func (p *sessionClosedError) Error() string {
+	return p.reason
+}
+
+// sessionLimits are the maximum numbers of concurrent sessions of a user and
+// on a server in a workspace, zero means no limit
+type sessionLimits struct {
+	PerUser   int64 `json:"perUser"`
+	PerServer int64 `json:"perServer"`
+}
+
+// SessionRegistry keeps the live sessions so that they can be listed, closed
+// when the access of the user has been revoked, or terminated by an admin
+type SessionRegistry struct {
+	sessions map[string]*Session
+	seq      uint64
+	mu       sync.Mutex
+}
+
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		sessions: make(map[string]*Session),
+	}
+}
+
+// Add registers the session if the limits allow it and returns its id
+func (p *SessionRegistry) Add(session *Session, limits *sessionLimits) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if limits != nil {
+		numOfUser, numOfServer := int64(0), int64(0)
+		for _, v := range p.sessions {
+			if v.bucket != session.bucket {
+				continue
+			}
+			if v.user == session.user {
+				numOfUser++
+			}
+			if v.serverID == session.serverID {
+				numOfServer++
+			}
+		}
+
+		if limits.PerUser > 0 && numOfUser >= limits.PerUser {
+			return "", fmt.Errorf(
+				"user \"%s\" has too many sessions (limit %d)", session.user, limits.PerUser,
+			)
+		} else if limits.PerServer > 0 && numOfServer >= limits.PerServer {
+			return "", fmt.Errorf(
+				"server \"%s\" has too many sessions (limit %d)", session.serverID, limits.PerServer,
+			)
+		}
+	}
+
+	p.seq++
+	session.id = fmt.Sprintf("%d", p.seq)
+	p.sessions[session.id] = session
+	return session.id, nil
+}
+
+// Remove removes the session, the bandwidth of the user is released
+func (p *SessionRegistry) Remove(id string) {
+	p.mu.Lock()
+	session, ok := p.sessions[id]
+	delete(p.sessions, id)
+	p.mu.Unlock()
+
+	if ok {
+		session.releaseBandwidth()
+	}
+}
+
+func (p *SessionRegistry) Get(id string) (*Session, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	session, ok := p.sessions[id]
+	return session, ok
+}
+
+func (p *SessionRegistry) List() []*Session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ret := make([]*Session, 0, len(p.sessions))
+	for _, session := range p.sessions {
+		ret = append(ret, session)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].startTime.Before(ret[j].startTime)
+	})
+	return ret
+}
+
+// Close closes the session, the reason is shown to the user
+func (p *SessionRegistry) Close(id string, reason string) bool {
+	p.mu.Lock()
+	session, ok := p.sessions[id]
+	delete(p.sessions, id)
+	p.mu.Unlock()
+
+	if ok {
+		session.releaseBandwidth()
+	}
+	if ok && session.fnClose != nil {
+		session.fnClose(reason)
+	}
+	return ok
+}
+
+// dbGetSessionLimits returns the limits of the workspace, the config is used
+// if the workspace has no limits
+func dbGetSessionLimits(db *core.DB, bucket string) (*sessionLimits, error) {
+	ret := &sessionLimits{
+		PerUser:   core.GetConfig().GetMaxSessionsPerUser(),
+		PerServer: core.GetConfig().GetMaxSessionsPerServer(),
+	}
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if data := b.Get([]byte("session.limits")); data == nil {
+			return nil
+		} else {
+			return json.Unmarshal(data, ret)
+		}
+	})
+}
+
+func dbSetSessionLimits(db *core.DB, bucket string, limits *sessionLimits) error {
+	if limits.PerUser < 0 || limits.PerServer < 0 {
+		return fmt.Errorf("session limits must not be negative")
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else {
+			return dbPutJSON(b, []byte("session.limits"), limits)
+		}
+	})
+}
+
+// dbTerminateSession closes the session of the workspace and leaves an in-app
+// notification so that the user knows why the session has gone
+func dbTerminateSession(db *core.DB, bucket string, id string, admin string, reason string) error {
+	session, ok := gSessionRegistry.Get(id)
+	if !ok || session.bucket != bucket {
+		return fmt.Errorf("session \"%s\" does not exist", id)
+	}
+
+	message := fmt.Sprintf(
+		"%s session of user \"%s\" on server \"%s\" has been terminated by \"%s\"",
+		session.kind, session.user, session.serverID, admin,
+	)
+	if reason != "" {
+		message += ": " + reason
+	}
+
+	if !gSessionRegistry.Close(id, message) {
+		return fmt.Errorf("session \"%s\" does not exist", id)
+	}
+
+	notifier, _ := newInAppNotifier(nil)
+	return notifier.Notify(db, bucket, &Notification{
+		Title:   "session terminated",
+		Message: message,
+		State:   "terminated",
+		Time:    getMillisecond(time.Now()),
+	})
+}
+
+func listSessions(rt rpc.Runtime, sessionID string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return rt.Reply(e)
+	} else {
+		ret := rpc.Array{}
+		for _, session := range gSessionRegistry.List() {
+			if session.bucket == bucket {
+				ret = append(ret, session.ToMap())
+			}
+		}
+		return rt.Reply(ret)
+	}
+}
+
+func terminateSession(rt rpc.Runtime, sessionID string, id string, reason string) rpc.Return {
+	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := dbTerminateSession(db, bucket, id, userName, reason); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(true)
+	}
+}
+
+func setSessionLimits(rt rpc.Runtime, sessionID string, perUser int64, perServer int64) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := dbSetSessionLimits(db, bucket, &sessionLimits{
+		PerUser:   perUser,
+		PerServer: perServer,
+	}); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(true)
+	}
+}
+
+func getSessionLimits(rt rpc.Runtime, sessionID string) rpc.Return {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if limits, e := dbGetSessionLimits(db, bucket); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(toMap(limits))
+	}
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestSessionRegistry_Add(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		registry := NewSessionRegistry()
+		limits := &sessionLimits{PerUser: 2, PerServer: 3}
+		add := func(user string, bucket string, serverID string) (string, error) {
+			return registry.Add(&Session{
+				user: user, bucket: bucket, serverID: serverID, startTime: time.Now(),
+			}, limits)
+		}
+
+		assert(add("alice", "-ops", "1")).Equals("1", nil)
+		assert(add("alice", "-ops", "2")).Equals("2", nil)
+		assert(add("alice", "-ops", "3")).
+			Equals("", errors.New("user \"alice\" has too many sessions (limit 2)"))
+		assert(add("alice", "-dev", "1")).Equals("3", nil)
+		assert(add("bob", "-ops", "1")).Equals("4", nil)
+		assert(add("carol", "-ops", "1")).Equals("5", nil)
+		assert(add("dave", "-ops", "1")).
+			Equals("", errors.New("server \"1\" has too many sessions (limit 3)"))
+
+		registry.Remove("5")
+		assert(add("dave", "-ops", "1")).Equals("6", nil)
+		assert(registry.Add(&Session{user: "alice", bucket: "-ops"}, nil)).Equals("7", nil)
+		assert(len(registry.List())).Equals(6)
+	})
+}
+
+func TestDBTerminateSession(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-ops")
+
+		reason := ""
+		id, _ := gSessionRegistry.Add(&Session{
+			kind:      "terminal",
+			user:      "alice",
+			bucket:    "-ops",
+			serverID:  "1",
+			startTime: time.Now(),
+			fnClose: func(v string) {
+				reason = v
+			},
+		}, nil)
+		session, _ := gSessionRegistry.Get(id)
+		session.AddBytesIn(3)
+		session.AddBytesOut(5)
+		assert(session.ToMap()["bytesIn"], session.ToMap()["bytesOut"]).
+			Equals(int64(3), int64(5))
+
+		assert(dbTerminateSession(db, "-dev", id, "bob", "")).
+			Equals(errors.New("session \"" + id + "\" does not exist"))
+		assert(dbTerminateSession(db, "-ops", id, "bob", "maintenance")).IsNil()
+		assert(reason).Equals(
+			"terminal session of user \"alice\" on server \"1\" has been terminated by \"bob\": maintenance",
+		)
+		_, ok := gSessionRegistry.Get(id)
+		assert(ok).IsFalse()
+
+		notifications, e := dbListSince(db, "-ops", "notification", 0)
+		assert(e, len(notifications)).Equals(nil, 1)
+		assert(dbTerminateSession(db, "-ops", id, "bob", "")).
+			Equals(errors.New("session \"" + id + "\" does not exist"))
+	})
+}
+
+func TestDBGetSessionLimits(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-ops")
+
+		assert(dbGetSessionLimits(db, "-ops")).Equals(&sessionLimits{}, nil)
+		assert(dbSetSessionLimits(db, "-ops", &sessionLimits{PerUser: -1})).
+			Equals(errors.New("session limits must not be negative"))
+		assert(dbSetSessionLimits(db, "-ops", &sessionLimits{PerUser: 2, PerServer: 5})).IsNil()
+		assert(dbGetSessionLimits(db, "-ops")).
+			Equals(&sessionLimits{PerUser: 2, PerServer: 5}, nil)
+	})
+}
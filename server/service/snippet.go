@@ -0,0 +1,400 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+// snippetBucket is the bucket of the snippet library, it is shared by all
+// the workspaces
+const snippetBucket = "template"
+
+const (
+	snippetScopePersonal = "personal"
+	snippetScopeShared   = "shared"
+)
+
+var snippetNameRegex = regexp.MustCompile(`^[-_0-9a-zA-Z]+$`)
+
+var SnippetService = rpc.NewService(nil).
+	On("Save", auditAction("snippet:Save", saveSnippet)).
+	On("List", auditAction("snippet:List", listSnippets)).
+	On("History", auditAction("snippet:History", listSnippetHistory)).
+	On("Restore", auditAction("snippet:Restore", restoreSnippet)).
+	On("Delete", auditAction("snippet:Delete", deleteSnippet)).
+	On("Render", auditAction("snippet:Render", renderSnippet)).
+	On("Paste", auditAction("snippet:Paste", pasteSnippet)).
+	On("Run", auditAction("snippet:Run", runSnippet))
+
+// snippet is a command template. A personal snippet is owned by a user and
+// a shared one by a workspace, the latest version is stored as
+// "snippet.<scope>.<owner>.<name>" and every version as
+// "snippetVersion.<scope>.<owner>.<name>.<version>".
+type snippet struct {
+	Name        string              `json:"name"`
+	Scope       string              `json:"scope"`
+	Description string              `json:"description"`
+	Template    string              `json:"template"`
+	Params      []core.SnippetParam `json:"params"`
+	Version     int64               `json:"version"`
+	UpdatedBy   string              `json:"updatedBy"`
+	UpdatedAt   int64               `json:"updatedAt"`
+}
+
+func getSnippetKey(scope string, owner string, name string) []byte {
+	return core.DBKey("snippet.%s.%s.%s", scope, owner, name)
+}
+
+func getSnippetVersionKey(scope string, owner string, name string, version int64) []byte {
+	return core.DBKey("snippetVersion.%s.%s.%s.%010d", scope, owner, name, version)
+}
+
+func dbSaveSnippet(db *core.DB, owner string, v *snippet) (int64, error) {
+	if !snippetNameRegex.MatchString(v.Name) {
+		return 0, fmt.Errorf("invalid snippet name \"%s\"", v.Name)
+	} else if e := core.CheckSnippet(v.Template, v.Params); e != nil {
+		return 0, e
+	}
+
+	return v.Version, db.Update(func(tx *bolt.Tx) error {
+		b, e := tx.CreateBucketIfNotExists([]byte(snippetBucket))
+		if e != nil {
+			return e
+		}
+
+		v.Version = 1
+		if data := b.Get(getSnippetKey(v.Scope, owner, v.Name)); data != nil {
+			latest := &snippet{}
+			if e := json.Unmarshal(data, latest); e != nil {
+				return e
+			}
+			v.Version = latest.Version + 1
+		}
+
+		if e := dbPutJSON(b, getSnippetVersionKey(v.Scope, owner, v.Name, v.Version), v); e != nil {
+			return e
+		}
+		return dbPutJSON(b, getSnippetKey(v.Scope, owner, v.Name), v)
+	})
+}
+
+func dbGetSnippet(db *core.DB, scope string, owner string, name string) (*snippet, error) {
+	ret := &snippet{}
+	return ret, db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(snippetBucket)); b == nil {
+			return fmt.Errorf("snippet \"%s\" does not exist", name)
+		} else if data := b.Get(getSnippetKey(scope, owner, name)); data == nil {
+			return fmt.Errorf("snippet \"%s\" does not exist", name)
+		} else {
+			return json.Unmarshal(data, ret)
+		}
+	})
+}
+
+func dbListSnippetsWithPrefix(db *core.DB, prefix string) ([]*snippet, error) {
+	ret := make([]*snippet, 0)
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(snippetBucket))
+		if b == nil {
+			return nil
+		}
+		return dbListJSON(b, prefix, func(data []byte) error {
+			v := &snippet{}
+			if e := json.Unmarshal(data, v); e != nil {
+				return e
+			}
+			ret = append(ret, v)
+			return nil
+		})
+	})
+}
+
+// dbListSnippets returns the personal snippets of the user and the shared
+// snippets of the workspace
+func dbListSnippets(db *core.DB, user string, bucket string) ([]*snippet, error) {
+	if personal, e := dbListSnippetsWithPrefix(
+		db, fmt.Sprintf("snippet.%s.%s.", snippetScopePersonal, user),
+	); e != nil {
+		return nil, e
+	} else if shared, e := dbListSnippetsWithPrefix(
+		db, fmt.Sprintf("snippet.%s.%s.", snippetScopeShared, bucket),
+	); e != nil {
+		return nil, e
+	} else {
+		return append(personal, shared...), nil
+	}
+}
+
+// dbListSnippetHistory returns the versions of the snippet, the latest first
+func dbListSnippetHistory(db *core.DB, scope string, owner string, name string) ([]*snippet, error) {
+	if _, e := dbGetSnippet(db, scope, owner, name); e != nil {
+		return nil, e
+	} else if ret, e := dbListSnippetsWithPrefix(
+		db, fmt.Sprintf("snippetVersion.%s.%s.%s.", scope, owner, name),
+	); e != nil {
+		return nil, e
+	} else {
+		for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+			ret[i], ret[j] = ret[j], ret[i]
+		}
+		return ret, nil
+	}
+}
+
+// dbRestoreSnippet saves an old version of the snippet as the new version
+func dbRestoreSnippet(
+	db *core.DB, scope string, owner string, name string, version int64, user string,
+) (int64, error) {
+	old := &snippet{}
+	if e := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(snippetBucket)); b == nil {
+			return fmt.Errorf("snippet \"%s\" does not exist", name)
+		} else if data := b.Get(getSnippetVersionKey(scope, owner, name, version)); data == nil {
+			return fmt.Errorf("version %d of snippet \"%s\" does not exist", version, name)
+		} else {
+			return json.Unmarshal(data, old)
+		}
+	}); e != nil {
+		return 0, e
+	}
+
+	old.UpdatedBy, old.UpdatedAt = user, getMillisecond(time.Now())
+	return dbSaveSnippet(db, owner, old)
+}
+
+func dbDeleteSnippetKeys(b *bolt.Bucket, prefix []byte) error {
+	keys := make([][]byte, 0)
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+	for _, k := range keys {
+		if e := b.Delete(k); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// dbDeleteSnippet deletes the snippet and its history
+func dbDeleteSnippet(db *core.DB, scope string, owner string, name string) error {
+	if _, e := dbGetSnippet(db, scope, owner, name); e != nil {
+		return e
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(snippetBucket))
+		if e := b.Delete(getSnippetKey(scope, owner, name)); e != nil {
+			return e
+		}
+		return dbDeleteSnippetKeys(b, core.DBKey("snippetVersion.%s.%s.%s.", scope, owner, name))
+	})
+}
+
+// dbDeleteSharedSnippets deletes the shared snippets of the workspace bucket
+func dbDeleteSharedSnippets(tx *bolt.Tx, bucket string) error {
+	b := tx.Bucket([]byte(snippetBucket))
+	if b == nil {
+		return nil
+	} else if e := dbDeleteSnippetKeys(b, core.DBKey("snippet.%s.%s.", snippetScopeShared, bucket)); e != nil {
+		return e
+	} else {
+		return dbDeleteSnippetKeys(b, core.DBKey("snippetVersion.%s.%s.", snippetScopeShared, bucket))
+	}
+}
+
+func parseSnippetParams(params rpc.Array) ([]core.SnippetParam, error) {
+	ret := make([]core.SnippetParam, 0, len(params))
+	for _, v := range params {
+		param := core.SnippetParam{}
+		if m, ok := v.(rpc.Map); !ok {
+			return nil, fmt.Errorf("invalid snippet parameter \"%v\"", v)
+		} else if data, e := json.Marshal(m); e != nil {
+			return nil, e
+		} else if e := json.Unmarshal(data, &param); e != nil {
+			return nil, fmt.Errorf("invalid snippet parameter \"%v\"", v)
+		} else {
+			ret = append(ret, param)
+		}
+	}
+	return ret, nil
+}
+
+func parseSnippetValues(values rpc.Map) (map[string]string, error) {
+	ret := make(map[string]string)
+	for name, v := range values {
+		switch value := v.(type) {
+		case string:
+			ret[name] = value
+		case int64:
+			ret[name] = fmt.Sprintf("%d", value)
+		default:
+			return nil, fmt.Errorf("invalid value of parameter \"%s\"", name)
+		}
+	}
+	return ret, nil
+}
+
+// getSnippetOwner returns the name of the user and the owner of the snippets
+// of the scope, the shared snippets need the role in the workspace
+func getSnippetOwner(rt rpc.Runtime, sessionID string, scope string, role string) (string, string, error) {
+	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return "", "", e
+	} else if scope == snippetScopePersonal {
+		return userName, userName, nil
+	} else if scope != snippetScopeShared {
+		return "", "", fmt.Errorf("unknown snippet scope \"%s\"", scope)
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, role).ToString(); e != nil {
+		return "", "", e
+	} else {
+		return userName, bucket, nil
+	}
+}
+
+// getRenderedSnippet renders the latest version of the snippet
+func getRenderedSnippet(
+	rt rpc.Runtime, sessionID string, scope string, name string, values rpc.Map,
+) (string, error) {
+	if _, owner, e := getSnippetOwner(rt, sessionID, scope, roleViewer); e != nil {
+		return "", e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return "", e
+	} else if v, e := dbGetSnippet(db, scope, owner, name); e != nil {
+		return "", e
+	} else if params, e := parseSnippetValues(values); e != nil {
+		return "", e
+	} else {
+		return core.RenderSnippet(v.Template, v.Params, params)
+	}
+}
+
+func saveSnippet(
+	rt rpc.Runtime, sessionID string, scope string, name string, description string,
+	template string, params rpc.Array,
+) (interface{}, error) {
+	if userName, owner, e := getSnippetOwner(rt, sessionID, scope, roleOperator); e != nil {
+		return nil, e
+	} else if snippetParams, e := parseSnippetParams(params); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if version, e := dbSaveSnippet(db, owner, &snippet{
+		Name:        name,
+		Scope:       scope,
+		Description: description,
+		Template:    template,
+		Params:      snippetParams,
+		UpdatedBy:   userName,
+		UpdatedAt:   getMillisecond(time.Now()),
+	}); e != nil {
+		return nil, e
+	} else {
+		return version, nil
+	}
+}
+
+func listSnippets(rt rpc.Runtime, sessionID string) (interface{}, error) {
+	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return nil, e
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if snippets, e := dbListSnippets(db, userName, bucket); e != nil {
+		return nil, e
+	} else {
+		ret := rpc.Array{}
+		for _, v := range snippets {
+			ret = append(ret, toMap(v))
+		}
+		return ret, nil
+	}
+}
+
+func listSnippetHistory(rt rpc.Runtime, sessionID string, scope string, name string) (interface{}, error) {
+	if _, owner, e := getSnippetOwner(rt, sessionID, scope, roleViewer); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if snippets, e := dbListSnippetHistory(db, scope, owner, name); e != nil {
+		return nil, e
+	} else {
+		ret := rpc.Array{}
+		for _, v := range snippets {
+			ret = append(ret, toMap(v))
+		}
+		return ret, nil
+	}
+}
+
+func restoreSnippet(rt rpc.Runtime, sessionID string, scope string, name string, version int64) (interface{}, error) {
+	if userName, owner, e := getSnippetOwner(rt, sessionID, scope, roleOperator); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if v, e := dbRestoreSnippet(db, scope, owner, name, version, userName); e != nil {
+		return nil, e
+	} else {
+		return v, nil
+	}
+}
+
+func deleteSnippet(rt rpc.Runtime, sessionID string, scope string, name string) (interface{}, error) {
+	if _, owner, e := getSnippetOwner(rt, sessionID, scope, roleOperator); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if e := dbDeleteSnippet(db, scope, owner, name); e != nil {
+		return nil, e
+	} else {
+		return true, nil
+	}
+}
+
+func renderSnippet(rt rpc.Runtime, sessionID string, scope string, name string, values rpc.Map) (interface{}, error) {
+	if command, e := getRenderedSnippet(rt, sessionID, scope, name, values); e != nil {
+		return nil, e
+	} else {
+		return command, nil
+	}
+}
+
+// pasteSnippet types the rendered snippet into a terminal of the user
+// without Enter, so that the user can review it before running it. It is
+// written under the input lock of the terminal like the typed input.
+func pasteSnippet(
+	rt rpc.Runtime, sessionID string, scope string, name string, values rpc.Map, terminalID string,
+) (interface{}, error) {
+	if command, e := getRenderedSnippet(rt, sessionID, scope, name, values); e != nil {
+		return nil, e
+	} else if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return nil, e
+	} else if t, e := getTerminalBySession(rt, sessionID, terminalID); e != nil {
+		return nil, e
+	} else if t.session.user != userName {
+		return nil, fmt.Errorf("terminal \"%s\" does not exist", terminalID)
+	} else if e := t.write([]byte(command)); e != nil {
+		return nil, e
+	} else {
+		return command, nil
+	}
+}
+
+// runSnippet runs the rendered snippet on the targets as the exec action
+// does
+func runSnippet(
+	rt rpc.Runtime, sessionID string, scope string, name string, values rpc.Map, targets rpc.Array,
+) (interface{}, error) {
+	if command, e := getRenderedSnippet(rt, sessionID, scope, name, values); e != nil {
+		return nil, e
+	} else {
+		return execCommand(rt, sessionID, targets, command)
+	}
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestDBSaveSnippet(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		params := []core.SnippetParam{{Name: "service", Type: "string", Required: true}}
+
+		assert(dbSaveSnippet(db, "alice", &snippet{Name: "a.b", Scope: "personal", Template: "ls"})).
+			Equals(int64(0), errors.New("invalid snippet name \"a.b\""))
+		assert(dbSaveSnippet(db, "alice", &snippet{Name: "logs", Scope: "personal", Template: "ls {{x}}"})).
+			Equals(int64(0), errors.New("placeholder \"x\" is not a parameter"))
+
+		assert(dbSaveSnippet(db, "alice", &snippet{
+			Name: "logs", Scope: "personal", Template: "journalctl -u {{service}}", Params: params,
+		})).Equals(int64(1), nil)
+		assert(dbSaveSnippet(db, "alice", &snippet{
+			Name: "logs", Scope: "personal", Template: "journalctl -f -u {{service}}", Params: params,
+		})).Equals(int64(2), nil)
+		assert(dbSaveSnippet(db, "-ops", &snippet{
+			Name: "uptime", Scope: "shared", Template: "uptime",
+		})).Equals(int64(1), nil)
+		assert(dbSaveSnippet(db, "bob", &snippet{Name: "df", Scope: "personal", Template: "df -h"})).
+			Equals(int64(1), nil)
+
+		list, e := dbListSnippets(db, "alice", "-ops")
+		assert(e, len(list)).Equals(nil, 2)
+		assert(list[0].Name, list[0].Version, list[1].Name).Equals("logs", int64(2), "uptime")
+
+		history, e := dbListSnippetHistory(db, "personal", "alice", "logs")
+		assert(e, len(history)).Equals(nil, 2)
+		assert(history[0].Version, history[1].Template).Equals(int64(2), "journalctl -u {{service}}")
+
+		assert(dbRestoreSnippet(db, "personal", "alice", "logs", 5, "alice")).
+			Equals(int64(0), errors.New("version 5 of snippet \"logs\" does not exist"))
+		assert(dbRestoreSnippet(db, "personal", "alice", "logs", 1, "alice")).Equals(int64(3), nil)
+		v, e := dbGetSnippet(db, "personal", "alice", "logs")
+		assert(e, v.Version, v.Template).Equals(nil, int64(3), "journalctl -u {{service}}")
+
+		assert(dbDeleteSnippet(db, "personal", "alice", "logs")).IsNil()
+		assert(dbListSnippetHistory(db, "personal", "alice", "logs")).
+			Equals(nil, errors.New("snippet \"logs\" does not exist"))
+		assert(dbListSnippetsWithPrefix(db, "snippetVersion.personal.alice.")).Equals([]*snippet{}, nil)
+
+		assert(db.Update(func(tx *bolt.Tx) error {
+			return dbDeleteSharedSnippets(tx, "-ops")
+		})).IsNil()
+		list, e = dbListSnippets(db, "bob", "-ops")
+		assert(e, len(list), list[0].Name).Equals(nil, 1, "df")
+	})
+}
+
+func TestTerminal_paste(t *testing.T) {
+	t.Run("while typing", func(t *testing.T) {
+		assert := assert.New(t)
+		term, stdin := addTestBroadcastTerminal("alice", "-ops")
+		defer func() {
+			gSessionRegistry.Remove(term.session.id)
+			gTerminalManager.Remove(term.session.id)
+		}()
+		policy, _ := core.NewCommandPolicy(nil, []string{"^ls", "^df"})
+		term.guard = core.NewCommandGuard(policy)
+
+		wg := sync.WaitGroup{}
+		for _, input := range []string{"ls\r", "df -h"} {
+			wg.Add(1)
+			go func(input string) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					_ = term.write([]byte(input))
+				}
+			}(input)
+		}
+		wg.Wait()
+		assert(strings.Count(stdin.String(), "df -h")).Equals(100)
+	})
+}
@@ -0,0 +1,336 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+	"golang.org/x/crypto/ssh"
+)
+
+const sshDialTimeout = 10 * time.Second
+
+// versionConn records the identification line that the ssh server sends
+// first, so the banner is known even if the handshake fails later.
+type versionConn struct {
+	net.Conn
+	version []byte
+	done    bool
+}
+
+func (p *versionConn) Read(b []byte) (int, error) {
+	n, e := p.Conn.Read(b)
+	if !p.done && n > 0 {
+		if idx := bytes.IndexByte(b[:n], '\n'); idx >= 0 {
+			p.version = append(p.version, b[:idx]...)
+			p.done = true
+		} else if len(p.version) < 255 {
+			p.version = append(p.version, b[:n]...)
+		}
+	}
+	return n, e
+}
+
+func (p *versionConn) Version() string {
+	return string(bytes.TrimSpace(p.version))
+}
+
+func dbGetServer(db *core.DB, bucket string, id string) (map[string]string, error) {
+	ret := make(map[string]string)
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if b.Get(core.DBKey("servers.%s", id)) == nil {
+			return fmt.Errorf("server \"%s\" does not exist", id)
+		}
+
+		c := b.Cursor()
+		p := core.DBKey("ssh.%s.", id)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			ret[string(k[len(p):])] = string(v)
+		}
+		return nil
+	})
+}
+
+func getSSHAuthMethods(password string, privateKey string) ([]ssh.AuthMethod, error) {
+	ret := make([]ssh.AuthMethod, 0)
+	if privateKey != "" {
+		signer, e := ssh.ParsePrivateKey([]byte(privateKey))
+		if e != nil {
+			return nil, fmt.Errorf("unable to parse private key: %s", e.Error())
+		}
+		ret = append(ret, ssh.PublicKeys(signer))
+	}
+
+	if password != "" {
+		ret = append(ret, ssh.Password(password))
+		ret = append(ret, ssh.KeyboardInteractive(
+			func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return answers, nil
+			},
+		))
+	}
+
+	return ret, nil
+}
+
+// getHostKeyCallback checks the key against knownHostKey (in
+// authorized_keys format). If knownHostKey is empty the key is passed to
+// trust, which saves it on the first use, a nil trust accepts any key.
+func getHostKeyCallback(
+	knownHostKey string, trust func(hostKey string) error, fn func(key ssh.PublicKey),
+) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if fn != nil {
+			fn(key)
+		}
+
+		if knownHostKey == "" && trust != nil {
+			return trust(string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(key))))
+		} else if knownHostKey == "" {
+			return nil
+		} else if known, _, _, _, e := ssh.ParseAuthorizedKey([]byte(knownHostKey)); e != nil {
+			return e
+		} else if !bytes.Equal(known.Marshal(), key.Marshal()) {
+			return fmt.Errorf(
+				"host key mismatch: expected %s, got %s",
+				ssh.FingerprintSHA256(known),
+				ssh.FingerprintSHA256(key),
+			)
+		} else {
+			return nil
+		}
+	}
+}
+
+// dialServer connects to the server with the stored fields and checks the
+// host key against the stored one, or trusts it if none is stored.
+func dialServer(fields map[string]string, trust func(hostKey string) error) (*ssh.Client, error) {
+	if isLocalServer(fields) {
+		return nil, fmt.Errorf("local server \"%s\" does not support ssh", fields["name"])
+	}
+
+	auth, e := getSSHAuthMethods(fields["password"], fields["privateKey"])
+	if e != nil {
+		return nil, e
+	}
+
+	return ssh.Dial(
+		"tcp",
+		net.JoinHostPort(fields["host"], fields["port"]),
+		&ssh.ClientConfig{
+			User:            fields["user"],
+			Auth:            auth,
+			HostKeyCallback: getHostKeyCallback(fields["hostKey"], trust, nil),
+			Timeout:         sshDialTimeout,
+		},
+	)
+}
+
+type testStep struct {
+	name string
+	ok   bool
+	err  string
+	cost time.Duration
+}
+
+func (p *testStep) ToMap() rpc.Map {
+	return rpc.Map{
+		"name":     p.name,
+		"ok":       p.ok,
+		"error":    p.err,
+		"duration": p.cost.Milliseconds(),
+	}
+}
+
+// testServer dials the server step by step: tcp connect, ssh handshake,
+// host key verification and authentication.
+func testServer(fields map[string]string) rpc.Map {
+	steps := make([]*testStep, 0)
+	addStep := func(name string, start time.Time, e error) bool {
+		step := &testStep{name: name, ok: e == nil, cost: time.Since(start)}
+		if e != nil {
+			step.err = e.Error()
+		}
+		steps = append(steps, step)
+		return e == nil
+	}
+
+	ret := rpc.Map{
+		"ok":          false,
+		"banner":      "",
+		"hostKey":     "",
+		"fingerprint": "",
+		"latency":     int64(0),
+	}
+	defer func() {
+		arr := rpc.Array{}
+		for _, step := range steps {
+			arr = append(arr, step.ToMap())
+		}
+		ret["steps"] = arr
+	}()
+
+	start := time.Now()
+	conn, e := net.DialTimeout(
+		"tcp",
+		net.JoinHostPort(fields["host"], fields["port"]),
+		sshDialTimeout,
+	)
+	if !addStep("tcp", start, e) {
+		return ret
+	}
+	defer conn.Close()
+	ret["latency"] = time.Since(start).Milliseconds()
+	_ = conn.SetDeadline(time.Now().Add(sshDialTimeout))
+
+	auth, e := getSSHAuthMethods(fields["password"], fields["privateKey"])
+	if e != nil {
+		addStep("auth", time.Now(), e)
+		return ret
+	}
+
+	var hostKey ssh.PublicKey
+	hostKeyTime := time.Time{}
+	hostKeyCallback := getHostKeyCallback(fields["hostKey"], nil, func(key ssh.PublicKey) {
+		hostKey = key
+		hostKeyTime = time.Now()
+	})
+
+	start = time.Now()
+	vConn := &versionConn{Conn: conn}
+	sshConn, chans, reqs, e := ssh.NewClientConn(
+		vConn,
+		net.JoinHostPort(fields["host"], fields["port"]),
+		&ssh.ClientConfig{
+			User:            fields["user"],
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         sshDialTimeout,
+		},
+	)
+	ret["banner"] = vConn.Version()
+
+	if hostKey == nil {
+		// the host key callback is invoked at the end of the key exchange
+		if e == nil {
+			e = errors.New("host key was not received")
+		}
+		addStep("handshake", start, e)
+		return ret
+	}
+
+	ret["hostKey"] = string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(hostKey)))
+	ret["fingerprint"] = ssh.FingerprintSHA256(hostKey)
+	addStep("handshake", start, nil)
+	if !addStep("hostKey", hostKeyTime, hostKeyCallback("", nil, hostKey)) {
+		return ret
+	}
+
+	if !addStep("auth", hostKeyTime, e) {
+		return ret
+	}
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	_ = client.Close()
+	ret["ok"] = true
+	return ret
+}
+
+func dbSetServerHostKey(db *core.DB, bucket string, id string, hostKey string) error {
+	return db.Put(bucket, fmt.Sprintf("ssh.%s.hostKey", id), []byte(hostKey))
+}
+
+// dbTrustHostKey returns the trust of the server for dialServer, the host
+// key of the first connection is saved and the later ones must match it.
+func dbTrustHostKey(db *core.DB, bucket string, id string) func(hostKey string) error {
+	return func(hostKey string) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucket))
+			if b == nil {
+				return fmt.Errorf("bucket \"%s\" not exist", bucket)
+			} else if b.Get(core.DBKey("servers.%s", id)) == nil {
+				return fmt.Errorf("server \"%s\" does not exist", id)
+			}
+
+			key := core.DBKey("ssh.%s.hostKey", id)
+			if known := string(b.Get(key)); known == "" {
+				return b.Put(key, []byte(hostKey))
+			} else if known != hostKey {
+				// another connection has saved a different key meanwhile
+				return errors.New("host key mismatch: a different key has been saved")
+			} else {
+				return nil
+			}
+		})
+	}
+}
+
+// testConnection checks the server settings. When serverID is not empty the
+// stored settings are used and the non-empty arguments override them, the
+// stored credentials and host key are not used for another host or port.
+func testConnection(
+	rt rpc.Runtime, sessionID string, serverID string,
+	host string, port string, user string, password string,
+) (interface{}, error) {
+	fields := make(map[string]string)
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleOperator).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if serverID != "" {
+		if fields, e = dbGetServer(db, bucket, serverID); e != nil {
+			return nil, e
+		}
+		if (host != "" && host != fields["host"]) || (port != "" && port != fields["port"]) {
+			delete(fields, "password")
+			delete(fields, "privateKey")
+			delete(fields, "hostKey")
+		}
+	}
+
+	for key, value := range map[string]string{
+		"host": host, "port": port, "user": user, "password": password,
+	} {
+		if value != "" {
+			fields[key] = value
+		}
+	}
+
+	return testServer(fields), nil
+}
+
+func getTestError(ret rpc.Map) error {
+	if steps, ok := ret["steps"].(rpc.Array); ok {
+		for _, v := range steps {
+			if step, ok := v.(rpc.Map); ok && step["ok"] != true {
+				return fmt.Errorf("connection test failed at %s: %s", step["name"], step["error"])
+			}
+		}
+	}
+	return errors.New("connection test failed")
+}
+
+// runCommand runs the command in a new session of the client and returns
+// its standard output
+func runCommand(client *ssh.Client, cmd string) (string, error) {
+	session, e := client.NewSession()
+	if e != nil {
+		return "", &newSessionError{err: e}
+	}
+	defer session.Close()
+
+	output, e := session.Output(cmd)
+	return string(output), e
+}
@@ -0,0 +1,242 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+	"golang.org/x/crypto/ssh"
+)
+
+type testSSHServer struct {
+	listener net.Listener
+	hostKey  ssh.PublicKey
+	fnExec   func(cmd string) (string, uint32)
+	fnShell  func(channel ssh.Channel)
+	conns    []net.Conn
+	mu       sync.Mutex
+}
+
+// startTestSSHServer starts a local ssh server that accepts the user "root"
+// with the password, exec requests are answered by fnExec. Shell requests
+// are served by fnShell if it has been set.
+func startTestSSHServer(password string, fnExec func(cmd string) (string, uint32)) *testSSHServer {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(priv)
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "root" && string(pass) == password {
+				return nil, nil
+			}
+			return nil, errors.New("password rejected")
+		},
+		ServerVersion: "SSH-2.0-vbotTest",
+	}
+	config.AddHostKey(signer)
+
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	ret := &testSSHServer{listener: listener, hostKey: signer.PublicKey(), fnExec: fnExec}
+	go func() {
+		for {
+			conn, e := listener.Accept()
+			if e != nil {
+				return
+			}
+			go ret.serve(conn, config)
+		}
+	}()
+	return ret
+}
+
+func (p *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	p.mu.Lock()
+	p.conns = append(p.conns, conn)
+	p.mu.Unlock()
+
+	_, chans, reqs, e := ssh.NewServerConn(conn, config)
+	if e != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, e := newChannel.Accept()
+		if e != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				if req.Type == "pty-req" || req.Type == "window-change" {
+					_ = req.Reply(true, nil)
+					continue
+				} else if req.Type == "shell" && p.fnShell != nil {
+					_ = req.Reply(true, nil)
+					go func() {
+						p.fnShell(channel)
+						_, _ = channel.SendRequest(
+							"exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}),
+						)
+						_ = channel.Close()
+					}()
+					continue
+				} else if req.Type != "exec" || p.fnExec == nil {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				_ = req.Reply(true, nil)
+				cmdLen := binary.BigEndian.Uint32(req.Payload)
+				output, status := p.fnExec(string(req.Payload[4 : 4+cmdLen]))
+				_, _ = channel.Write([]byte(output))
+				_, _ = channel.SendRequest(
+					"exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}),
+				)
+				return
+			}
+		}()
+	}
+}
+
+func (p *testSSHServer) Fields(password string) map[string]string {
+	host, port, _ := net.SplitHostPort(p.listener.Addr().String())
+	return map[string]string{
+		"host":     host,
+		"port":     port,
+		"user":     "root",
+		"password": password,
+		"hostKey":  strings.TrimSpace(string(ssh.MarshalAuthorizedKey(p.hostKey))),
+	}
+}
+
+// DropConnections closes the connections of the clients without closing
+// the server
+func (p *testSSHServer) DropConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.conns = nil
+}
+
+func (p *testSSHServer) Close() {
+	_ = p.listener.Close()
+}
+
+func getTestStepNames(ret rpc.Map) []string {
+	names := make([]string, 0)
+	for _, v := range ret["steps"].(rpc.Array) {
+		step := v.(rpc.Map)
+		names = append(names, step["name"].(string)+":"+map[bool]string{true: "ok", false: "fail"}[step["ok"].(bool)])
+	}
+	return names
+}
+
+func TestTestServer(t *testing.T) {
+	t.Run("tcp error", func(t *testing.T) {
+		assert := assert.New(t)
+		server := startTestSSHServer("pwd", nil)
+		fields := server.Fields("pwd")
+		server.Close()
+		ret := testServer(fields)
+		assert(ret["ok"]).Equals(false)
+		assert(getTestStepNames(ret)).Equals([]string{"tcp:fail"})
+	})
+
+	t.Run("auth error", func(t *testing.T) {
+		assert := assert.New(t)
+		server := startTestSSHServer("pwd", nil)
+		defer server.Close()
+		ret := testServer(server.Fields("wrong"))
+		assert(ret["ok"]).Equals(false)
+		assert(ret["banner"]).Equals("SSH-2.0-vbotTest")
+		assert(ret["fingerprint"]).Equals(ssh.FingerprintSHA256(server.hostKey))
+		assert(getTestStepNames(ret)).
+			Equals([]string{"tcp:ok", "handshake:ok", "hostKey:ok", "auth:fail"})
+		assert(strings.HasPrefix(getTestError(ret).Error(), "connection test failed at auth")).
+			IsTrue()
+	})
+
+	t.Run("host key mismatch", func(t *testing.T) {
+		assert := assert.New(t)
+		server := startTestSSHServer("pwd", nil)
+		defer server.Close()
+		other := startTestSSHServer("pwd", nil)
+		defer other.Close()
+		fields := server.Fields("pwd")
+		fields["hostKey"] = string(ssh.MarshalAuthorizedKey(other.hostKey))
+		ret := testServer(fields)
+		assert(ret["ok"]).Equals(false)
+		assert(getTestStepNames(ret)).
+			Equals([]string{"tcp:ok", "handshake:ok", "hostKey:fail"})
+	})
+
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		server := startTestSSHServer("pwd", nil)
+		defer server.Close()
+		ret := testServer(server.Fields("pwd"))
+		assert(ret["ok"]).Equals(true)
+		assert(getTestStepNames(ret)).
+			Equals([]string{"tcp:ok", "handshake:ok", "hostKey:ok", "auth:ok"})
+
+		// the returned host key is accepted on the next connection
+		fields := server.Fields("pwd")
+		fields["hostKey"] = ret["hostKey"].(string)
+		client, e := dialServer(fields, nil)
+		assert(e).IsNil()
+		_ = client.Close()
+	})
+}
+
+func TestDialServer(t *testing.T) {
+	t.Run("trust on first use", func(t *testing.T) {
+		assert := assert.New(t)
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-test")
+		_ = dbCreateServer(db, "-test", "1", "127.0.0.1", "22", "root", "pwd", "", "web1", "")
+		server := startTestSSHServer("pwd", nil)
+		defer server.Close()
+		other := startTestSSHServer("pwd", nil)
+		defer other.Close()
+
+		unknown := func(server *testSSHServer) map[string]string {
+			fields := server.Fields("pwd")
+			delete(fields, "hostKey")
+			return fields
+		}
+
+		// the first connection saves the key
+		client, e := dialServer(unknown(server), dbTrustHostKey(db, "-test", "1"))
+		assert(e).IsNil()
+		_ = client.Close()
+		fields, _ := dbGetServer(db, "-test", "1")
+		assert(fields["hostKey"]).Equals(server.Fields("pwd")["hostKey"])
+
+		// a connection that has not seen the saved key must show the same one
+		client, e = dialServer(unknown(server), dbTrustHostKey(db, "-test", "1"))
+		assert(e).IsNil()
+		_ = client.Close()
+		_, e = dialServer(unknown(other), dbTrustHostKey(db, "-test", "1"))
+		assert(e).IsNotNil()
+		_, e = dialServer(unknown(server), dbTrustHostKey(db, "-test", "2"))
+		assert(e).IsNotNil()
+	})
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+// PeriodicTask runs fn in background on the timer of a service, a new run
+// starts only if the interval has passed and the previous run has finished
+type PeriodicTask struct {
+	fn        func(db *core.DB)
+	isRunning bool
+	lastRun   time.Time
+	mu        sync.Mutex
+}
+
+func NewPeriodicTask(fn func(db *core.DB)) *PeriodicTask {
+	return &PeriodicTask{fn: fn}
+}
+
+func (p *PeriodicTask) OnTimer(interval time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.isRunning || interval <= 0 || time.Since(p.lastRun) < interval {
+		return
+	}
+
+	p.isRunning = true
+	p.lastRun = time.Now()
+	go func() {
+		defer func() {
+			p.mu.Lock()
+			p.isRunning = false
+			p.mu.Unlock()
+		}()
+
+		if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e == nil {
+			p.fn(db)
+		}
+	}()
+}
+
+func getPeriodicTask(rt rpc.Runtime, name string) (*PeriodicTask, error) {
+	if configTask, ok := rt.GetServiceConfig(name); !ok {
+		return nil, errors.New("service config error")
+	} else if task, ok := configTask.(*PeriodicTask); !ok {
+		return nil, errors.New("service config error")
+	} else {
+		return task, nil
+	}
+}
+
+func onServerTimer(rt rpc.Runtime, seq uint64) rpc.Return {
+	if health, e := getPeriodicTask(rt, "health"); e != nil {
+		return rt.Reply(e)
+	} else if facts, e := getPeriodicTask(rt, "facts"); e != nil {
+		return rt.Reply(e)
+	} else {
+		health.OnTimer(core.GetConfig().GetHealthCheckInterval())
+		facts.OnTimer(core.GetConfig().GetFactsInterval())
+	}
+
+	return rt.Reply(nil)
+}
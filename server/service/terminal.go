@@ -0,0 +1,754 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	terminalRows       = 30
+	terminalCols       = 80
+	terminalScrollback = 5000
+
+	terminalMaxUploadFrame = 1024 * 1024
+)
+
+type windowSize struct {
+	Rows int `json:"rows"`
+	Cols int `json:"cols"`
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:    4096,
+	WriteBufferSize:   terminalReadSize,
+	WriteBufferPool:   &sync.Pool{},
+	EnableCompression: true,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// wsConn serializes the writes to the websocket, the output of the shell
+// and the notices of the server are written from different goroutines
+type wsConn struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (p *wsConn) WriteMessage(messageType int, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.conn.WriteMessage(messageType, data)
+}
+
+// terminal is a shell on a server. It outlives the websocket so that the
+// user can reattach to it, the output is fed to a VT emulator which redraws
+// the screen on reattach and serves the snapshots. The output for the
+// websocket is queued in pending and sent by flushOutput. The workspace is
+// the one of the bucket that the terminal has been opened in, the user may
+// switch to another one meanwhile.
+type terminal struct {
+	session     *Session
+	user        *User
+	workspace   string
+	serverName  string
+	serverHost  string
+	db          *core.DB
+	vt          *core.VTerm
+	guard       *core.CommandGuard
+	triggers    *triggerSet
+	decoder     *core.CharsetDecoder
+	encoder     *core.CharsetEncoder
+	recorder    *core.CommandRecorder
+	transfer    *core.ZModem
+	upload      *io.PipeWriter
+	shell       shell
+	stdin       io.Writer
+	stdout      io.Reader
+	conn        *wsConn
+	detachTimer *time.Timer
+	pending     *bytes.Buffer
+	cond        *sync.Cond
+	isClosed    bool
+	inputMu     sync.Mutex
+	mu          sync.Mutex
+}
+
+// shell is the process behind a terminal, a shell on a ssh server or a
+// local shell on the vbot host
+type shell interface {
+	Resize(rows int, cols int) error
+	Wait() error
+	Close() error
+}
+
+type sshShell struct {
+	conn    *ssh.Client
+	session *ssh.Session
+}
+
+func (p *sshShell) Resize(rows int, cols int) error {
+	return p.session.WindowChange(rows, cols)
+}
+
+func (p *sshShell) Wait() error {
+	return p.session.Wait()
+}
+
+func (p *sshShell) Close() error {
+	return p.conn.Close()
+}
+
+// terminalManager keeps the terminals by the id of their sessions in the
+// registry
+type terminalManager struct {
+	terminals map[string]*terminal
+	mu        sync.Mutex
+}
+
+var gTerminalManager = &terminalManager{terminals: make(map[string]*terminal)}
+
+func (p *terminalManager) Add(t *terminal) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.terminals[t.session.id] = t
+}
+
+func (p *terminalManager) Get(id string) (*terminal, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t, ok := p.terminals[id]
+	return t, ok
+}
+
+func (p *terminalManager) Remove(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.terminals, id)
+}
+
+// openTerminal starts a shell on the server and registers it
+func openTerminal(
+	db *core.DB, user *User, bucket string, serverID string, fields map[string]string, clientIP string,
+) (*terminal, error) {
+	guard, e := dbGetCommandGuard(db, bucket, serverID)
+	if e != nil {
+		return nil, e
+	}
+	triggers, e := dbGetTriggerSet(db, bucket, serverID)
+	if e != nil {
+		return nil, e
+	}
+	limits, e := dbGetSessionLimits(db, bucket)
+	if e != nil {
+		return nil, e
+	}
+	decoder, e := core.NewCharsetDecoder(fields["charset"])
+	if e != nil {
+		return nil, e
+	}
+	encoder, e := core.NewCharsetEncoder(fields["charset"])
+	if e != nil {
+		return nil, e
+	}
+
+	ret := &terminal{
+		user:       user,
+		workspace:  strings.TrimPrefix(bucket, "-"),
+		serverName: fields["name"],
+		serverHost: fields["host"],
+		db:         db,
+		vt:         core.NewVTerm(terminalRows, terminalCols, terminalScrollback),
+		guard:      guard,
+		triggers:   triggers,
+		decoder:    decoder,
+		encoder:    encoder,
+		recorder:   core.NewCommandRecorder(gPromptPattern, commandMaxOutput),
+		pending:    getBridgeBuffer(),
+	}
+	ret.cond = sync.NewCond(&ret.mu)
+	ret.session = &Session{
+		kind:      "terminal",
+		user:      user.name,
+		bucket:    bucket,
+		serverID:  serverID,
+		clientIP:  clientIP,
+		startTime: time.Now(),
+		fnClose:   ret.Close,
+	}
+	ret.session.setBandwidth(getBandwidthLimits(fields))
+
+	if _, e := gSessionRegistry.Add(ret.session, limits); e != nil {
+		ret.session.releaseBandwidth()
+		writeTerminalAudit(ret, "terminal:open", 0, 0, e)
+		return nil, e
+	} else if _, e := ret.runHooks(hookEventPreConnect); e != nil {
+		gSessionRegistry.Remove(ret.session.id)
+		writeTerminalAudit(ret, "terminal:open", 0, 0, e)
+		return nil, e
+	} else if e := ret.start(fields); e != nil {
+		gSessionRegistry.Remove(ret.session.id)
+		writeTerminalAudit(ret, "terminal:open", 0, 0, e)
+		return nil, e
+	}
+
+	writeTerminalAudit(ret, "terminal:open", 0, 0, nil)
+	if banners, e := ret.runHooks(hookEventPostConnect); e != nil {
+		log.Print(e)
+	} else {
+		ret.showBanners(banners)
+	}
+
+	go ret.readOutput()
+	go ret.flushOutput()
+	go func() {
+		if e := ret.shell.Wait(); e != nil {
+			log.Println("failed to wait shell: ", e)
+		}
+		ret.Close("")
+	}()
+	return ret, nil
+}
+
+func (p *terminal) start(fields map[string]string) error {
+	if isLocalServer(fields) {
+		return p.startLocal()
+	}
+
+	// Connect to the remote server and perform the SSH handshake.
+	sshConn, e := dialServer(fields, dbTrustHostKey(p.db, p.session.bucket, p.session.serverID))
+	if e != nil {
+		return e
+	}
+
+	// Set up terminal modes
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,     // enable echoing
+		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
+		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+	}
+
+	if session, e := sshConn.NewSession(); e != nil {
+		_ = sshConn.Close()
+		return e
+	} else if e := session.RequestPty("xterm", terminalRows, terminalCols, modes); e != nil {
+		_ = sshConn.Close()
+		return e
+	} else if stdout, e := session.StdoutPipe(); e != nil {
+		_ = sshConn.Close()
+		return e
+	} else if stdin, e := session.StdinPipe(); e != nil {
+		_ = sshConn.Close()
+		return e
+	} else if e := session.Shell(); e != nil {
+		_ = sshConn.Close()
+		return e
+	} else {
+		return p.setShell(&sshShell{conn: sshConn, session: session}, stdin, stdout)
+	}
+}
+
+// setShell sets the started shell and adds the terminal to the manager, a
+// shell that has been started after the terminal was closed is closed at
+// once
+func (p *terminal) setShell(shell shell, stdin io.Writer, stdout io.Reader) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.isClosed {
+		_ = shell.Close()
+		return errors.New("terminal has been closed while connecting")
+	}
+	p.shell, p.stdin, p.stdout = shell, stdin, stdout
+	gTerminalManager.Add(p)
+	return nil
+}
+
+// readOutput reads the output of the shell until it is closed
+func (p *terminal) readOutput() {
+	buf := gReadBufferPool.Get().(*[terminalReadSize]byte)
+	defer gReadBufferPool.Put(buf)
+
+	for {
+		n, e := p.stdout.Read(buf[:])
+		if e != nil {
+			if e != io.EOF {
+				log.Print(e)
+			}
+			return
+		}
+		p.session.AddBytesOut(n)
+		p.session.Throttle(n)
+
+		for output := buf[:n]; len(output) > 0; {
+			output = p.processOutput(output)
+		}
+	}
+}
+
+// writeOutput converts the output to UTF-8 and feeds it to the emulator
+// and to the attached websocket, the triggers of the server are evaluated
+// on it
+func (p *terminal) writeOutput(output []byte) {
+	if output = p.decoder.Decode(output); len(output) == 0 {
+		return
+	}
+
+	view, fired := output, []*outputTrigger(nil)
+	if p.triggers != nil {
+		view, fired = p.triggers.Feed(output, time.Now())
+	}
+
+	p.mu.Lock()
+	p.waitOutput()
+	_, _ = p.vt.Write(output)
+	commands := p.recordCommands(output, time.Now())
+	if p.conn != nil {
+		p.pushOutput(view)
+	}
+	p.mu.Unlock()
+
+	p.saveCommands(commands)
+
+	for _, trigger := range fired {
+		p.fireTrigger(trigger)
+	}
+}
+
+// Attach sends the current screen to the websocket and streams the output
+// to it, the websocket that was attached before is closed
+func (p *terminal) Attach(conn *wsConn) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.isClosed {
+		return fmt.Errorf("terminal \"%s\" has been closed", p.session.id)
+	}
+	if p.conn != nil {
+		_ = p.conn.WriteMessage(websocket.TextMessage, []byte("terminal attached from another window"))
+		_ = p.conn.conn.Close()
+	}
+	if p.detachTimer != nil {
+		p.detachTimer.Stop()
+		p.detachTimer = nil
+	}
+	p.conn = conn
+	p.dropOutput()
+	return conn.WriteMessage(websocket.BinaryMessage, p.vt.Render())
+}
+
+// Detach stops streaming to the websocket and cancels the file transfer,
+// the shell is closed if it is not attached again before the detach timeout
+func (p *terminal) Detach(conn *wsConn) {
+	p.mu.Lock()
+	if p.conn != conn {
+		p.mu.Unlock()
+		return
+	}
+	p.conn = nil
+	p.dropOutput()
+	transfer := p.transfer
+	p.mu.Unlock()
+
+	if transfer != nil {
+		transfer.Cancel()
+	}
+
+	timeout := core.GetConfig().GetTerminalDetachTimeout()
+	if timeout <= 0 {
+		gSessionRegistry.Close(p.session.id, "")
+		return
+	}
+
+	// the timer is replaced by a later detach and stopped by an attach, a
+	// timer that has fired meanwhile sees that it is not the current one
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	timer := (*time.Timer)(nil)
+	timer = time.AfterFunc(timeout, func() {
+		p.mu.Lock()
+		isExpired := p.detachTimer == timer
+		p.mu.Unlock()
+		if isExpired {
+			gSessionRegistry.Close(p.session.id, "")
+		}
+	})
+	if p.detachTimer != nil {
+		p.detachTimer.Stop()
+	}
+	p.detachTimer = timer
+}
+
+// Close closes the shell, the reason is shown on the attached websocket. A
+// terminal that is closed before its shell has started is only removed, the
+// opening fails.
+func (p *terminal) Close(reason string) {
+	p.mu.Lock()
+	if p.isClosed {
+		p.mu.Unlock()
+		return
+	}
+	p.isClosed = true
+	conn := p.conn
+	p.conn = nil
+	shell := p.shell
+	p.dropOutput()
+	p.mu.Unlock()
+
+	if conn != nil {
+		if reason != "" {
+			_ = conn.WriteMessage(websocket.TextMessage, []byte(reason))
+		}
+		_ = conn.conn.Close()
+	}
+
+	gSessionRegistry.Remove(p.session.id)
+	gTerminalManager.Remove(p.session.id)
+	gBroadcastManager.RemoveTerminal(p.session.id)
+	if shell == nil {
+		return
+	}
+	_ = shell.Close()
+	writeTerminalAudit(
+		p, "terminal:close", atomic.LoadInt64(&p.session.bytesIn), atomic.LoadInt64(&p.session.bytesOut), nil,
+	)
+	go func() {
+		if _, e := p.runHooks(hookEventPostDisconnect); e != nil {
+			log.Print(e)
+		}
+	}()
+}
+
+// write sends the input through the guard and the recorder to the shell.
+// The input comes from the websocket, the broadcast of the other members
+// and the pasted snippets, inputMu keeps them in order.
+func (p *terminal) write(input []byte) error {
+	p.inputMu.Lock()
+	defer p.inputMu.Unlock()
+
+	if p.guard != nil {
+		var matches []*core.CommandMatch
+		input, matches = p.guard.Feed(input)
+		for _, match := range matches {
+			_ = dbLogCommandMatch(p.db, p.session.bucket, p.user.name, p.session.serverID, match, time.Now())
+			if notice := getCommandNotice(match); notice != "" {
+				p.notice(notice)
+			}
+		}
+	}
+
+	if p.recorder != nil && bytes.ContainsAny(input, "\r\n") {
+		p.mu.Lock()
+		p.recorder.Submit()
+		p.mu.Unlock()
+	}
+	return p.writeInput(input)
+}
+
+func (p *terminal) notice(text string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != nil {
+		p.pushOutput([]byte(text))
+	}
+}
+
+func (p *terminal) resize(rows int, cols int) error {
+	p.mu.Lock()
+	p.vt.Resize(rows, cols)
+	p.mu.Unlock()
+
+	return p.shell.Resize(rows, cols)
+}
+
+// serve reads the messages of the websocket until it is closed. The first
+// byte of a message is the type, 0 is the input, 1 is the window size, 2 is
+// the control of a file transfer and 3 is the data of an uploading file.
+// An input message is written as one input so that a paste stays whole.
+// The input goes to the broadcast group if the terminal is in one, and it
+// is dropped during a file transfer.
+func (p *terminal) serve(ws *websocket.Conn) {
+	for {
+		// set up io.Reader of websocket
+		_, reader, err := ws.NextReader()
+		if err != nil {
+			return
+		}
+		// read first byte to determine whether to pass data or resize terminal
+		dataTypeBuf := make([]byte, 1)
+		_, err = reader.Read(dataTypeBuf)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+
+		switch dataTypeBuf[0] {
+		// when pass data
+		case 0:
+			input, ok, err := readFrame(reader, terminalMaxInputFrame)
+			if err != nil {
+				log.Print(err)
+				return
+			}
+			if !ok {
+				p.notice("\r\n[vbot] the input is larger than 1MB and has been dropped\r\n")
+			} else if p.getTransfer() == nil {
+				err = p.input(input.Bytes())
+			}
+			putBridgeBuffer(input)
+			if err != nil {
+				log.Print(err)
+				p.notice(err.Error())
+				return
+			}
+		// when resize terminal
+		case 1:
+			decoder := json.NewDecoder(reader)
+			resizeMessage := windowSize{}
+			err := decoder.Decode(&resizeMessage)
+			if err != nil {
+				log.Print(err.Error())
+				continue
+			}
+			err = p.resize(resizeMessage.Rows, resizeMessage.Cols)
+			if err != nil {
+				log.Print(err.Error())
+				p.notice(err.Error())
+				return
+			}
+		// when control file transfer
+		case 2:
+			control := &transferControl{}
+			if err := json.NewDecoder(reader).Decode(control); err != nil {
+				log.Print(err.Error())
+				continue
+			}
+			if err := p.controlTransfer(control); err != nil {
+				p.sendTransferMessage(rpc.Map{"transfer": "error", "error": err.Error()})
+			}
+		// when upload file data
+		case 3:
+			data, _, err := readFrame(reader, terminalMaxUploadFrame)
+			if err != nil {
+				log.Print(err)
+				return
+			}
+			p.uploadData(data.Bytes())
+			putBridgeBuffer(data)
+		// unexpected data
+		default:
+			log.Print("Unexpected data type")
+		}
+	}
+}
+
+// getTerminalTarget checks the session of the user and the permissions on
+// the server, it returns the user, the bucket and the fields of the server.
+// A local server needs the admin role.
+func getTerminalTarget(sessionID string, serverID string) (*User, string, map[string]string, error) {
+	user, ok := gUserManager.GetUser(sessionID)
+	if !ok {
+		return nil, "", nil, errors.New("sessionID does not find")
+	}
+
+	bucket := getWorkspaceBucket(user.workspace)
+	if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, "", nil, e
+	} else if e := dbCheckWorkspaceRole(db, user.workspace, user.name, roleOperator); e != nil {
+		return nil, "", nil, e
+	} else if e := dbCheckServerAccess(db, bucket, serverID, user.name, time.Now()); e != nil {
+		return nil, "", nil, e
+	} else if fields, e := dbGetServer(db, bucket, serverID); e != nil {
+		return nil, "", nil, e
+	} else if !isLocalServer(fields) {
+		return user, bucket, fields, nil
+	} else if e := checkLocalShellEnabled(); e != nil {
+		return nil, "", nil, e
+	} else if e := dbCheckWorkspaceRole(db, user.workspace, user.name, roleAdmin); e != nil {
+		return nil, "", nil, e
+	} else {
+		return user, bucket, fields, nil
+	}
+}
+
+// getAttachTarget returns the terminal of the user to reattach to, the
+// permissions on the server are checked again
+func getAttachTarget(sessionID string, terminalID string) (*terminal, error) {
+	t, ok := gTerminalManager.Get(terminalID)
+	if !ok {
+		return nil, fmt.Errorf("terminal \"%s\" does not exist", terminalID)
+	} else if user, _, _, e := getTerminalTarget(sessionID, t.session.serverID); e != nil {
+		return nil, e
+	} else if user.name != t.session.user || getWorkspaceBucket(user.workspace) != t.session.bucket {
+		return nil, fmt.Errorf("terminal \"%s\" does not exist", terminalID)
+	} else {
+		return t, nil
+	}
+}
+
+// getClientIP returns the address of the client without the port
+func getClientIP(r *http.Request) string {
+	if host, _, e := net.SplitHostPort(r.RemoteAddr); e == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// SSHWebsocket bridges the web terminal to a shell on the server. The query
+// parameters are sessionID and serverID to open a new shell, or sessionID
+// and terminalID to reattach to a shell that is still running.
+func SSHWebsocket(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.URL.Query().Get("sessionID")
+	serverID := r.URL.Query().Get("serverID")
+	terminalID := r.URL.Query().Get("terminalID")
+
+	t := (*terminal)(nil)
+	user, bucket, fields := (*User)(nil), "", map[string]string(nil)
+	err := error(nil)
+	if terminalID != "" {
+		t, err = getAttachTarget(sessionID, terminalID)
+	} else {
+		user, bucket, fields, err = getTerminalTarget(sessionID, serverID)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	db, err := core.GetManager().GetDB(core.GetConfig().GetDBFile())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	//upgrade http to websocket
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer ws.Close()
+	conn := newWSConn(ws)
+
+	if t == nil {
+		if t, err = openTerminal(db, user, bucket, serverID, fields, getClientIP(r)); err != nil {
+			_ = conn.WriteMessage(websocket.TextMessage, []byte(err.Error()))
+			return
+		}
+	}
+
+	if err := t.Attach(conn); err != nil {
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(err.Error()))
+		return
+	}
+	defer t.Detach(conn)
+
+	t.serve(ws)
+}
+
+// getTerminalBySession returns a terminal in the current workspace, the
+// terminals of the other users need the admin role
+func getTerminalBySession(rt rpc.Runtime, sessionID string, terminalID string) (*terminal, error) {
+	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return nil, e
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return nil, e
+	} else if t, ok := gTerminalManager.Get(terminalID); !ok || t.session.bucket != bucket {
+		return nil, fmt.Errorf("terminal \"%s\" does not exist", terminalID)
+	} else if t.session.user == userName {
+		return t, nil
+	} else if _, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
+	} else {
+		return t, nil
+	}
+}
+
+// listTerminals returns the running terminals of the user in the current
+// workspace, they can be reattached
+func listTerminals(rt rpc.Runtime, sessionID string) (interface{}, error) {
+	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return nil, e
+	} else if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return nil, e
+	} else {
+		ret := rpc.Array{}
+		for _, session := range gSessionRegistry.List() {
+			t, ok := gTerminalManager.Get(session.id)
+			if !ok || session.user != userName || session.bucket != bucket {
+				continue
+			}
+
+			t.mu.Lock()
+			isAttached := t.conn != nil
+			t.mu.Unlock()
+			rows, cols := t.vt.Size()
+			ret = append(ret, rpc.Map{
+				"id":         session.id,
+				"serverID":   session.serverID,
+				"startTime":  getMillisecond(session.startTime),
+				"isAttached": isAttached,
+				"rows":       int64(rows),
+				"cols":       int64(cols),
+			})
+		}
+		return ret, nil
+	}
+}
+
+// getTerminalSnapshot returns the text on the screen of the terminal
+func getTerminalSnapshot(rt rpc.Runtime, sessionID string, terminalID string) (interface{}, error) {
+	if t, e := getTerminalBySession(rt, sessionID, terminalID); e != nil {
+		return nil, e
+	} else {
+		rows, cols := t.vt.Size()
+		cursorRow, cursorCol := t.vt.Cursor()
+		lines := rpc.Array{}
+		for _, line := range t.vt.Snapshot() {
+			lines = append(lines, line)
+		}
+		return rpc.Map{
+			"rows":      int64(rows),
+			"cols":      int64(cols),
+			"cursorRow": int64(cursorRow),
+			"cursorCol": int64(cursorCol),
+			"lines":     lines,
+		}, nil
+	}
+}
+
+// searchTerminal returns the lines of the scrollback and the screen that
+// contain the text
+func searchTerminal(rt rpc.Runtime, sessionID string, terminalID string, text string) (interface{}, error) {
+	if text == "" {
+		return nil, errors.New("search text is empty")
+	} else if t, e := getTerminalBySession(rt, sessionID, terminalID); e != nil {
+		return nil, e
+	} else {
+		ret := rpc.Array{}
+		for _, match := range t.vt.Search(text) {
+			ret = append(ret, rpc.Map{"line": int64(match.Line), "text": match.Text})
+		}
+		return ret, nil
+	}
+}
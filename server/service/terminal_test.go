@@ -0,0 +1,102 @@
+package service
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/vbot/server/core"
+	"golang.org/x/crypto/ssh"
+)
+
+// startTestEchoServer starts a ssh server with a shell that echoes the input
+func startTestEchoServer() *testSSHServer {
+	server := startTestSSHServer("pwd", nil)
+	server.fnShell = func(channel ssh.Channel) {
+		buf := make([]byte, 1024)
+		for {
+			n, e := channel.Read(buf)
+			if e != nil {
+				return
+			}
+			if string(buf[:n]) == "exit\r" {
+				return
+			}
+			_, _ = channel.Write(buf[:n])
+		}
+	}
+	return server
+}
+
+func waitTerminalScreen(t *terminal, line string) bool {
+	for i := 0; i < 200; i++ {
+		if t.vt.Snapshot()[0] == line {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestOpenTerminal(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		core.GetConfig().SetDBFile("terminal_test.db")
+		defer func() {
+			core.GetConfig().SetDBFile("./vbot.db")
+			os.Remove("terminal_test.db")
+		}()
+		db, _ := core.GetManager().GetDB("terminal_test.db")
+		_ = db.CreateBucketIsNotExist("-test")
+		_ = dbCreateServer(db, "-test", "1", "10.0.0.1", "22", "root", "pwd", "", "web", "")
+		server := startTestEchoServer()
+		defer server.Close()
+
+		user := NewUser("alice", "terminal-session")
+		term, e := openTerminal(db, user, "-test", "1", server.Fields("pwd"), "127.0.0.1")
+		assert(e).IsNil()
+		_, ok := gTerminalManager.Get(term.session.id)
+		assert(ok).IsTrue()
+
+		assert(term.write([]byte("hello"))).IsNil()
+		assert(waitTerminalScreen(term, "hello")).IsTrue()
+		assert(term.resize(10, 40)).IsNil()
+		assert(term.vt.Size()).Equals(10, 40)
+
+		assert(term.write([]byte("exit\r"))).IsNil()
+		records := []*auditRecord(nil)
+		for i := 0; i < 200 && len(records) < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+			records, _, e = dbQueryAudit(db, &auditFilter{Method: "terminal"})
+		}
+		assert(e, len(records)).Equals(nil, 2)
+		_, ok = gTerminalManager.Get(term.session.id)
+		assert(ok).IsFalse()
+		assert(records[1].Method, records[1].BytesIn, records[1].BytesOut).
+			Equals("terminal:close", int64(10), int64(5))
+		assert(records[1].User, records[1].Workspace).Equals("alice", "test")
+	})
+
+	t.Run("session limit", func(t *testing.T) {
+		assert := assert.New(t)
+		core.GetConfig().SetDBFile("terminal_test.db")
+		defer func() {
+			core.GetConfig().SetDBFile("./vbot.db")
+			os.Remove("terminal_test.db")
+		}()
+		db, _ := core.GetManager().GetDB("terminal_test.db")
+		_ = db.CreateBucketIsNotExist("-test")
+		_ = dbSetSessionLimits(db, "-test", &sessionLimits{PerServer: 1})
+		server := startTestEchoServer()
+		defer server.Close()
+
+		user := NewUser("alice", "terminal-session")
+		term, e := openTerminal(db, user, "-test", "1", server.Fields("pwd"), "127.0.0.1")
+		assert(e).IsNil()
+		defer term.Close("")
+
+		_, e = openTerminal(db, user, "-test", "1", server.Fields("pwd"), "127.0.0.1")
+		assert(e).IsNotNil()
+	})
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+// transferControl is a message of the client to the transfer, the action
+// is "file" (the next file to upload), "finish" (no more files to upload)
+// or "cancel"
+type transferControl struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+}
+
+func (p *terminal) getTransfer() *core.ZModem {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.transfer
+}
+
+// processOutput handles the output of the shell and returns the part that
+// has not been handled yet. The output goes to the transfer if there is
+// one, and a transfer starts when rz or sz starts on the server.
+func (p *terminal) processOutput(output []byte) []byte {
+	if transfer := p.getTransfer(); transfer != nil {
+		if rest, done := transfer.Feed(output); done {
+			return rest
+		}
+		return nil
+	}
+
+	if idx, direction := core.DetectZModem(output); idx >= 0 {
+		p.writeOutput(output[:idx])
+		if p.startTransfer(direction) {
+			return output[idx:]
+		}
+		p.writeOutput(output[idx:])
+		p.notice("\r\n[vbot] file transfer needs an attached terminal\r\n")
+		return nil
+	}
+
+	p.writeOutput(output)
+	if core.DetectTrzsz(output) {
+		p.notice("\r\n[vbot] trzsz is not supported, press Ctrl+C and use rz or sz instead\r\n")
+	}
+	return nil
+}
+
+// startTransfer switches the terminal into a ZMODEM transfer, it fails if
+// no websocket is attached to exchange the files with
+func (p *terminal) startTransfer(direction int) bool {
+	transfer := (*core.ZModem)(nil)
+	transfer = core.NewZModem(direction, func(data []byte) error {
+		n, e := p.stdin.Write(data)
+		p.session.AddBytesIn(n)
+		p.session.Throttle(n)
+		return e
+	}, func(event *core.ZModemEvent) {
+		p.onTransferEvent(transfer, event)
+	})
+
+	p.mu.Lock()
+	isAttached := p.conn != nil
+	if isAttached {
+		p.transfer = transfer
+	}
+	p.mu.Unlock()
+
+	if !isAttached {
+		transfer.Cancel()
+		return false
+	}
+
+	name := "download"
+	if direction == core.ZModemUpload {
+		name = "upload"
+	}
+	p.sendTransferMessage(rpc.Map{"transfer": "start", "direction": name})
+	return true
+}
+
+// sendTransferMessage sends the queued output first, so that the message
+// follows the output that has been read before it
+func (p *terminal) sendTransferMessage(message rpc.Map) bool {
+	data, e := json.Marshal(message)
+	if e != nil {
+		log.Print(e)
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != nil && p.pending.Len() > 0 {
+		if e := p.conn.WriteOutput(p.pending.Bytes()); e != nil {
+			log.Print(e)
+		}
+		p.dropOutput()
+	}
+
+	if p.conn == nil {
+		return false
+	} else if e := p.conn.WriteMessage(websocket.TextMessage, data); e != nil {
+		log.Print(e)
+		return false
+	} else {
+		return true
+	}
+}
+
+// onTransferEvent forwards the event to the websocket, the transfer is
+// cancelled if the websocket has gone
+func (p *terminal) onTransferEvent(transfer *core.ZModem, event *core.ZModemEvent) {
+	message := rpc.Map{
+		"transfer": event.Type,
+		"name":     event.Name,
+		"size":     event.Size,
+		"offset":   event.Offset,
+		"error":    event.Error,
+	}
+	if event.Type == "data" {
+		message["data"] = base64.StdEncoding.EncodeToString(event.Data)
+	}
+
+	switch event.Type {
+	case "fileEnd":
+		method := "terminal:download"
+		if transfer.Direction() == core.ZModemUpload {
+			method = "terminal:upload"
+		}
+		record := newAuditRecord(method, p.user.name, p.workspace, p.session.serverID, time.Now())
+		record.Args = []interface{}{event.Name, event.Offset}
+		if event.Error != "" {
+			record.setResult(errors.New(event.Error))
+		} else {
+			record.setResult(nil)
+		}
+		writeAuditRecord(record)
+	case "end":
+		p.mu.Lock()
+		if p.transfer == transfer {
+			p.transfer = nil
+		}
+		upload := p.upload
+		p.upload = nil
+		p.mu.Unlock()
+
+		if upload != nil {
+			_ = upload.Close()
+		}
+	}
+
+	if !p.sendTransferMessage(message) && event.Type != "end" {
+		transfer.Cancel()
+	}
+}
+
+// controlTransfer runs the action of the client on the transfer
+func (p *terminal) controlTransfer(control *transferControl) error {
+	transfer := p.getTransfer()
+	if transfer == nil {
+		return fmt.Errorf("there is no file transfer")
+	}
+
+	switch control.Action {
+	case "file":
+		reader, writer := io.Pipe()
+		p.mu.Lock()
+		upload := p.upload
+		p.upload = writer
+		p.mu.Unlock()
+		if upload != nil {
+			_ = upload.Close()
+		}
+		return transfer.SendFile(control.Name, control.Size, reader)
+	case "finish":
+		return transfer.Finish()
+	case "cancel":
+		transfer.Cancel()
+		return nil
+	default:
+		return fmt.Errorf("unknown transfer action \"%s\"", control.Action)
+	}
+}
+
+// uploadData passes the data of the uploading file to the transfer, it
+// blocks until the transfer has read it. The data of a skipped file is
+// dropped.
+func (p *terminal) uploadData(data []byte) {
+	p.mu.Lock()
+	upload := p.upload
+	p.mu.Unlock()
+
+	if upload != nil {
+		_, _ = upload.Write(data)
+	}
+}
@@ -0,0 +1,32 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestTerminal_processOutput(t *testing.T) {
+	t.Run("not attached", func(t *testing.T) {
+		assert := assert.New(t)
+		stdin := &bytes.Buffer{}
+		decoder, _ := core.NewCharsetDecoder(core.CharsetUTF8)
+		term := &terminal{
+			session: &Session{kind: "terminal", user: "alice"},
+			vt:      core.NewVTerm(terminalRows, terminalCols, terminalScrollback),
+			decoder: decoder,
+			stdin:   stdin,
+		}
+
+		assert(term.processOutput([]byte("$ sz a.txt\r\nrz\r**\x18B00000000000000\r\x8a\x11"))).IsNil()
+		assert(term.getTransfer() == nil).IsTrue()
+		assert(bytes.HasPrefix(stdin.Bytes(), []byte("\x18\x18\x18\x18\x18"))).IsTrue()
+		assert(term.vt.Snapshot()[0]).Equals("$ sz a.txt")
+
+		assert(term.controlTransfer(&transferControl{Action: "finish"})).
+			Equals(errors.New("there is no file transfer"))
+	})
+}
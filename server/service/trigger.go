@@ -0,0 +1,252 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+const (
+	triggerActionRespond   = "respond"
+	triggerActionHighlight = "highlight"
+	triggerActionNotify    = "notify"
+
+	// triggerCooldown stops a respond trigger from answering a prompt that
+	// the server repeats, e.g. after a wrong password
+	triggerCooldown = 5 * time.Second
+)
+
+// outputTrigger is stored as "trigger.<serverID>.<id>". The response of a
+// respond trigger is either a plain text or the name of a credential whose
+// secret is sent, the secret is never stored in the trigger.
+type outputTrigger struct {
+	ID         string `json:"id"`
+	Pattern    string `json:"pattern"`
+	Action     string `json:"action"`
+	Response   string `json:"response"`
+	Credential string `json:"credential"`
+}
+
+func checkOutputTrigger(db *core.DB, bucket string, trigger *outputTrigger) error {
+	if _, e := core.NewOutputWatcher([]string{trigger.Pattern}); e != nil {
+		return e
+	}
+
+	switch trigger.Action {
+	case triggerActionRespond:
+		if (trigger.Response == "") == (trigger.Credential == "") {
+			return fmt.Errorf("respond trigger needs either a response or a credential")
+		} else if trigger.Credential != "" {
+			_, e := dbGetCredential(db, bucket, trigger.Credential)
+			return e
+		}
+		return nil
+	case triggerActionHighlight, triggerActionNotify:
+		if trigger.Response != "" || trigger.Credential != "" {
+			return fmt.Errorf("%s trigger does not take a response", trigger.Action)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown trigger action \"%s\"", trigger.Action)
+	}
+}
+
+func dbCreateTrigger(db *core.DB, bucket string, serverID string, trigger *outputTrigger) (string, error) {
+	if e := checkOutputTrigger(db, bucket, trigger); e != nil {
+		return "", e
+	}
+
+	return trigger.ID, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if b.Get(core.DBKey("servers.%s", serverID)) == nil {
+			return fmt.Errorf("server \"%s\" does not exist", serverID)
+		} else if seq, e := b.NextSequence(); e != nil {
+			return e
+		} else {
+			trigger.ID = fmt.Sprintf("%d", seq)
+			return dbPutJSON(b, core.DBKey("trigger.%s.%s", serverID, trigger.ID), trigger)
+		}
+	})
+}
+
+func dbListTriggers(db *core.DB, bucket string, serverID string) ([]*outputTrigger, error) {
+	ret := make([]*outputTrigger, 0)
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		}
+		return dbListJSON(b, fmt.Sprintf("trigger.%s.", serverID), func(data []byte) error {
+			v := &outputTrigger{}
+			if e := json.Unmarshal(data, v); e != nil {
+				return e
+			}
+			ret = append(ret, v)
+			return nil
+		})
+	})
+}
+
+func dbDeleteTrigger(db *core.DB, bucket string, serverID string, id string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket \"%s\" not exist", bucket)
+		} else if b.Get(core.DBKey("trigger.%s.%s", serverID, id)) == nil {
+			return fmt.Errorf("trigger \"%s\" does not exist", id)
+		} else {
+			return b.Delete(core.DBKey("trigger.%s.%s", serverID, id))
+		}
+	})
+}
+
+// triggerSet evaluates the triggers of a server on the output of a terminal
+type triggerSet struct {
+	triggers []*outputTrigger
+	watcher  *core.OutputWatcher
+	lastFire map[string]time.Time
+	mu       sync.Mutex
+}
+
+// dbGetTriggerSet returns the triggers of the terminal on the server, it
+// returns nil if the server has no triggers
+func dbGetTriggerSet(db *core.DB, bucket string, serverID string) (*triggerSet, error) {
+	triggers, e := dbListTriggers(db, bucket, serverID)
+	if e != nil || len(triggers) == 0 {
+		return nil, e
+	}
+
+	patterns := make([]string, 0, len(triggers))
+	for _, trigger := range triggers {
+		patterns = append(patterns, trigger.Pattern)
+	}
+	if watcher, e := core.NewOutputWatcher(patterns); e != nil {
+		return nil, e
+	} else {
+		return &triggerSet{
+			triggers: triggers,
+			watcher:  watcher,
+			lastFire: make(map[string]time.Time),
+		}, nil
+	}
+}
+
+// Feed returns the output to show with the highlights and the triggers that
+// have fired. A match is highlighted only if it is not split by an escape
+// sequence or across the chunks of the output. A credential is only sent to
+// a prompt at the end of the output, which is still waiting for the input.
+func (p *triggerSet) Feed(output []byte, now time.Time) ([]byte, []*outputTrigger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	view := output
+	fired := make([]*outputTrigger, 0)
+	for _, match := range p.watcher.Feed(output) {
+		trigger := p.triggers[match.Index]
+		if trigger.Action == triggerActionHighlight {
+			view = bytes.Replace(view, []byte(match.Text), []byte("\x1b[7m"+match.Text+"\x1b[27m"), 1)
+		} else if trigger.Credential != "" && !match.AtEnd {
+			continue
+		} else if now.Sub(p.lastFire[trigger.ID]) >= triggerCooldown {
+			p.lastFire[trigger.ID] = now
+			fired = append(fired, trigger)
+		}
+	}
+	return view, fired
+}
+
+// fireTrigger runs the respond or the notify action of a trigger on the
+// terminal. The responses are recorded in the audit log with the session
+// that has received them but without their text.
+func (p *terminal) fireTrigger(trigger *outputTrigger) {
+	start := time.Now()
+	switch trigger.Action {
+	case triggerActionRespond:
+		response, e := trigger.Response, error(nil)
+		if trigger.Credential != "" {
+			response, e = dbGetCredentialSecret(p.db, p.session.bucket, trigger.Credential)
+		}
+		if e == nil {
+			e = p.writeInput([]byte(response + "\r"))
+		}
+
+		record := newAuditRecord("terminal:trigger", p.user.name, p.workspace, p.session.serverID, start)
+		record.Args = []interface{}{trigger.ID, p.session.id}
+		record.setResult(e)
+		writeAuditRecord(record)
+		if e != nil {
+			p.notice(fmt.Sprintf("\r\n[vbot] trigger \"%s\" failed: %s\r\n", trigger.ID, e.Error()))
+		}
+	case triggerActionNotify:
+		message := fmt.Sprintf(
+			"output of terminal \"%s\" of user \"%s\" on server \"%s\" matches \"%s\"",
+			p.session.id, p.user.name, p.session.serverID, trigger.Pattern,
+		)
+		notifier, _ := newInAppNotifier(nil)
+		if e := notifier.Notify(p.db, p.session.bucket, &Notification{
+			Title:   "terminal trigger",
+			Message: message,
+			State:   "matched",
+			Time:    getMillisecond(start),
+		}); e != nil {
+			log.Print(e)
+		}
+	}
+}
+
+func createTrigger(
+	rt rpc.Runtime, sessionID string, serverID string, pattern string, action string,
+	response string, credential string,
+) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if id, e := dbCreateTrigger(db, bucket, serverID, &outputTrigger{
+		Pattern:    pattern,
+		Action:     action,
+		Response:   response,
+		Credential: credential,
+	}); e != nil {
+		return nil, e
+	} else {
+		return id, nil
+	}
+}
+
+func listTriggers(rt rpc.Runtime, sessionID string, serverID string) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleViewer).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if triggers, e := dbListTriggers(db, bucket, serverID); e != nil {
+		return nil, e
+	} else {
+		ret := rpc.Array{}
+		for _, trigger := range triggers {
+			ret = append(ret, toMap(trigger))
+		}
+		return ret, nil
+	}
+}
+
+func deleteTrigger(rt rpc.Runtime, sessionID string, serverID string, id string) (interface{}, error) {
+	if bucket, e := rt.Call("#.user:getBucketBySessionID", sessionID, roleAdmin).ToString(); e != nil {
+		return nil, e
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return nil, e
+	} else if e := dbDeleteTrigger(db, bucket, serverID, id); e != nil {
+		return nil, e
+	} else {
+		return true, nil
+	}
+}
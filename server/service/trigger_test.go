@@ -0,0 +1,154 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDBCreateTrigger(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		core.GetConfig().SetCredentialKeyFile("test.key")
+		db, _ := core.NewDB("test.db")
+		defer func() {
+			core.GetConfig().SetCredentialKeyFile("./vbot.key")
+			os.Remove("test.key")
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-ops")
+		_ = dbCreateServer(db, "-ops", "1", "10.0.0.1", "22", "root", "pwd", "", "web", "")
+		_ = dbSetCredential(db, "-ops", "sudo", "s3cret", "alice")
+
+		assert(dbCreateTrigger(db, "-ops", "1", &outputTrigger{Pattern: "(", Action: "notify"})).
+			Equals("", errors.New("invalid trigger pattern \"(\""))
+		assert(dbCreateTrigger(db, "-ops", "1", &outputTrigger{Pattern: "a", Action: "run"})).
+			Equals("", errors.New("unknown trigger action \"run\""))
+		assert(dbCreateTrigger(db, "-ops", "1", &outputTrigger{Pattern: "a", Action: "respond"})).
+			Equals("", errors.New("respond trigger needs either a response or a credential"))
+		assert(dbCreateTrigger(db, "-ops", "1", &outputTrigger{
+			Pattern: "a", Action: "respond", Credential: "root",
+		})).Equals("", errors.New("credential \"root\" does not exist"))
+		assert(dbCreateTrigger(db, "-ops", "1", &outputTrigger{
+			Pattern: "a", Action: "notify", Response: "y",
+		})).Equals("", errors.New("notify trigger does not take a response"))
+		assert(dbCreateTrigger(db, "-ops", "2", &outputTrigger{Pattern: "a", Action: "notify"})).
+			Equals("", errors.New("server \"2\" does not exist"))
+
+		id, e := dbCreateTrigger(db, "-ops", "1", &outputTrigger{
+			Pattern: "password: $", Action: "respond", Credential: "sudo",
+		})
+		assert(e).IsNil()
+		triggers, e := dbListTriggers(db, "-ops", "1")
+		assert(e, len(triggers), triggers[0].ID).Equals(nil, 1, id)
+
+		assert(dbDeleteTrigger(db, "-ops", "1", id)).IsNil()
+		assert(dbDeleteTrigger(db, "-ops", "1", id)).
+			Equals(errors.New("trigger \"" + id + "\" does not exist"))
+		assert(dbGetTriggerSet(db, "-ops", "1")).Equals(nil, nil)
+	})
+}
+
+func TestTriggerSet_Feed(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		watcher, _ := core.NewOutputWatcher([]string{"ERROR", `\[y/N\]`})
+		set := &triggerSet{
+			triggers: []*outputTrigger{
+				{ID: "1", Pattern: "ERROR", Action: "highlight"},
+				{ID: "2", Pattern: `\[y/N\]`, Action: "respond", Response: "y"},
+			},
+			watcher:  watcher,
+			lastFire: make(map[string]time.Time),
+		}
+
+		now := time.Now()
+		view, fired := set.Feed([]byte("an ERROR occurred, continue? [y/N]"), now)
+		assert(string(view), len(fired), fired[0].ID).
+			Equals("an \x1b[7mERROR\x1b[27m occurred, continue? [y/N]", 1, "2")
+		_, fired = set.Feed([]byte("[y/N]"), now.Add(time.Second))
+		assert(len(fired)).Equals(0)
+		_, fired = set.Feed([]byte("[y/N]"), now.Add(triggerCooldown))
+		assert(len(fired)).Equals(1)
+	})
+
+	t.Run("credential", func(t *testing.T) {
+		assert := assert.New(t)
+		watcher, _ := core.NewOutputWatcher([]string{"password: "})
+		set := &triggerSet{
+			triggers: []*outputTrigger{
+				{ID: "1", Pattern: "password: ", Action: "respond", Credential: "sudo"},
+			},
+			watcher:  watcher,
+			lastFire: make(map[string]time.Time),
+		}
+
+		// a prompt in the output of a command is not answered
+		now := time.Now()
+		_, fired := set.Feed([]byte("$ cat notes\r\nthe password: is in the vault\r\n"), now)
+		assert(len(fired)).Equals(0)
+		_, fired = set.Feed([]byte("[sudo] password: "), now)
+		assert(len(fired)).Equals(1)
+	})
+}
+
+func TestTerminal_fireTrigger(t *testing.T) {
+	t.Run("test ok", func(t *testing.T) {
+		assert := assert.New(t)
+		core.GetConfig().SetDBFile("trigger_test.db")
+		core.GetConfig().SetCredentialKeyFile("test.key")
+		defer func() {
+			core.GetConfig().SetDBFile("./vbot.db")
+			core.GetConfig().SetCredentialKeyFile("./vbot.key")
+			os.Remove("trigger_test.db")
+			os.Remove("test.key")
+		}()
+		db, _ := core.GetManager().GetDB("trigger_test.db")
+		_ = db.CreateBucketIsNotExist("-test")
+		_ = dbCreateServer(db, "-test", "1", "10.0.0.1", "22", "root", "pwd", "", "web", "")
+		_ = dbSetCredential(db, "-test", "sudo", "s3cret", "alice")
+		_, _ = dbCreateTrigger(db, "-test", "1", &outputTrigger{
+			Pattern: "password: $", Action: "respond", Credential: "sudo",
+		})
+		_, _ = dbCreateTrigger(db, "-test", "1", &outputTrigger{Pattern: "FATAL", Action: "notify"})
+
+		server := startTestSSHServer("pwd", nil)
+		server.fnShell = func(channel ssh.Channel) {
+			_, _ = channel.Write([]byte("[sudo] password: "))
+			buf := make([]byte, 1024)
+			n, _ := channel.Read(buf)
+			_, _ = channel.Write([]byte("\r\ngot " + string(buf[:n-1]) + " FATAL"))
+			_, _ = channel.Read(buf)
+		}
+		defer server.Close()
+
+		term, e := openTerminal(db, NewUser("alice", "trigger-session"), "-test", "1", server.Fields("pwd"), "")
+		assert(e).IsNil()
+		defer term.Close("")
+
+		found := false
+		for i := 0; i < 300 && !found; i++ {
+			time.Sleep(10 * time.Millisecond)
+			found = len(term.vt.Search("got s3cret FATAL")) > 0
+		}
+		assert(found).IsTrue()
+
+		notifications := rpc.Array(nil)
+		for i := 0; i < 200 && len(notifications) == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+			list, _ := dbListSince(db, "-test", "notification", 0)
+			notifications = list
+		}
+		assert(len(notifications)).Equals(1)
+
+		records, _, e := dbQueryAudit(db, &auditFilter{Method: "terminal:trigger"})
+		assert(e, len(records), records[0].Result).Equals(nil, 1, "ok")
+		assert(records[0].Workspace, records[0].Args[1]).Equals("test", term.session.id)
+	})
+}
@@ -19,6 +19,7 @@ var (
 type User struct {
 	name       string
 	sessionID  string
+	workspace  string
 	activeTime time.Time
 }
 
@@ -26,6 +27,7 @@ func NewUser(name string, sessionID string) *User {
 	return &User{
 		name:       name,
 		sessionID:  sessionID,
+		workspace:  name,
 		activeTime: time.Now(),
 	}
 }
@@ -34,6 +36,7 @@ func (p *User) ToMap() rpc.Map {
 	return rpc.Map{
 		"name":      p.name,
 		"sessionID": p.sessionID,
+		"workspace": p.workspace,
 	}
 }
 
@@ -55,6 +58,30 @@ func (p *UserManager) AddUser(user *User) {
 	p.sessionMap[user.sessionID] = user
 }
 
+// GetUser returns a copy of the user of the session, the workspace of the
+// copy does not change when the session switches to another one
+func (p *UserManager) GetUser(sessionID string) (*User, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if user, ok := p.sessionMap[sessionID]; ok {
+		ret := *user
+		return &ret, true
+	}
+	return nil, false
+}
+
+func (p *UserManager) SetWorkspace(sessionID string, workspace string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if user, ok := p.sessionMap[sessionID]; ok {
+		user.workspace = workspace
+		return true
+	}
+	return false
+}
+
 func (p *UserManager) OnTimer(timeout time.Duration) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -67,12 +94,16 @@ func (p *UserManager) OnTimer(timeout time.Duration) {
 	}
 }
 
-var UserService = rpc.NewService(rpc.Map{"manager": NewUserManager()}).
+var gUserManager = NewUserManager()
+
+var UserService = rpc.NewService(rpc.Map{"manager": gUserManager}).
 	On("$onTimer", onTimer).
-	On("Create", createUser).
-	On("Login", login).
-	On("IsInitialized", isInitialized).
-	On("getNameBySessionID", getNameBySessionID)
+	On("Create", auditAction("user:Create", createUser, 1)).
+	On("Login", auditAction("user:Login", login, 1)).
+	On("IsInitialized", auditAction("user:IsInitialized", isInitialized)).
+	On("getNameBySessionID", getNameBySessionID).
+	On("getBucketBySessionID", getBucketBySessionID).
+	On("setWorkspace", setWorkspace)
 
 func onTimer(rt rpc.Runtime, seq uint64) rpc.Return {
 	if seq%10 == 0 {
@@ -94,6 +125,8 @@ func dbCreateUser(db *core.DB, name string, enOK []byte, enSecret []byte) error
 
 		if b.Get(core.DBKey("user.%s.ok", name)) != nil {
 			return fmt.Errorf("user \"%s\" has been initialized", name)
+		} else if dbIsWorkspaceExist(b, name) {
+			return fmt.Errorf("name \"%s\" is used by a workspace", name)
 		}
 
 		if e := b.Put(core.DBKey("user.%s.ok", name), enOK); e != nil {
@@ -102,70 +135,78 @@ func dbCreateUser(db *core.DB, name string, enOK []byte, enSecret []byte) error
 			return e
 		} else if e = b.Put(core.DBKey("system.user.%s", name), []byte{1}); e != nil {
 			return e
+		} else if e = b.Put(core.DBKey("workspace.%s.personal", name), []byte{1}); e != nil {
+			return e
+		} else if e = b.Put(
+			core.DBKey("workspace.%s.member.%s", name, name), []byte(roleAdmin),
+		); e != nil {
+			return e
 		} else {
 			return nil
 		}
 	})
 }
 
-func createUser(rt rpc.Runtime, name string, password string) rpc.Return {
+func createUser(rt rpc.Runtime, name string, password string) (interface{}, error) {
 	if !userNameRegex.MatchString(name) {
-		return rt.Reply(fmt.Errorf("invalid user name \"%s\"", name))
+		return nil, fmt.Errorf("invalid user name \"%s\"", name)
 	} else if secret, e := core.GetRandString(100); e != nil {
-		return rt.Reply(e)
+		return nil, e
 	} else if enOK, e := core.Encrypt([]byte(secret), []byte("OK")); e != nil {
-		return rt.Reply(e)
+		return nil, e
 	} else if enSecret, e := core.Encrypt([]byte(password), []byte(secret)); e != nil {
-		return rt.Reply(e)
+		return nil, e
 	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
-		return rt.Reply(e)
+		return nil, e
 	} else if e = db.CreateBucketIsNotExist("auth"); e != nil {
-		return rt.Reply(e)
+		return nil, e
 	} else if e = db.CreateBucketIsNotExist(fmt.Sprintf("-%s", name)); e != nil {
-		return rt.Reply(e)
+		return nil, e
 	} else if e = db.CreateBucketIsNotExist("template"); e != nil {
-		return rt.Reply(e)
+		return nil, e
 	} else if e = dbCreateUser(db, name, enOK, enSecret); e != nil {
 		fmt.Println(e)
-		return rt.Reply(e)
+		return nil, e
 	} else {
-		return rt.Reply(true)
+		return true, nil
 	}
 }
 
-func login(rt rpc.Runtime, name string, password string) rpc.Return {
+func login(rt rpc.Runtime, name string, password string) (interface{}, error) {
 	if configMgr, ok := rt.GetServiceConfig("manager"); !ok {
-		return rt.Reply(errors.New("user service config error"))
+		return nil, errors.New("user service config error")
 	} else if manager, ok := configMgr.(*UserManager); !ok {
-		return rt.Reply(errors.New("user service config error"))
+		return nil, errors.New("user service config error")
 	} else if !userNameRegex.MatchString(name) {
-		return rt.Reply(fmt.Errorf("invalid user name \"%s\"", name))
+		return nil, fmt.Errorf("invalid user name \"%s\"", name)
 	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
-		return rt.Reply(e)
+		return nil, e
+	} else if e := dbMigrateWorkspaces(db); e != nil {
+		return nil, e
 	} else if enSecret, e := db.Get("auth", fmt.Sprintf("user.%s.secret", name)); e != nil {
-		return rt.Reply(e)
+		return nil, e
 	} else if enOK, e := db.Get("auth", fmt.Sprintf("user.%s.ok", name)); e != nil {
-		return rt.Reply(e)
+		return nil, e
 	} else if secret, e := core.Decrypt([]byte(password), enSecret); e != nil {
-		return rt.Reply(e)
+		return nil, e
 	} else if ok, e := core.Decrypt([]byte(secret), enOK); e != nil {
-		return rt.Reply(e)
+		return nil, e
 	} else if string(ok) != "OK" {
-		return rt.Reply(fmt.Errorf("internal error"))
+		return nil, fmt.Errorf("internal error")
 	} else if sessionID, e := core.GetRandString(32); e != nil {
-		return rt.Reply(e)
+		return nil, e
 	} else {
 		user := NewUser(name, sessionID)
 		manager.AddUser(user)
-		return rt.Reply(user.ToMap())
+		return user.ToMap(), nil
 	}
 }
 
-func isInitialized(rt rpc.Runtime) rpc.Return {
+func isInitialized(rt rpc.Runtime) (interface{}, error) {
 	if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
-		return rt.Reply(e)
+		return nil, e
 	} else {
-		return rt.Reply(db.IsBucketExist("auth"))
+		return db.IsBucketExist("auth"), nil
 	}
 }
 
@@ -174,9 +215,43 @@ func getNameBySessionID(rt rpc.Runtime, sessionID string) rpc.Return {
 		return rt.Reply(errors.New("user service config error"))
 	} else if manager, ok := configMgr.(*UserManager); !ok {
 		return rt.Reply(errors.New("user service config error"))
-	} else if user, ok := manager.sessionMap[sessionID]; !ok {
+	} else if user, ok := manager.GetUser(sessionID); !ok {
 		return rt.Reply(errors.New("sessionID does not find"))
 	} else {
 		return rt.Reply(user.name)
 	}
 }
+
+// getBucketBySessionID returns the bucket of the current workspace of the
+// session if the user has the role in it
+func getBucketBySessionID(rt rpc.Runtime, sessionID string, role string) rpc.Return {
+	if configMgr, ok := rt.GetServiceConfig("manager"); !ok {
+		return rt.Reply(errors.New("user service config error"))
+	} else if manager, ok := configMgr.(*UserManager); !ok {
+		return rt.Reply(errors.New("user service config error"))
+	} else if user, ok := manager.GetUser(sessionID); !ok {
+		return rt.Reply(errors.New("sessionID does not find"))
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := dbCheckWorkspaceRole(db, user.workspace, user.name, role); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(getWorkspaceBucket(user.workspace))
+	}
+}
+
+func setWorkspace(rt rpc.Runtime, sessionID string, workspace string) rpc.Return {
+	if configMgr, ok := rt.GetServiceConfig("manager"); !ok {
+		return rt.Reply(errors.New("user service config error"))
+	} else if manager, ok := configMgr.(*UserManager); !ok {
+		return rt.Reply(errors.New("user service config error"))
+	} else if user, ok := manager.GetUser(sessionID); !ok {
+		return rt.Reply(errors.New("sessionID does not find"))
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := dbCheckWorkspaceRole(db, workspace, user.name, roleViewer); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(manager.SetWorkspace(sessionID, workspace))
+	}
+}
@@ -0,0 +1,333 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+// A workspace owns the servers, scripts and recordings that are stored in
+// the bucket "-<workspace>". The personal workspace of a user has the name
+// of the user. The members are stored in the "auth" bucket as
+// "workspace.<workspace>.member.<user>" = role.
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+var roleLevels = map[string]int{
+	roleViewer:   1,
+	roleOperator: 2,
+	roleAdmin:    3,
+}
+
+var WorkspaceService = rpc.NewService(nil).
+	On("Create", createWorkspace).
+	On("List", listWorkspaces).
+	On("Switch", switchWorkspace).
+	On("Delete", deleteWorkspace).
+	On("ListMembers", listWorkspaceMembers).
+	On("SetMember", setWorkspaceMember).
+	On("RemoveMember", removeWorkspaceMember)
+
+func getWorkspaceBucket(workspace string) string {
+	return "-" + workspace
+}
+
+func dbGetWorkspaceRole(b *bolt.Bucket, workspace string, user string) string {
+	return string(b.Get(core.DBKey("workspace.%s.member.%s", workspace, user)))
+}
+
+// dbCheckWorkspaceRole returns an error if the user does not have the role
+// or a higher role in the workspace
+func dbCheckWorkspaceRole(db *core.DB, workspace string, user string, role string) error {
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("auth"))
+		if b == nil {
+			return fmt.Errorf("bucket \"auth\" not exist")
+		}
+
+		if current := dbGetWorkspaceRole(b, workspace, user); current == "" {
+			return fmt.Errorf("user \"%s\" is not a member of workspace \"%s\"", user, workspace)
+		} else if roleLevels[current] < roleLevels[role] {
+			return fmt.Errorf(
+				"user \"%s\" needs role \"%s\" in workspace \"%s\"", user, role, workspace,
+			)
+		} else {
+			return nil
+		}
+	})
+}
+
+// workspaceMigrationKey is set in the auth bucket when the users have been
+// moved to workspaces
+const workspaceMigrationKey = "system.migration.workspaces"
+
+// dbMigrateWorkspaces turns the bucket of every user that was created before
+// workspaces existed into the personal workspace of the user, it runs once
+// for a database
+func dbMigrateWorkspaces(db *core.DB) error {
+	isMigrated := false
+	if e := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte("auth")); b != nil {
+			isMigrated = b.Get([]byte(workspaceMigrationKey)) != nil
+		}
+		return nil
+	}); e != nil || isMigrated {
+		return e
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("auth"))
+		if b == nil {
+			return nil
+		}
+
+		users := make([]string, 0)
+		c := b.Cursor()
+		p := []byte("system.user.")
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+			users = append(users, string(k[len(p):]))
+		}
+
+		for _, user := range users {
+			if dbGetWorkspaceRole(b, user, user) != "" {
+				continue
+			} else if _, e := tx.CreateBucketIfNotExists([]byte(getWorkspaceBucket(user))); e != nil {
+				return e
+			} else if e := b.Put(core.DBKey("workspace.%s.personal", user), []byte{1}); e != nil {
+				return e
+			} else if e := b.Put(core.DBKey("workspace.%s.member.%s", user, user), []byte(roleAdmin)); e != nil {
+				return e
+			}
+		}
+
+		return b.Put([]byte(workspaceMigrationKey), []byte{1})
+	})
+}
+
+func dbIsWorkspaceExist(b *bolt.Bucket, name string) bool {
+	p := core.DBKey("workspace.%s.", name)
+	k, _ := b.Cursor().Seek(p)
+	return k != nil && bytes.HasPrefix(k, p)
+}
+
+func dbCreateWorkspace(db *core.DB, name string, user string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("auth"))
+		if b == nil {
+			return fmt.Errorf("bucket \"auth\" not exist")
+		}
+
+		// workspaces and users share the names of the buckets
+		if dbIsWorkspaceExist(b, name) || b.Get(core.DBKey("system.user.%s", name)) != nil ||
+			tx.Bucket([]byte(getWorkspaceBucket(name))) != nil {
+			return fmt.Errorf("workspace \"%s\" already exists", name)
+		} else if _, e := tx.CreateBucket([]byte(getWorkspaceBucket(name))); e != nil {
+			return e
+		} else {
+			return b.Put(core.DBKey("workspace.%s.member.%s", name, user), []byte(roleAdmin))
+		}
+	})
+}
+
+func createWorkspace(rt rpc.Runtime, sessionID string, name string) rpc.Return {
+	if !userNameRegex.MatchString(name) {
+		return rt.Reply(fmt.Errorf("invalid workspace name \"%s\"", name))
+	} else if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := dbCreateWorkspace(db, name, userName); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(true)
+	}
+}
+
+func dbListWorkspaces(db *core.DB, user string) (rpc.Array, error) {
+	ret := rpc.Array{}
+	return ret, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("auth"))
+		if b == nil {
+			return fmt.Errorf("bucket \"auth\" not exist")
+		}
+
+		c := b.Cursor()
+		p := []byte("workspace.")
+		suffix := []byte(".member." + user)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if bytes.HasSuffix(k, suffix) {
+				name := string(k[len(p) : len(k)-len(suffix)])
+				ret = append(ret, rpc.Map{
+					"name":     name,
+					"role":     string(v),
+					"personal": b.Get(core.DBKey("workspace.%s.personal", name)) != nil,
+				})
+			}
+		}
+		return nil
+	})
+}
+
+func listWorkspaces(rt rpc.Runtime, sessionID string) rpc.Return {
+	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if ret, e := dbListWorkspaces(db, userName); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(ret)
+	}
+}
+
+func switchWorkspace(rt rpc.Runtime, sessionID string, name string) rpc.Return {
+	if _, e := rt.Call("#.user:setWorkspace", sessionID, name).ToBool(); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(true)
+	}
+}
+
+func dbDeleteWorkspace(db *core.DB, name string, user string) error {
+	if e := dbCheckWorkspaceRole(db, name, user, roleAdmin); e != nil {
+		return e
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("auth"))
+		if b.Get(core.DBKey("workspace.%s.personal", name)) != nil {
+			return fmt.Errorf("personal workspace \"%s\" can not be deleted", name)
+		}
+
+		keys := make([][]byte, 0)
+		c := b.Cursor()
+		p := core.DBKey("workspace.%s.", name)
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range keys {
+			if e := b.Delete(k); e != nil {
+				return e
+			}
+		}
+
+		if e := dbDeleteSharedSnippets(tx, getWorkspaceBucket(name)); e != nil {
+			return e
+		}
+		return tx.DeleteBucket([]byte(getWorkspaceBucket(name)))
+	})
+}
+
+func deleteWorkspace(rt rpc.Runtime, sessionID string, name string) rpc.Return {
+	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := dbDeleteWorkspace(db, name, userName); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(true)
+	}
+}
+
+func dbListWorkspaceMembers(db *core.DB, name string) (rpc.Array, error) {
+	ret := rpc.Array{}
+	return ret, db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("auth")).Cursor()
+		p := core.DBKey("workspace.%s.member.", name)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			ret = append(ret, rpc.Map{
+				"name": string(k[len(p):]),
+				"role": string(v),
+			})
+		}
+		return nil
+	})
+}
+
+func listWorkspaceMembers(rt rpc.Runtime, sessionID string, name string) rpc.Return {
+	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := dbCheckWorkspaceRole(db, name, userName, roleViewer); e != nil {
+		return rt.Reply(e)
+	} else if ret, e := dbListWorkspaceMembers(db, name); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(ret)
+	}
+}
+
+// dbSetWorkspaceMember adds the member or changes its role, an empty role
+// removes the member. A workspace always keeps at least one admin.
+func dbSetWorkspaceMember(db *core.DB, name string, member string, role string) error {
+	if _, ok := roleLevels[role]; !ok && role != "" {
+		return fmt.Errorf("unknown role \"%s\"", role)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("auth"))
+		key := core.DBKey("workspace.%s.member.%s", name, member)
+
+		if b.Get(core.DBKey("system.user.%s", member)) == nil {
+			return fmt.Errorf("user \"%s\" does not exist", member)
+		} else if role != roleAdmin && string(b.Get(key)) == roleAdmin {
+			admins := 0
+			c := b.Cursor()
+			p := core.DBKey("workspace.%s.member.", name)
+			for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+				if string(v) == roleAdmin {
+					admins++
+				}
+			}
+			if admins <= 1 {
+				return fmt.Errorf("workspace \"%s\" needs at least one admin", name)
+			}
+		}
+
+		if role == "" {
+			return b.Delete(key)
+		}
+		return b.Put(key, []byte(role))
+	})
+}
+
+func setWorkspaceMember(
+	rt rpc.Runtime, sessionID string, name string, member string, role string,
+) rpc.Return {
+	if role == "" {
+		return rt.Reply(fmt.Errorf("role is empty"))
+	} else if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := dbCheckWorkspaceRole(db, name, userName, roleAdmin); e != nil {
+		return rt.Reply(e)
+	} else if e := dbSetWorkspaceMember(db, name, strings.TrimSpace(member), role); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(true)
+	}
+}
+
+func removeWorkspaceMember(rt rpc.Runtime, sessionID string, name string, member string) rpc.Return {
+	if userName, e := rt.Call("#.user:getNameBySessionID", sessionID).ToString(); e != nil {
+		return rt.Reply(e)
+	} else if db, e := core.GetManager().GetDB(core.GetConfig().GetDBFile()); e != nil {
+		return rt.Reply(e)
+	} else if e := dbCheckWorkspaceRole(db, name, userName, roleAdmin); e != nil {
+		return rt.Reply(e)
+	} else if e := dbSetWorkspaceMember(db, name, member, ""); e != nil {
+		return rt.Reply(e)
+	} else {
+		return rt.Reply(true)
+	}
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/rpccloud/assert"
+	"github.com/rpccloud/rpc"
+	"github.com/rpccloud/vbot/server/core"
+)
+
+func TestDBWorkspace(t *testing.T) {
+	newTestDB := func() *core.DB {
+		db, _ := core.NewDB("test.db")
+		_ = db.CreateBucketIsNotExist("auth")
+		for _, user := range []string{"alice", "bob"} {
+			_ = db.Put("auth", "system.user."+user, []byte{1})
+		}
+		return db
+	}
+
+	t.Run("migrate personal buckets", func(t *testing.T) {
+		assert := assert.New(t)
+		db := newTestDB()
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = db.CreateBucketIsNotExist("-alice")
+		_ = dbCreateServer(db, "-alice", "1", "10.0.0.1", "22", "root", "", "", "web", "")
+
+		assert(dbMigrateWorkspaces(db)).IsNil()
+		assert(dbListWorkspaces(db, "alice")).Equals(rpc.Array{
+			rpc.Map{"name": "alice", "role": "admin", "personal": true},
+		}, nil)
+		assert(db.IsBucketExist("-bob")).IsTrue()
+		assert(dbListServerIDs(db, getWorkspaceBucket("alice"))).Equals([]string{"1"}, nil)
+
+		// the migration runs once
+		_ = db.Put("auth", "system.user.carol", []byte{1})
+		assert(dbMigrateWorkspaces(db)).IsNil()
+		assert(db.IsBucketExist("-carol")).IsFalse()
+	})
+
+	t.Run("roles", func(t *testing.T) {
+		assert := assert.New(t)
+		db := newTestDB()
+		defer func() {
+			os.Remove("test.db")
+		}()
+		_ = dbMigrateWorkspaces(db)
+
+		assert(dbCreateWorkspace(db, "bob", "alice")).
+			Equals(errors.New("workspace \"bob\" already exists"))
+		assert(dbCreateWorkspace(db, "ops", "alice")).IsNil()
+		assert(dbCreateWorkspace(db, "ops", "alice")).
+			Equals(errors.New("workspace \"ops\" already exists"))
+
+		assert(dbCheckWorkspaceRole(db, "ops", "bob", roleViewer)).
+			Equals(errors.New("user \"bob\" is not a member of workspace \"ops\""))
+		assert(dbSetWorkspaceMember(db, "ops", "bob", "root")).
+			Equals(errors.New("unknown role \"root\""))
+		assert(dbSetWorkspaceMember(db, "ops", "carol", roleViewer)).
+			Equals(errors.New("user \"carol\" does not exist"))
+		assert(dbSetWorkspaceMember(db, "ops", "bob", roleOperator)).IsNil()
+		assert(dbCheckWorkspaceRole(db, "ops", "bob", roleViewer)).IsNil()
+		assert(dbCheckWorkspaceRole(db, "ops", "bob", roleOperator)).IsNil()
+		assert(dbCheckWorkspaceRole(db, "ops", "bob", roleAdmin)).
+			Equals(errors.New("user \"bob\" needs role \"admin\" in workspace \"ops\""))
+
+		assert(dbSetWorkspaceMember(db, "ops", "alice", "")).
+			Equals(errors.New("workspace \"ops\" needs at least one admin"))
+		assert(dbSetWorkspaceMember(db, "ops", "bob", roleAdmin)).IsNil()
+		assert(dbSetWorkspaceMember(db, "ops", "alice", "")).IsNil()
+		assert(dbListWorkspaceMembers(db, "ops")).Equals(rpc.Array{
+			rpc.Map{"name": "bob", "role": "admin"},
+		}, nil)
+
+		assert(dbDeleteWorkspace(db, "bob", "bob")).
+			Equals(errors.New("personal workspace \"bob\" can not be deleted"))
+		assert(dbDeleteWorkspace(db, "ops", "alice")).
+			Equals(errors.New("user \"alice\" is not a member of workspace \"ops\""))
+		assert(dbDeleteWorkspace(db, "ops", "bob")).IsNil()
+		assert(db.IsBucketExist("-ops")).IsFalse()
+		assert(dbListWorkspaces(db, "bob")).Equals(rpc.Array{
+			rpc.Map{"name": "bob", "role": "admin", "personal": true},
+		}, nil)
+	})
+}
+
+func TestUserManager_SetWorkspace(t *testing.T) {
+	t.Run("switch while reading", func(t *testing.T) {
+		assert := assert.New(t)
+		manager := NewUserManager()
+		manager.AddUser(NewUser("alice", "switch-session"))
+		user, _ := manager.GetUser("switch-session")
+
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				manager.SetWorkspace("switch-session", "ops")
+			}
+		}()
+		for i := 0; i < 100; i++ {
+			v, _ := manager.GetUser("switch-session")
+			assert(v.workspace == "alice" || v.workspace == "ops").IsTrue()
+		}
+		wg.Wait()
+		assert(user.workspace).Equals("alice")
+		_, ok := manager.GetUser("none")
+		assert(ok).IsFalse()
+	})
+}
@@ -70,7 +70,8 @@ export class ServerAdd extends React.Component<PluginProps, ServerAddState> {
                 this.state.password,
                 this.state.alias,
                 "",
-                false
+                false,
+                true
             )
                 .then((v) => {
                     this.setState({
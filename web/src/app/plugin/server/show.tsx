@@ -13,7 +13,7 @@ const ServerShow = (props: PluginProps) => {
     //     );
     // }, [props.tabID]);
 
-    return <XTerm style={{ flex: "1 0 0" }} />;
+    return <XTerm serverID={props.data} style={{ flex: "1 0 0" }} />;
 };
 
 export default ServerShow;
@@ -2,9 +2,12 @@ import * as React from "react";
 import { Terminal } from "xterm";
 import { FitAddon } from "xterm-addon-fit";
 import "xterm/css/xterm.css";
+import { AppUser } from "../../AppManager";
 
 export interface IXtermProps extends React.DOMAttributes<{}> {
     path?: string;
+    serverID?: string;
+    terminalID?: string;
     value?: string;
     className?: string;
     style?: React.CSSProperties;
@@ -14,12 +17,27 @@ export interface IXtermState {
     isFocused: boolean;
 }
 
+interface ITransferMessage {
+    transfer: string;
+    direction?: string;
+    name?: string;
+    size?: number;
+    offset?: number;
+    data?: string;
+    error?: string;
+}
+
+const uploadChunkSize = 32 * 1024;
+
 export class XTerm extends React.Component<IXtermProps, IXtermState> {
     xterm?: Terminal;
     containerRef: React.RefObject<HTMLDivElement>;
     websocket?: WebSocket;
     fitAddon: FitAddon;
     resizeObserver: ResizeObserver;
+    transferDirection?: string;
+    downloadChunks: Uint8Array[] = [];
+    uploadFiles?: File[];
 
     constructor(props: IXtermProps) {
         super(props);
@@ -43,7 +61,16 @@ export class XTerm extends React.Component<IXtermProps, IXtermState> {
                 this.websocket?.send(new TextEncoder().encode("\x00" + data));
             });
 
-            this.websocket = new WebSocket("ws://127.0.0.1:8080/ssh");
+            // a terminal that is still running on the server is reattached
+            // and its screen is redrawn by the server
+            const target = this.props.terminalID
+                ? "&terminalID=" + encodeURIComponent(this.props.terminalID)
+                : "&serverID=" + encodeURIComponent(this.props.serverID || "");
+            this.websocket = new WebSocket(
+                "ws://127.0.0.1:8080/ssh?sessionID=" +
+                    encodeURIComponent(AppUser.getSessionID()) +
+                    target
+            );
             this.websocket.binaryType = "arraybuffer";
             this.websocket.onopen = () => {
                 this.resizeObserver.observe(this.containerRef.current!!);
@@ -51,6 +78,8 @@ export class XTerm extends React.Component<IXtermProps, IXtermState> {
             this.websocket.onmessage = (evt) => {
                 if (evt.data instanceof ArrayBuffer) {
                     this.xterm?.write(new TextDecoder().decode(evt.data));
+                } else if (evt.data.startsWith("{")) {
+                    this.onTransfer(JSON.parse(evt.data));
                 } else {
                     alert(evt.data);
                 }
@@ -82,6 +111,111 @@ export class XTerm extends React.Component<IXtermProps, IXtermState> {
         }
     }
 
+    // a file transfer runs when rz or sz is started in the shell, the
+    // files are exchanged with dedicated messages until the transfer ends
+    onTransfer(msg: ITransferMessage) {
+        switch (msg.transfer) {
+            case "start":
+                this.transferDirection = msg.direction;
+                this.uploadFiles = undefined;
+                this.xterm?.write(
+                    "\r\n[vbot] file " + msg.direction + " started\r\n"
+                );
+                break;
+            case "file":
+                this.downloadChunks = [];
+                break;
+            case "data": {
+                const raw = atob(msg.data || "");
+                const chunk = new Uint8Array(raw.length);
+                for (let i = 0; i < raw.length; i++) {
+                    chunk[i] = raw.charCodeAt(i);
+                }
+                this.downloadChunks.push(chunk);
+                this.writeProgress(msg);
+                break;
+            }
+            case "progress":
+                this.writeProgress(msg);
+                break;
+            case "fileEnd":
+                if (this.transferDirection === "download") {
+                    const link = document.createElement("a");
+                    link.href = URL.createObjectURL(
+                        new Blob(this.downloadChunks)
+                    );
+                    link.download = msg.name || "download";
+                    link.click();
+                    URL.revokeObjectURL(link.href);
+                    this.downloadChunks = [];
+                }
+                this.xterm?.write("\r\n");
+                break;
+            case "next":
+                this.uploadNext();
+                break;
+            case "end":
+                this.xterm?.write(
+                    msg.error
+                        ? "\r\n[vbot] file transfer failed: " + msg.error + "\r\n"
+                        : "\r\n[vbot] file transfer finished\r\n"
+                );
+                this.transferDirection = undefined;
+                this.downloadChunks = [];
+                this.uploadFiles = undefined;
+                break;
+            case "error":
+                this.xterm?.write("\r\n[vbot] " + msg.error + "\r\n");
+                break;
+        }
+    }
+
+    writeProgress(msg: ITransferMessage) {
+        const size = msg.size || 0;
+        const percent =
+            size > 0 ? Math.floor(((msg.offset || 0) * 100) / size) : 100;
+        this.xterm?.write("\r[vbot] " + msg.name + " " + percent + "%");
+    }
+
+    sendTransferControl(control: object) {
+        this.websocket?.send(
+            new TextEncoder().encode("\x02" + JSON.stringify(control))
+        );
+    }
+
+    async uploadNext() {
+        if (!this.uploadFiles) {
+            this.uploadFiles = await new Promise<File[]>((resolve) => {
+                const input = document.createElement("input");
+                input.type = "file";
+                input.multiple = true;
+                input.onchange = () => resolve(Array.from(input.files || []));
+                input.click();
+            });
+        }
+
+        const file = this.uploadFiles.shift();
+        if (!file) {
+            this.sendTransferControl({ action: "finish" });
+            return;
+        }
+
+        this.sendTransferControl({
+            action: "file",
+            name: file.name,
+            size: file.size,
+        });
+        for (let offset = 0; offset < file.size; offset += uploadChunkSize) {
+            const chunk = new Uint8Array(
+                await file.slice(offset, offset + uploadChunkSize).arrayBuffer()
+            );
+            const frame = new Uint8Array(chunk.length + 1);
+            frame[0] = 3;
+            frame.set(chunk, 1);
+            this.websocket?.send(frame);
+        }
+    }
+
     autoFit() {
         this.fitAddon.fit();
         this.websocket?.send(